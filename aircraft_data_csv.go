@@ -0,0 +1,141 @@
+// Code generated by csvgen from datatypes.go. DO NOT EDIT.
+
+package main
+
+// Columns of the fields of the AircraftData struct in the order of the struct.
+var aircraftDataCsvColumns = []csvColumn{
+	{Go_name: "Alr", Json_name: "alr", Long_name: "Alert flag",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Alr), false)
+		}},
+	{Go_name: "Alt", Json_name: "alt", Long_name: "Barometric altitude [ft]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Alt), false)
+		}},
+	{Go_name: "Altg", Json_name: "altg", Long_name: "Geometric altitude [ft]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Altg), true)
+		}},
+	{Go_name: "Alts", Json_name: "alts", Long_name: "Selected altitude [ft]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Alts), true)
+		}},
+	{Go_name: "Ape", Json_name: "ape", Long_name: "Autopilot engaged",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatBool(ac_data.Ape, false)
+		}},
+	{Go_name: "Ava", Json_name: "ava", Long_name: "Altitude source",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Ava }},
+	{Go_name: "Cat", Json_name: "cat", Long_name: "Emitter category",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Cat }},
+	{Go_name: "Cou", Json_name: "cou", Long_name: "Country of registration",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Cou }},
+	{Go_name: "Dbm", Json_name: "dbm", Long_name: "Signal level [dBm]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Dbm), true)
+		}},
+	{Go_name: "Dis", Json_name: "dis", Long_name: "Distance to the receiver [km]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatFloat(float64(ac_data.Dis), 32, true)
+		}},
+	{Go_name: "Dst", Json_name: "dst", Long_name: "Destination airport",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Dst }},
+	{Go_name: "Fli", Json_name: "fli", Long_name: "Call sign",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Fli }},
+	{Go_name: "Gda", Json_name: "gda", Long_name: "Ground or airborne",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Gda }},
+	{Go_name: "Hex", Json_name: "hex", Long_name: "ICAO address",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Hex }},
+	{Go_name: "Lat", Json_name: "lat", Long_name: "Latitude [deg]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatFloat(ac_data.Lat, 64, true)
+		}},
+	{Go_name: "Lla", Json_name: "lla", Long_name: "Age of the last position [s]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Lla), false)
+		}},
+	{Go_name: "Lon", Json_name: "lon", Long_name: "Longitude [deg]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatFloat(ac_data.Lon, 64, true)
+		}},
+	{Go_name: "Mop", Json_name: "mop", Long_name: "MOPS version",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Mop), false)
+		}},
+	{Go_name: "Nacp", Json_name: "nacp", Long_name: "Navigation accuracy category for position",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Nacp), true)
+		}},
+	{Go_name: "Ns", Json_name: "ns", Long_name: "Nanoseconds of the update time [ns]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatUint(uint64(ac_data.Ns), false)
+		}},
+	{Go_name: "Opr", Json_name: "opr", Long_name: "Operator",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Opr }},
+	{Go_name: "Org", Json_name: "org", Long_name: "Origin airport",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Org }},
+	{Go_name: "Pic", Json_name: "pic", Long_name: "Position integrity category",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Pic), true)
+		}},
+	{Go_name: "Qnhs", Json_name: "qnhs", Long_name: "QNH setting [hPa]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatFloat(float64(ac_data.Qnhs), 32, true)
+		}},
+	{Go_name: "Reg", Json_name: "reg", Long_name: "Registration",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Reg }},
+	{Go_name: "Sda", Json_name: "sda", Long_name: "System design assurance",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Sda), true)
+		}},
+	{Go_name: "Sil", Json_name: "sil", Long_name: "Source integrity level",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Sil), true)
+		}},
+	{Go_name: "Spd", Json_name: "spd", Long_name: "Ground speed [kt]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Spd), false)
+		}},
+	{Go_name: "Spi", Json_name: "spi", Long_name: "Special position indicator",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatBool(ac_data.Spi, false)
+		}},
+	{Go_name: "Squ", Json_name: "squ", Long_name: "Squawk",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Squ }},
+	{Go_name: "Src", Json_name: "src", Long_name: "Source of the position",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Src }},
+	{Go_name: "Tcm", Json_name: "tcm", Long_name: "TCAS mode",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Tcm), false)
+		}},
+	{Go_name: "Tmp", Json_name: "tmp", Long_name: "Static air temperature [degC]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Tmp), false)
+		}},
+	{Go_name: "Trk", Json_name: "trk", Long_name: "Track [deg]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Trk), false)
+		}},
+	{Go_name: "Tru", Json_name: "tru", Long_name: "True airspeed [kt]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Tru), true)
+		}},
+	{Go_name: "Typ", Json_name: "typ", Long_name: "ICAO aircraft type",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string { return ac_data.Typ }},
+	{Go_name: "Uti", Json_name: "uti", Long_name: "Update time [unix s]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatUint(uint64(ac_data.Uti), false)
+		}},
+	{Go_name: "Vrt", Json_name: "vrt", Long_name: "Vertical rate [ft/min]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Vrt), false)
+		}},
+	{Go_name: "Wdi", Json_name: "wdi", Long_name: "Wind direction [deg]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Wdi), false)
+		}},
+	{Go_name: "Wsp", Json_name: "wsp", Long_name: "Wind speed [kt]",
+		field: func(ac_data AircraftData, csv_config CsvConfig) string {
+			return csv_config.formatInt(int64(ac_data.Wsp), false)
+		}},
+}
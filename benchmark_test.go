@@ -0,0 +1,168 @@
+// Write and CSV benchmarks.
+//
+// Compares the throughput of the write strategies of the processor with the amount of
+// data which is lost in the worst case if the listener or the machine crashes. The
+// flush and fsync intervals are evaluated against a simulated operating time which
+// advances with the expected record rate, so the number of flushes and fsyncs per
+// record matches the one in operation while the records are written as fast as possible.
+//
+// The csv benchmarks compare the generated formatting of the rows with the reflection
+// based formatting which was used before.
+//
+// Run them with `go test -run '^$' -bench . -benchmem`. The files are written to the
+// temporary directory, set TMPDIR to measure the disk of the data directory.
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// benchRecordRate is the expected number of records per second in operation (e.g. 50
+// aircraft at 2 Hz).
+const benchRecordRate float64 = 100
+
+// writeStrategy is one set of write parameters which is benchmarked.
+type writeStrategy struct {
+	name           string
+	flush_records  int
+	flush_interval time.Duration
+	fsync_interval time.Duration
+}
+
+// Get the longest period of time whose records are lost if the listener crashes, i.e.
+// the time it takes until buffered records are flushed at the given record rate.
+func (strategy writeStrategy) crashLossWindow(rate float64) time.Duration {
+	if strategy.flush_records <= 1 {
+		return 0
+	}
+	window := time.Duration(float64(strategy.flush_records-1) / rate * float64(time.Second))
+	if strategy.flush_interval > 0 && strategy.flush_interval < window {
+		window = strategy.flush_interval
+	}
+	return window.Round(time.Millisecond)
+}
+
+func BenchmarkWriteStrategies(b *testing.B) {
+	strategies := []writeStrategy{
+		{"flush_per_record", 1, 0, 0},
+		{"batched", 100, time.Second, 0},
+		{"batched_fsync", 100, time.Second, 30 * time.Second},
+	}
+	for _, compression := range []string{"none", "zstd"} {
+		for _, strategy := range strategies {
+			strategy := strategy
+			partitioning := Partitioning{Location: time.UTC, Compression: CompressionConfig{Format: compression},
+				Csv: CsvConfig{Header: csvHeaderGo}}
+			b.Run(compression+"/"+strategy.name, func(b *testing.B) {
+				runWriteBenchmark(b, partitioning, strategy)
+			})
+		}
+	}
+}
+
+// Write b.N records with the given strategy. Reports the flushes and fsyncs per record and
+// the worst case data loss window of the strategy.
+func runWriteBenchmark(b *testing.B, partitioning Partitioning, strategy writeStrategy) {
+	folder_path := b.TempDir() + "/"
+	record := partitioning.CsvLayout("A320").Row(Record{AircraftData: AircraftData{
+		Alt: 37000, Cat: "A3", Fli: "SWR123", Hex: "4b1805", Lat: 47.4647, Lon: 8.5492,
+		Reg: "HB-JLT", Spd: 450, Squ: "1000", Typ: "A320", Uti: 1700000000,
+	}})
+
+	writer, err := openCsvWriter(folder_path, "A320", time.Time{}, 0, partitioning)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var flushes, fsyncs int
+	var simulated_time, last_flush, last_fsync time.Duration
+	record_period := time.Duration(float64(time.Second) / benchRecordRate)
+	pending := 0
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		simulated_time += record_period
+
+		if err := writer.Write(record); err != nil {
+			b.Fatal(err)
+		}
+		pending++
+
+		if pending >= strategy.flush_records ||
+			strategy.flush_interval > 0 && simulated_time-last_flush >= strategy.flush_interval {
+			if err := writer.Flush(); err != nil {
+				b.Fatal(err)
+			}
+			flushes++
+			pending = 0
+			last_flush = simulated_time
+		}
+
+		if strategy.fsync_interval > 0 && simulated_time-last_fsync >= strategy.fsync_interval {
+			if err := writer.Sync(); err != nil {
+				b.Fatal(err)
+			}
+			fsyncs++
+			last_fsync = simulated_time
+		}
+	}
+	if err := writer.Close(); err != nil {
+		b.Fatal(err)
+	}
+	b.StopTimer()
+
+	b.SetBytes(writer.Size() / int64(b.N))
+	b.ReportMetric(float64(flushes)/float64(b.N), "flushes/op")
+	b.ReportMetric(float64(fsyncs)/float64(b.N), "fsyncs/op")
+	b.ReportMetric(float64(strategy.crashLossWindow(benchRecordRate).Milliseconds()), "crash_loss_ms")
+}
+
+// Format a record with reflection, as the listener did before the formatting was generated.
+func reflectCsvRow(ac_data AircraftData) []string {
+	v := reflect.ValueOf(ac_data)
+
+	row := make([]string, v.NumField())
+	for i := range row {
+		row[i] = fmt.Sprint(v.Field(i))
+	}
+	return row
+}
+
+func BenchmarkCsvRow(b *testing.B) {
+	partitioning := Partitioning{
+		Location: time.UTC,
+		Csv:      CsvConfig{Header: csvHeaderGo, Header_mismatch: headerMismatchRoll},
+		Site:     SiteConfig{Latitude: 47.4035, Longitude: 8.6130},
+	}
+	all_columns := partitioning.CsvLayout("A320")
+	partitioning.Csv.Columns = []string{"hex", "fli", "received", "gps_time", "latency_ms", "alt_m", "spd_ms",
+		"site_distance_km", "poll_seq"}
+	selected_columns := partitioning.CsvLayout("A320")
+
+	record := NewRecord(AircraftData{
+		Alt: 37000, Cat: "A3", Dbm: -72, Dis: 23.7, Fli: "SWR123", Hex: "4b1805", Lat: 47.4647, Lon: 8.5492, Ns: 123456789,
+		Qnhs: 1013.2, Reg: "HB-JLT", Spd: 450, Squ: "1000", Trk: 271, Typ: "A320", Uti: 1700000000, Vrt: -640,
+	}, time.Unix(1700000000, 250000000), 3*time.Second, 42)
+
+	benchmarks := []struct {
+		name string
+		row  func() []string
+	}{
+		{"reflection", func() []string { return reflectCsvRow(record.AircraftData) }},
+		{"generated_all_columns", func() []string { return all_columns.Row(record) }},
+		{"generated_selected_columns", func() []string { return selected_columns.Row(record) }},
+	}
+	for _, benchmark := range benchmarks {
+		row := benchmark.row
+		b.Run(benchmark.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				row()
+			}
+		})
+	}
+}
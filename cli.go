@@ -0,0 +1,531 @@
+// Command line interface.
+//
+// The binary is driven by subcommands (run, validate-config, upload, verify, replay, stats
+// and version). Values from the yaml config file can be overridden by environment
+// variables, which in turn can be overridden by command line flags.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// version is the version of the listener. It is set at build time using
+// `go build -ldflags "-X main.version=<version>"`.
+var version string = "dev"
+
+// envPrefix is the prefix of all environment variables which are read by the listener.
+const envPrefix string = "RADARCAPE"
+
+// cliCommand describes a subcommand of the command line interface.
+type cliCommand struct {
+	name        string
+	description string
+	run         func(args []string) error
+}
+
+var cli_commands = []cliCommand{
+	{"run", "Run the listener (default if no subcommand is given).", runCommand},
+	{"validate-config", "Check the config file and print the effective configuration.", validateConfigCommand},
+	{"upload", "Manually upload the data of a given day.", uploadCommand},
+	{"verify", "Check the uploaded and backed up files against their manifests.", verifyCommand},
+	{"replay", "Feed recorded aircraftlist.json files through the filter into the CSVs.", replayCommand},
+	{"stats", "Print file sizes and row counts of the local data files.", statsCommand},
+	{"version", "Print the version of the listener.", versionCommand},
+}
+
+// Parse the command line arguments and run the selected subcommand.
+//
+// Returns the exit code of the program.
+func RunCli(args []string) int {
+	// Running the binary without a subcommand (or with flags only) starts the
+	// listener such that existing setups keep working.
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") && args[0] != "-h" && args[0] != "--help" {
+		args = append([]string{"run"}, args...)
+	}
+
+	if args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage(os.Stdout)
+		return 0
+	}
+
+	for _, command := range cli_commands {
+		if command.name != args[0] {
+			continue
+		}
+
+		err := command.run(args[1:])
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		} else if err != nil {
+			fmt.Fprintln(os.Stderr, command.name+":", err)
+			return 1
+		}
+		return 0
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+	printUsage(os.Stderr)
+	return 2
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: radarcape_listener <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tab_writer := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, command := range cli_commands {
+		fmt.Fprintf(tab_writer, "  %s\t%s\n", command.name, command.description)
+	}
+	tab_writer.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run 'radarcape_listener <command> -h' for the flags of a command.")
+	fmt.Fprintln(w, "Config values can be overridden by environment variables named "+
+		envPrefix+"_<YAML_KEY>, e.g. "+envPrefix+"_RADARCAPE_HOSTNAME or "+envPrefix+"_LOGGING_LEVEL.")
+}
+
+// commonFlags are the flags which are shared between all the subcommands that
+// need a configuration.
+type commonFlags struct {
+	config_path string
+	data_dir    string
+	state_dir   string
+	log_level   string
+	debug       bool
+}
+
+func registerCommonFlags(flag_set *flag.FlagSet) *commonFlags {
+	common := &commonFlags{}
+	flag_set.StringVar(&common.config_path, "config", "",
+		"path to the yaml config file (env "+envPrefix+"_CONFIG). "+
+			"Defaults to "+configFileName+" in the config directory or next to the executable.")
+	flag_set.StringVar(&common.data_dir, "data-dir", "",
+		"directory where the data files are stored. Overrides 'data_dir' of the config file.")
+	flag_set.StringVar(&common.state_dir, "state-dir", "",
+		"directory where logs and bookkeeping files are stored. Overrides 'state_dir' of the config file.")
+	flag_set.StringVar(&common.log_level, "log-level", "",
+		"log level (debug, info, warn, warn_severe, error). Overrides the config file.")
+	flag_set.BoolVar(&common.debug, "debug", false,
+		"enable debug logging. Shorthand for -log-level=debug.")
+	return common
+}
+
+// Get the path of the config file.
+func (common *commonFlags) configPath() string {
+	if common.config_path != "" {
+		return common.config_path
+	}
+	if config_path := os.Getenv(envPrefix + "_CONFIG"); config_path != "" {
+		return config_path
+	}
+	return findConfigFile()
+}
+
+// Load the config file, apply the overrides from the environment and the command line
+// and validate the result.
+func (common *commonFlags) loadConfig() (Config, error) {
+	config := NewConfig()
+	if err := config.LoadConfiguration(common.configPath()); err != nil {
+		return config, err
+	}
+
+	if err := config.ApplyEnvironment(envPrefix); err != nil {
+		return config, err
+	}
+
+	if common.data_dir != "" {
+		config.Data_dir = common.data_dir
+	}
+	if common.state_dir != "" {
+		config.State_dir = common.state_dir
+	}
+	if common.log_level != "" {
+		config.Logging.Level = common.log_level
+	}
+	if common.debug {
+		config.Logging.Level = "debug"
+	}
+
+	config.Normalize()
+	config.ApplyDefaults()
+
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("invalid configuration %s: %w", common.configPath(), err)
+	}
+
+	if err := ConfigureLogging(config.Logging, ""); err != nil {
+		return config, fmt.Errorf("invalid logging configuration: %w", err)
+	}
+
+	return config, nil
+}
+
+func newFlagSet(name, usage string) *flag.FlagSet {
+	flag_set := flag.NewFlagSet(name, flag.ContinueOnError)
+	flag_set.Usage = func() {
+		fmt.Fprintln(flag_set.Output(), "Usage: radarcape_listener "+name+" "+usage)
+		flag_set.PrintDefaults()
+	}
+	return flag_set
+}
+
+func runCommand(args []string) error {
+	flag_set := newFlagSet("run", "[flags]")
+	common := registerCommonFlags(flag_set)
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	defer CloseLogging()
+
+	if data_dir := MigrateLegacyDataFolder(config.Data_dir); !sameFolder(data_dir, config.Data_dir) {
+		// Like a -data-dir flag, such that the reloaded configs keep the legacy folder.
+		common.data_dir = data_dir
+		if config, err = common.loadConfig(); err != nil {
+			return err
+		}
+	}
+
+	config_store := NewConfigStore(config)
+	go WatchConfiguration(config_store, common.configPath(), common.loadConfig, 5*time.Second, nil)
+
+	RunListener(config_store, RealClock)
+	return nil
+}
+
+func validateConfigCommand(args []string) error {
+	flag_set := newFlagSet("validate-config", "[flags]")
+	common := registerCommonFlags(flag_set)
+	print_config := flag_set.Bool("print", false, "print the effective configuration as yaml.")
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	defer CloseLogging()
+
+	if *print_config {
+		encoded, err := yaml.Marshal(config.Redacted())
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(encoded)
+	}
+
+	fmt.Println("configuration is valid.")
+	return nil
+}
+
+func uploadCommand(args []string) error {
+	flag_set := newFlagSet("upload", "--date YYYYMMDD [flags]")
+	common := registerCommonFlags(flag_set)
+	date_string := flag_set.String("date", "", "day to upload in the YYYYMMDD format.")
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	if *date_string == "" {
+		flag_set.Usage()
+		return errors.New("--date is required")
+	}
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	defer CloseLogging()
+
+	day, err := time.ParseInLocation(dateFormatString, *date_string, config.Location())
+	if err != nil {
+		return fmt.Errorf("invalid date %q: %w", *date_string, err)
+	}
+
+	if !config.UploadEnabled() {
+		return errors.New("no upload target is specified ('upload_folder_path' or the 'upload' section)")
+	}
+
+	return UploadDay(config, RealClock, day, RealClock.Now())
+}
+
+// Verify the manifests of the day folders and day archives.
+//
+// By default the upload folder (of the folder target) and the backup folder are checked.
+// Other folders, e.g. a mounted WebDAV share, can be passed as arguments.
+func verifyCommand(args []string) error {
+	flag_set := newFlagSet("verify", "[flags] [folder ...]")
+	common := registerCommonFlags(flag_set)
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	folders := flag_set.Args()
+	if len(folders) == 0 {
+		config, err := common.loadConfig()
+		if err != nil {
+			return err
+		}
+		defer CloseLogging()
+
+		if config.Upload.Target == uploadTargetFolder && config.Upload_folder_path != "" {
+			folders = append(folders, config.Upload_folder_path)
+		}
+		if config.Backup_folder_path != "" {
+			folders = append(folders, config.Backup_folder_path)
+		}
+		if len(folders) == 0 {
+			return errors.New("no folder to verify ('upload_folder_path' or 'backup_folder_path')")
+		}
+	}
+
+	checked, failed := 0, 0
+	tab_writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, folder := range folders {
+		folder = normalizeFolderPath(folder)
+		entries, err := ioutil.ReadDir(folder)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range entries {
+			var files int
+			var problems []string
+			switch {
+			case entry.IsDir():
+				files, problems, err = verifyManifestFolder(folder + entry.Name() + "/")
+			case strings.HasSuffix(entry.Name(), archiveExtension):
+				files, problems, err = verifyManifestArchive(folder + entry.Name())
+			default:
+				continue
+			}
+
+			if errors.Is(err, fs.ErrNotExist) {
+				fmt.Fprintf(tab_writer, "%s\tno manifest\n", folder+entry.Name())
+				continue
+			}
+			checked++
+			if err != nil {
+				problems = []string{err.Error()}
+			}
+			if len(problems) > 0 {
+				failed++
+				fmt.Fprintf(tab_writer, "%s\tFAILED\t%s\n", folder+entry.Name(), strings.Join(problems, "; "))
+			} else {
+				fmt.Fprintf(tab_writer, "%s\tok\t%d files\n", folder+entry.Name(), files)
+			}
+		}
+	}
+	tab_writer.Flush()
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d manifests failed the verification", failed, checked)
+	}
+	fmt.Printf("%d manifests verified.\n", checked)
+	return nil
+}
+
+// Replay recorded aircraft lists.
+//
+// The input is either a single file or a folder of files, each containing one or more
+// aircraftlist.json documents as served by the radarcape. The records are filtered and
+// deduplicated exactly like in the receiver and written to the CSV of the day given by
+// their `uti` time stamp.
+func replayCommand(args []string) error {
+	flag_set := newFlagSet("replay", "--input <file or folder> [flags]")
+	common := registerCommonFlags(flag_set)
+	input_path := flag_set.String("input", "", "recorded aircraftlist.json file or folder of such files.")
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	if *input_path == "" {
+		flag_set.Usage()
+		return errors.New("--input is required")
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	defer CloseLogging()
+
+	input_files, err := listReplayFiles(*input_path)
+	if err != nil {
+		return err
+	}
+
+	last_received_messages := make(map[string]AircraftData)
+	partitioning := config.Partitioning()
+	csv_writers_per_partition := make(map[string]map[string]CsvWriteCloser)
+	defer func() {
+		for _, csv_writers := range csv_writers_per_partition {
+			for _, writer := range csv_writers {
+				if err := writer.Close(); err != nil {
+					main_log.Warn("failed to close a csv file.", "err", err)
+				}
+			}
+		}
+	}()
+
+	replayed, polls := 0, 0
+	for _, input_file := range input_files {
+		err := decodeAircraftLists(input_file, func(aircraft_list []AircraftData) error {
+			polls++
+			for _, aircraft := range FilterAircraftList(aircraft_list, config.Icao_aircraft_types, last_received_messages) {
+				start := partitioning.Start(time.Unix(int64(aircraft.Uti), 0))
+				start_key := start.Format(partitionFormatString)
+
+				csv_writers, ok := csv_writers_per_partition[start_key]
+				if !ok {
+					var err error
+					csv_writers, err = GenerateCsvWriters(config.Data_dir, start, partitioning, config.Icao_aircraft_types)
+					csv_writers_per_partition[start_key] = csv_writers
+					if err != nil {
+						return err
+					}
+				}
+
+				// The time of the reception is not known, only the number of the aircraft list.
+				record := NewRecord(aircraft, time.Time{}, 0, uint64(polls))
+				if err := csv_writers[aircraft.Typ].WriteRecord(record); err != nil {
+					return err
+				}
+				replayed++
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %w", input_file, err)
+		}
+	}
+
+	main_log.Info("replay finished.", "files", len(input_files), "records", replayed)
+	return nil
+}
+
+// List the files which should be replayed in lexical order.
+func listReplayFiles(input_path string) ([]string, error) {
+	info, err := os.Stat(input_path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{input_path}, nil
+	}
+
+	entries, err := ioutil.ReadDir(input_path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			files = append(files, filepath.Join(input_path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// Decode all the aircraft lists in a file and pass them to `handle` one by one.
+//
+// Compressed files (e.g. of the raw archive) are decompressed according to their extension.
+func decodeAircraftLists(file_path string, handle func([]AircraftData) error) error {
+	file, err := openDataFile(file_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(file)
+	for {
+		var aircraft_list []AircraftData
+		if err := decoder.Decode(&aircraft_list); err == io.EOF || isUnfinishedStream(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if err := handle(aircraft_list); err != nil {
+			return err
+		}
+	}
+}
+
+func statsCommand(args []string) error {
+	flag_set := newFlagSet("stats", "[flags]")
+	common := registerCommonFlags(flag_set)
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	config, err := common.loadConfig()
+	if err != nil {
+		return err
+	}
+	defer CloseLogging()
+
+	data_dir := getDataRoot(config.Data_dir)
+	day_folders, err := ioutil.ReadDir(data_dir)
+	if err != nil {
+		return err
+	}
+
+	tab_writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', tabwriter.AlignRight)
+	defer tab_writer.Flush()
+
+	fmt.Fprintln(tab_writer, "date\tfile\trows\tsize [kB]\t")
+	for _, day_folder := range day_folders {
+		if !day_folder.IsDir() {
+			continue
+		}
+
+		files, err := ioutil.ReadDir(filepath.Join(data_dir, day_folder.Name()))
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if !isCsvFileName(file.Name()) {
+				continue
+			}
+			rows, err := countCsvRows(filepath.Join(data_dir, day_folder.Name(), file.Name()))
+			if err != nil {
+				return err
+			}
+			fmt.Fprintf(tab_writer, "%s\t%s\t%d\t%.1f\t\n", day_folder.Name(), file.Name(), rows, float64(file.Size())/1024)
+		}
+	}
+
+	return nil
+}
+
+func versionCommand(args []string) error {
+	flag_set := newFlagSet("version", "")
+	if err := flag_set.Parse(args); err != nil {
+		return err
+	}
+
+	fmt.Printf("radarcape_listener %s (%s %s/%s)\n", version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return nil
+}
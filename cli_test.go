@@ -0,0 +1,171 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Write a config file whose directories are temporary directories of the test. `extra` is
+// appended to the yaml. Returns the path of the file and the root of the directories.
+func writeTestConfigFile(t *testing.T, extra string) (string, string) {
+	t.Helper()
+	root := t.TempDir() + "/"
+	config_path := root + "config.yaml"
+	writeTestConfigFileTo(t, config_path, root, extra)
+	return config_path, root
+}
+
+// Write the config file of writeTestConfigFile to `config_path`. Keys in `extra` replace the
+// ones of the test config.
+func writeTestConfigFileTo(t *testing.T, config_path string, root string, extra string) {
+	t.Helper()
+	lines := []string{
+		"icao_aircraft_types: [A320, B738]",
+		"radarcape_hostname: radarcape.local",
+		"data_dir: " + root + "data",
+		"state_dir: " + root + "state",
+		"upload_folder_path: " + root + "upload",
+		"timezone: UTC",
+	}
+	data := ""
+	for _, line := range lines {
+		key, _, _ := strings.Cut(line, ":")
+		if !strings.HasPrefix(extra, key+":") && !strings.Contains(extra, "\n"+key+":") {
+			data += line + "\n"
+		}
+	}
+	writeTestFile(t, config_path, data+extra)
+}
+
+// Run the command line interface and get its exit code and what it printed to stdout
+// and stderr.
+func runTestCli(t *testing.T, args ...string) (int, string, string) {
+	t.Helper()
+	collect := func(reader *os.File) <-chan string {
+		output := make(chan string, 1)
+		go func() {
+			data, _ := ioutil.ReadAll(reader)
+			output <- string(data)
+		}()
+		return output
+	}
+	stdout_reader, stdout_writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr_reader, stderr_writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout_output, stderr_output := collect(stdout_reader), collect(stderr_reader)
+
+	stdout, stderr := os.Stdout, os.Stderr
+	os.Stdout, os.Stderr = stdout_writer, stderr_writer
+	exit_code := RunCli(args)
+	os.Stdout, os.Stderr = stdout, stderr
+
+	stdout_writer.Close()
+	stderr_writer.Close()
+	return exit_code, <-stdout_output, <-stderr_output
+}
+
+func TestCliUsageAndUnknownCommands(t *testing.T) {
+	if exit_code, stdout, _ := runTestCli(t, "help"); exit_code != 0 || !strings.Contains(stdout, "validate-config") {
+		t.Errorf("help exited with %d and printed %q", exit_code, stdout)
+	}
+	if exit_code, _, stderr := runTestCli(t, "frobnicate"); exit_code != 2 || !strings.Contains(stderr, `unknown command "frobnicate"`) {
+		t.Errorf("an unknown command exited with %d and printed %q", exit_code, stderr)
+	}
+	if exit_code, stdout, _ := runTestCli(t, "version"); exit_code != 0 || !strings.HasPrefix(stdout, "radarcape_listener dev (") {
+		t.Errorf("version exited with %d and printed %q", exit_code, stdout)
+	}
+}
+
+func TestValidateConfigCommand(t *testing.T) {
+	config_path, root := writeTestConfigFile(t, "mqtt:\n  broker: tcp://localhost:1883\n  password: hunter2\n")
+
+	// The environment overrides the config file and the flags override both.
+	t.Setenv("RADARCAPE_RADARCAPE_HOSTNAME", "radarcape.env")
+	t.Setenv("RADARCAPE_DATA_DIR", root+"env_data")
+	exit_code, stdout, stderr := runTestCli(t, "validate-config", "-config", config_path, "-data-dir", root+"flag_data", "-print")
+	if exit_code != 0 {
+		t.Fatalf("validate-config exited with %d: %s", exit_code, stderr)
+	}
+	for _, expected := range []string{"radarcape_hostname: radarcape.env", "data_dir: " + root + "flag_data/", "password: '***'", "configuration is valid."} {
+		if !strings.Contains(stdout, expected) {
+			t.Errorf("the output doesn't contain %q:\n%s", expected, stdout)
+		}
+	}
+	if strings.Contains(stdout, "hunter2") {
+		t.Errorf("the password was printed:\n%s", stdout)
+	}
+
+	config_path, _ = writeTestConfigFile(t, "rotation:\n  interval: 7m\n")
+	exit_code, _, stderr = runTestCli(t, "validate-config", "-config", config_path)
+	if exit_code != 1 || !strings.Contains(stderr, "invalid configuration "+config_path+": ") {
+		t.Errorf("an invalid config exited with %d and printed %q", exit_code, stderr)
+	}
+}
+
+func TestUploadAndVerifyCommands(t *testing.T) {
+	config_path, root := writeTestConfigFile(t, "")
+	writeTestFile(t, root+"data/20240305/output_file_A320.csv", "Hex\n4b1805\n")
+
+	if exit_code, _, stderr := runTestCli(t, "upload", "-config", config_path); exit_code != 1 || !strings.Contains(stderr, "--date is required") {
+		t.Errorf("upload without a date exited with %d and printed %q", exit_code, stderr)
+	}
+	if exit_code, _, stderr := runTestCli(t, "upload", "-config", config_path, "-date", "20240305"); exit_code != 0 {
+		t.Fatalf("upload exited with %d: %s", exit_code, stderr)
+	}
+	checkRemoteFile(t, root+"upload/20240305/output_file_A320.csv", "Hex\n4b1805\n")
+
+	exit_code, stdout, stderr := runTestCli(t, "verify", "-config", config_path)
+	if exit_code != 0 || !strings.Contains(stdout, "1 manifests verified.") {
+		t.Errorf("verify exited with %d and printed %q %q", exit_code, stdout, stderr)
+	}
+
+	writeTestFile(t, root+"upload/20240305/output_file_A320.csv", "Hex\n4b1806\n")
+	exit_code, stdout, stderr = runTestCli(t, "verify", root+"upload")
+	if exit_code != 1 || !strings.Contains(stdout, "FAILED") || !strings.Contains(stderr, "1 of 1 manifests failed") {
+		t.Errorf("verify of a changed file exited with %d and printed %q %q", exit_code, stdout, stderr)
+	}
+}
+
+func TestReplayAndStatsCommands(t *testing.T) {
+	config_path, root := writeTestConfigFile(t, "")
+
+	// The repeated message of the A320 and the aircraft of other types are dropped.
+	aircraft_list := `[{"hex":"4b1805","typ":"A320","fli":"SWR123","uti":1709640000},{"hex":"3c6444","typ":"A388","uti":1709640000}]`
+	writeTestFile(t, root+"recordings/aircraftlist_001.json", aircraft_list+"\n"+aircraft_list+"\n")
+	writeTestFile(t, root+"recordings/aircraftlist_002.json",
+		`[{"hex":"4b1806","typ":"B738","fli":"EDW12","uti":1709643600}]`)
+
+	if exit_code, _, stderr := runTestCli(t, "replay", "-config", config_path); exit_code != 1 || !strings.Contains(stderr, "--input is required") {
+		t.Errorf("replay without an input exited with %d and printed %q", exit_code, stderr)
+	}
+	if exit_code, _, stderr := runTestCli(t, "replay", "-config", config_path, "-input", root+"recordings"); exit_code != 0 {
+		t.Fatalf("replay exited with %d: %s", exit_code, stderr)
+	}
+	for file_name, flight := range map[string]string{"output_file_A320.csv": "SWR123", "output_file_B738.csv": "EDW12"} {
+		content, err := ioutil.ReadFile(root + "data/20240305/" + file_name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lines := strings.Split(strings.TrimSpace(string(content)), "\n"); len(lines) != 2 || !strings.Contains(lines[1], flight) {
+			t.Errorf("%s holds %q, expected the header and the record of %s", file_name, content, flight)
+		}
+	}
+
+	exit_code, stdout, stderr := runTestCli(t, "stats", "-config", config_path)
+	if exit_code != 0 {
+		t.Fatalf("stats exited with %d: %s", exit_code, stderr)
+	}
+	for _, line := range strings.Split(stdout, "\n") {
+		if strings.Contains(line, "output_file_A320.csv") && len(strings.Fields(line)) == 4 && strings.Fields(line)[2] == "1" {
+			return
+		}
+	}
+	t.Errorf("stats doesn't report the row of the A320:\n%s", stdout)
+}
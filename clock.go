@@ -0,0 +1,213 @@
+// Clock abstraction.
+//
+// All the goroutines get the current time, timers and tickers from a Clock instead
+// of using the time package directly. In production this is the wall clock, while the
+// FakeClock allows simulating days of operation in a fraction of a second.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Clock provides the current time as well as timers and tickers which are based on it.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	NewTicker(d time.Duration) Ticker
+	Sleep(d time.Duration)
+}
+
+// Timer is the equivalent of time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Ticker is the equivalent of time.Ticker.
+type Ticker interface {
+	C() <-chan time.Time
+	Stop()
+}
+
+// RealClock is the Clock which is backed by the time package.
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (realClock) NewTicker(d time.Duration) Ticker {
+	return realTicker{time.NewTicker(d)}
+}
+
+func (realClock) Sleep(d time.Duration) {
+	time.Sleep(d)
+}
+
+type realTimer struct {
+	*time.Timer
+}
+
+func (timer realTimer) C() <-chan time.Time {
+	return timer.Timer.C
+}
+
+type realTicker struct {
+	*time.Ticker
+}
+
+func (ticker realTicker) C() <-chan time.Time {
+	return ticker.Ticker.C
+}
+
+// FakeClock is a Clock whose time only moves when Advance or Set is called.
+//
+// Timers and tickers fire in chronological order while the clock is advanced and
+// the clock reports their fire time as the current time while doing so.
+type FakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []*fakeWaiter
+}
+
+// fakeWaiter is a pending timer or ticker of the FakeClock.
+type fakeWaiter struct {
+	clock     *FakeClock
+	fire_time time.Time
+	period    time.Duration // zero for timers.
+	channel   chan time.Time
+}
+
+// fakeTicker adapts the Stop method of a fakeWaiter to the Ticker interface.
+type fakeTicker struct {
+	*fakeWaiter
+}
+
+func (ticker fakeTicker) Stop() {
+	ticker.fakeWaiter.Stop()
+}
+
+func NewFakeClock(start time.Time) *FakeClock {
+	return &FakeClock{now: start}
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) NewTimer(d time.Duration) Timer {
+	return clock.addWaiter(d, 0)
+}
+
+func (clock *FakeClock) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for FakeClock.NewTicker")
+	}
+	return fakeTicker{clock.addWaiter(d, d)}
+}
+
+// Block until the clock has been advanced by `d`.
+func (clock *FakeClock) Sleep(d time.Duration) {
+	<-clock.NewTimer(d).C()
+}
+
+// Get the number of timers and tickers which are currently pending.
+//
+// Useful to wait until a goroutine has reached the point where it waits for the clock.
+func (clock *FakeClock) Waiters() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.waiters)
+}
+
+// Move the clock forward by `d` and fire all the timers and tickers which expire
+// on the way.
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.Set(clock.Now().Add(d))
+}
+
+// Move the clock forward to `t` and fire all the timers and tickers which expire
+// on the way. Like time.Ticker, a ticker drops ticks if its channel is full.
+func (clock *FakeClock) Set(t time.Time) {
+	for {
+		clock.mu.Lock()
+		if len(clock.waiters) == 0 || clock.waiters[0].fire_time.After(t) {
+			clock.now = t
+			clock.mu.Unlock()
+			return
+		}
+
+		waiter := clock.waiters[0]
+		fire_time := waiter.fire_time
+		clock.now = fire_time
+		if waiter.period > 0 {
+			waiter.fire_time = waiter.fire_time.Add(waiter.period)
+			clock.sortWaiters()
+		} else {
+			clock.waiters = clock.waiters[1:]
+		}
+		clock.mu.Unlock()
+
+		select {
+		case waiter.channel <- fire_time:
+		default:
+		}
+	}
+}
+
+func (clock *FakeClock) addWaiter(d time.Duration, period time.Duration) *fakeWaiter {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	waiter := &fakeWaiter{
+		clock:     clock,
+		fire_time: clock.now.Add(d),
+		period:    period,
+		channel:   make(chan time.Time, 1),
+	}
+
+	if d <= 0 {
+		waiter.channel <- clock.now
+		return waiter
+	}
+
+	clock.waiters = append(clock.waiters, waiter)
+	clock.sortWaiters()
+	return waiter
+}
+
+func (clock *FakeClock) sortWaiters() {
+	sort.SliceStable(clock.waiters, func(i, j int) bool {
+		return clock.waiters[i].fire_time.Before(clock.waiters[j].fire_time)
+	})
+}
+
+func (waiter *fakeWaiter) C() <-chan time.Time {
+	return waiter.channel
+}
+
+// Stop the timer or ticker. Returns false if it already fired or was stopped.
+func (waiter *fakeWaiter) Stop() bool {
+	clock := waiter.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	for i, pending := range clock.waiters {
+		if pending == waiter {
+			clock.waiters = append(clock.waiters[:i], clock.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,168 @@
+// CSV code generator.
+//
+// Generates the reflection free csv columns of a struct of the listener, i.e. the names of
+// every field and a function which formats its value. The json tag of a field gives the json
+// name of the column and the csv tag the descriptive name, optionally followed by `,optional`
+// if a zero value means that the value is missing.
+//
+//	go run ./cmd/csvgen -type AircraftData -input datatypes.go -output aircraft_data_csv.go
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// field holds everything the generator needs to know about a struct field.
+type field struct {
+	go_name   string
+	json_name string
+	long_name string
+	go_type   string
+	optional  bool
+}
+
+func main() {
+	type_name := flag.String("type", "", "name of the struct.")
+	input_path := flag.String("input", "", "go file which declares the struct.")
+	output_path := flag.String("output", "", "go file which is generated.")
+	flag.Parse()
+
+	if err := generate(*type_name, *input_path, *output_path); err != nil {
+		fmt.Fprintln(os.Stderr, "csvgen:", err)
+		os.Exit(1)
+	}
+}
+
+func generate(type_name string, input_path string, output_path string) error {
+	if type_name == "" || input_path == "" || output_path == "" {
+		return fmt.Errorf("-type, -input and -output are required")
+	}
+
+	fields, err := parseStruct(input_path, type_name)
+	if err != nil {
+		return err
+	}
+
+	source, err := generateSource(type_name, input_path, fields)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(output_path, source, 0o644)
+}
+
+// Read the fields of the struct `type_name` from the go file at `input_path`.
+func parseStruct(input_path string, type_name string) ([]field, error) {
+	file_set := token.NewFileSet()
+	file, err := parser.ParseFile(file_set, input_path, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	object := file.Scope.Lookup(type_name)
+	if object == nil {
+		return nil, fmt.Errorf("type %s not found in %s", type_name, input_path)
+	}
+	type_spec, ok := object.Decl.(*ast.TypeSpec)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a type", type_name)
+	}
+	struct_type, ok := type_spec.Type.(*ast.StructType)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a struct", type_name)
+	}
+
+	var fields []field
+	for _, struct_field := range struct_type.Fields.List {
+		type_ident, ok := struct_field.Type.(*ast.Ident)
+		if !ok {
+			return nil, fmt.Errorf("field %s: only basic types are supported", struct_field.Names[0].Name)
+		}
+
+		var tag reflect.StructTag
+		if struct_field.Tag != nil {
+			tag_value, err := strconv.Unquote(struct_field.Tag.Value)
+			if err != nil {
+				return nil, err
+			}
+			tag = reflect.StructTag(tag_value)
+		}
+
+		for _, name := range struct_field.Names {
+			current := field{go_name: name.Name, go_type: type_ident.Name}
+			current.json_name, _, _ = strings.Cut(tag.Get("json"), ",")
+			if current.json_name == "" {
+				current.json_name = name.Name
+			}
+			csv_tag := strings.Split(tag.Get("csv"), ",")
+			current.long_name = csv_tag[0]
+			if current.long_name == "" {
+				current.long_name = name.Name
+			}
+			for _, option := range csv_tag[1:] {
+				if option != "optional" {
+					return nil, fmt.Errorf("field %s: unknown csv option %q", name.Name, option)
+				}
+				current.optional = true
+			}
+			fields = append(fields, current)
+		}
+	}
+	return fields, nil
+}
+
+// Get the expression which formats a field of the receiver `ac_data`.
+func formatExpression(current field) (string, error) {
+	value := "ac_data." + current.go_name
+	optional := strconv.FormatBool(current.optional)
+	switch current.go_type {
+	case "string":
+		return value, nil
+	case "bool":
+		return fmt.Sprintf("csv_config.formatBool(%s, %s)", value, optional), nil
+	case "int", "int8", "int16", "int32", "int64":
+		return fmt.Sprintf("csv_config.formatInt(int64(%s), %s)", value, optional), nil
+	case "uint", "uint8", "uint16", "uint32", "uint64":
+		return fmt.Sprintf("csv_config.formatUint(uint64(%s), %s)", value, optional), nil
+	case "float32":
+		return fmt.Sprintf("csv_config.formatFloat(float64(%s), 32, %s)", value, optional), nil
+	case "float64":
+		return fmt.Sprintf("csv_config.formatFloat(%s, 64, %s)", value, optional), nil
+	}
+	return "", fmt.Errorf("field %s: type %s is not supported", current.go_name, current.go_type)
+}
+
+func generateSource(type_name string, input_path string, fields []field) ([]byte, error) {
+	var source bytes.Buffer
+	columns_name := strings.ToLower(type_name[:1]) + type_name[1:] + "CsvColumns"
+
+	fmt.Fprintf(&source, "// Code generated by csvgen from %s. DO NOT EDIT.\n\n", input_path)
+	fmt.Fprintf(&source, "package main\n\n")
+
+	fmt.Fprintf(&source, "// Columns of the fields of the %s struct in the order of the struct.\n", type_name)
+	fmt.Fprintf(&source, "var %s = []csvColumn{\n", columns_name)
+	for _, current := range fields {
+		expression, err := formatExpression(current)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&source, "{Go_name: %q, Json_name: %q, Long_name: %q,\n", current.go_name, current.json_name,
+			current.long_name)
+		fmt.Fprintf(&source, "field: func(ac_data %s, csv_config CsvConfig) string { return %s }},\n", type_name,
+			expression)
+	}
+	fmt.Fprintf(&source, "}\n")
+
+	return format.Source(source.Bytes())
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The committed aircraft_data_csv.go is what the generator makes of the current
+// AircraftData struct, i.e. go generate was run after the struct was changed.
+func TestGeneratedCsvColumnsAreUpToDate(t *testing.T) {
+	// The generator is run like go generate, i.e. in the folder of the listener.
+	working_dir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir("../.."); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(working_dir)
+
+	output_path := filepath.Join(t.TempDir(), "aircraft_data_csv.go")
+	if err := generate("AircraftData", "datatypes.go", output_path); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ioutil.ReadFile(output_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed, err := ioutil.ReadFile("aircraft_data_csv.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(generated, committed) {
+		t.Error("aircraft_data_csv.go is out of date. Run go generate.")
+	}
+}
+
+func TestGenerateRejectsUnsupportedFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		source string
+		err    string
+	}{
+		{"unknown option", "type Data struct {\n\tAlt int `csv:\"Altitude,required\"`\n}\n", `unknown csv option "required"`},
+		{"unsupported type", "type Data struct {\n\tAlt complex64\n}\n", "type complex64 is not supported"},
+		{"composite type", "type Data struct {\n\tAlts []int\n}\n", "only basic types are supported"},
+		{"missing type", "type Other struct {\n\tAlt int\n}\n", "type Data not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			folder_path := t.TempDir()
+			input_path := filepath.Join(folder_path, "data.go")
+			if err := ioutil.WriteFile(input_path, []byte("package main\n\n"+test.source), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			err := generate("Data", input_path, filepath.Join(folder_path, "data_csv.go"))
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("got the error %v, expected %q", err, test.err)
+			}
+		})
+	}
+}
+
+// The json and csv tags give the names of the columns and whether the zero value is missing.
+func TestGenerateUsesTheTags(t *testing.T) {
+	folder_path := t.TempDir()
+	input_path := filepath.Join(folder_path, "data.go")
+	source := "package main\n\ntype Data struct {\n" +
+		"\tAlt int `json:\"alt\" csv:\"Altitude [ft],optional\"`\n" +
+		"\tDis float32\n" +
+		"}\n"
+	if err := ioutil.WriteFile(input_path, []byte(source), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	output_path := filepath.Join(folder_path, "data_csv.go")
+	if err := generate("Data", input_path, output_path); err != nil {
+		t.Fatal(err)
+	}
+	generated, err := ioutil.ReadFile(output_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{
+		"var dataCsvColumns = []csvColumn{",
+		`{Go_name: "Alt", Json_name: "alt", Long_name: "Altitude [ft]",`,
+		"return csv_config.formatInt(int64(ac_data.Alt), true)",
+		`{Go_name: "Dis", Json_name: "Dis", Long_name: "Dis",`,
+		"return csv_config.formatFloat(float64(ac_data.Dis), 32, false)",
+	} {
+		if !strings.Contains(string(generated), expected) {
+			t.Errorf("the generated code doesn't contain %q:\n%s", expected, generated)
+		}
+	}
+}
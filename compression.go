@@ -0,0 +1,259 @@
+// Compression of the data files.
+//
+// The CSVs can be compressed on the fly. The compressed streams are flushed such that a
+// crash only loses the data which was not flushed yet: gzip streams are sync flushed and
+// zstd files consist of independently decodable frames. Finished days can additionally be
+// packed into one archive before they are uploaded.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CompressionConfig groups the parameters of the compression of the data files.
+type CompressionConfig struct {
+	Format         string `yaml:"format"`         // none (default), gzip or zstd.
+	Level          int    `yaml:"level"`          // 0 selects the default level of the format.
+	Upload_archive bool   `yaml:"upload_archive"` // upload every day as one tar.gz archive.
+}
+
+// archiveExtension is the extension of the archives of whole days.
+const archiveExtension string = ".tar.gz"
+
+// Get the extension which is appended to the name of the compressed data files.
+func (compression CompressionConfig) Extension() string {
+	switch compression.Format {
+	case "gzip":
+		return ".gz"
+	case "zstd":
+		return ".zst"
+	default:
+		return ""
+	}
+}
+
+// Check the compression parameters and append the problems to `config_errors`.
+func (compression CompressionConfig) validate(config_errors *ConfigErrors) {
+	switch compression.Format {
+	case "", "none":
+	case "gzip":
+		if compression.Level < 0 || compression.Level > gzip.BestCompression {
+			config_errors.add("compression.level: %d must be between 1 and 9 for gzip", compression.Level)
+		}
+	case "zstd":
+		if compression.Level < 0 || compression.Level > 22 {
+			config_errors.add("compression.level: %d must be between 1 and 22 for zstd", compression.Level)
+		}
+	default:
+		config_errors.add("compression.format: %q must be none, gzip or zstd", compression.Format)
+	}
+}
+
+// frameWriter is a compressing writer. After a call to Flush, all the data which was
+// written so far can be decoded from the underlying writer.
+type frameWriter interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// Create a compressing writer for the configured format. Returns nil if the data is
+// not compressed.
+func newFrameWriter(w io.Writer, compression CompressionConfig) (frameWriter, error) {
+	switch compression.Format {
+	case "gzip":
+		level := compression.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		return gzip.NewWriterLevel(w, level)
+	case "zstd":
+		level := zstd.SpeedDefault
+		if compression.Level != 0 {
+			level = zstd.EncoderLevelFromZstd(compression.Level)
+		}
+		encoder, err := zstd.NewWriter(w, zstd.WithEncoderLevel(level), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &zstdFrameWriter{Encoder: encoder, w: w}, nil
+	default:
+		return nil, nil
+	}
+}
+
+// zstdFrameWriter ends the current zstd frame on every flush and starts a new one
+// such that every flushed frame can be decoded on its own.
+type zstdFrameWriter struct {
+	*zstd.Encoder
+	w     io.Writer
+	dirty bool // whether data was written since the last flush.
+}
+
+func (writer *zstdFrameWriter) Write(p []byte) (int, error) {
+	writer.dirty = writer.dirty || len(p) > 0
+	return writer.Encoder.Write(p)
+}
+
+func (writer *zstdFrameWriter) Flush() error {
+	if !writer.dirty {
+		return nil
+	}
+	if err := writer.Encoder.Close(); err != nil {
+		return err
+	}
+	writer.Encoder.Reset(writer.w)
+	writer.dirty = false
+	return nil
+}
+
+// Close the current frame. The encoder doesn't write anything after a reset until new
+// data is written, so no empty frame is appended.
+func (writer *zstdFrameWriter) Close() error {
+	return writer.Flush()
+}
+
+// Check whether the file name is the one of a (compressed) CSV.
+func isCsvFileName(file_name string) bool {
+	for _, extension := range []string{".csv", ".csv.gz", ".csv.zst"} {
+		if strings.HasSuffix(file_name, extension) {
+			return true
+		}
+	}
+	return false
+}
+
+// Open a data file for reading. Compressed files are decompressed according to their extension.
+func openDataFile(file_path string) (io.ReadCloser, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	reader, err := newDataReader(file_path, file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return readCloser{reader, closerFunc(func() error {
+		reader.Close()
+		return file.Close()
+	})}, nil
+}
+
+// Decompress the contents of a data file according to the extension of `file_name`. Closing
+// the returned reader doesn't close `r`.
+func newDataReader(file_name string, r io.Reader) (io.ReadCloser, error) {
+	switch {
+	case strings.HasSuffix(file_name, ".gz"):
+		return gzip.NewReader(bufio.NewReader(r))
+	case strings.HasSuffix(file_name, ".zst"):
+		decoder, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	default:
+		return ioutil.NopCloser(r), nil
+	}
+}
+
+// readCloser combines a reader with the closer of the underlying file.
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// Check whether a compressed data file ends with a complete frame, i.e. whether it was
+// closed properly. Data can only be appended to files which were closed properly.
+func isCompleteDataFile(file_path string) bool {
+	reader, err := openDataFile(file_path)
+	if err != nil {
+		return false
+	}
+	defer reader.Close()
+
+	_, err = io.Copy(ioutil.Discard, reader)
+	return err == nil
+}
+
+// Check whether the error of a read from a compressed file only indicates that the file
+// is still being written to, i.e. that its last frame was not closed yet.
+func isUnfinishedStream(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF)
+}
+
+// Pack the given files of a folder into a tar.gz archive at `archive_path`.
+//
+// The archive is written to a temporary file first such that an interrupted run
+// never leaves a truncated archive behind.
+func createArchive(archive_path string, folder_path string, file_names []string) error {
+	tmp_path := archive_path + ".tmp"
+	archive_file, err := os.Create(tmp_path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp_path)
+	defer archive_file.Close()
+
+	gzip_writer := gzip.NewWriter(archive_file)
+	tar_writer := tar.NewWriter(gzip_writer)
+
+	for _, file_name := range file_names {
+		if err := addFileToArchive(tar_writer, folder_path, file_name); err != nil {
+			return fmt.Errorf("failed to add %s to the archive: %w", file_name, err)
+		}
+	}
+
+	if err := tar_writer.Close(); err != nil {
+		return err
+	}
+	if err := gzip_writer.Close(); err != nil {
+		return err
+	}
+	if err := archive_file.Sync(); err != nil {
+		return err
+	}
+	if err := archive_file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, archive_path)
+}
+
+func addFileToArchive(tar_writer *tar.Writer, folder_path string, file_name string) error {
+	file, err := os.Open(folder_path + file_name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	file_info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	header, err := tar.FileInfoHeader(file_info, "")
+	if err != nil {
+		return err
+	}
+	if err := tar_writer.WriteHeader(header); err != nil {
+		return err
+	}
+	_, err = io.Copy(tar_writer, file)
+	return err
+}
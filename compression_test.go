@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+// A compressed file which was cut off by a crash can be decoded up to its last flush, and
+// isCompleteDataFile tells that no data may be appended to it.
+func TestCompressedFileCutOffAfterFlush(t *testing.T) {
+	tests := []struct {
+		format string
+		// Whether the file is complete if it is cut off right after a flush. Every flush ends a
+		// zstd frame, while a gzip member only ends when the file is closed.
+		complete_at_flush bool
+	}{
+		{"gzip", false},
+		{"zstd", true},
+	}
+	for _, test := range tests {
+		t.Run(test.format, func(t *testing.T) {
+			compression := CompressionConfig{Format: test.format}
+			var compressed bytes.Buffer
+			writer, err := newFrameWriter(&compressed, compression)
+			if err != nil {
+				t.Fatal(err)
+			}
+			flush := func(data string) int {
+				if _, err := writer.Write([]byte(data)); err != nil {
+					t.Fatal(err)
+				}
+				if err := writer.Flush(); err != nil {
+					t.Fatal(err)
+				}
+				return compressed.Len()
+			}
+			all_data := "Hex,Fli\n4b1805,SWR1\n4b1806,SWR2\n"
+			first_flush := flush("Hex,Fli\n4b1805,SWR1\n")
+			second_flush := flush("4b1806,SWR2\n")
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			folder_path := t.TempDir() + "/"
+			check := func(name string, size int, expected string, complete bool) {
+				t.Helper()
+				file_path := folder_path + name + ".csv" + compression.Extension()
+				if err := ioutil.WriteFile(file_path, compressed.Bytes()[:size], 0o644); err != nil {
+					t.Fatal(err)
+				}
+				reader, err := openDataFile(file_path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				defer reader.Close()
+				// The part of the data after the flush which was not cut off may be decoded as well.
+				data, err := ioutil.ReadAll(reader)
+				if !strings.HasPrefix(string(data), expected) || !strings.HasPrefix(all_data, string(data)) {
+					t.Errorf("%s decodes to %q, expected %q", name, data, expected)
+				}
+				if err != nil && !isUnfinishedStream(err) {
+					t.Errorf("decoding %s failed: %s", name, err)
+				}
+				if isCompleteDataFile(file_path) != complete {
+					t.Errorf("%s is complete: %t, expected %t", name, !complete, complete)
+				}
+			}
+
+			check("closed", compressed.Len(), all_data, true)
+			check("at_flush", first_flush, "Hex,Fli\n4b1805,SWR1\n", test.complete_at_flush)
+			check("after_flush", (first_flush+second_flush)/2, "Hex,Fli\n4b1805,SWR1\n", false)
+		})
+	}
+}
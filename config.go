@@ -0,0 +1,618 @@
+// Configuration handling.
+//
+// Loading, validation and normalisation of the yaml config file as well as the hot
+// reload logic which allows changing e.g. the aircraft types without restarting.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	_ "time/tzdata" // Windows machines don't ship a time zone database.
+
+	"gopkg.in/yaml.v2"
+)
+
+// Config struct implements and groups the config parameters of this module.
+type Config struct {
+	Icao_aircraft_types []string          `yaml:"icao_aircraft_types"`
+	Radarcape_hostname  string            `yaml:"radarcape_hostname"`
+	Data_dir            string            `yaml:"data_dir"`
+	State_dir           string            `yaml:"state_dir"`
+	Timezone            string            `yaml:"timezone"` // IANA name, e.g. UTC or Europe/Zurich.
+	Upload_folder_path  string            `yaml:"upload_folder_path"`
+	Backup_folder_path  string            `yaml:"backup_folder_path"`
+	Upload              UploadConfig      `yaml:"upload"`
+	Rotation            RotationConfig    `yaml:"rotation"`
+	Compression         CompressionConfig `yaml:"compression"`
+	Csv                 CsvConfig         `yaml:"csv"`
+	Site                SiteConfig        `yaml:"site"` // name and location of the antenna.
+	Write               WriteConfig       `yaml:"write"`
+	Queue               QueueConfig       `yaml:"queue"`
+	Wal                 WalConfig         `yaml:"wal"`
+	Metrics_address     string            `yaml:"metrics_address"` // e.g. 127.0.0.1:9100. Empty disables the metrics server.
+	Schedule            ScheduleConfig    `yaml:"schedule"`
+	Retention           RetentionConfig   `yaml:"retention"`
+	Raw_archive         RawArchiveConfig  `yaml:"raw_archive"`
+	Mqtt                MqttConfig        `yaml:"mqtt"`
+	Logging             LogConfig         `yaml:"logging"`
+}
+
+// unsetInt marks the integer parameters whose zero is a valid setting as not specified, such
+// that ApplyDefaults can tell them apart from an explicit zero.
+const unsetInt int = -1
+
+// Create a config in which none of the parameters are specified yet.
+func NewConfig() Config {
+	var config Config
+	config.Write.Flush_records = unsetInt
+	config.Logging.Max_backups = unsetInt
+	return config
+}
+
+// Load configuration file from disk.
+//
+// The Config file is in the .yaml file format and contains info about
+// which aircrafts are relevant to the study. Keys which are not part of the
+// Config struct are reported as an error (e.g. due to a typo).
+func (config *Config) LoadConfiguration(file string) error {
+
+	config_file, err := os.Open(file)
+
+	if err != nil {
+		return fmt.Errorf("failed to open the config file: %w", err)
+	}
+
+	defer config_file.Close()
+
+	decoder := yaml.NewDecoder(config_file)
+	decoder.SetStrict(true)
+	err = decoder.Decode(config)
+
+	if err != nil {
+		return fmt.Errorf("failed to decode the config file %s: %w", file, err)
+	}
+
+	config_log.Debug("loaded configuration", "path", file, "config", fmt.Sprintf("%+v", config.Redacted()))
+
+	return nil
+}
+
+// Override config values with environment variables.
+//
+// Every yaml key can be overridden by an environment variable named after the key in
+// upper case and prefixed with `prefix`. Keys of nested sections are joined with an
+// underscore, e.g. RADARCAPE_LOGGING_LEVEL overrides `level` in the `logging` section.
+// Lists are given as comma separated values.
+func (config *Config) ApplyEnvironment(prefix string) error {
+	return applyEnvironmentToStruct(reflect.ValueOf(config).Elem(), prefix)
+}
+
+func applyEnvironmentToStruct(v reflect.Value, prefix string) error {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		env_name := prefix + "_" + strings.ToUpper(key)
+		field := v.Field(i)
+
+		if field.Kind() == reflect.Struct {
+			if err := applyEnvironmentToStruct(field, env_name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env_value, ok := os.LookupEnv(env_name)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(env_value)
+		case reflect.Bool:
+			parsed, err := strconv.ParseBool(env_value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env_name, err)
+			}
+			field.SetBool(parsed)
+		case reflect.Float64:
+			parsed, err := strconv.ParseFloat(env_value, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env_name, err)
+			}
+			field.SetFloat(parsed)
+		case reflect.Int, reflect.Int64:
+			parsed, err := strconv.ParseInt(env_value, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s: %w", env_name, err)
+			}
+			field.SetInt(parsed)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.String {
+				return fmt.Errorf("%s: cannot be set from the environment", env_name)
+			}
+			values := []string{}
+			for _, value := range strings.Split(env_value, ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+			field.Set(reflect.ValueOf(values))
+		default:
+			return fmt.Errorf("%s: cannot be set from the environment", env_name)
+		}
+	}
+
+	return nil
+}
+
+// Fill in the default values of all the parameters which were not specified.
+//
+// Expects a config to which Normalize has been applied.
+func (config *Config) ApplyDefaults() {
+	default_dirs := DefaultAppDirs()
+	if config.Data_dir == "" {
+		config.Data_dir = default_dirs.Data_dir
+	}
+	if config.State_dir == "" {
+		config.State_dir = default_dirs.State_dir
+	}
+	if config.Raw_archive.Dir == "" {
+		config.Raw_archive.Dir = config.Data_dir + rawArchiveFolderName
+	}
+
+	if config.Timezone == "" {
+		config.Timezone = "UTC"
+	}
+
+	if config.Csv.Header == "" {
+		config.Csv.Header = csvHeaderGo
+	}
+	if config.Csv.Header_mismatch == "" {
+		config.Csv.Header_mismatch = headerMismatchRoll
+	}
+
+	config.Upload.applyDefaults()
+	config.Mqtt.applyDefaults()
+
+	if config.Queue.Size == 0 {
+		config.Queue.Size = 1000
+	}
+	if config.Queue.Overflow_policy == "" {
+		config.Queue.Overflow_policy = overflowBlock
+	}
+
+	if config.Wal.Segment_size_mb == 0 {
+		config.Wal.Segment_size_mb = 16
+	}
+
+	if config.Write.Flush_records == unsetInt {
+		config.Write.Flush_records = 100
+	}
+	if config.Write.Flush_interval == "" {
+		config.Write.Flush_interval = "1s"
+	}
+
+	// The rollover has to happen shortly after the start of every partition.
+	if config.Schedule.Rollover == "" {
+		config.Schedule.Rollover = config.Partitioning().RolloverSchedule()
+	}
+	if config.Schedule.Upload == "" {
+		config.Schedule.Upload = "0 0 3 * * *"
+	}
+	if config.Schedule.Retention == "" {
+		config.Schedule.Retention = "0 30 3 * * *"
+	}
+	if config.Schedule.Report == "" {
+		config.Schedule.Report = "0 5 0 * * *"
+	}
+
+	if config.Logging.File_path == "" {
+		config.Logging.File_path = config.State_dir + "logs/radarcape_listener.log"
+	}
+	if config.Logging.Level == "" {
+		config.Logging.Level = "info"
+	}
+	if config.Logging.Format == "" {
+		config.Logging.Format = "text"
+	}
+	if config.Logging.Max_size_mb == 0 {
+		config.Logging.Max_size_mb = 10
+	}
+	if config.Logging.Max_backups == unsetInt {
+		config.Logging.Max_backups = 5
+	}
+}
+
+// Normalise the values of the config.
+//
+// Aircraft types are upper cased and folder paths use forward slashes and end with a
+// trailing slash since they are concatenated with file names throughout the project.
+func (config *Config) Normalize() {
+	for i, aircraft_type := range config.Icao_aircraft_types {
+		config.Icao_aircraft_types[i] = strings.ToUpper(strings.TrimSpace(aircraft_type))
+	}
+	config.Radarcape_hostname = strings.TrimSpace(config.Radarcape_hostname)
+	config.Timezone = strings.TrimSpace(config.Timezone)
+	config.Site.Name = strings.TrimSpace(config.Site.Name)
+	config.Compression.Format = strings.ToLower(strings.TrimSpace(config.Compression.Format))
+	config.Csv.normalize()
+	config.Queue.Overflow_policy = strings.ToLower(strings.TrimSpace(config.Queue.Overflow_policy))
+	config.Data_dir = normalizeFolderPath(config.Data_dir)
+	config.State_dir = normalizeFolderPath(config.State_dir)
+	config.Upload_folder_path = normalizeFolderPath(config.Upload_folder_path)
+	config.Backup_folder_path = normalizeFolderPath(config.Backup_folder_path)
+	config.Raw_archive.Dir = normalizeFolderPath(config.Raw_archive.Dir)
+	config.Upload.normalize()
+	config.Mqtt.normalize()
+}
+
+// Convert the path to forward slashes and add a trailing slash. Empty paths stay empty.
+func normalizeFolderPath(folder_path string) string {
+	folder_path = strings.TrimSpace(folder_path)
+	if folder_path == "" {
+		return ""
+	}
+	// The paths are also written with backslashes on windows machines.
+	folder_path = strings.ReplaceAll(filepath.Clean(folder_path), "\\", "/")
+	if !strings.HasSuffix(folder_path, "/") {
+		folder_path += "/"
+	}
+	return folder_path
+}
+
+// Get the location which is used for the daily partitioning of the data.
+//
+// The day folders are named after the date in this location, and the rollover and
+// upload times are given as wall clock times in this location.
+func (config Config) Location() *time.Location {
+	locations_mu.Lock()
+	defer locations_mu.Unlock()
+
+	if location, ok := locations[config.Timezone]; ok {
+		return location
+	}
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		// Validate makes sure that this does not happen.
+		return time.UTC
+	}
+	locations[config.Timezone] = location
+	return location
+}
+
+// The time zones which were loaded so far by their name. time.LoadLocation reads and
+// parses the time zone database on every call.
+var (
+	locations_mu sync.Mutex
+	locations    = make(map[string]*time.Location)
+)
+
+// Get a copy of the config in which the secrets are masked, e.g. to print or log it.
+func (config Config) Redacted() Config {
+	if config.Upload.Webdav.Password != "" {
+		config.Upload.Webdav.Password = "***"
+	}
+	if config.Upload.Sftp.Key_passphrase != "" {
+		config.Upload.Sftp.Key_passphrase = "***"
+	}
+	if config.Upload.S3.Secret_access_key != "" {
+		config.Upload.S3.Secret_access_key = "***"
+	}
+	if config.Mqtt.Password != "" {
+		config.Mqtt.Password = "***"
+	}
+	return config
+}
+
+// Parse the schedule of a job in the configured time zone. Returns nil if the job is turned off.
+//
+// Validate makes sure that all the schedules can be parsed.
+func (config Config) ParsedSchedule(expression string) (Schedule, error) {
+	return ParseSchedule(expression, config.Location())
+}
+
+// ConfigErrors collects all the problems which were found in a config such that
+// they can be fixed in one go.
+type ConfigErrors []string
+
+func (config_errors ConfigErrors) Error() string {
+	return "\n  - " + strings.Join(config_errors, "\n  - ")
+}
+
+func (config_errors *ConfigErrors) add(format string, args ...any) {
+	*config_errors = append(*config_errors, fmt.Sprintf(format, args...))
+}
+
+// ICAO aircraft type designators (Doc 8643) consist of 2 to 4 characters
+// and start with a letter.
+var icao_type_designator_regexp = regexp.MustCompile(`^[A-Z][A-Z0-9]{1,3}$`)
+
+// Check that all the values of the config are consistent.
+//
+// Expects a config to which Normalize and ApplyDefaults have been applied.
+func (config Config) Validate() error {
+	var config_errors ConfigErrors
+
+	if config.Radarcape_hostname == "" {
+		config_errors.add("radarcape_hostname: must be specified")
+	} else if strings.Contains(config.Radarcape_hostname, "://") || strings.Contains(config.Radarcape_hostname, "/") {
+		config_errors.add("radarcape_hostname: %q must be a host name (optionally with port) without scheme or path",
+			config.Radarcape_hostname)
+	}
+
+	if len(config.Icao_aircraft_types) == 0 {
+		config_errors.add("icao_aircraft_types: at least one aircraft type must be specified")
+	}
+	seen_types := make(map[string]bool, len(config.Icao_aircraft_types))
+	for i, aircraft_type := range config.Icao_aircraft_types {
+		if !icao_type_designator_regexp.MatchString(aircraft_type) {
+			config_errors.add("icao_aircraft_types[%d]: %q is not a valid ICAO type designator (e.g. A320, B738)",
+				i, aircraft_type)
+		}
+		if seen_types[aircraft_type] {
+			config_errors.add("icao_aircraft_types[%d]: %q is listed more than once", i, aircraft_type)
+		}
+		seen_types[aircraft_type] = true
+	}
+
+	config.Upload.validate(&config_errors)
+	if config.Backup_folder_path != "" && !config.UploadEnabled() {
+		config_errors.add("backup_folder_path: backups are only created when an upload target is specified")
+	}
+	if config.Upload_folder_path != "" && sameFolder(config.Upload_folder_path, config.Data_dir) {
+		config_errors.add("upload_folder_path: must differ from data_dir")
+	}
+	if config.Backup_folder_path != "" && sameFolder(config.Backup_folder_path, config.Data_dir) {
+		config_errors.add("backup_folder_path: must differ from data_dir")
+	}
+
+	if _, err := time.LoadLocation(config.Timezone); err != nil {
+		config_errors.add("timezone: %q is not a known time zone (e.g. UTC or Europe/Zurich)", config.Timezone)
+	}
+
+	if _, err := ParseRotationInterval(config.Rotation.Interval); err != nil {
+		config_errors.add("rotation.interval: %s (e.g. daily, hourly or 15m)", err)
+	}
+	if config.Rotation.Max_size_mb < 0 {
+		config_errors.add("rotation.max_size_mb: must not be negative")
+	}
+
+	config.Compression.validate(&config_errors)
+	config.Csv.validate(&config_errors)
+	config.Site.validate(&config_errors)
+	if !config.Site.IsSet() && config.Csv.usesColumn("site_distance_km") {
+		config_errors.add("site: the location is required for the site_distance_km column")
+	}
+
+	if config.Queue.Size < 0 {
+		config_errors.add("queue.size: must not be negative")
+	}
+	switch config.Queue.Overflow_policy {
+	case overflowBlock, overflowDropOldest, overflowDropNewest, overflowSpill:
+	default:
+		config_errors.add("queue.overflow_policy: %q must be block, drop-oldest, drop-newest or spill",
+			config.Queue.Overflow_policy)
+	}
+
+	if config.Wal.Segment_size_mb < 0 {
+		config_errors.add("wal.segment_size_mb: must not be negative")
+	}
+
+	if config.Write.Flush_records < 0 {
+		config_errors.add("write.flush_records: must not be negative")
+	}
+	if flush_interval, err := parseWriteInterval(config.Write.Flush_interval); err != nil {
+		config_errors.add("write.flush_interval: %s", err)
+	} else if flush_interval == 0 && config.Write.Flush_records == 0 {
+		config_errors.add("write.flush_records: 0 needs a flush_interval, otherwise the files are only written on rollover")
+	}
+	if _, err := parseWriteInterval(config.Write.Fsync_interval); err != nil {
+		config_errors.add("write.fsync_interval: %s", err)
+	}
+
+	schedules := []struct {
+		name       string
+		expression string
+	}{
+		{"rollover", config.Schedule.Rollover},
+		{"upload", config.Schedule.Upload},
+		{"retention", config.Schedule.Retention},
+		{"report", config.Schedule.Report},
+	}
+	for _, schedule := range schedules {
+		parsed, err := ParseSchedule(schedule.expression, time.UTC)
+		if err != nil {
+			config_errors.add("schedule.%s: %s", schedule.name, err)
+		} else if parsed == nil && schedule.name == "rollover" {
+			config_errors.add("schedule.rollover: the rollover can't be turned off")
+		}
+	}
+
+	config.Retention.validate(&config_errors)
+	config.Mqtt.validate(&config_errors)
+
+	if _, err := ParseLogLevel(config.Logging.Level); err != nil {
+		config_errors.add("logging.level: %s", err)
+	}
+	if format := strings.ToLower(config.Logging.Format); format != "text" && format != "json" {
+		config_errors.add("logging.format: %q must be either text or json", config.Logging.Format)
+	}
+	if config.Logging.Max_size_mb < 0 {
+		config_errors.add("logging.max_size_mb: must not be negative")
+	}
+	if config.Logging.Max_age_hours < 0 {
+		config_errors.add("logging.max_age_hours: must not be negative")
+	}
+	if config.Logging.Max_backups < 0 {
+		config_errors.add("logging.max_backups: must not be negative")
+	}
+
+	if len(config_errors) > 0 {
+		return config_errors
+	}
+	return nil
+}
+
+// ConfigStore holds the currently active configuration.
+//
+// The goroutines get the config from the store every time they need it such that
+// changes due to a reload are picked up without restarting the program.
+type ConfigStore struct {
+	mu           sync.RWMutex
+	config       Config
+	partitioning Partitioning // of the config, computed once per loaded config.
+}
+
+func NewConfigStore(config Config) *ConfigStore {
+	return &ConfigStore{config: config, partitioning: config.Partitioning()}
+}
+
+// Get a copy of the currently active config.
+func (store *ConfigStore) Get() Config {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	config := store.config
+	config.Icao_aircraft_types = append([]string(nil), store.config.Icao_aircraft_types...)
+	config.Csv = store.config.Csv.clone()
+	return config
+}
+
+// Get the partitioning of the currently active config.
+func (store *ConfigStore) Partitioning() Partitioning {
+	store.mu.RLock()
+	defer store.mu.RUnlock()
+
+	partitioning := store.partitioning
+	partitioning.Csv = store.partitioning.Csv.clone()
+	return partitioning
+}
+
+func (store *ConfigStore) Set(config Config) {
+	partitioning := config.Partitioning()
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	store.config = config
+	store.partitioning = partitioning
+}
+
+// Config reloader goroutine.
+//
+// Reloads the config whenever a SIGHUP is received or the modification time of the config
+// file changes. `load` is expected to return a fully validated config. If the new config is
+// invalid, the error is logged and the previous config stays active. Returns once `stop` is
+// closed.
+func WatchConfiguration(store *ConfigStore, config_path string, load func() (Config, error), poll_interval time.Duration,
+	stop <-chan struct{}) {
+	sighup_chan := make(chan os.Signal, 1)
+	signal.Notify(sighup_chan, syscall.SIGHUP)
+	defer signal.Stop(sighup_chan)
+
+	poll_ticker := time.NewTicker(poll_interval)
+	defer poll_ticker.Stop()
+
+	last_mod_time := getModTime(config_path)
+
+	for {
+		select {
+		case <-sighup_chan:
+			config_log.Info("received SIGHUP. Reloading the configuration.", "path", config_path)
+			last_mod_time = getModTime(config_path)
+
+		case <-poll_ticker.C:
+			mod_time := getModTime(config_path)
+			if mod_time.Equal(last_mod_time) {
+				continue
+			}
+			last_mod_time = mod_time
+			config_log.Info("config file changed. Reloading the configuration.", "path", config_path)
+
+		case <-stop:
+			return
+		}
+
+		new_config, err := load()
+		if err != nil {
+			config_log.WarnSevere("failed to reload the configuration. Keeping the previous one.", "err", err)
+			continue
+		}
+
+		old_config := store.Get()
+		if new_config.Data_dir != old_config.Data_dir {
+			config_log.Warn("data_dir changed. New files are created there from the next rollover on.",
+				"old", old_config.Data_dir, "new", new_config.Data_dir)
+		}
+		new_config = pinPartitioning(old_config, new_config)
+		warnRestartRequired(old_config, new_config)
+
+		store.Set(new_config)
+		config_log.Info("configuration reloaded.",
+			"hostname", new_config.Radarcape_hostname,
+			"aircraft_types", new_config.Icao_aircraft_types,
+		)
+	}
+}
+
+// Keep the settings of the reloaded config which define the partitions.
+//
+// The rollover ticker and the scheduler are not rescheduled, so the partitions and the
+// file names have to stay consistent with the interval and the time zone they fire on.
+func pinPartitioning(old_config Config, new_config Config) Config {
+	if new_config.Rotation.Interval != old_config.Rotation.Interval {
+		config_log.Warn("rotation.interval changed. The new interval is used after a restart.",
+			"old", old_config.Rotation.Interval, "new", new_config.Rotation.Interval)
+		new_config.Rotation.Interval = old_config.Rotation.Interval
+	}
+	if new_config.Timezone != old_config.Timezone {
+		config_log.Warn("timezone changed. The new time zone is used after a restart.",
+			"old", old_config.Timezone, "new", new_config.Timezone)
+		new_config.Timezone = old_config.Timezone
+	}
+	return new_config
+}
+
+// Warn about the changed settings which are only read on startup.
+func warnRestartRequired(old_config Config, new_config Config) {
+	settings := []struct {
+		name    string
+		changed bool
+	}{
+		{"write.flush_interval", new_config.Write.Flush_interval != old_config.Write.Flush_interval},
+		{"write.fsync_interval", new_config.Write.Fsync_interval != old_config.Write.Fsync_interval},
+		{"queue", new_config.Queue != old_config.Queue},
+		{"wal", new_config.Wal != old_config.Wal},
+		{"schedule", new_config.Schedule != old_config.Schedule},
+		{"metrics_address", new_config.Metrics_address != old_config.Metrics_address},
+		{"mqtt", new_config.Mqtt != old_config.Mqtt},
+	}
+	for _, setting := range settings {
+		if setting.changed {
+			config_log.Warn(setting.name + " changed. The new settings are used after a restart.")
+		}
+	}
+}
+
+// Get the modification time of a file or the zero time if it can't be accessed.
+func getModTime(file_path string) time.Time {
+	info, err := os.Stat(file_path)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
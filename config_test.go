@@ -0,0 +1,265 @@
+package main
+
+import (
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsThePartitioningSettings(t *testing.T) {
+	old_config := newTestConfig(t, nil)
+	new_config := newTestConfig(t, func(config *Config) {
+		config.Icao_aircraft_types = []string{"A320", "A388"}
+		config.Timezone = "Europe/Zurich"
+		config.Rotation.Interval = "hourly"
+	})
+
+	reloaded := pinPartitioning(old_config, new_config)
+	if reloaded.Timezone != "UTC" || reloaded.Rotation.Interval != old_config.Rotation.Interval {
+		t.Errorf("the reload changed the partitioning to %s and %q", reloaded.Timezone, reloaded.Rotation.Interval)
+	}
+	if len(reloaded.Icao_aircraft_types) != 2 || reloaded.Icao_aircraft_types[1] != "A388" {
+		t.Errorf("the reload didn't change the aircraft types: %v", reloaded.Icao_aircraft_types)
+	}
+}
+
+func TestConfigHashCoversOnlyTheFileSettings(t *testing.T) {
+	config := newTestConfig(t, nil)
+	hash := config.Hash()
+
+	unrelated := config
+	unrelated.Mqtt.Password = "hunter2"
+	unrelated.Upload.Webdav.Password = "hunter2"
+	unrelated.Radarcape_hostname = "radarcape.other"
+	if unrelated.Hash() != hash {
+		t.Error("the hash depends on settings which don't shape the files")
+	}
+
+	for name, modify := range map[string]func(config *Config){
+		"timezone": func(config *Config) { config.Timezone = "Europe/Zurich" },
+		"rotation": func(config *Config) { config.Rotation.Interval = "hourly" },
+		"columns":  func(config *Config) { config.Csv.Columns = []string{"hex", "fli"} },
+		"site":     func(config *Config) { config.Site.Name = "Zurich" },
+	} {
+		changed := config
+		changed.Csv = config.Csv.clone()
+		modify(&changed)
+		if changed.Hash() == hash {
+			t.Errorf("the hash doesn't change with the %s", name)
+		}
+	}
+}
+
+func TestConfigStoreComputesThePartitioningOncePerConfig(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) { config.Csv.Columns = []string{"hex", "fli"} })
+	store := NewConfigStore(config)
+	if partitioning := store.Partitioning(); partitioning.Config_hash != config.Hash() || partitioning.Interval != 0 {
+		t.Errorf("unexpected partitioning %+v", partitioning)
+	}
+
+	// The returned partitioning is a copy.
+	store.Partitioning().Csv.Columns[0] = "changed"
+	if store.Partitioning().Csv.Columns[0] == "changed" {
+		t.Error("the columns of the store were changed through a copy")
+	}
+
+	hourly := newTestConfig(t, func(config *Config) { config.Rotation.Interval = "hourly" })
+	store.Set(hourly)
+	if partitioning := store.Partitioning(); partitioning.Config_hash != hourly.Hash() || partitioning.Interval != time.Hour {
+		t.Errorf("the partitioning was not updated: %+v", partitioning)
+	}
+
+	zurich := newTestConfig(t, func(config *Config) { config.Timezone = "Europe/Zurich" })
+	if zurich.Location() != zurich.Location() || zurich.Location().String() != "Europe/Zurich" {
+		t.Error("the location is not cached")
+	}
+}
+
+// Load a config file like the listener does.
+func loadTestConfig(config_path string) (Config, error) {
+	return (&commonFlags{config_path: config_path}).loadConfig()
+}
+
+// Keys which are not part of the config, e.g. because they are misspelt, are rejected.
+func TestLoadConfigurationRejectsUnknownKeys(t *testing.T) {
+	tests := []struct {
+		name  string
+		extra string
+		err   string
+	}{
+		{"misspelt key", "radarcape_hostnme: radarcape.other\n", "field radarcape_hostnme not found"},
+		{"misspelt nested key", "write:\n  flush_record: 10\n", "field flush_record not found"},
+		{"unknown section", "uploads:\n  workers: 2\n", "field uploads not found"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config_path, _ := writeTestConfigFile(t, test.extra)
+			_, err := loadTestConfig(config_path)
+			if err == nil || !strings.Contains(err.Error(), test.err) || !strings.Contains(err.Error(), config_path) {
+				t.Errorf("got the error %v, expected %q in %s", err, test.err, config_path)
+			}
+		})
+	}
+}
+
+// All the problems of a config are reported at once, each with its key.
+func TestValidateReportsEveryProblem(t *testing.T) {
+	config := newTestConfig(t, nil)
+	config.Radarcape_hostname = "http://radarcape.local/"
+	config.Icao_aircraft_types = []string{"A320", "1X"}
+	config.Timezone = "Europe/Nowhere"
+	config.Write.Flush_records = -3
+	config.Queue.Overflow_policy = "drop-all"
+	err := config.Validate()
+	if err == nil {
+		t.Fatal("the invalid config was accepted")
+	}
+	for _, expected := range []string{
+		`radarcape_hostname: "http://radarcape.local/" must be a host name`,
+		`"1X"`,
+		"timezone:",
+		"write.flush_records: must not be negative",
+		`queue.overflow_policy: "drop-all" must be block, drop-oldest, drop-newest or spill`,
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("the error doesn't contain %q:%s", expected, err)
+		}
+	}
+	if problems := strings.Count(err.Error(), "\n  - "); problems != 5 {
+		t.Errorf("got %d problems, expected 5:%s", problems, err)
+	}
+}
+
+// The folder paths end with a slash and use forward slashes, since they are concatenated with
+// file names.
+func TestNormalizeFolderPaths(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"/srv/radarcape/data", "/srv/radarcape/data/"},
+		{"/srv/radarcape/data/", "/srv/radarcape/data/"},
+		{" /srv/radarcape//upload/ ", "/srv/radarcape/upload/"},
+		{`C:\radarcape\upload`, "C:/radarcape/upload/"},
+		{"", ""},
+	}
+	for _, test := range tests {
+		config := Config{Data_dir: test.path, Upload_folder_path: test.path}
+		config.Normalize()
+		if config.Data_dir != test.expected || config.Upload_folder_path != test.expected {
+			t.Errorf("%q was normalized to %q and %q, expected %q", test.path, config.Data_dir,
+				config.Upload_folder_path, test.expected)
+		}
+	}
+}
+
+// A zero which is given explicitly is kept, while a missing parameter gets its default.
+func TestLoadConfigurationKeepsExplicitZeros(t *testing.T) {
+	config_path, _ := writeTestConfigFile(t, "write:\n  flush_records: 0\nlogging:\n  max_backups: 0\n")
+	config, err := loadTestConfig(config_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Write.Flush_records != 0 || config.Logging.Max_backups != 0 {
+		t.Errorf("got flush_records %d and max_backups %d, expected 0", config.Write.Flush_records,
+			config.Logging.Max_backups)
+	}
+
+	config_path, _ = writeTestConfigFile(t, "")
+	if config, err = loadTestConfig(config_path); err != nil {
+		t.Fatal(err)
+	}
+	if config.Write.Flush_records != 100 || config.Logging.Max_backups != 5 {
+		t.Errorf("got flush_records %d and max_backups %d, expected the defaults", config.Write.Flush_records,
+			config.Logging.Max_backups)
+	}
+
+	// Without a flush interval, the files would only be written on rollover.
+	config_path, _ = writeTestConfigFile(t, "write:\n  flush_records: 0\n  flush_interval: off\n")
+	if _, err = loadTestConfig(config_path); err == nil || !strings.Contains(err.Error(), "write.flush_records") {
+		t.Errorf("got the error %v, expected one about write.flush_records", err)
+	}
+}
+
+// A changed config file is reloaded, and the files of the aircraft types which were added are
+// opened without a rollover. An invalid config keeps the previous one active.
+func TestWatchConfigurationReloadsChangedFile(t *testing.T) {
+	config_path, root := writeTestConfigFile(t, "")
+	config, err := loadTestConfig(config_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewConfigStore(config)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchConfiguration(store, config_path, func() (Config, error) { return loadTestConfig(config_path) },
+		10*time.Millisecond, stop)
+
+	// An invalid config is ignored.
+	modified := time.Now()
+	writeTestFile(t, config_path, "icao_aircraft_types: [A320\n")
+	os.Chtimes(config_path, modified, modified)
+	time.Sleep(50 * time.Millisecond)
+	if types := store.Get().Icao_aircraft_types; len(types) != 2 {
+		t.Fatalf("the invalid config was loaded: %v", types)
+	}
+
+	writeTestConfigFileTo(t, config_path, root, "icao_aircraft_types: [A320, B738, A388]\n")
+	os.Chtimes(config_path, modified.Add(time.Second), modified.Add(time.Second))
+	waitUntil(t, "the config is reloaded", func() bool { return len(store.Get().Icao_aircraft_types) == 3 })
+
+	start := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	sink := &csvSink{config_store: store, buffered: make(map[string][]bufferedRecord)}
+	if err := sink.open(start); err != nil {
+		t.Fatal(err)
+	}
+	record := testRecord(1)
+	record.Typ = "A388"
+	if err := sink.write(SequencedRecord{Seq: 0, Record: record}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(getDataFolder(config.Data_dir, start) + "output_file_A388.csv"); err != nil {
+		t.Errorf("the csv of the added aircraft type was not written: %s", err)
+	}
+}
+
+// The config is reloaded on SIGHUP, even if the file looks unchanged.
+func TestWatchConfigurationReloadsOnSighup(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("there is no SIGHUP on windows")
+	}
+	config_path, root := writeTestConfigFile(t, "")
+	config, err := loadTestConfig(config_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(config_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Otherwise a SIGHUP before the watcher subscribed to it would end the test.
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	defer signal.Stop(sighup)
+
+	store := NewConfigStore(config)
+	stop := make(chan struct{})
+	defer close(stop)
+	go WatchConfiguration(store, config_path, func() (Config, error) { return loadTestConfig(config_path) },
+		time.Hour, stop)
+
+	writeTestConfigFileTo(t, config_path, root, "radarcape_hostname: radarcape.other\n")
+	os.Chtimes(config_path, info.ModTime(), info.ModTime())
+	waitUntil(t, "the config is reloaded", func() bool {
+		// The watcher may not have subscribed to the signal yet.
+		syscall.Kill(os.Getpid(), syscall.SIGHUP)
+		return store.Get().Radarcape_hostname == "radarcape.other"
+	})
+}
@@ -0,0 +1,134 @@
+// Derived csv columns.
+//
+// Columns whose values are not taken from the aircraftlist.json as they are, but are
+// computed from the received data, e.g. converted to SI units, or describe the reception
+// of the record.
+
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// SiteConfig holds the name and the location of the Radarcape antenna.
+type SiteConfig struct {
+	Name      string  `yaml:"name"`      // e.g. in the metadata of uploaded objects.
+	Latitude  float64 `yaml:"latitude"`  // in degrees.
+	Longitude float64 `yaml:"longitude"` // in degrees.
+}
+
+// Unit conversions of the derived columns.
+const (
+	metresPerFoot       float64 = 0.3048
+	metresPerSecPerKnot float64 = 1852.0 / 3600.0
+	earthRadiusKm       float64 = 6371.0
+)
+
+// ISO-8601 formats of the time columns. The GPS time is given with the full precision
+// of the Radarcape.
+const (
+	isoTimeFormatString     string = "2006-01-02T15:04:05.000000Z07:00"
+	isoNanoTimeFormatString string = "2006-01-02T15:04:05.000000000Z07:00"
+)
+
+// Columns which are derived from the records. They can be selected by their json name in
+// addition to the fields of the AircraftData struct.
+var derivedCsvColumns = []csvColumn{
+	{Go_name: "Received", Json_name: "received", Long_name: "Receive time [ISO-8601]",
+		derived: func(record Record, layout CsvLayout) string {
+			return layout.formatTime(record.Received, isoTimeFormatString)
+		}},
+	{Go_name: "Received_mono", Json_name: "received_mono", Long_name: "Monotonic receive time since the start [s]",
+		derived: func(record Record, layout CsvLayout) string {
+			if record.Received.IsZero() {
+				return ""
+			}
+			return layout.formatDerivedFloat(record.Received_mono.Seconds(), 9)
+		}},
+	{Go_name: "Gps_time", Json_name: "gps_time", Long_name: "GPS time of the message [ISO-8601]",
+		derived: func(record Record, layout CsvLayout) string {
+			return layout.formatTime(record.Gps_time, isoNanoTimeFormatString)
+		}},
+	{Go_name: "Latency_ms", Json_name: "latency_ms", Long_name: "Time between the GPS time and the reception [ms]",
+		derived: func(record Record, layout CsvLayout) string {
+			if record.Received.IsZero() || record.Gps_time.IsZero() {
+				return ""
+			}
+			latency := record.Received.Sub(record.Gps_time)
+			return layout.formatDerivedFloat(float64(latency)/float64(time.Millisecond), 3)
+		}},
+	{Go_name: "Uti_time", Json_name: "uti_time", Long_name: "Update time [ISO-8601]",
+		derived: func(record Record, layout CsvLayout) string {
+			if record.Uti == 0 {
+				return ""
+			}
+			return layout.formatTime(time.Unix(int64(record.Uti), 0), isoTimeFormatString)
+		}},
+	{Go_name: "Alt_m", Json_name: "alt_m", Long_name: "Barometric altitude [m]",
+		derived: func(record Record, layout CsvLayout) string {
+			return layout.formatDerivedFloat(float64(record.Alt)*metresPerFoot, 1)
+		}},
+	{Go_name: "Spd_ms", Json_name: "spd_ms", Long_name: "Ground speed [m/s]",
+		derived: func(record Record, layout CsvLayout) string {
+			return layout.formatDerivedFloat(float64(record.Spd)*metresPerSecPerKnot, 2)
+		}},
+	{Go_name: "Site_distance_km", Json_name: "site_distance_km", Long_name: "Distance to the site [km]",
+		derived: func(record Record, layout CsvLayout) string {
+			// Without a position the distance is unknown.
+			if record.Lat == 0 && record.Lon == 0 {
+				return ""
+			}
+			return layout.formatDerivedFloat(
+				greatCircleDistanceKm(layout.site.Latitude, layout.site.Longitude, record.Lat, record.Lon), 3)
+		}},
+	{Go_name: "Poll_seq", Json_name: "poll_seq", Long_name: "Poll sequence number",
+		derived: func(record Record, layout CsvLayout) string {
+			return layout.csv_config.formatUint(record.Poll_seq, false)
+		}},
+}
+
+// Check the site parameters and add the problems to `config_errors`.
+func (site SiteConfig) validate(config_errors *ConfigErrors) {
+	if site.Latitude < -90 || site.Latitude > 90 {
+		config_errors.add("site.latitude: %v must be between -90 and 90", site.Latitude)
+	}
+	if site.Longitude < -180 || site.Longitude > 180 {
+		config_errors.add("site.longitude: %v must be between -180 and 180", site.Longitude)
+	}
+}
+
+// Check whether the location of the site was configured.
+func (site SiteConfig) IsSet() bool {
+	return site.Latitude != 0 || site.Longitude != 0
+}
+
+// Format a time in the time zone of the listener. An unknown (zero) time gives an empty cell.
+func (layout CsvLayout) formatTime(value time.Time, format string) string {
+	if value.IsZero() {
+		return ""
+	}
+	return value.In(layout.location).Format(format)
+}
+
+// Format a computed value. Unless a precision is configured, it is rounded to
+// `default_precision` digits such that the conversion doesn't show rounding errors.
+func (layout CsvLayout) formatDerivedFloat(value float64, default_precision int) string {
+	csv_config := layout.csv_config
+	if csv_config.Float_precision == 0 {
+		csv_config.Float_precision = default_precision
+	}
+	return csv_config.formatFloat(value, 64, false)
+}
+
+// Get the distance between two positions along the surface of the earth using the
+// haversine formula.
+func greatCircleDistanceKm(latitude_1, longitude_1, latitude_2, longitude_2 float64) float64 {
+	to_radians := math.Pi / 180
+	delta_latitude := (latitude_2 - latitude_1) * to_radians
+	delta_longitude := (longitude_2 - longitude_1) * to_radians
+
+	a := math.Pow(math.Sin(delta_latitude/2), 2) +
+		math.Cos(latitude_1*to_radians)*math.Cos(latitude_2*to_radians)*math.Pow(math.Sin(delta_longitude/2), 2)
+	return 2 * earthRadiusKm * math.Asin(math.Sqrt(a))
+}
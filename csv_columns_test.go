@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Create a config whose A320 files have their own columns, and whose site is Zurich airport.
+func newDerivedColumnsTestConfig(t *testing.T, float_precision int) Config {
+	return newTestConfig(t, func(config *Config) {
+		config.Timezone = "Europe/Zurich"
+		config.Site = SiteConfig{Name: "Zurich", Latitude: 47.4647, Longitude: 8.5492}
+		config.Csv.Columns = []string{"hex", "fli", "alt"}
+		config.Csv.Type_columns = map[string][]string{
+			"A320": {"poll_seq", "hex", "alt_m", "spd_ms", "site_distance_km", "uti_time", "received"},
+		}
+		config.Csv.Float_precision = float_precision
+	})
+}
+
+func TestCsvLayoutOfTheAircraftTypes(t *testing.T) {
+	partitioning := newDerivedColumnsTestConfig(t, 0).Partitioning()
+	tests := []struct {
+		aircraft_type string
+		expected      []string
+	}{
+		{"A320", []string{"Poll_seq", "Hex", "Alt_m", "Spd_ms", "Site_distance_km", "Uti_time", "Received"}},
+		{"B738", []string{"Hex", "Fli", "Alt"}},
+	}
+	for _, test := range tests {
+		if header := partitioning.CsvLayout(test.aircraft_type).Header(); !reflect.DeepEqual(header, test.expected) {
+			t.Errorf("%s: got the header %q, expected %q", test.aircraft_type, header, test.expected)
+		}
+	}
+}
+
+func TestDerivedCsvColumns(t *testing.T) {
+	// Over Geneva airport, about 230 km from Zurich airport.
+	aircraft := AircraftData{Hex: "4b1805", Typ: "A320", Alt: 35000, Spd: 450, Lat: 46.2381, Lon: 6.1090,
+		Uti: uint64(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC).Unix())}
+	received := time.Date(2024, 3, 5, 12, 0, 1, 500_000_000, time.UTC)
+	without_position := aircraft
+	without_position.Lat, without_position.Lon, without_position.Uti = 0, 0, 0
+
+	tests := []struct {
+		name            string
+		aircraft        AircraftData
+		float_precision int
+		expected        []string
+	}{
+		{"default precision", aircraft, 0, []string{"7", "4b1805", "10668.0", "231.50", "230.280",
+			"2024-03-05T13:00:00.000000+01:00", "2024-03-05T13:00:01.500000+01:00"}},
+		{"configured precision", aircraft, 1, []string{"7", "4b1805", "10668.0", "231.5", "230.3",
+			"2024-03-05T13:00:00.000000+01:00", "2024-03-05T13:00:01.500000+01:00"}},
+		{"without position and update time", without_position, 0, []string{"7", "4b1805", "10668.0", "231.50", "", "",
+			"2024-03-05T13:00:01.500000+01:00"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			layout := newDerivedColumnsTestConfig(t, test.float_precision).Partitioning().CsvLayout("A320")
+			row := layout.Row(NewRecord(test.aircraft, received, time.Second, 7))
+			if !reflect.DeepEqual(row, test.expected) {
+				t.Errorf("got the row %q, expected %q", row, test.expected)
+			}
+		})
+	}
+}
+
+func TestGreatCircleDistance(t *testing.T) {
+	tests := []struct {
+		name                    string
+		latitude_1, longitude_1 float64
+		latitude_2, longitude_2 float64
+		expected                float64
+	}{
+		{"same position", 47.4647, 8.5492, 47.4647, 8.5492, 0},
+		{"one degree of latitude", 47, 8, 48, 8, 111.195},
+		{"Zurich to Geneva", 47.4647, 8.5492, 46.2381, 6.1090, 230.280},
+		{"across the antimeridian", 0, 179.5, 0, -179.5, 111.195},
+	}
+	for _, test := range tests {
+		distance := greatCircleDistanceKm(test.latitude_1, test.longitude_1, test.latitude_2, test.longitude_2)
+		if distance < test.expected-0.001 || distance > test.expected+0.001 {
+			t.Errorf("%s: got %.3f km, expected %.3f km", test.name, distance, test.expected)
+		}
+	}
+}
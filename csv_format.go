@@ -0,0 +1,236 @@
+// CSV formatting.
+//
+// The columns of the fields of the AircraftData struct are generated (aircraft_data_csv.go),
+// such that no reflection is needed for every record. Together with the derived columns
+// (csv_columns.go) they can be selected and ordered per aircraft type. The options in this
+// file decide how the header and the values are formatted.
+
+package main
+
+//go:generate go run ./cmd/csvgen -type AircraftData -input datatypes.go -output aircraft_data_csv.go
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CsvConfig groups the parameters of the format of the csv files.
+type CsvConfig struct {
+	Header          string `yaml:"header"`          // go (default), json or long.
+	Float_precision int    `yaml:"float_precision"` // digits after the decimal point, 0 prints the shortest exact representation.
+	Empty_missing   bool   `yaml:"empty_missing"`   // write empty cells for values which the Radarcape did not report.
+	Header_mismatch string `yaml:"header_mismatch"` // roll (default) or migrate an existing file with a different header.
+
+	// Columns of the files by json name. Defaults to all the fields of the AircraftData struct.
+	Columns      []string            `yaml:"columns"`
+	Type_columns map[string][]string `yaml:"type_columns"` // columns of the files of single aircraft types.
+}
+
+// Header namings of the csv files.
+const (
+	csvHeaderGo   string = "go"   // name of the struct field, e.g. Alt.
+	csvHeaderJson string = "json" // key in the aircraftlist.json, e.g. alt.
+	csvHeaderLong string = "long" // descriptive name with unit, e.g. Barometric altitude [ft].
+)
+
+// csvColumn describes one column of the csv files. The value is either a field of the
+// received data or derived from the record.
+type csvColumn struct {
+	Go_name   string
+	Json_name string
+	Long_name string
+	field     func(ac_data AircraftData, csv_config CsvConfig) string
+	derived   func(record Record, layout CsvLayout) string
+}
+
+// Get the column with the given json name.
+func csvColumnByName(name string) (csvColumn, bool) {
+	for _, columns := range [][]csvColumn{aircraftDataCsvColumns, derivedCsvColumns} {
+		for _, column := range columns {
+			if column.Json_name == name {
+				return column, true
+			}
+		}
+	}
+	return csvColumn{}, false
+}
+
+// CsvLayout is the list of columns of a csv file together with everything which is needed
+// to format the values.
+type CsvLayout struct {
+	columns    []csvColumn
+	csv_config CsvConfig
+	site       SiteConfig
+	location   *time.Location
+}
+
+// Get the layout of the csv files of an aircraft type.
+//
+// Validate makes sure that all the configured columns exist.
+func (partitioning Partitioning) CsvLayout(aircraft_type string) CsvLayout {
+	layout := CsvLayout{csv_config: partitioning.Csv, site: partitioning.Site, location: partitioning.Location}
+
+	names, ok := partitioning.Csv.Type_columns[aircraft_type]
+	if !ok {
+		names = partitioning.Csv.Columns
+	}
+	if len(names) == 0 {
+		layout.columns = aircraftDataCsvColumns
+		return layout
+	}
+	for _, name := range names {
+		if column, ok := csvColumnByName(name); ok {
+			layout.columns = append(layout.columns, column)
+		}
+	}
+	return layout
+}
+
+// Get the header of the csv file.
+func (layout CsvLayout) Header() []string {
+	header := make([]string, len(layout.columns))
+	for i, column := range layout.columns {
+		header[i] = layout.csv_config.headerName(column)
+	}
+	return header
+}
+
+// Format the values of a record as a row of the csv file.
+func (layout CsvLayout) Row(record Record) []string {
+	row := make([]string, len(layout.columns))
+	for i, column := range layout.columns {
+		if column.derived != nil {
+			row[i] = column.derived(record, layout)
+		} else {
+			row[i] = column.field(record.AircraftData, layout.csv_config)
+		}
+	}
+	return row
+}
+
+// Check whether any of the files contains a column.
+func (csv_config CsvConfig) usesColumn(name string) bool {
+	for _, names := range csv_config.Type_columns {
+		if IsInSlice(name, names) {
+			return true
+		}
+	}
+	return IsInSlice(name, csv_config.Columns)
+}
+
+// Check the csv parameters and add the problems to `config_errors`.
+func (csv_config CsvConfig) validate(config_errors *ConfigErrors) {
+	switch csv_config.Header {
+	case csvHeaderGo, csvHeaderJson, csvHeaderLong:
+	default:
+		config_errors.add("csv.header: %q must be go, json or long", csv_config.Header)
+	}
+	if csv_config.Float_precision < 0 {
+		config_errors.add("csv.float_precision: must not be negative")
+	}
+	switch csv_config.Header_mismatch {
+	case headerMismatchRoll, headerMismatchMigrate:
+	default:
+		config_errors.add("csv.header_mismatch: %q must be roll or migrate", csv_config.Header_mismatch)
+	}
+
+	validateColumns := func(key string, names []string) {
+		seen := make(map[string]bool, len(names))
+		for _, name := range names {
+			if _, ok := csvColumnByName(name); !ok {
+				config_errors.add("%s: unknown column %q", key, name)
+			} else if seen[name] {
+				config_errors.add("%s: column %q is listed twice", key, name)
+			}
+			seen[name] = true
+		}
+	}
+	validateColumns("csv.columns", csv_config.Columns)
+	for aircraft_type, names := range csv_config.Type_columns {
+		if len(names) == 0 {
+			config_errors.add("csv.type_columns.%s: must not be empty", aircraft_type)
+		}
+		validateColumns("csv.type_columns."+aircraft_type, names)
+	}
+}
+
+// Copy the config such that its columns are not shared with the original.
+func (csv_config CsvConfig) clone() CsvConfig {
+	csv_config.Columns = append([]string(nil), csv_config.Columns...)
+	if csv_config.Type_columns != nil {
+		type_columns := make(map[string][]string, len(csv_config.Type_columns))
+		for aircraft_type, names := range csv_config.Type_columns {
+			type_columns[aircraft_type] = append([]string(nil), names...)
+		}
+		csv_config.Type_columns = type_columns
+	}
+	return csv_config
+}
+
+// Normalize the column names and aircraft types.
+func (csv_config *CsvConfig) normalize() {
+	csv_config.Header = strings.ToLower(strings.TrimSpace(csv_config.Header))
+	csv_config.Header_mismatch = strings.ToLower(strings.TrimSpace(csv_config.Header_mismatch))
+	for i, name := range csv_config.Columns {
+		csv_config.Columns[i] = strings.ToLower(strings.TrimSpace(name))
+	}
+	type_columns := make(map[string][]string, len(csv_config.Type_columns))
+	for aircraft_type, names := range csv_config.Type_columns {
+		for i, name := range names {
+			names[i] = strings.ToLower(strings.TrimSpace(name))
+		}
+		type_columns[strings.ToUpper(strings.TrimSpace(aircraft_type))] = names
+	}
+	if csv_config.Type_columns != nil {
+		csv_config.Type_columns = type_columns
+	}
+}
+
+// Get the name of a column according to the configured header naming.
+func (csv_config CsvConfig) headerName(column csvColumn) string {
+	switch csv_config.Header {
+	case csvHeaderJson:
+		return column.Json_name
+	case csvHeaderLong:
+		return column.Long_name
+	default:
+		return column.Go_name
+	}
+}
+
+// Format an integer. A zero of an optional field is a missing value.
+func (csv_config CsvConfig) formatInt(value int64, optional bool) string {
+	if optional && value == 0 && csv_config.Empty_missing {
+		return ""
+	}
+	return strconv.FormatInt(value, 10)
+}
+
+// Format an unsigned integer. A zero of an optional field is a missing value.
+func (csv_config CsvConfig) formatUint(value uint64, optional bool) string {
+	if optional && value == 0 && csv_config.Empty_missing {
+		return ""
+	}
+	return strconv.FormatUint(value, 10)
+}
+
+// Format a float with the configured precision. `bit_size` is 32 for float32 values such
+// that the shortest representation doesn't show the rounding error of the conversion.
+func (csv_config CsvConfig) formatFloat(value float64, bit_size int, optional bool) string {
+	if optional && value == 0 && csv_config.Empty_missing {
+		return ""
+	}
+	if csv_config.Float_precision > 0 {
+		return strconv.FormatFloat(value, 'f', csv_config.Float_precision, bit_size)
+	}
+	return strconv.FormatFloat(value, 'g', -1, bit_size)
+}
+
+// Format a boolean. A false of an optional field is a missing value.
+func (csv_config CsvConfig) formatBool(value bool, optional bool) string {
+	if optional && !value && csv_config.Empty_missing {
+		return ""
+	}
+	return strconv.FormatBool(value)
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// testCsvRecord has values which are reported, missing and zero although they are reported.
+func testCsvRecord() Record {
+	aircraft := AircraftData{Hex: "4b1805", Typ: "A320", Alt: 0, Altg: 0, Dis: 12.3, Qnhs: 1013.6, Ape: false,
+		Ns: 250}
+	return NewRecord(aircraft, time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC), time.Second, 1)
+}
+
+func TestCsvLayoutHeaderNames(t *testing.T) {
+	tests := []struct {
+		header   string
+		expected []string
+	}{
+		{csvHeaderGo, []string{"Hex", "Alt", "Dis", "Ns"}},
+		{csvHeaderJson, []string{"hex", "alt", "dis", "ns"}},
+		{csvHeaderLong, []string{"ICAO address", "Barometric altitude [ft]", "Distance to the receiver [km]",
+			"Nanoseconds of the update time [ns]"}},
+	}
+	for _, test := range tests {
+		t.Run(test.header, func(t *testing.T) {
+			config := newTestConfig(t, func(config *Config) {
+				config.Csv.Header = test.header
+				config.Csv.Columns = []string{"hex", "alt", "dis", "ns"}
+			})
+			if header := config.Partitioning().CsvLayout("A320").Header(); !reflect.DeepEqual(header, test.expected) {
+				t.Errorf("got the header %q, expected %q", header, test.expected)
+			}
+		})
+	}
+
+	// Without configured columns, the files have all the fields of the struct in their order.
+	layout := newTestConfig(t, nil).Partitioning().CsvLayout("A320")
+	header := layout.Header()
+	if len(header) != reflect.TypeOf(AircraftData{}).NumField() || header[0] != "Alr" || header[len(header)-1] != "Wsp" {
+		t.Errorf("got the default header %q", header)
+	}
+}
+
+// The float32 fields (dis, qnhs) are printed without the rounding error of their conversion,
+// and only the zeros of the optional fields (altg, dis, lat) are missing values.
+func TestCsvLayoutRowFormat(t *testing.T) {
+	columns := []string{"alt", "altg", "dis", "qnhs", "lat", "ape", "ns", "hex"}
+	tests := []struct {
+		name            string
+		float_precision int
+		empty_missing   bool
+		expected        []string
+	}{
+		{"default", 0, false, []string{"0", "0", "12.3", "1013.6", "0", "false", "250", "4b1805"}},
+		{"float_precision", 2, false, []string{"0", "0", "12.30", "1013.60", "0.00", "false", "250", "4b1805"}},
+		{"empty_missing", 0, true, []string{"0", "", "12.3", "1013.6", "", "false", "250", "4b1805"}},
+		{"float_precision_and_empty_missing", 3, true, []string{"0", "", "12.300", "1013.600", "", "false", "250",
+			"4b1805"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := newTestConfig(t, func(config *Config) {
+				config.Csv.Columns = columns
+				config.Csv.Float_precision = test.float_precision
+				config.Csv.Empty_missing = test.empty_missing
+			})
+			row := config.Partitioning().CsvLayout("A320").Row(testCsvRecord())
+			if !reflect.DeepEqual(row, test.expected) {
+				t.Errorf("got the row %q, expected %q", row, test.expected)
+			}
+		})
+	}
+}
+
+func TestCsvConfigFormatsOptionalValues(t *testing.T) {
+	csv_config := CsvConfig{Empty_missing: true}
+	tests := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		{"missing int", csv_config.formatInt(0, true), ""},
+		{"reported int", csv_config.formatInt(-5, true), "-5"},
+		{"zero int", csv_config.formatInt(0, false), "0"},
+		{"missing uint", csv_config.formatUint(0, true), ""},
+		{"zero uint", csv_config.formatUint(0, false), "0"},
+		{"missing bool", csv_config.formatBool(false, true), ""},
+		{"reported bool", csv_config.formatBool(true, true), "true"},
+		{"false bool", csv_config.formatBool(false, false), "false"},
+		{"missing float", csv_config.formatFloat(0, 64, true), ""},
+		{"zero float", csv_config.formatFloat(0, 64, false), "0"},
+		{"float32", csv_config.formatFloat(float64(float32(0.1)), 32, true), "0.1"},
+		{"float32 as float64", csv_config.formatFloat(float64(float32(0.1)), 64, true), "0.10000000149011612"},
+	}
+	for _, test := range tests {
+		if test.value != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.name, test.value, test.expected)
+		}
+	}
+}
@@ -4,129 +4,181 @@ package main
 
 import (
 	"encoding/csv"
-	"errors"
-	"fmt"
 	"io"
 	"os"
-	"reflect"
 	"time"
-
-	"gopkg.in/yaml.v2"
 )
 
-// Config struct implements and groups the config parameters of this module.
-type Config struct {
-	Icao_aircraft_types []string `yaml:"icao_aircraft_types"`
-	Radarcape_hostname  string   `yaml:"radarcape_hostname"`
-	Upload_folder_path  string   `yaml:"upload_folder_path"`
-	Backup_folder_path  string   `yaml:"backup_folder_path"`
+// This struct implements the structure of the received json data
+// and stores the information of one aircraft at a certain time.
+//
+// The csv tag holds the descriptive name of the column (with the unit in brackets) and
+// marks the fields for which a zero value means that the Radarcape did not report the
+// value. After a change of the fields, run `go generate` to update aircraft_data_csv.go.
+type AircraftData struct {
+	Alr  int     `json:"alr" csv:"Alert flag"`
+	Alt  int     `json:"alt" csv:"Barometric altitude [ft]"`
+	Altg int     `json:"altg" csv:"Geometric altitude [ft],optional"`
+	Alts int     `json:"alts" csv:"Selected altitude [ft],optional"`
+	Ape  bool    `json:"ape" csv:"Autopilot engaged"`
+	Ava  string  `json:"ava" csv:"Altitude source"`
+	Cat  string  `json:"cat" csv:"Emitter category"`
+	Cou  string  `json:"cou" csv:"Country of registration"`
+	Dbm  int     `json:"dbm" csv:"Signal level [dBm],optional"`
+	Dis  float32 `json:"dis" csv:"Distance to the receiver [km],optional"`
+	Dst  string  `json:"dst" csv:"Destination airport"`
+	Fli  string  `json:"fli" csv:"Call sign"`
+	Gda  string  `json:"gda" csv:"Ground or airborne"`
+	Hex  string  `json:"hex" csv:"ICAO address"`
+	Lat  float64 `json:"lat" csv:"Latitude [deg],optional"`
+	Lla  int     `json:"lla" csv:"Age of the last position [s]"`
+	Lon  float64 `json:"lon" csv:"Longitude [deg],optional"`
+	Mop  int     `json:"mop" csv:"MOPS version"`
+	Nacp int     `json:"nacp" csv:"Navigation accuracy category for position,optional"`
+	Ns   uint32  `json:"ns" csv:"Nanoseconds of the update time [ns]"`
+	Opr  string  `json:"opr" csv:"Operator"`
+	Org  string  `json:"org" csv:"Origin airport"`
+	Pic  int     `json:"pic" csv:"Position integrity category,optional"`
+	Qnhs float32 `json:"qnhs" csv:"QNH setting [hPa],optional"`
+	Reg  string  `json:"reg" csv:"Registration"`
+	Sda  int     `json:"sda" csv:"System design assurance,optional"`
+	Sil  int     `json:"sil" csv:"Source integrity level,optional"`
+	Spd  int     `json:"spd" csv:"Ground speed [kt]"`
+	Spi  bool    `json:"spi" csv:"Special position indicator"`
+	Squ  string  `json:"squ" csv:"Squawk"`
+	Src  string  `json:"src" csv:"Source of the position"`
+	Tcm  int     `json:"tcm" csv:"TCAS mode"`
+	Tmp  int     `json:"tmp" csv:"Static air temperature [degC]"`
+	Trk  int     `json:"trk" csv:"Track [deg]"`
+	Tru  int     `json:"tru" csv:"True airspeed [kt],optional"`
+	Typ  string  `json:"typ" csv:"ICAO aircraft type"`
+	Uti  uint64  `json:"uti" csv:"Update time [unix s]"`
+	Vrt  int     `json:"vrt" csv:"Vertical rate [ft/min]"`
+	Wdi  int     `json:"wdi" csv:"Wind direction [deg]"`
+	Wsp  int     `json:"wsp" csv:"Wind speed [kt]"`
 }
 
-// Load configuration file from disk.
+// Record is a message of an aircraft together with the information about its reception.
 //
-// The Config file is in the .yaml file format and contains info about
-// which aircrafts are relevant to the study.
-func (config *Config) LoadConfiguration(file string) {
+// The fields of the message are embedded such that the json encoding of a record is the
+// json of the message with the additional keys.
+type Record struct {
+	AircraftData
+	Received      time.Time     `json:"received"`      // wall clock time at which the aircraft list was received.
+	Received_mono time.Duration `json:"received_mono"` // monotonic time since the start of the listener at the reception.
+	Gps_time      time.Time     `json:"gps_time"`      // time of the message according to the Radarcape (uti + ns).
+	Poll_seq      uint64        `json:"poll_seq"`      // number of the poll of the Radarcape since the start of the listener.
+}
 
-	// config_ptr := new(Config)
+// Wrap a message which was received at `received` (`received_mono` after the start of the
+// listener) with the given poll. The GPS time is combined from the uti and ns fields.
+func NewRecord(aircraft AircraftData, received time.Time, received_mono time.Duration, poll_seq uint64) Record {
+	record := Record{AircraftData: aircraft, Received: received, Received_mono: received_mono, Poll_seq: poll_seq}
+	if aircraft.Uti != 0 {
+		record.Gps_time = time.Unix(int64(aircraft.Uti), int64(aircraft.Ns)).UTC()
+	}
+	return record
+}
 
-	config_file, err := os.Open(file)
+// Wrapper struct to ensure files are properly closed once the csv.Writer
+// is not needed anymore.
+//
+// It also keeps track of the partition and the part the file belongs to as well as
+// the size of the file for the size based rotation. If the file is compressed, the
+// compressor sits between the csv.Writer and the file.
+type CsvWriteCloser struct {
+	*csv.Writer
+	io.Closer
+	Start      time.Time // start of the partition.
+	Part       int
+	path       string
+	layout     CsvLayout // columns and format of the rows, matches the header of the file.
+	size       *countingWriter
+	compressor frameWriter // nil for uncompressed files.
+}
 
-	if err != nil {
-		LogError(err)
-	}
+// Write the record as a row in the format of the file.
+func (writer CsvWriteCloser) WriteRecord(record Record) error {
+	return writer.Write(writer.layout.Row(record))
+}
 
-	defer config_file.Close()
+// Flush the csv writer and the compressor such that all the data which was written so
+// far can be read from the file, even if the program crashes afterwards.
+func (writer CsvWriteCloser) Flush() error {
+	writer.Writer.Flush()
+	if err := writer.Writer.Error(); err != nil {
+		return err
+	}
+	if writer.compressor != nil {
+		if err := writer.compressor.Flush(); err != nil {
+			return err
+		}
+	}
+	if writer.size != nil {
+		writer.size.flushed = writer.size.n
+	}
+	return nil
+}
 
-	err = yaml.NewDecoder(config_file).Decode(config)
+// Cut off the data which was written to the file after the last successful flush, e.g. a
+// partial row of a failed write. This also works if the file was closed already.
+func (writer CsvWriteCloser) Truncate() error {
+	if writer.size == nil {
+		return nil
+	}
+	if err := os.Truncate(writer.path, writer.size.flushed); err != nil {
+		return err
+	}
+	writer.size.n = writer.size.flushed
+	return nil
+}
 
-	if err != nil {
-		LogError(err)
+// Commit the flushed data of the file to the disk.
+func (writer CsvWriteCloser) Sync() error {
+	if syncer, ok := writer.Closer.(interface{ Sync() error }); ok {
+		return syncer.Sync()
 	}
+	return nil
+}
 
-	if DEBUG {
-		LogInfo("GetConfiguration: config:")
-		LogInfo("GetConfiguration: ", *config)
+// Flush all the buffered data, finish the compressed stream, commit it to the disk and
+// close the file.
+func (writer CsvWriteCloser) Close() error {
+	writer.Writer.Flush()
+	err := writer.Writer.Error()
+	if writer.compressor != nil {
+		if close_err := writer.compressor.Close(); err == nil {
+			err = close_err
+		}
+	}
+	if sync_err := writer.Sync(); err == nil {
+		err = sync_err
+	}
+	if close_err := writer.Closer.Close(); err == nil {
+		err = close_err
 	}
+	return err
+}
 
+// Get the size of the (compressed) file in bytes. Data which was not flushed yet is not included.
+func (writer CsvWriteCloser) Size() int64 {
+	if writer.size == nil {
+		return 0
+	}
+	return writer.size.n
 }
 
-// This struct implements the structure of the received json data
-// and stores the information of one aircraft at a certain time.
-type AircraftData struct {
-	Alr  int     `json:"alr"`
-	Alt  int     `json:"alt"`
-	Altg int     `json:"altg"`
-	Alts int     `json:"alts"`
-	Ape  bool    `json:"ape"`
-	Ava  string  `json:"ava"`
-	Cat  string  `json:"cat"`
-	Cou  string  `json:"cou"`
-	Dbm  int     `json:"dbm"`
-	Dis  float32 `json:"dis"`
-	Dst  string  `json:"dst"`
-	Fli  string  `json:"fli"`
-	Gda  string  `json:"gda"`
-	Hex  string  `json:"hex"`
-	Lat  float64 `json:"lat"`
-	Lla  int     `json:"lla"`
-	Lon  float64 `json:"lon"`
-	Mop  int     `json:"mop"`
-	Nacp int     `json:"nacp"`
-	Ns   uint32  `json:"ns"`
-	Opr  string  `json:"opr"`
-	Org  string  `json:"org"`
-	Pic  int     `json:"pic"`
-	Qnhs float32 `json:"qnhs"`
-	Reg  string  `json:"reg"`
-	Sda  int     `json:"sda"`
-	Sil  int     `json:"sil"`
-	Spd  int     `json:"spd"`
-	Spi  bool    `json:"spi"`
-	Squ  string  `json:"squ"`
-	Src  string  `json:"src"`
-	Tcm  int     `json:"tcm"`
-	Tmp  int     `json:"tmp"`
-	Trk  int     `json:"trk"`
-	Tru  int     `json:"tru"`
-	Typ  string  `json:"typ"`
-	Uti  uint64  `json:"uti"`
-	Vrt  int     `json:"vrt"`
-	Wdi  int     `json:"wdi"`
-	Wsp  int     `json:"wsp"`
-}
-
-// Get the name of the fields of the AircraftData struct as a
-// slice of strings.
-func (ac_data AircraftData) GetHeadersAsList() []string {
-	// Based on https://stackoverflow.com/a/67608475
-	t := reflect.TypeOf(ac_data)
-
-	aircraft_data_struct_field_names := make([]string, t.NumField())
-	for i := range aircraft_data_struct_field_names {
-		aircraft_data_struct_field_names[i] = t.Field(i).Name
-	}
-	return aircraft_data_struct_field_names
-}
-
-// Get the values of the fields of the AircraftData struct as a
-// slice of strings.
-func (ac_data AircraftData) GetDataAsList() []string {
-	// Based on https://stackoverflow.com/a/67608475
-	v := reflect.ValueOf(ac_data)
-
-	aircraft_data_struct_field_names := make([]string, v.NumField())
-	for i := range aircraft_data_struct_field_names {
-		aircraft_data_struct_field_names[i] = fmt.Sprint(v.Field(i))
-	}
-	return aircraft_data_struct_field_names
+// countingWriter counts the bytes which are written to the underlying writer.
+type countingWriter struct {
+	io.Writer
+	n       int64
+	flushed int64 // n at the last successful flush.
 }
 
-// Wrapper struct to ensure files are properly closed once the csv.Writer
-// is not needed anymore.
-type CsvWriteCloser struct {
-	*csv.Writer
-	io.Closer
+func (writer *countingWriter) Write(p []byte) (int, error) {
+	n, err := writer.Writer.Write(p)
+	writer.n += int64(n)
+	return n, err
 }
 
 // Wrapper for the timer and tickers used for synchronisation of the goroutines.
@@ -134,15 +186,33 @@ type TimeTicker struct {
 	Processor_tick_chan <-chan time.Time
 	halt                chan<- struct{} // singal channel to indicate that all the
 	// channels should be closed.
+	on_done func() // records a completed run, nil if the runs are not recorded.
+}
+
+// Interval at which a TimeTicker checks the wall clock while it waits for the next fire time.
+//
+// The timers are based on the monotonic clock, which stops while the machine is suspended,
+// so a timer for the next fire time would fire late by the duration of the suspension.
+const scheduleWakeInterval = time.Minute
+
+// Wrapper function which instantiates and initializes a TimeTicker which fires every
+// day at the specified wall clock time in the given location.
+func NewTimeTicker(clock Clock, hour, minute, second int, location *time.Location) *TimeTicker {
+	return NewScheduleTicker(clock, DailySchedule{hour, minute, second, location}, false, nil)
 }
 
 // Wrapper function which instantiates and initializes the TimeTicker struct.
 //
 // Inside the function we spin up a goroutine which runs in the background and sends
-// time stamps from a timer and a ticker to the TimeTicker channels.
-// This allows us to conveniently use the provided channels without having to worry
-// about the logic which is needed to fire the tickers at the right time.
-func NewTimeTicker(hour, minute, second int) *TimeTicker {
+// time stamps to the TimeTicker channel at the times given by the schedule. This allows
+// us to conveniently use the provided channel without having to worry about the logic
+// which is needed to fire the ticker at the right time. The goroutine wakes up at least
+// every scheduleWakeInterval and compares the wall clock with the next fire time, such
+// that a run which was missed while the machine was suspended fires right after it
+// resumes. Several missed runs are caught up by a single run. If `fire_immediately` is
+// set, the ticker fires once right away (e.g. to catch up on a missed run). `on_done` is
+// called by Done and may be nil.
+func NewScheduleTicker(clock Clock, schedule Schedule, fire_immediately bool, on_done func()) *TimeTicker {
 
 	time_ticker_chan1 := make(chan time.Time, 1)
 	time_halt_chan := make(chan struct{})
@@ -150,71 +220,59 @@ func NewTimeTicker(hour, minute, second int) *TimeTicker {
 	time_ticker := &TimeTicker{
 		Processor_tick_chan: time_ticker_chan1,
 		halt:                time_halt_chan,
+		on_done:             on_done,
+	}
+
+	// Send a time stamp to the ticker channel unless the ticker is halted in the meantime.
+	fire := func(fire_time time.Time) bool {
+		select {
+		case time_ticker_chan1 <- fire_time:
+			return true
+		case <-time_halt_chan:
+			close(time_ticker_chan1)
+			return false
+		}
 	}
 
 	// Spin up goroutine which makes sure that the
-	// tickers roll over at the specified time.
+	// ticker rolls over at the specified times.
 	go func() {
-		// Set up a timer which expires at specified time on the next day.
-		curr_time := time.Now()
-
-		// NOTE(@naefjo): time.Date normalizes dates (e.g. Oct. 32 == Nov. 1).
-		time_timer := time.NewTimer(
-			time.Until(
-				time.Date(
-					curr_time.Year(),
-					curr_time.Month(),
-					curr_time.Day()+1,
-					hour, minute, second, 0,
-					curr_time.Location(),
-				),
-			),
-		)
-		defer time_timer.Stop()
-
-		// Blocking function which waits until either the timer
-		// expires or a halt signal is sent to the MidnightTicker.
-		err := func() error {
-			select {
-			case timer_time := <-time_timer.C:
-				time_ticker_chan1 <- timer_time
-				return nil
-
-			case <-time_halt_chan:
-				// time_timer does not need to be stopped since
-				// we return from the goroutine and the stop has
-				// been deferred.
-				close(time_ticker_chan1)
-				return errors.New("ticker has been halted early")
-			}
-		}()
-		if err != nil {
-			LogError(err)
+		if fire_immediately && !fire(clock.Now()) {
+			return
 		}
 
-		if DEBUG {
-			LogInfo("init: timer rolled over.")
-		}
+		// Every fire time is computed from the calendar instead of adding a fixed
+		// duration such that days with a DST transition (23 or 25 hours) don't
+		// make us drift.
+		next_time := schedule.Next(clock.Now())
+		for {
+			now := clock.Now()
+			if !now.Before(next_time) {
+				if now.Sub(next_time) > scheduleWakeInterval {
+					ticker_log.Info("catching up on a run which was missed while the machine was suspended.",
+						"missed_run", next_time)
+				}
+				ticker_log.Debug("ticker rolled over", "time", now, "scheduled", next_time)
+				if !fire(next_time) {
+					return
+				}
+				next_time = schedule.Next(clock.Now())
+				continue
+			}
 
-		// Set up a ticker which triggers every 24 hours.
-		ticker_24hrs := time.NewTicker(24 * time.Hour)
-		defer ticker_24hrs.Stop()
+			wait := next_time.Sub(now)
+			if wait > scheduleWakeInterval {
+				wait = scheduleWakeInterval
+			}
+			time_timer := clock.NewTimer(wait)
 
-		// Every time the ticker fires, we send the item to the
-		// TimeTicker channels.
-		for {
+			// Block until either the timer expires or a halt signal
+			// is sent to the TimeTicker.
 			select {
-			case ticker_time := <-ticker_24hrs.C:
-				time_ticker_chan1 <- ticker_time
-
-				if DEBUG {
-					LogInfo("init: ticker rolled over.")
-				}
+			case <-time_timer.C():
 
 			case <-time_halt_chan:
-				// ticker_24hrs does not need to be stopped since
-				// we return from the goroutine and the stop has
-				// been deferred.
+				time_timer.Stop()
 				close(time_ticker_chan1)
 				return
 			}
@@ -224,9 +282,72 @@ func NewTimeTicker(hour, minute, second int) *TimeTicker {
 	return time_ticker
 }
 
+// Record that the job of the last tick completed successfully, such that the scheduler
+// doesn't catch up on it after a restart.
+func (ticker *TimeTicker) Done() {
+	if ticker.on_done != nil {
+		ticker.on_done()
+	}
+}
+
+// Get the next point in time after `now` at which the wall clock in `location`
+// shows the given time of the day.
+//
+// If the time of the day does not exist on a given day (i.e. it falls into the gap of
+// a DST transition), time.Date normalizes it to the corresponding time after the gap.
+// If it occurs twice (i.e. when the clocks are turned back), the first occurrence is used.
+func NextDailyTime(now time.Time, hour, minute, second int, location *time.Location) time.Time {
+	local_now := now.In(location)
+
+	// NOTE(@naefjo): time.Date normalizes dates (e.g. Oct. 32 == Nov. 1).
+	next_time := wallClockDate(
+		local_now.Year(),
+		local_now.Month(),
+		local_now.Day(),
+		hour, minute, second,
+		location,
+	)
+	for !next_time.After(now) {
+		local_now = local_now.AddDate(0, 0, 1)
+		next_time = wallClockDate(
+			local_now.Year(),
+			local_now.Month(),
+			local_now.Day(),
+			hour, minute, second,
+			location,
+		)
+	}
+
+	return next_time
+}
+
+// Get the point in time at which the wall clock in `location` shows the given date and
+// time, like time.Date.
+//
+// When the clocks are turned back, the wall clock shows the times of an hour twice (e.g.
+// 02:30 on 2024-10-27 in Europe/Zurich) and time.Date doesn't guarantee which of the two
+// it returns. We always take the first one such that the schedules and the partitions
+// agree on when the repeated hour starts.
+func wallClockDate(year int, month time.Month, day, hour, minute, second int, location *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, minute, second, 0, location)
+
+	// The clocks are turned back by at most an hour, so the first occurrence lies less
+	// than an hour before the second one.
+	_, offset := t.Zone()
+	_, offset_before := t.Add(-time.Hour).Zone()
+	if offset_before <= offset {
+		return t
+	}
+	earlier := t.Add(-time.Duration(offset_before-offset) * time.Second)
+	if _, earlier_offset := earlier.Zone(); earlier_offset != offset_before {
+		return t
+	}
+	return earlier
+}
+
 // Close the channels of the ticker.
 //
-// Send a signal to the goroutine which is spun up in the NewTimeTicker
+// Send a signal to the goroutine which is spun up in the NewScheduleTicker
 // function which stops the underlying timer/ticker and closes the ticker
 // channels of the TimeTicker struct.
 func (ticker *TimeTicker) Stop() {
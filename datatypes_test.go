@@ -0,0 +1,66 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestNewRecordCombinesTheGpsTime(t *testing.T) {
+	received := time.Date(2024, 3, 5, 12, 0, 1, 0, time.UTC)
+	tests := []struct {
+		name     string
+		uti      uint64
+		ns       uint32
+		expected time.Time
+	}{
+		{"uti and ns", 1709640000, 123_456_789, time.Date(2024, 3, 5, 12, 0, 0, 123_456_789, time.UTC)},
+		{"uti only", 1709640000, 0, time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)},
+		{"no uti", 0, 123_456_789, time.Time{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := NewRecord(AircraftData{Hex: "4b1805", Uti: test.uti, Ns: test.ns}, received, 90*time.Second, 3)
+			if !record.Gps_time.Equal(test.expected) || record.Gps_time.IsZero() != test.expected.IsZero() {
+				t.Errorf("got the GPS time %s, expected %s", record.Gps_time, test.expected)
+			}
+			if !record.Received.Equal(received) || record.Received_mono != 90*time.Second || record.Poll_seq != 3 {
+				t.Errorf("got the reception %s (%s) of poll %d", record.Received, record.Received_mono, record.Poll_seq)
+			}
+		})
+	}
+}
+
+func TestReceptionTimeColumns(t *testing.T) {
+	partitioning := newTestConfig(t, func(config *Config) {
+		config.Timezone = "Europe/Zurich"
+		config.Csv.Columns = []string{"received", "received_mono", "gps_time", "latency_ms"}
+	}).Partitioning()
+	layout := partitioning.CsvLayout("A320")
+
+	received := time.Date(2024, 3, 5, 12, 0, 1, 500_000_000, time.UTC)
+	tests := []struct {
+		name     string
+		uti      uint64
+		ns       uint32
+		mono     time.Duration
+		expected []string
+	}{
+		{"gps time", 1709640000, 123_456_789, 90*time.Second + 250*time.Microsecond, []string{
+			"2024-03-05T13:00:01.500000+01:00", "90.000250000", "2024-03-05T13:00:00.123456789+01:00", "1376.543"}},
+		{"no gps time", 0, 0, time.Millisecond, []string{"2024-03-05T13:00:01.500000+01:00", "0.001000000", "", ""}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			record := NewRecord(AircraftData{Hex: "4b1805", Uti: test.uti, Ns: test.ns}, received, test.mono, 1)
+			if row := layout.Row(record); !reflect.DeepEqual(row, test.expected) {
+				t.Errorf("got the row %q, expected %q", row, test.expected)
+			}
+		})
+	}
+
+	// A record without reception, e.g. of an older version of the write-ahead log.
+	if row := layout.Row(Record{}); !reflect.DeepEqual(row, []string{"", "", "", ""}) {
+		t.Errorf("got the row %q for a record without reception", row)
+	}
+}
@@ -0,0 +1,245 @@
+// Application directories.
+//
+// The config, the data files and the state of the listener (logs, bookkeeping files)
+// live in separate directories. By default they follow the XDG base directory
+// specification on linux and the platform conventions elsewhere such that the
+// listener works in packaged installs, from read-only binary locations and in
+// containers.
+
+package main
+
+import (
+	"errors"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// appName is the name of the sub folder which is created in the base directories.
+const appName string = "radarcape_listener"
+
+// configFileName is the name of the config file in the config directory.
+const configFileName string = "radarcape_listener_config.yaml"
+
+// AppDirs groups the default directories of the listener. All paths use forward
+// slashes and end with a trailing slash.
+type AppDirs struct {
+	Config_dir string
+	Data_dir   string
+	State_dir  string
+}
+
+// Get the default directories of the current platform.
+//
+//   - linux:   $XDG_CONFIG_HOME, $XDG_DATA_HOME and $XDG_STATE_HOME (defaulting to
+//     ~/.config, ~/.local/share and ~/.local/state).
+//   - windows: %APPDATA% for the config and %LOCALAPPDATA% for data and state.
+//   - darwin:  ~/Library/Application Support for everything.
+//
+// If the home directory can't be determined, we fall back to the folder of the executable.
+func DefaultAppDirs() AppDirs {
+	home_dir, home_err := os.UserHomeDir()
+
+	xdgDir := func(env_name string, home_relative string) string {
+		if dir := os.Getenv(env_name); filepath.IsAbs(dir) {
+			return dir
+		}
+		if home_err != nil {
+			return ""
+		}
+		return filepath.Join(home_dir, home_relative)
+	}
+
+	var config_base, data_base, state_base string
+	switch runtime.GOOS {
+	case "windows":
+		config_base = os.Getenv("APPDATA")
+		data_base = os.Getenv("LOCALAPPDATA")
+		state_base = data_base
+	case "darwin":
+		if home_err == nil {
+			config_base = filepath.Join(home_dir, "Library", "Application Support")
+		}
+		data_base = config_base
+		state_base = config_base
+	default:
+		config_base = xdgDir("XDG_CONFIG_HOME", ".config")
+		data_base = xdgDir("XDG_DATA_HOME", filepath.Join(".local", "share"))
+		state_base = xdgDir("XDG_STATE_HOME", filepath.Join(".local", "state"))
+	}
+
+	appDir := func(base string, sub_folder string) string {
+		if base == "" {
+			return normalizeFolderPath(getAppBasePath() + sub_folder)
+		}
+		return normalizeFolderPath(filepath.Join(base, appName, sub_folder))
+	}
+
+	return AppDirs{
+		Config_dir: appDir(config_base, ""),
+		Data_dir:   appDir(data_base, "Data"),
+		State_dir:  appDir(state_base, ""),
+	}
+}
+
+// Find the config file if no path was given explicitly.
+//
+// The config directory takes precedence. For existing installs, we fall back to the
+// config file next to the executable.
+func findConfigFile() string {
+	config_path := DefaultAppDirs().Config_dir + configFileName
+	if _, err := os.Stat(config_path); err == nil {
+		return config_path
+	}
+
+	legacy_config_path := getAppBasePath() + configFileName
+	if _, err := os.Stat(legacy_config_path); err == nil {
+		return legacy_config_path
+	}
+
+	return config_path
+}
+
+// Move the `Data/` folder of previous versions (next to the executable) into `data_dir`.
+//
+// Day folders which don't exist in `data_dir` yet are moved as a whole, otherwise the
+// individual files are moved. Files which exist at both locations or can't be moved are
+// left in place and reported. The legacy folder is removed once it is empty.
+//
+// Returns the data directory to use. If the data can't be moved at all (e.g. because the
+// legacy folder is read-only), the legacy folder is kept as the data directory.
+func MigrateLegacyDataFolder(data_dir string) string {
+	return migrateDataFolder(getAppBasePath()+"Data/", data_dir)
+}
+
+func migrateDataFolder(legacy_data_dir string, data_dir string) string {
+	if sameFolder(legacy_data_dir, data_dir) {
+		return data_dir
+	}
+	day_folders, err := ioutil.ReadDir(legacy_data_dir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return data_dir
+	} else if err != nil {
+		main_log.Warn("failed to read the legacy data folder. Please move its files manually.",
+			"path", legacy_data_dir, "err", err)
+		return data_dir
+	}
+
+	if err := checkMovable(legacy_data_dir, data_dir); err != nil {
+		main_log.Warn("can't migrate the data of a previous version. Continuing to use the legacy data folder.",
+			"path", legacy_data_dir, "data_dir", data_dir, "err", err)
+		return legacy_data_dir
+	}
+
+	main_log.Info("migrating data of a previous version.", "from", legacy_data_dir, "to", data_dir)
+
+	for _, day_folder := range day_folders {
+		source_path := legacy_data_dir + day_folder.Name()
+		dest_path := data_dir + day_folder.Name()
+
+		if _, err := os.Stat(dest_path); errors.Is(err, fs.ErrNotExist) {
+			if err := moveTree(source_path, dest_path); err != nil {
+				main_log.Warn("failed to migrate a day folder.", "path", source_path, "err", err)
+			}
+			continue
+		} else if err != nil {
+			main_log.Warn("failed to migrate a day folder.", "path", source_path, "err", err)
+			continue
+		}
+
+		if !day_folder.IsDir() {
+			main_log.Warn("not migrating file which already exists in the data dir.", "path", source_path)
+			continue
+		}
+
+		files, err := ioutil.ReadDir(source_path)
+		if err != nil {
+			main_log.Warn("failed to migrate a day folder.", "path", source_path, "err", err)
+			continue
+		}
+		for _, file := range files {
+			if _, err := os.Stat(dest_path + "/" + file.Name()); err == nil {
+				main_log.Warn("not migrating file which already exists in the data dir.",
+					"path", source_path+"/"+file.Name())
+				continue
+			}
+			if err := moveTree(source_path+"/"+file.Name(), dest_path+"/"+file.Name()); err != nil {
+				main_log.Warn("failed to migrate a file.", "path", source_path+"/"+file.Name(), "err", err)
+			}
+		}
+		// Only succeeds if all the files were moved.
+		os.Remove(source_path)
+	}
+
+	if err := os.Remove(legacy_data_dir); err != nil {
+		main_log.Warn("legacy data folder is not empty. Please move the remaining files manually.",
+			"path", legacy_data_dir)
+	} else {
+		main_log.Info("finished migrating the data of a previous version.")
+	}
+
+	return data_dir
+}
+
+// Check that the data of the legacy folder can be moved: the data dir can be created and
+// the legacy folder can be written to, which is needed to move its entries.
+func checkMovable(legacy_data_dir string, data_dir string) error {
+	if err := createFolder(data_dir); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(legacy_data_dir, ".migration")
+	if err != nil {
+		return err
+	}
+	probe.Close()
+	return os.Remove(probe.Name())
+}
+
+// Move a file or folder. If a rename is not possible (e.g. across devices), the
+// files are copied and the source is removed afterwards.
+func moveTree(source_path, dest_path string) error {
+	if err := os.Rename(source_path, dest_path); err == nil {
+		return nil
+	}
+
+	info, err := os.Stat(source_path)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return MoveFile(source_path, dest_path)
+	}
+
+	if err := createFolder(dest_path); err != nil {
+		return err
+	}
+	entries, err := ioutil.ReadDir(source_path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := moveTree(filepath.Join(source_path, entry.Name()), filepath.Join(dest_path, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return os.Remove(source_path)
+}
+
+// Check whether two paths point to the same folder.
+func sameFolder(a, b string) bool {
+	abs_a, err_a := filepath.Abs(a)
+	abs_b, err_b := filepath.Abs(b)
+	if err_a != nil || err_b != nil {
+		return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+	}
+	if abs_a == abs_b {
+		return true
+	}
+
+	info_a, err_a := os.Stat(abs_a)
+	info_b, err_b := os.Stat(abs_b)
+	return err_a == nil && err_b == nil && os.SameFile(info_a, info_b)
+}
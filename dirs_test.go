@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestMigrateLegacyDataFolder(t *testing.T) {
+	root := t.TempDir() + "/"
+	legacy_data_dir, data_dir := root+"Data/", root+"data/"
+	writeTestFile(t, legacy_data_dir+"20240304/output_file_A320.csv", "Hex\n4b1804\n")
+	writeTestFile(t, legacy_data_dir+"20240305/output_file_A320.csv", "Hex\n4b1805\n")
+	writeTestFile(t, legacy_data_dir+"20240305/output_file_B738.csv", "Hex\n4b1806\n")
+	// The files of a day which was already started in the data dir are moved one by one,
+	// and the ones which exist at both locations are kept.
+	writeTestFile(t, data_dir+"20240305/output_file_A320.csv", "Hex\n4b1807\n")
+
+	if used_data_dir := migrateDataFolder(legacy_data_dir, data_dir); used_data_dir != data_dir {
+		t.Errorf("the migration kept using %s", used_data_dir)
+	}
+	checkRemoteFile(t, data_dir+"20240304/output_file_A320.csv", "Hex\n4b1804\n")
+	checkRemoteFile(t, data_dir+"20240305/output_file_A320.csv", "Hex\n4b1807\n")
+	checkRemoteFile(t, data_dir+"20240305/output_file_B738.csv", "Hex\n4b1806\n")
+	checkRemoteFile(t, legacy_data_dir+"20240305/output_file_A320.csv", "Hex\n4b1805\n")
+	if _, err := os.Stat(legacy_data_dir + "20240304"); !os.IsNotExist(err) {
+		t.Errorf("the moved day is still in the legacy folder: %v", err)
+	}
+
+	if used_data_dir := migrateDataFolder(root+"Missing/", data_dir); used_data_dir != data_dir {
+		t.Errorf("a missing legacy folder changed the data dir to %s", used_data_dir)
+	}
+}
+
+func TestMigrateLegacyDataFolderKeepsUsingAFolderWhichCantBeMoved(t *testing.T) {
+	root := t.TempDir() + "/"
+	legacy_data_dir := root + "Data/"
+	writeTestFile(t, legacy_data_dir+"20240305/output_file_A320.csv", "Hex\n4b1805\n")
+
+	// The data dir can't be created below a file.
+	writeTestFile(t, root+"file", "")
+	if used_data_dir := migrateDataFolder(legacy_data_dir, root+"file/data/"); used_data_dir != legacy_data_dir {
+		t.Errorf("the migration switched to %s", used_data_dir)
+	}
+	checkRemoteFile(t, legacy_data_dir+"20240305/output_file_A320.csv", "Hex\n4b1805\n")
+
+	if os.Geteuid() == 0 {
+		t.Skip("root can move the entries of a read-only folder")
+	}
+	if err := os.Chmod(legacy_data_dir, 0o555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(legacy_data_dir, 0o755) })
+	if used_data_dir := migrateDataFolder(legacy_data_dir, root+"data/"); used_data_dir != legacy_data_dir {
+		t.Errorf("the migration of a read-only folder switched to %s", used_data_dir)
+	}
+	checkRemoteFile(t, legacy_data_dir+"20240305/output_file_A320.csv", "Hex\n4b1805\n")
+}
@@ -0,0 +1,123 @@
+// Disk space guard.
+//
+// An optional output (e.g. the raw archive) is paused while the free space on the disk it is
+// written to is below the configured minimum, such that the core CSVs keep enough room if
+// they share the disk. It resumes once space was freed, e.g. by the retention job.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// diskGuardInterval is the minimum time between two checks of the free disk space.
+const diskGuardInterval time.Duration = time.Minute
+
+// Names of the optional outputs.
+const optionalOutputRawArchive string = "raw_archive"
+
+// Gauges of the disk space guard.
+var (
+	disk_free_bytes_gauge         = new(expvar.Map) // by optional output.
+	optional_outputs_paused_gauge = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("disk_free_bytes", disk_free_bytes_gauge)
+	metrics.Set("optional_outputs_paused", optional_outputs_paused_gauge)
+}
+
+// DiskGuard decides whether the optional outputs may be written.
+//
+// It is not safe for concurrent use.
+type DiskGuard struct {
+	clock      Clock
+	free_space func(path string) (uint64, error)
+	outputs    map[string]*guardedOutput
+}
+
+// guardedOutput is the state of an optional output.
+type guardedOutput struct {
+	checked time.Time // time of the last check of the free space.
+	paused  bool
+}
+
+func NewDiskGuard(clock Clock) *DiskGuard {
+	return &DiskGuard{clock: clock, free_space: freeDiskSpace, outputs: make(map[string]*guardedOutput)}
+}
+
+// Check whether the optional output `name` may be written to `dir`. The free space on the
+// disk of `dir` is checked at most once per diskGuardInterval.
+func (guard *DiskGuard) OptionalOutputAllowed(config Config, name string, dir string) bool {
+	output := guard.outputs[name]
+	if output == nil {
+		output = &guardedOutput{}
+		guard.outputs[name] = output
+	}
+
+	if config.Retention.Min_free_disk_mb <= 0 {
+		guard.setPaused(output, false, name, dir, 0, config)
+		return true
+	}
+
+	now := guard.clock.Now()
+	if !output.checked.IsZero() && now.Sub(output.checked) < diskGuardInterval {
+		return !output.paused
+	}
+	output.checked = now
+
+	// The folder of the output is only created once it is written to.
+	path, err := existingParent(dir)
+	var free_bytes uint64
+	if err == nil {
+		free_bytes, err = guard.free_space(path)
+	}
+	if err != nil {
+		retention_log.Debug("failed to get the free disk space.", "output", name, "path", dir, "err", err)
+		return !output.paused
+	}
+	free_bytes_gauge := new(expvar.Int)
+	free_bytes_gauge.Set(int64(free_bytes))
+	disk_free_bytes_gauge.Set(name, free_bytes_gauge)
+
+	guard.setPaused(output, free_bytes < uint64(config.Retention.Min_free_disk_mb)<<20, name, dir, free_bytes, config)
+	return !output.paused
+}
+
+// Change the state of an output and log the transitions.
+func (guard *DiskGuard) setPaused(output *guardedOutput, paused bool, name string, dir string, free_bytes uint64,
+	config Config) {
+	if paused == output.paused {
+		return
+	}
+	output.paused = paused
+	if paused {
+		optional_outputs_paused_gauge.Add(1)
+		retention_log.WarnSevere("the disk is running low on space. Pausing an optional output.", "output", name,
+			"path", dir, "free_mb", free_bytes>>20, "min_free_disk_mb", config.Retention.Min_free_disk_mb)
+	} else {
+		optional_outputs_paused_gauge.Add(-1)
+		retention_log.Info("resuming an optional output.", "output", name, "path", dir, "free_mb", free_bytes>>20)
+	}
+}
+
+// Get `path` or the closest of its parent folders which exists.
+func existingParent(path string) (string, error) {
+	path = filepath.Clean(path)
+	for {
+		_, err := os.Stat(path)
+		if err == nil || !errors.Is(err, fs.ErrNotExist) {
+			return path, err
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// The raw archive is paused while the free space on its own disk is below the minimum and
+// resumes once space was freed. The free space on the disk of the data directory doesn't
+// matter if the archive is written to another disk.
+func TestDiskGuardPausesAndResumesOptionalOutput(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) {
+		config.Retention.Min_free_disk_mb = 100
+	})
+	archive_dir := filepath.ToSlash(t.TempDir()) + "/raw/"
+	clock := NewFakeClock(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC))
+	guard := NewDiskGuard(clock)
+
+	free_mb := map[string]uint64{getDataRoot(config.Data_dir): 10}
+	var checked_paths []string
+	guard.free_space = func(path string) (uint64, error) {
+		checked_paths = append(checked_paths, path)
+		return free_mb[filepath.ToSlash(path)+"/"] << 20, nil
+	}
+	paused := optional_outputs_paused_gauge.Value()
+
+	steps := []struct {
+		free_mb uint64 // on the disk of the archive.
+		advance time.Duration
+		allowed bool
+	}{
+		{100, 0, true},
+		{99, time.Second, true}, // not checked again yet.
+		{99, diskGuardInterval, false},
+		{100, time.Second, false},
+		{100, diskGuardInterval, true},
+	}
+	for i, step := range steps {
+		// The folder of the archive doesn't exist yet, so the free space of its parent is checked.
+		free_mb[filepath.ToSlash(filepath.Dir(filepath.Clean(archive_dir)))+"/"] = step.free_mb
+		clock.Advance(step.advance)
+		if allowed := guard.OptionalOutputAllowed(config, optionalOutputRawArchive, archive_dir); allowed != step.allowed {
+			t.Errorf("step %d: the raw archive is allowed: %t, expected %t", i, allowed, step.allowed)
+		}
+		expected := paused
+		if !step.allowed {
+			expected++
+		}
+		if optional_outputs_paused_gauge.Value() != expected {
+			t.Errorf("step %d: %d optional outputs are paused, expected %d", i, optional_outputs_paused_gauge.Value(), expected)
+		}
+	}
+	if len(checked_paths) != 3 {
+		t.Errorf("the free space was checked at %v, expected 3 checks", checked_paths)
+	}
+
+	// The guard is disabled.
+	config.Retention.Min_free_disk_mb = 0
+	free_mb[filepath.ToSlash(filepath.Dir(filepath.Clean(archive_dir)))+"/"] = 0
+	clock.Advance(diskGuardInterval)
+	if !guard.OptionalOutputAllowed(config, optionalOutputRawArchive, archive_dir) {
+		t.Error("the raw archive is paused while the guard is disabled")
+	}
+}
@@ -0,0 +1,18 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// Get the number of bytes which are available to the user on the disk of `path`.
+func freeDiskSpace(path string) (uint64, error) {
+	path_utf16, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free_bytes, total_bytes, total_free_bytes uint64
+	if err := windows.GetDiskFreeSpaceEx(path_utf16, &free_bytes, &total_bytes, &total_free_bytes); err != nil {
+		return 0, err
+	}
+	return free_bytes, nil
+}
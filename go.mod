@@ -3,6 +3,17 @@ module radarcape_listener
 go 1.18
 
 require (
-	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/eclipse/paho.mqtt.golang v1.4.2
+	github.com/klauspost/compress v1.16.7
+	github.com/pkg/sftp v1.13.5
+	golang.org/x/crypto v0.0.0-20220722155217-630584e8d5aa
+	golang.org/x/net v0.0.0-20211112202133-69e39bad7dc2
+	golang.org/x/sync v0.0.0-20220601150217-0de741cfad7f
+	golang.org/x/sys v0.0.0-20211216021012-1d35b9e2eb4e
+	gopkg.in/yaml.v2 v2.4.0
+)
+
+require (
+	github.com/gorilla/websocket v1.4.2 // indirect
+	github.com/kr/fs v0.1.0 // indirect
 )
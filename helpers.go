@@ -4,7 +4,7 @@ package main
 
 import (
 	"errors"
-	"fmt"
+	"io"
 	"io/fs"
 	"os"
 	"os/signal"
@@ -25,21 +25,33 @@ func IsInSlice(x string, slice []string) bool {
 	return false
 }
 
-// Get the path where we save our measurements
+// Get the folder of the executable with a trailing slash.
 //
-// We place everything into a folder on the desktop for convenience sake.
+// Previous versions placed the config and the data next to the executable. We still
+// look there to support existing installs.
 func getAppBasePath() string {
 	ex, err := os.Executable()
 	if err != nil {
-		LogError(err)
+		main_log.Fatal("failed to locate the executable", "err", err)
 	}
-	folder_path := filepath.Dir(ex) + "/"
-	return strings.ReplaceAll(folder_path, "\\", "/")
+	return filepath.ToSlash(filepath.Dir(ex)) + "/"
+}
+
+// Return the root folder of the data files with a trailing slash.
+//
+// If no `data_dir` is given, the default data directory of the platform is used.
+func getDataRoot(data_dir string) string {
+	if data_dir == "" {
+		return DefaultAppDirs().Data_dir
+	} else if !strings.HasSuffix(data_dir, "/") {
+		return data_dir + "/"
+	}
+	return data_dir
 }
 
 // Return the data folder path as a string which is associated with the given date.
-func getDataFolder(date time.Time) string {
-	return getAppBasePath() + "Data/" + date.Format(dateFormatString) + "/"
+func getDataFolder(data_dir string, date time.Time) string {
+	return getDataRoot(data_dir) + date.Format(dateFormatString) + "/"
 }
 
 // Create a folder at a given path but do not return an error if the path alread exists.
@@ -54,62 +66,71 @@ func createFolder(folder_path string) error {
 	return nil
 }
 
-// Close interrupt handler
+// Sync a folder such that the files which were created or renamed in it survive a power loss.
 //
-// If we close the program (e.g. using Ctrl+C), this function releases
-// its block which resumes execution in the main loop
-func waitForCloseInterrupt() {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	func() {
-		<-c
-		LogInfo("- Ctrl+C pressed in Terminal")
-	}()
+// Folders can't be synced on windows, where the metadata is written through by NTFS.
+func syncFolder(folder_path string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	folder, err := os.Open(folder_path)
+	if err != nil {
+		return err
+	}
+	// Some network file systems (e.g. mounted shares) don't support syncing folders.
+	if err := folder.Sync(); err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTSUP) {
+		folder.Close()
+		return err
+	}
+	return folder.Close()
 }
 
-// Logger functions
+// Count the data rows (i.e. lines without the header) of a CSV file.
 //
-// Wrapper around the standard log methods which apply color
-// according to the severity.
-func LogError(v ...any) {
-	var color_reset, color_red string
-
-	if runtime.GOOS != "windows" {
-		color_reset = ""
-		color_red = ""
-	} else {
-		color_reset = "\x1b[0m"
-		color_red = "\x1b[31m"
+// Compressed files are decompressed on the fly. The rows of a compressed file which is
+// still being written to are counted up to the last flush.
+func countCsvRows(file_path string) (int, error) {
+	file, err := openDataFile(file_path)
+	if err != nil {
+		return 0, err
 	}
-	logger.Fatal(color_red+"[Error]: ", fmt.Sprint(v...), color_reset)
+	defer file.Close()
+	return countRows(file)
 }
 
-func LogWarnSevere(v ...any) {
-	var color_reset, color_red string
-
-	if runtime.GOOS != "windows" {
-		color_reset = ""
-		color_red = ""
-	} else {
-		color_reset = "\x1b[0m"
-		color_red = "\x1b[31m"
+// Count the data rows of the decompressed contents of a CSV file.
+func countRows(reader io.Reader) (int, error) {
+	lines := 0
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := reader.Read(buf)
+		for _, b := range buf[:n] {
+			if b == '\n' {
+				lines++
+			}
+		}
+		if err == io.EOF || isUnfinishedStream(err) {
+			break
+		} else if err != nil {
+			return 0, err
+		}
 	}
-	logger.Println(color_red+"[WarnSevere]: ", fmt.Sprint(v...), color_reset)
-}
 
-func LogWarn(v ...any) {
-	var color_reset, color_yellow string
-
-	if runtime.GOOS != "windows" {
-		color_reset = ""
-		color_yellow = ""
-	} else {
-		color_reset = "\x1b[0m"
-		color_yellow = "\x1b[33m"
+	if lines == 0 {
+		return 0, nil
 	}
-	logger.Println(color_yellow+"[Warn]: ", fmt.Sprint(v...), color_reset)
+	return lines - 1, nil
 }
 
-func LogInfo(v ...any) {
-	logger.Println("[Info]: ", fmt.Sprint(v...))
+// Close interrupt handler
+//
+// If we close the program (e.g. using Ctrl+C), this function releases
+// its block which resumes execution in the main loop
+func waitForCloseInterrupt() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	func() {
+		<-c
+		main_log.Info("Ctrl+C pressed in terminal")
+	}()
 }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Create a valid config whose directories are temporary directories of the test. `modify`
+// changes the config before the defaults are applied.
+func newTestConfig(t *testing.T, modify func(config *Config)) Config {
+	t.Helper()
+	root := t.TempDir() + "/"
+	config := NewConfig()
+	config.Icao_aircraft_types = []string{"A320", "B738"}
+	config.Radarcape_hostname = "radarcape.local"
+	config.Data_dir = root + "data"
+	config.State_dir = root + "state"
+	config.Upload_folder_path = root + "upload"
+	config.Timezone = "UTC"
+	if modify != nil {
+		modify(&config)
+	}
+	config.Normalize()
+	config.ApplyDefaults()
+	if err := config.Validate(); err != nil {
+		t.Fatalf("invalid test config: %s", err)
+	}
+	return config
+}
+
+// Write a file and its folders.
+func writeTestFile(t *testing.T, file_path string, data string) {
+	t.Helper()
+	if err := createFolder(filepath.Dir(file_path)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file_path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Check the contents of a file, e.g. of an uploaded one.
+func checkRemoteFile(t *testing.T, file_path string, expected string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != expected {
+		t.Errorf("%s contains %q, expected %q", file_path, content, expected)
+	}
+}
+
+// Wait until `condition` holds, e.g. until a goroutine has handled a message. Fails the test
+// after five seconds.
+func waitUntil(t *testing.T, description string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", description)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Load the time zone of Zurich, whose clocks are turned forward on 2024-03-31 at 02:00 (a day
+// of 23 hours) and turned back on 2024-10-27 at 03:00 (a day of 25 hours).
+func loadZurich(t *testing.T) *time.Location {
+	t.Helper()
+	location, err := time.LoadLocation("Europe/Zurich")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+// Parse a time stamp with its UTC offset, e.g. 2024-10-27T02:30:00+02:00, which tells the
+// two occurrences of a repeated wall clock time apart.
+func parseTestTime(t *testing.T, value string) time.Time {
+	t.Helper()
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
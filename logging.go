@@ -0,0 +1,555 @@
+// Structured logging.
+//
+// Levelled loggers which emit a message together with key/value fields either as
+// human readable text or as JSON lines. Every component (receiver, processor, ...)
+// gets its own logger such that the origin of a message is always part of the record.
+// Optionally, the records are additionally written to a log file in the state directory
+// which is rotated once it exceeds a certain size or age.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel defines the severity of a log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelWarnSevere
+	LevelError
+)
+
+// Get the name of the log level as used in the log records and the config file.
+func (level LogLevel) String() string {
+	switch level {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelWarnSevere:
+		return "warn_severe"
+	case LevelError:
+		return "error"
+	}
+	return "level(" + strconv.Itoa(int(level)) + ")"
+}
+
+// Parse a log level from its name.
+func ParseLogLevel(name string) (LogLevel, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "warn_severe", "severe":
+		return LevelWarnSevere, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// LogConfig groups the logging related parameters of the config file.
+type LogConfig struct {
+	Level         string `yaml:"level"`  // debug, info, warn, warn_severe or error.
+	Format        string `yaml:"format"` // text or json.
+	To_file       bool   `yaml:"to_file"`
+	File_path     string `yaml:"file_path"` // defaults to logs/radarcape_listener.log in the state directory.
+	Max_size_mb   int    `yaml:"max_size_mb"`
+	Max_age_hours int    `yaml:"max_age_hours"`
+	Max_backups   int    `yaml:"max_backups"` // number of rotated files to keep. 0 keeps all of them.
+}
+
+// logBackend is shared by all loggers and holds the destination and format
+// of the log records.
+type logBackend struct {
+	mu       sync.Mutex
+	level    LogLevel
+	json     bool
+	color    bool
+	console  io.Writer
+	log_file *RotatingFile
+}
+
+var log_backend = &logBackend{
+	level:   LevelInfo,
+	color:   isTerminal(os.Stderr) && runtime.GOOS != "windows",
+	console: os.Stderr,
+}
+
+// Per-component loggers.
+var (
+	main_log      = NewLogger("main")
+	config_log    = NewLogger("config")
+	receiver_log  = NewLogger("receiver")
+	processor_log = NewLogger("processor")
+	uploader_log  = NewLogger("uploader")
+	ticker_log    = NewLogger("ticker")
+	retention_log = NewLogger("retention")
+	report_log    = NewLogger("report")
+	queue_log     = NewLogger("queue")
+	metrics_log   = NewLogger("metrics")
+	mqtt_log      = NewLogger("mqtt")
+)
+
+// Apply the logging configuration.
+//
+// `level_override` takes precedence over the level in the config file if it is non-empty
+// (e.g. if it was specified on the command line).
+func ConfigureLogging(log_config LogConfig, level_override string) error {
+	level_name := log_config.Level
+	if level_override != "" {
+		level_name = level_override
+	}
+	level, err := ParseLogLevel(level_name)
+	if err != nil {
+		return err
+	}
+
+	var use_json bool
+	switch strings.ToLower(log_config.Format) {
+	case "", "text":
+		use_json = false
+	case "json":
+		use_json = true
+	default:
+		return fmt.Errorf("unknown log format %q", log_config.Format)
+	}
+
+	var log_file *RotatingFile
+	if log_config.To_file {
+		file_path := log_config.File_path
+		if file_path == "" {
+			file_path = DefaultAppDirs().State_dir + "logs/radarcape_listener.log"
+		}
+		log_file, err = NewRotatingFile(
+			file_path,
+			int64(log_config.Max_size_mb)*1024*1024,
+			time.Duration(log_config.Max_age_hours)*time.Hour,
+			log_config.Max_backups,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	log_backend.mu.Lock()
+	defer log_backend.mu.Unlock()
+
+	if log_backend.log_file != nil {
+		log_backend.log_file.Close()
+	}
+	log_backend.level = level
+	log_backend.json = use_json
+	log_backend.log_file = log_file
+
+	return nil
+}
+
+// Flush and close the log file if there is one.
+func CloseLogging() {
+	log_backend.mu.Lock()
+	defer log_backend.mu.Unlock()
+
+	if log_backend.log_file != nil {
+		log_backend.log_file.Close()
+		log_backend.log_file = nil
+	}
+}
+
+// Logger writes log records which are tagged with a component name and an
+// optional set of fields which are attached to every record.
+type Logger struct {
+	component string
+	fields    []any
+}
+
+// Create a new logger for the given component.
+func NewLogger(component string) *Logger {
+	return &Logger{component: component}
+}
+
+// Get a copy of the logger which attaches the given key/value pairs to every record.
+func (logger *Logger) With(key_values ...any) *Logger {
+	fields := make([]any, 0, len(logger.fields)+len(key_values))
+	fields = append(fields, logger.fields...)
+	fields = append(fields, key_values...)
+	return &Logger{component: logger.component, fields: fields}
+}
+
+// Check whether records of the given level are currently written.
+func (logger *Logger) Enabled(level LogLevel) bool {
+	log_backend.mu.Lock()
+	defer log_backend.mu.Unlock()
+	return level >= log_backend.level
+}
+
+func (logger *Logger) Debug(msg string, key_values ...any) {
+	logger.log(LevelDebug, msg, key_values)
+}
+
+func (logger *Logger) Info(msg string, key_values ...any) {
+	logger.log(LevelInfo, msg, key_values)
+}
+
+func (logger *Logger) Warn(msg string, key_values ...any) {
+	logger.log(LevelWarn, msg, key_values)
+}
+
+func (logger *Logger) WarnSevere(msg string, key_values ...any) {
+	logger.log(LevelWarnSevere, msg, key_values)
+}
+
+// Log the record and terminate the program.
+//
+// Only to be used on startup: the exit skips closing the csv files, the write-ahead log and
+// the sinks, so errors of the running goroutines are logged with WarnSevere and handled.
+func (logger *Logger) Fatal(msg string, key_values ...any) {
+	logger.log(LevelError, msg, key_values)
+	CloseLogging()
+	os.Exit(1)
+}
+
+// Format the record and write it to the console and the log file.
+func (logger *Logger) log(level LogLevel, msg string, key_values []any) {
+	log_backend.mu.Lock()
+	defer log_backend.mu.Unlock()
+
+	if level < log_backend.level {
+		return
+	}
+
+	now := time.Now()
+	fields := append(append([]any{}, logger.fields...), key_values...)
+
+	var record []byte
+	if log_backend.json {
+		record = formatJsonRecord(now, level, logger.component, msg, fields)
+	} else {
+		record = formatTextRecord(now, level, logger.component, msg, fields)
+	}
+
+	if log_backend.color && !log_backend.json {
+		log_backend.console.Write(colorizeRecord(level, record))
+	} else {
+		log_backend.console.Write(record)
+	}
+
+	if log_backend.log_file != nil {
+		if _, err := log_backend.log_file.Write(record); err != nil {
+			fmt.Fprintln(log_backend.console, "failed to write to log file:", err)
+		}
+	}
+}
+
+// Format a record as a single line of text:
+//
+//	2022-06-01T12:00:00.000Z INFO  [receiver] message key=value other="quoted value"
+func formatTextRecord(now time.Time, level LogLevel, component, msg string, fields []any) []byte {
+	var buf bytes.Buffer
+
+	buf.WriteString(now.UTC().Format("2006-01-02T15:04:05.000Z"))
+	buf.WriteByte(' ')
+	fmt.Fprintf(&buf, "%-5s", strings.ToUpper(level.String()))
+	buf.WriteString(" [" + component + "] ")
+	buf.WriteString(msg)
+
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		buf.WriteByte(' ')
+		buf.WriteString(key)
+		buf.WriteByte('=')
+		buf.WriteString(quoteIfNeeded(formatFieldValue(value)))
+	}
+	buf.WriteByte('\n')
+
+	return buf.Bytes()
+}
+
+// Format a record as a single JSON object terminated by a newline.
+func formatJsonRecord(now time.Time, level LogLevel, component, msg string, fields []any) []byte {
+	record := make(map[string]any, len(fields)/2+4)
+	for i := 0; i < len(fields); i += 2 {
+		key, value := fieldAt(fields, i)
+		switch v := value.(type) {
+		case error:
+			record[key] = v.Error()
+		case fmt.Stringer:
+			record[key] = v.String()
+		default:
+			record[key] = v
+		}
+	}
+	record["time"] = now.UTC().Format(time.RFC3339Nano)
+	record["level"] = level.String()
+	record["component"] = component
+	record["msg"] = msg
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		// Fall back to the text representation of all the fields.
+		for key, value := range record {
+			record[key] = formatFieldValue(value)
+		}
+		encoded, _ = json.Marshal(record)
+	}
+	return append(encoded, '\n')
+}
+
+// Get the key/value pair at position i. A missing value or a key which is not a
+// string is reported instead of silently dropping the field.
+func fieldAt(fields []any, i int) (string, any) {
+	key, ok := fields[i].(string)
+	if !ok {
+		key = "!BADKEY(" + formatFieldValue(fields[i]) + ")"
+	}
+	if i+1 >= len(fields) {
+		return key, "!MISSING"
+	}
+	return key, fields[i+1]
+}
+
+func formatFieldValue(value any) string {
+	switch v := value.(type) {
+	case nil:
+		return "<nil>"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Time:
+		return v.Format(time.RFC3339Nano)
+	case fmt.Stringer:
+		return v.String()
+	}
+	return fmt.Sprint(value)
+}
+
+func quoteIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " =\"\t\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// Apply an ANSI color to the record according to its severity.
+func colorizeRecord(level LogLevel, record []byte) []byte {
+	const color_reset = "\x1b[0m"
+
+	var color string
+	switch level {
+	case LevelDebug:
+		color = "\x1b[90m"
+	case LevelWarn:
+		color = "\x1b[33m"
+	case LevelWarnSevere, LevelError:
+		color = "\x1b[31m"
+	default:
+		return record
+	}
+
+	trimmed := bytes.TrimSuffix(record, []byte("\n"))
+	colored := make([]byte, 0, len(record)+len(color)+len(color_reset))
+	colored = append(colored, color...)
+	colored = append(colored, trimmed...)
+	colored = append(colored, color_reset...)
+	return append(colored, '\n')
+}
+
+// Check whether the file is attached to a terminal.
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// logBackupTimeFormat is the format of the rotation time in the names of the rotated files.
+const logBackupTimeFormat string = "20060102T150405.000"
+
+// RotatingFile is an io.Writer which writes to a file and moves it aside once
+// the file is larger than `max_size` bytes or older than `max_age`. At most
+// `max_backups` rotated files are kept.
+type RotatingFile struct {
+	mu          sync.Mutex
+	path        string
+	max_size    int64
+	max_age     time.Duration
+	max_backups int
+	clock       Clock
+
+	file      *os.File
+	size      int64
+	opened_at time.Time
+	closed    bool
+}
+
+// Open (or create) the log file at the given path.
+//
+// A zero `max_size` or `max_age` disables the corresponding rotation criterion, a
+// zero `max_backups` keeps all the rotated files.
+func NewRotatingFile(path string, max_size int64, max_age time.Duration, max_backups int) (*RotatingFile, error) {
+	return newRotatingFile(path, max_size, max_age, max_backups, RealClock)
+}
+
+func newRotatingFile(path string, max_size int64, max_age time.Duration, max_backups int, clock Clock,
+) (*RotatingFile, error) {
+	rotating_file := &RotatingFile{
+		path:        path,
+		max_size:    max_size,
+		max_age:     max_age,
+		max_backups: max_backups,
+		clock:       clock,
+	}
+
+	if err := createFolder(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := rotating_file.open(); err != nil {
+		return nil, err
+	}
+
+	return rotating_file, nil
+}
+
+func (rotating_file *RotatingFile) Write(p []byte) (int, error) {
+	rotating_file.mu.Lock()
+	defer rotating_file.mu.Unlock()
+
+	if rotating_file.closed {
+		return 0, os.ErrClosed
+	}
+	if rotating_file.file == nil {
+		// The file couldn't be reopened after the last rotation.
+		if err := rotating_file.open(); err != nil {
+			return 0, err
+		}
+	}
+
+	var rotate_err error
+	size_exceeded := rotating_file.max_size > 0 && rotating_file.size+int64(len(p)) > rotating_file.max_size
+	age_exceeded := rotating_file.max_age > 0 && rotating_file.clock.Now().Sub(rotating_file.opened_at) > rotating_file.max_age
+	if (size_exceeded && rotating_file.size > 0) || age_exceeded {
+		rotate_err = rotating_file.rotate()
+		if rotating_file.file == nil {
+			return 0, rotate_err
+		}
+	}
+
+	n, err := rotating_file.file.Write(p)
+	rotating_file.size += int64(n)
+	if err == nil {
+		err = rotate_err
+	}
+	return n, err
+}
+
+func (rotating_file *RotatingFile) Close() error {
+	rotating_file.mu.Lock()
+	defer rotating_file.mu.Unlock()
+
+	if rotating_file.file == nil {
+		return nil
+	}
+	err := rotating_file.file.Close()
+	rotating_file.file = nil
+	rotating_file.closed = true
+	return err
+}
+
+func (rotating_file *RotatingFile) open() error {
+	file, err := os.OpenFile(rotating_file.path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	rotating_file.file = file
+	rotating_file.size = info.Size()
+	rotating_file.opened_at = rotating_file.clock.Now()
+	if started, ok := rotating_file.lastRotation(); ok && info.Size() > 0 && started.Before(rotating_file.opened_at) {
+		rotating_file.opened_at = started
+	}
+	return nil
+}
+
+// Get the time at which the current file was started, i.e. the suffix of the newest backup.
+//
+// The modification time of the file can't be used because every write updates it. Without
+// a backup, the age of the file starts when it is opened.
+func (rotating_file *RotatingFile) lastRotation() (time.Time, bool) {
+	backups, err := filepath.Glob(rotating_file.path + ".*")
+	if err != nil || len(backups) == 0 {
+		return time.Time{}, false
+	}
+	sort.Strings(backups)
+	suffix := strings.TrimPrefix(backups[len(backups)-1], rotating_file.path+".")
+	started, err := time.ParseInLocation(logBackupTimeFormat, suffix, time.UTC)
+	return started, err == nil
+}
+
+// Move the current file aside (suffixed with the rotation time), open a fresh
+// one and remove the oldest backups.
+//
+// If the file can't be moved aside, we keep appending to it and try again once
+// another `max_size` bytes were written or `max_age` has passed. If it can't be
+// reopened, the next write tries again.
+func (rotating_file *RotatingFile) rotate() error {
+	err := rotating_file.file.Close()
+	rotating_file.file = nil
+	if err == nil {
+		backup_path := rotating_file.path + "." + rotating_file.clock.Now().UTC().Format(logBackupTimeFormat)
+		err = os.Rename(rotating_file.path, backup_path)
+	}
+
+	if open_err := rotating_file.open(); open_err != nil {
+		return open_err
+	}
+	if err != nil {
+		rotating_file.size = 0
+		rotating_file.opened_at = rotating_file.clock.Now()
+		return fmt.Errorf("failed to rotate the log file: %w", err)
+	}
+
+	if rotating_file.max_backups <= 0 {
+		return nil
+	}
+
+	backups, err := filepath.Glob(rotating_file.path + ".*")
+	if err != nil {
+		return err
+	}
+	// The timestamp suffix sorts chronologically.
+	sort.Strings(backups)
+	for len(backups) > rotating_file.max_backups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write the log records of the test to a buffer with the given level and format.
+func captureLogs(t *testing.T, new_level LogLevel, use_json bool) *bytes.Buffer {
+	t.Helper()
+	log_backend.mu.Lock()
+	defer log_backend.mu.Unlock()
+
+	level, use_json_before, color, console := log_backend.level, log_backend.json, log_backend.color, log_backend.console
+	t.Cleanup(func() {
+		log_backend.mu.Lock()
+		defer log_backend.mu.Unlock()
+		log_backend.level, log_backend.json, log_backend.color, log_backend.console = level, use_json_before, color, console
+	})
+
+	buffer := &bytes.Buffer{}
+	log_backend.level = new_level
+	log_backend.json = use_json
+	log_backend.color = false
+	log_backend.console = buffer
+	return buffer
+}
+
+func TestTextLogRecords(t *testing.T) {
+	buffer := captureLogs(t, LevelDebug, false)
+	NewLogger("test").With("site", "Zurich").Info("uploaded file.", "path", "20240305/a b.csv", "err", errors.New("failed"), 3)
+
+	record := buffer.String()
+	if !strings.HasSuffix(record, "\n") || strings.Count(record, "\n") != 1 {
+		t.Fatalf("the record is not a single line: %q", record)
+	}
+	_, err := time.Parse("2006-01-02T15:04:05.000Z", record[:strings.Index(record, " ")])
+	if err != nil {
+		t.Errorf("the record doesn't start with the time: %q", record)
+	}
+	expected := ` INFO  [test] uploaded file. site=Zurich path="20240305/a b.csv" err=failed !BADKEY(3)=!MISSING` + "\n"
+	if !strings.HasSuffix(record, expected) {
+		t.Errorf("the record is %q, expected it to end with %q", record, expected)
+	}
+}
+
+func TestJsonLogRecords(t *testing.T) {
+	buffer := captureLogs(t, LevelDebug, true)
+	NewLogger("test").WarnSevere("failed to upload.", "date", "20240305", "attempts", 3, "err", errors.New("timeout"))
+
+	var record map[string]any
+	if err := json.Unmarshal(buffer.Bytes(), &record); err != nil {
+		t.Fatalf("invalid record %q: %s", buffer.String(), err)
+	}
+	expected := map[string]any{
+		"level":     "warn_severe",
+		"component": "test",
+		"msg":       "failed to upload.",
+		"date":      "20240305",
+		"attempts":  float64(3),
+		"err":       "timeout",
+	}
+	for key, value := range expected {
+		if record[key] != value {
+			t.Errorf("%s is %v, expected %v", key, record[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339Nano, record["time"].(string)); err != nil {
+		t.Errorf("invalid time: %s", err)
+	}
+}
+
+func TestLogLevelFiltersRecords(t *testing.T) {
+	buffer := captureLogs(t, LevelWarn, false)
+	logger := NewLogger("test")
+	logger.Debug("debug record.")
+	logger.Info("info record.")
+	logger.Warn("warn record.")
+	logger.WarnSevere("severe record.")
+
+	records := buffer.String()
+	if strings.Contains(records, "debug record.") || strings.Contains(records, "info record.") {
+		t.Errorf("records below the level were written:\n%s", records)
+	}
+	if !strings.Contains(records, "WARN  [test] warn record.") || !strings.Contains(records, "WARN_SEVERE [test] severe record.") {
+		t.Errorf("records at or above the level are missing:\n%s", records)
+	}
+	if logger.Enabled(LevelInfo) || !logger.Enabled(LevelWarn) {
+		t.Error("Enabled doesn't follow the level")
+	}
+}
+
+// Open a rotating file in a temporary folder which uses a fake clock.
+func newTestRotatingFile(t *testing.T, max_size int64, max_age time.Duration, max_backups int) (*RotatingFile, *FakeClock) {
+	t.Helper()
+	clock := NewFakeClock(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC))
+	rotating_file, err := newRotatingFile(t.TempDir()+"/logs/radarcape_listener.log", max_size, max_age, max_backups, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { rotating_file.Close() })
+	return rotating_file, clock
+}
+
+// Get the contents of the log file and its backups, oldest first.
+func readLogFiles(t *testing.T, path string) []string {
+	t.Helper()
+	backups, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := []string{}
+	for _, file_path := range append(backups, path) {
+		content, err := ioutil.ReadFile(file_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		contents = append(contents, string(content))
+	}
+	return contents
+}
+
+func writeLogRecord(t *testing.T, rotating_file *RotatingFile, record string) {
+	t.Helper()
+	if _, err := rotating_file.Write([]byte(record)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRotatingFileRotatesBySize(t *testing.T) {
+	rotating_file, clock := newTestRotatingFile(t, 10, 0, 2)
+	for _, record := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		writeLogRecord(t, rotating_file, record)
+		clock.Advance(time.Second)
+	}
+
+	// The oldest backup was removed.
+	contents := readLogFiles(t, rotating_file.path)
+	if strings.Join(contents, "|") != "second\n|third\n|fourth\n" {
+		t.Errorf("the log files hold %q", contents)
+	}
+}
+
+func TestRotatingFileRotatesByAge(t *testing.T) {
+	rotating_file, clock := newTestRotatingFile(t, 0, time.Hour, 0)
+	writeLogRecord(t, rotating_file, "first\n")
+	clock.Advance(30 * time.Minute)
+	writeLogRecord(t, rotating_file, "second\n")
+	clock.Advance(31 * time.Minute)
+	writeLogRecord(t, rotating_file, "third\n")
+
+	contents := readLogFiles(t, rotating_file.path)
+	if strings.Join(contents, "|") != "first\nsecond\n|third\n" {
+		t.Errorf("the log files hold %q", contents)
+	}
+}
+
+func TestRotatingFileKeepsItsAgeAfterARestart(t *testing.T) {
+	rotating_file, clock := newTestRotatingFile(t, 0, time.Hour, 0)
+	writeLogRecord(t, rotating_file, "first\n")
+	clock.Advance(61 * time.Minute)
+	writeLogRecord(t, rotating_file, "second\n")
+	clock.Advance(30 * time.Minute)
+	writeLogRecord(t, rotating_file, "third\n")
+	if err := rotating_file.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// After the restart, the age of the file still starts at the last rotation although the
+	// file was written to in the meantime.
+	clock.Advance(10 * time.Minute)
+	rotating_file, err := newRotatingFile(rotating_file.path, 0, time.Hour, 0, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rotating_file.Close()
+	writeLogRecord(t, rotating_file, "fourth\n")
+	clock.Advance(21 * time.Minute)
+	writeLogRecord(t, rotating_file, "fifth\n")
+
+	contents := readLogFiles(t, rotating_file.path)
+	if strings.Join(contents, "|") != "first\n|second\nthird\nfourth\n|fifth\n" {
+		t.Errorf("the log files hold %q", contents)
+	}
+}
+
+func TestRotatingFileKeepsWritingIfTheFileCantBeMoved(t *testing.T) {
+	rotating_file, clock := newTestRotatingFile(t, 10, 0, 0)
+	writeLogRecord(t, rotating_file, "first\n")
+
+	// A folder with the name of the backup makes the rename fail.
+	backup_path := rotating_file.path + "." + clock.Now().UTC().Format(logBackupTimeFormat)
+	writeTestFile(t, backup_path+"/blocker", "")
+	if _, err := rotating_file.Write([]byte("second\n")); err == nil {
+		t.Error("the failed rotation was not reported")
+	}
+	os.RemoveAll(backup_path)
+
+	// The record was still written to the file, which is rotated once another 10 bytes
+	// were written to it.
+	clock.Advance(time.Second)
+	writeLogRecord(t, rotating_file, "third\n")
+	contents := readLogFiles(t, rotating_file.path)
+	if strings.Join(contents, "|") != "first\nsecond\n|third\n" {
+		t.Errorf("the log files hold %q", contents)
+	}
+
+	if err := rotating_file.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rotating_file.Write([]byte("closed\n")); !errors.Is(err, os.ErrClosed) {
+		t.Errorf("writing to a closed file returned %v", err)
+	}
+}
@@ -6,7 +6,6 @@
 package main
 
 import (
-	"log"
 	"os"
 	"time"
 )
@@ -14,59 +13,166 @@ import (
 // dateFormatString defines the date format we use.
 const dateFormatString string = "20060102"
 
-// DEBUG defines whether debug prints should be enabled or not.
-var DEBUG bool = false
-
-// Set up logger to display additional information.
-var logger *log.Logger = log.New(
-	os.Stderr,
-	"Radarcape_listener: ",
-	log.LstdFlags|log.Lshortfile,
-)
-
 // Main function (duh..)
 //
-// Entry point for the program. Instantiate all relevant variables and launch all
-// goroutines.
+// Entry point for the program. Parse the command line and run the selected subcommand.
 func main() {
-	cfg_filepath := getAppBasePath() + "radarcape_listener_config.yaml"
+	os.Exit(RunCli(os.Args[1:]))
+}
 
-	config := Config{}
-	config.LoadConfiguration(cfg_filepath)
+// Run the listener.
+//
+// Instantiate all relevant variables and launch all goroutines. Blocks until the
+// program is interrupted.
+func RunListener(config_store *ConfigStore, clock Clock) {
+	config := config_store.Get()
+
+	if err := createFolder(config.State_dir); err != nil {
+		main_log.Fatal("failed to create the state directory", "path", config.State_dir, "err", err)
+	}
 
-	// data channel between the receiver and worker goroutine.
-	aircraft_data_channel := make(chan AircraftData, 50)
+	// data queue between the receiver and worker goroutine.
+	aircraft_data_queue, err := NewRecordQueue(config.Queue, config.State_dir+"queue_spill.jsonl", clock)
+	if err != nil {
+		main_log.Fatal("failed to create the record queue", "err", err)
+	}
+
+	// Every record is persisted in the write-ahead log before it reaches the worker goroutine.
+	// Records which were not written to the csv files before the last stop are replayed.
+	wal, err := OpenWriteAheadLog(config.State_dir+"wal/", config.Wal, clock, config.Write.walSyncInterval())
+	if err != nil {
+		main_log.Fatal("failed to open the write-ahead log", "err", err)
+	}
+
+	// The records are also published to the MQTT broker, if one is configured, once they
+	// were appended to the write-ahead log.
+	sinks := []Sink{}
+	if config.MqttEnabled() {
+		mqtt_sink, err := NewMqttSink(config, clock)
+		if err != nil {
+			main_log.Fatal("failed to set up the MQTT sink", "broker", config.Mqtt.Broker, "err", err)
+		}
+		sinks = append(sinks, mqtt_sink)
+	}
+	appender_done := make(chan struct{})
+	go func() {
+		wal.AppendFromQueue(aircraft_data_queue.C(), sinks)
+		close(appender_done)
+	}()
+
+	if config.Metrics_address != "" {
+		if err := StartMetricsServer(config.Metrics_address); err != nil {
+			main_log.Fatal("failed to start the metrics server", "address", config.Metrics_address, "err", err)
+		}
+	}
 
 	// This ticker specifies the update rate with which we poll the
 	// radarcape for new data.
-	ticker_2hz := time.NewTicker(500 * time.Millisecond)
+	ticker_2hz := clock.NewTicker(500 * time.Millisecond)
 	defer ticker_2hz.Stop()
 
-	// Instantiate tickers which control csv generation and data uploading.
-	midnight_ticker := NewTimeTicker(0, 0, 10)
-	three_am_ticker := NewTimeTicker(3, 0, 0)
+	// Instantiate the tickers of the scheduled jobs. Missed uploads, cleanups and reports
+	// (e.g. because the machine was switched off) are caught up right away.
+	scheduler := NewScheduler(clock, config.State_dir+"scheduler_state.json")
+
+	schedules := make(map[string]Schedule)
+	for name, expression := range map[string]string{
+		"rollover":  config.Schedule.Rollover,
+		"upload":    config.Schedule.Upload,
+		"retention": config.Schedule.Retention,
+		"report":    config.Schedule.Report,
+	} {
+		schedule, err := config.ParsedSchedule(expression)
+		if err != nil {
+			main_log.Fatal("invalid schedule", "job", name, "schedule", expression, "err", err)
+		}
+		schedules[name] = schedule
+	}
+
+	rollover_ticker := scheduler.Add("rollover", schedules["rollover"], false)
 
 	// Instantiate reveiver goroutine.
-	go GetAircraftsFromHttp(aircraft_data_channel, config, ticker_2hz)
+	stop_receiver := make(chan struct{})
+	receiver_done := make(chan struct{})
+	go func() {
+		GetAircraftsFromHttp(aircraft_data_queue, config_store, clock, ticker_2hz, stop_receiver)
+		close(receiver_done)
+	}()
 
 	// Instantiate worker goroutine.
-	go ProcessAircraftData(aircraft_data_channel, config, midnight_ticker)
-
-	// Instantiate uploader goroutine if a non-empty upload path was specified.
-	if config.Upload_folder_path != "" {
-		go UploadFilesToSharedFolder(config, three_am_ticker)
-	} else {
-		LogInfo("main: 'upload_folder_path' not specified in config yaml file.",
-			"Saving the data locally.")
+	processor_done := make(chan struct{})
+	go func() {
+		ProcessAircraftData(wal, config_store, clock, rollover_ticker)
+		close(processor_done)
+	}()
+
+	// Instantiate uploader goroutine. It skips the upload as long as no upload target is specified.
+	if schedule := schedules["upload"]; schedule != nil {
+		go UploadFilesToSharedFolder(config_store, clock, scheduler.Add("upload", schedule, true))
+	}
+	if !config.UploadEnabled() {
+		main_log.Info("no upload target specified in config yaml file. Saving the data locally.")
+	}
+
+	// Instantiate the retention and report goroutines.
+	if schedule := schedules["retention"]; schedule != nil {
+		go RetentionCleanup(config_store, clock, scheduler.Add("retention", schedule, true))
+	}
+	if schedule := schedules["report"]; schedule != nil {
+		go DailyReport(config_store, clock, scheduler.Add("report", schedule, true))
 	}
 
-	LogInfo("main: Started the radarcape listener.")
-	LogInfo(
-		"main: Listening on hostname ", config.Radarcape_hostname,
-		" for the following aircrafts: ", config.Icao_aircraft_types,
+	main_log.Info("started the radarcape listener.",
+		"version", version,
+		"hostname", config.Radarcape_hostname,
+		"timezone", config.Timezone,
+		"aircraft_types", config.Icao_aircraft_types,
 	)
 
 	waitForCloseInterrupt()
-	midnight_ticker.Stop()
 
+	// Stop the receiver first and move the records which are still queued into the
+	// write-ahead log, such that no record is lost.
+	close(stop_receiver)
+	receiver_timer := clock.NewTimer(10 * time.Second)
+	defer receiver_timer.Stop()
+	select {
+	case <-receiver_done:
+		// Closing the queue stops the appending goroutine once it appended the queued
+		// records. It sends the records which the sinks still buffer before it returns.
+		aircraft_data_queue.Close()
+		appender_timer := clock.NewTimer(10 * time.Second)
+		defer appender_timer.Stop()
+		select {
+		case <-appender_done:
+		case <-appender_timer.C():
+			main_log.Warn("timed out waiting for the queued records to be appended to the write-ahead log.")
+		}
+	case <-receiver_timer.C():
+		main_log.WarnSevere("timed out waiting for the receiver to stop. The queued records are lost.")
+	}
+
+	// Stopping the tickers makes the worker goroutine write the buffered records and
+	// close the csv files.
+	scheduler.Stop()
+	shutdown_timer := clock.NewTimer(10 * time.Second)
+	defer shutdown_timer.Stop()
+	select {
+	case <-processor_done:
+	case <-shutdown_timer.C():
+		main_log.Warn("timed out waiting for the csv files to be closed.")
+	}
+
+	// Records which were not acknowledged yet are replayed after the next start. Closing the
+	// log also stops the appending goroutine if it is still running.
+	if err := wal.Close(); err != nil {
+		main_log.Warn("failed to close the write-ahead log.", "err", err)
+	}
+	sinks_timer := clock.NewTimer(10 * time.Second)
+	defer sinks_timer.Stop()
+	select {
+	case <-appender_done:
+	case <-sinks_timer.C():
+		main_log.Warn("timed out waiting for the sinks to be closed.")
+	}
 }
@@ -0,0 +1,285 @@
+// Manifests of the uploaded files.
+//
+// Every uploaded day folder (and every day archive) contains a MANIFEST.sha256 with the
+// SHA-256 checksums of its files and the number of rows of the CSVs. The checksums use the
+// format of sha256sum, so the folders can also be checked with `sha256sum -c MANIFEST.sha256`.
+// The manifests of the days which are not finished yet are kept in the state directory, such
+// that files which are uploaded in several runs end up in one manifest.
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// manifestFileName is the name of the manifest in the day folders and archives.
+const manifestFileName string = "MANIFEST.sha256"
+
+// manifestFolderName is the folder of the manifests of unfinished days in the state directory.
+const manifestFolderName string = "manifests/"
+
+// ManifestEntry describes a file of a manifest.
+type ManifestEntry struct {
+	File   string
+	Sha256 string // hex encoded.
+	Rows   int    // data rows of a CSV, -1 for other files.
+}
+
+// Get the manifest entry of a file in `folder_path`.
+func manifestEntryOf(folder_path string, file_name string) (ManifestEntry, error) {
+	file, err := os.Open(folder_path + file_name)
+	if err != nil {
+		return ManifestEntry{}, err
+	}
+	defer file.Close()
+	return hashDataFile(file_name, file)
+}
+
+// Hash the contents of a data file and count its rows on the way.
+//
+// The rows of CSVs which can't be decompressed are not counted; their checksum is
+// computed nevertheless.
+func hashDataFile(file_name string, r io.Reader) (ManifestEntry, error) {
+	hash := sha256.New()
+	tee_reader := io.TeeReader(r, hash)
+
+	rows := -1
+	if isCsvFileName(file_name) {
+		if data_reader, err := newDataReader(file_name, tee_reader); err == nil {
+			if count, err := countRows(data_reader); err == nil {
+				rows = count
+			}
+			data_reader.Close()
+		}
+	}
+	// Whatever the decompression didn't read (e.g. after an error) is hashed as well.
+	if _, err := io.Copy(hash, r); err != nil {
+		return ManifestEntry{}, err
+	}
+
+	return ManifestEntry{File: file_name, Sha256: hex.EncodeToString(hash.Sum(nil)), Rows: rows}, nil
+}
+
+// Compute the SHA-256 checksum of a file.
+func fileSha256(file_path string) (string, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Parse a manifest.
+//
+// The row counts are stored in comment lines (`# <file>: <rows> rows`), which sha256sum
+// ignores.
+func parseManifest(r io.Reader) ([]ManifestEntry, error) {
+	rows := make(map[string]int)
+	entries := []ManifestEntry{}
+
+	scanner := bufio.NewScanner(r)
+	for line_number := 1; scanner.Scan(); line_number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			file_name, count, ok := strings.Cut(strings.TrimSpace(line[1:]), ": ")
+			var row_count int
+			if ok {
+				if _, err := fmt.Sscanf(count, "%d rows", &row_count); err == nil {
+					rows[file_name] = row_count
+				}
+			}
+			continue
+		}
+
+		checksum, file_name, ok := strings.Cut(line, " ")
+		file_name = strings.TrimPrefix(strings.TrimLeft(file_name, " "), "*")
+		if !ok || len(checksum) != 2*sha256.Size || file_name == "" {
+			return nil, fmt.Errorf("line %d: invalid checksum line %q", line_number, line)
+		}
+		entries = append(entries, ManifestEntry{File: file_name, Sha256: strings.ToLower(checksum), Rows: -1})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range entries {
+		if row_count, ok := rows[entries[i].File]; ok {
+			entries[i].Rows = row_count
+		}
+	}
+	return entries, nil
+}
+
+// Read the manifest at `file_path`. A missing manifest is returned as fs.ErrNotExist.
+func readManifest(file_path string) ([]ManifestEntry, error) {
+	file, err := os.Open(file_path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return parseManifest(file)
+}
+
+// Format a manifest with the entries sorted by file name.
+func formatManifest(day_string string, entries []ManifestEntry) []byte {
+	sorted_entries := append([]ManifestEntry(nil), entries...)
+	sort.Slice(sorted_entries, func(i, j int) bool { return sorted_entries[i].File < sorted_entries[j].File })
+
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "# radarcape_listener %s: files of %s. Check with: sha256sum -c %s\n", version,
+		day_string, manifestFileName)
+	for _, entry := range sorted_entries {
+		if entry.Rows >= 0 {
+			fmt.Fprintf(&builder, "# %s: %d rows\n", entry.File, entry.Rows)
+		}
+		fmt.Fprintf(&builder, "%s  %s\n", entry.Sha256, entry.File)
+	}
+	return []byte(builder.String())
+}
+
+// Add entries to the manifest at `file_path`, replacing the entries of the same files.
+// The manifest is created if it doesn't exist.
+func mergeManifest(file_path string, day_string string, entries []ManifestEntry) error {
+	existing_entries, err := readManifest(file_path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	merged := make(map[string]ManifestEntry, len(existing_entries)+len(entries))
+	for _, entry := range existing_entries {
+		merged[entry.File] = entry
+	}
+	for _, entry := range entries {
+		merged[entry.File] = entry
+	}
+	merged_entries := make([]ManifestEntry, 0, len(merged))
+	for _, entry := range merged {
+		merged_entries = append(merged_entries, entry)
+	}
+	return writeFileAtomic(file_path, formatManifest(day_string, merged_entries))
+}
+
+// Compare the files with the entries of their manifest. Returns the problems which were
+// found, e.g. files with a different checksum or row count, missing files or files which
+// are not listed.
+func compareManifest(manifest []ManifestEntry, files map[string]ManifestEntry) []string {
+	problems := []string{}
+	listed := make(map[string]bool, len(manifest))
+	for _, expected := range manifest {
+		listed[expected.File] = true
+		actual, ok := files[expected.File]
+		switch {
+		case !ok:
+			problems = append(problems, expected.File+": missing")
+		case actual.Sha256 != expected.Sha256:
+			problems = append(problems, expected.File+": checksum mismatch")
+		case expected.Rows >= 0 && actual.Rows != expected.Rows:
+			problems = append(problems, fmt.Sprintf("%s: %d rows instead of %d", expected.File, actual.Rows,
+				expected.Rows))
+		}
+	}
+
+	unlisted := []string{}
+	for file_name := range files {
+		if !listed[file_name] {
+			unlisted = append(unlisted, file_name)
+		}
+	}
+	sort.Strings(unlisted)
+	for _, file_name := range unlisted {
+		problems = append(problems, file_name+": not in the manifest")
+	}
+	return problems
+}
+
+// Verify the files of a day folder against its manifest.
+func verifyManifestFolder(folder_path string) (files int, problems []string, err error) {
+	manifest, err := readManifest(folder_path + manifestFileName)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	entries, err := ioutil.ReadDir(folder_path)
+	if err != nil {
+		return 0, nil, err
+	}
+	actual := make(map[string]ManifestEntry, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || entry.Name() == manifestFileName {
+			continue
+		}
+		actual_entry, err := manifestEntryOf(folder_path, entry.Name())
+		if err != nil {
+			return 0, nil, err
+		}
+		actual[entry.Name()] = actual_entry
+	}
+	return len(manifest), compareManifest(manifest, actual), nil
+}
+
+// Verify the files of a day archive against the manifest within it.
+func verifyManifestArchive(archive_path string) (files int, problems []string, err error) {
+	archive_file, err := os.Open(archive_path)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer archive_file.Close()
+	gzip_reader, err := gzip.NewReader(bufio.NewReader(archive_file))
+	if err != nil {
+		return 0, nil, err
+	}
+	defer gzip_reader.Close()
+
+	var manifest []ManifestEntry
+	actual := make(map[string]ManifestEntry)
+	tar_reader := tar.NewReader(gzip_reader)
+	for {
+		header, err := tar_reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return 0, nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == manifestFileName {
+			if manifest, err = parseManifest(tar_reader); err != nil {
+				return 0, nil, err
+			}
+			continue
+		}
+		actual_entry, err := hashDataFile(header.Name, tar_reader)
+		if err != nil {
+			return 0, nil, err
+		}
+		actual[header.Name] = actual_entry
+	}
+
+	if manifest == nil {
+		return 0, nil, fmt.Errorf("%s has no %s: %w", archive_path, manifestFileName, fs.ErrNotExist)
+	}
+	return len(manifest), compareManifest(manifest, actual), nil
+}
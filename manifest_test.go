@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testA320Csv string = "Hex,Fli\n4b1805,SWR1\n4b1806,SWR2\n"
+	testB738Csv string = "Hex,Fli\n"
+)
+
+// Write the csv files of a day to the data directory and get the manifest which is expected
+// for them.
+func writeManifestTestDay(t *testing.T, config Config, day time.Time) string {
+	t.Helper()
+	data_folder_path := getDataFolder(config.Data_dir, day)
+	writeTestFile(t, data_folder_path+"output_file_A320.csv", testA320Csv)
+	writeTestFile(t, data_folder_path+"output_file_B738.csv", testB738Csv)
+
+	checksum := func(data string) string {
+		sum := sha256.Sum256([]byte(data))
+		return hex.EncodeToString(sum[:])
+	}
+	return "# radarcape_listener " + version + ": files of 20240305. Check with: sha256sum -c MANIFEST.sha256\n" +
+		"# output_file_A320.csv: 2 rows\n" +
+		checksum(testA320Csv) + "  output_file_A320.csv\n" +
+		"# output_file_B738.csv: 0 rows\n" +
+		checksum(testB738Csv) + "  output_file_B738.csv\n"
+}
+
+// Run the verify command on the given folders and check how many manifests failed.
+func checkVerifyCommand(t *testing.T, folders []string, failed int, problems ...string) {
+	t.Helper()
+	exit_code, stdout, stderr := runTestCli(t, append([]string{"verify"}, folders...)...)
+	if failed == 0 {
+		if exit_code != 0 || !strings.Contains(stdout, "2 manifests verified.") {
+			t.Errorf("verify exited with %d and printed %q %q", exit_code, stdout, stderr)
+		}
+		return
+	}
+	if exit_code == 0 || strings.Count(stdout, "FAILED") != failed {
+		t.Errorf("verify exited with %d and printed %q, expected %d failed manifests", exit_code, stdout, failed)
+	}
+	for _, problem := range problems {
+		if !strings.Contains(stdout, problem) {
+			t.Errorf("verify didn't report %q: %q", problem, stdout)
+		}
+	}
+}
+
+// The uploaded day folder and its backup get a manifest with the checksums and the row counts
+// of the files, and verify detects changed and truncated files.
+func TestUploadDayWritesVerifiableManifests(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) {
+		config.Backup_folder_path = filepath.Dir(config.Data_dir) + "/backup"
+	})
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))
+	expected := writeManifestTestDay(t, config, day)
+	if err := UploadDay(config, clock, day, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	folders := []string{config.Upload_folder_path, config.Backup_folder_path}
+	for _, folder := range folders {
+		manifest_path := getDataFolder(folder, day) + manifestFileName
+		content, err := ioutil.ReadFile(manifest_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(content) != expected {
+			t.Errorf("%s holds\n%s\nexpected\n%s", manifest_path, content, expected)
+		}
+		entries, err := readManifest(manifest_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Rows != 2 || entries[1].Rows != 0 {
+			t.Errorf("the row counts of %s are not read back: %+v", manifest_path, entries)
+		}
+	}
+	checkVerifyCommand(t, folders, 0)
+
+	// A changed row in the upload folder and a truncated file in the backup folder.
+	upload_folder_path := getDataFolder(config.Upload_folder_path, day)
+	backup_folder_path := getDataFolder(config.Backup_folder_path, day)
+	writeTestFile(t, upload_folder_path+"output_file_A320.csv", strings.Replace(testA320Csv, "SWR2", "SWR3", 1))
+	if err := os.Truncate(backup_folder_path+"output_file_A320.csv", int64(len(testA320Csv)-5)); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, backup_folder_path+"notes.txt", "")
+	checkVerifyCommand(t, folders, 2, "output_file_A320.csv: checksum mismatch", "notes.txt: not in the manifest")
+
+	// A file whose row count differs from the manifest and a missing file.
+	files := map[string]ManifestEntry{
+		"output_file_A320.csv": {File: "output_file_A320.csv", Sha256: "ab", Rows: 1},
+	}
+	manifest := []ManifestEntry{
+		{File: "output_file_A320.csv", Sha256: "ab", Rows: 2},
+		{File: "output_file_B738.csv", Sha256: "cd", Rows: 0},
+	}
+	problems := compareManifest(manifest, files)
+	if strings.Join(problems, "; ") != "output_file_A320.csv: 1 rows instead of 2; output_file_B738.csv: missing" {
+		t.Errorf("the comparison found %v", problems)
+	}
+}
+
+// A day archive contains the manifest of its files, and verify detects a changed file in it.
+func TestUploadDayArchiveContainsVerifiableManifest(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) {
+		config.Backup_folder_path = filepath.Dir(config.Data_dir) + "/backup"
+		config.Compression.Upload_archive = true
+	})
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))
+	expected := writeManifestTestDay(t, config, day)
+	if err := UploadDay(config, clock, day, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	folders := []string{config.Upload_folder_path, config.Backup_folder_path}
+	for _, folder := range folders {
+		archive_path := normalizeFolderPath(folder) + "20240305" + archiveExtension
+		files, problems, err := verifyManifestArchive(archive_path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if files != 2 || len(problems) != 0 {
+			t.Errorf("%s lists %d files and has the problems %v", archive_path, files, problems)
+		}
+	}
+	checkVerifyCommand(t, folders, 0)
+
+	// Replace the backup with an archive of a changed file and the original manifest.
+	folder_path := t.TempDir() + "/"
+	writeTestFile(t, folder_path+"output_file_A320.csv", strings.Replace(testA320Csv, "SWR2", "SWR3", 1))
+	writeTestFile(t, folder_path+"output_file_B738.csv", testB738Csv)
+	writeTestFile(t, folder_path+manifestFileName, expected)
+	err := createArchive(normalizeFolderPath(config.Backup_folder_path)+"20240305"+archiveExtension, folder_path,
+		[]string{"output_file_A320.csv", "output_file_B738.csv", manifestFileName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkVerifyCommand(t, folders, 1, "output_file_A320.csv: checksum mismatch")
+}
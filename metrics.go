@@ -0,0 +1,35 @@
+// Metrics.
+//
+// Counters of the listener are published with the expvar package. If a metrics address
+// is configured, they are served as JSON under /debug/vars, e.g. for a monitoring script.
+
+package main
+
+import (
+	"expvar"
+	"net"
+	"net/http"
+)
+
+// metrics holds all the counters of the listener.
+var metrics = expvar.NewMap("radarcape_listener")
+
+// Serve the metrics at http://<address>/debug/vars in the background.
+func StartMetricsServer(address string) error {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+
+	server_mux := http.NewServeMux()
+	server_mux.Handle("/debug/vars", expvar.Handler())
+
+	go func() {
+		if err := http.Serve(listener, server_mux); err != nil {
+			metrics_log.Warn("metrics server stopped.", "err", err)
+		}
+	}()
+
+	metrics_log.Info("serving metrics.", "url", "http://"+listener.Addr().String()+"/debug/vars")
+	return nil
+}
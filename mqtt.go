@@ -0,0 +1,435 @@
+// MQTT publishing.
+//
+// Optionally, every record which passes the aircraft type filter is published to an MQTT
+// broker as soon as it was appended to the write-ahead log, e.g. for live dashboards. The
+// records are sent as JSON to <topic_prefix>/<site>/<type>/<hex>. While the broker can't be reached, the records
+// are kept in an offline buffer and sent once the connection is back. If the buffer is full,
+// the oldest records are dropped; the csv files are not affected by the MQTT sink at all.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+// MqttConfig groups the parameters of the MQTT sink.
+type MqttConfig struct {
+	Broker               string `yaml:"broker"` // e.g. tcp://broker.example.org:1883 or ssl://... Empty disables the sink.
+	Client_id            string `yaml:"client_id"`
+	Username             string `yaml:"username"`
+	Password             string `yaml:"password"`     // preferably set by RADARCAPE_MQTT_PASSWORD.
+	Topic_prefix         string `yaml:"topic_prefix"` // first level(s) of the topics, e.g. radarcape.
+	Qos                  int    `yaml:"qos"`          // 0, 1 or 2.
+	Retain               bool   `yaml:"retain"`       // the broker keeps the last record of every aircraft.
+	Ca_file              string `yaml:"ca_file"`      // PEM certificates of the broker's CA. Empty uses the system ones.
+	Cert_file            string `yaml:"cert_file"`    // PEM client certificate, together with key_file.
+	Key_file             string `yaml:"key_file"`
+	Insecure_skip_verify bool   `yaml:"insecure_skip_verify"`
+	Buffer_size          int    `yaml:"buffer_size"`     // records which are kept while the broker can't be reached.
+	Connect_timeout      string `yaml:"connect_timeout"` // e.g. 10s.
+	Keep_alive           string `yaml:"keep_alive"`      // e.g. 30s.
+}
+
+// URL schemes of the broker which are supported by the MQTT client.
+var mqttBrokerSchemes = map[string]bool{
+	"tcp": true, "mqtt": true, "ssl": true, "tls": true, "mqtts": true, "ws": true, "wss": true,
+}
+
+// Timing of the MQTT sink.
+const (
+	mqttRetryDelay     time.Duration = 5 * time.Second // of the first connection attempt and of failed publishes.
+	mqttMaxRetryDelay  time.Duration = 2 * time.Minute
+	mqttPublishTimeout time.Duration = 10 * time.Second
+	mqttCloseTimeout   time.Duration = 5 * time.Second // to send the buffered records on shutdown.
+)
+
+// Counters of the MQTT sink.
+var (
+	mqtt_published_counter      = new(expvar.Int)
+	mqtt_dropped_counter        = new(expvar.Int)
+	mqtt_publish_errors_counter = new(expvar.Int)
+	mqtt_connected_gauge        = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("mqtt_published", mqtt_published_counter)
+	metrics.Set("mqtt_dropped", mqtt_dropped_counter)
+	metrics.Set("mqtt_publish_errors", mqtt_publish_errors_counter)
+	metrics.Set("mqtt_connected", mqtt_connected_gauge)
+}
+
+// Check whether an MQTT broker is configured.
+func (config Config) MqttEnabled() bool {
+	return config.Mqtt.Broker != ""
+}
+
+// Fill in the default values of the MQTT parameters which were not specified.
+func (mqtt_config *MqttConfig) applyDefaults() {
+	if mqtt_config.Topic_prefix == "" {
+		mqtt_config.Topic_prefix = "radarcape"
+	}
+	if mqtt_config.Buffer_size == 0 {
+		mqtt_config.Buffer_size = 10000
+	}
+	if mqtt_config.Connect_timeout == "" {
+		mqtt_config.Connect_timeout = "10s"
+	}
+	if mqtt_config.Keep_alive == "" {
+		mqtt_config.Keep_alive = "30s"
+	}
+}
+
+// Normalise the MQTT parameters.
+func (mqtt_config *MqttConfig) normalize() {
+	mqtt_config.Broker = strings.TrimSpace(mqtt_config.Broker)
+	mqtt_config.Client_id = strings.TrimSpace(mqtt_config.Client_id)
+	mqtt_config.Topic_prefix = strings.Trim(strings.TrimSpace(mqtt_config.Topic_prefix), "/")
+	mqtt_config.Ca_file = strings.TrimSpace(mqtt_config.Ca_file)
+	mqtt_config.Cert_file = strings.TrimSpace(mqtt_config.Cert_file)
+	mqtt_config.Key_file = strings.TrimSpace(mqtt_config.Key_file)
+}
+
+// Check the MQTT parameters and add the problems to `config_errors`.
+func (mqtt_config MqttConfig) validate(config_errors *ConfigErrors) {
+	if mqtt_config.Broker == "" {
+		return
+	}
+	if parsed, err := url.Parse(mqtt_config.Broker); err != nil {
+		config_errors.add("mqtt.broker: %s", err)
+	} else if !mqttBrokerSchemes[parsed.Scheme] || parsed.Hostname() == "" {
+		config_errors.add("mqtt.broker: %q must be a tcp, ssl, ws or wss url, e.g. tcp://broker.example.org:1883",
+			mqtt_config.Broker)
+	}
+	if strings.ContainsAny(mqtt_config.Topic_prefix, "+#") {
+		config_errors.add("mqtt.topic_prefix: %q must not contain the wildcards + or #", mqtt_config.Topic_prefix)
+	}
+	if mqtt_config.Qos < 0 || mqtt_config.Qos > 2 {
+		config_errors.add("mqtt.qos: %d must be 0, 1 or 2", mqtt_config.Qos)
+	}
+	if (mqtt_config.Cert_file == "") != (mqtt_config.Key_file == "") {
+		config_errors.add("mqtt: cert_file and key_file must be specified together")
+	}
+	if mqtt_config.Buffer_size < 1 {
+		config_errors.add("mqtt.buffer_size: %d must be positive", mqtt_config.Buffer_size)
+	}
+	if _, err := parseUploadDuration(mqtt_config.Connect_timeout); err != nil {
+		config_errors.add("mqtt.connect_timeout: %s", err)
+	}
+	if _, err := parseUploadDuration(mqtt_config.Keep_alive); err != nil {
+		config_errors.add("mqtt.keep_alive: %s", err)
+	}
+}
+
+// Get the url of the broker with the default port of its scheme if it has none.
+func (mqtt_config MqttConfig) brokerUrl() string {
+	parsed, err := url.Parse(mqtt_config.Broker)
+	if err != nil || parsed.Port() != "" {
+		return mqtt_config.Broker
+	}
+	switch parsed.Scheme {
+	case "tcp", "mqtt":
+		parsed.Host += ":1883"
+	case "ssl", "tls", "mqtts":
+		parsed.Host += ":8883"
+	}
+	return parsed.String()
+}
+
+// Create the TLS config of the connection to the broker. Returns nil if the broker is not
+// reached over TLS and no client certificate is given.
+func (mqtt_config MqttConfig) tlsConfig() (*tls.Config, error) {
+	scheme := ""
+	if parsed, err := url.Parse(mqtt_config.Broker); err == nil {
+		scheme = parsed.Scheme
+	}
+	secure := scheme == "ssl" || scheme == "tls" || scheme == "mqtts" || scheme == "wss"
+	if !secure && mqtt_config.Ca_file == "" && mqtt_config.Cert_file == "" {
+		return nil, nil
+	}
+
+	tls_config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: mqtt_config.Insecure_skip_verify,
+	}
+	if mqtt_config.Ca_file != "" {
+		ca_pem, err := ioutil.ReadFile(mqtt_config.Ca_file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the ca_file: %w", err)
+		}
+		tls_config.RootCAs = x509.NewCertPool()
+		if !tls_config.RootCAs.AppendCertsFromPEM(ca_pem) {
+			return nil, fmt.Errorf("%s contains no PEM certificates", mqtt_config.Ca_file)
+		}
+	}
+	if mqtt_config.Cert_file != "" {
+		certificate, err := tls.LoadX509KeyPair(mqtt_config.Cert_file, mqtt_config.Key_file)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the client certificate: %w", err)
+		}
+		tls_config.Certificates = []tls.Certificate{certificate}
+	}
+	return tls_config, nil
+}
+
+// Get the default client id of the listener, which is unique per machine.
+func defaultMqttClientId() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		return "radarcape_listener"
+	}
+	return "radarcape_listener-" + hostname
+}
+
+// Make a value usable as a single topic level. Separators and wildcards are replaced.
+func mqttTopicLevel(value string) string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "unknown"
+	}
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '+', '#', ' ', '\t':
+			return '_'
+		}
+		return r
+	}, value)
+}
+
+// mqttMessage is a record which is waiting to be published.
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// MqttSink publishes the records to an MQTT broker.
+//
+// Publish only appends to the offline buffer; a goroutine sends the buffered records
+// whenever the broker is connected. The client reconnects on its own after a lost
+// connection. Publish and Close must be called from one goroutine.
+type MqttSink struct {
+	mqtt_config MqttConfig
+	clock       Clock
+	site        string // topic level of the site.
+	client      mqtt.Client
+
+	buffer      chan mqttMessage
+	connected   chan struct{} // signalled whenever the connection is (re-)established.
+	stop        chan struct{} // closed to give up on the buffered records.
+	done        chan struct{} // closed once the publishing goroutine returned.
+	overflowing bool
+}
+
+// Create the MQTT sink of the configured broker and start connecting to it.
+//
+// The records are published under the name of the site or, without one, under the hostname
+// of the radarcape.
+func NewMqttSink(config Config, clock Clock) (*MqttSink, error) {
+	mqtt_config := config.Mqtt
+	tls_config, err := mqtt_config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+	// Validate makes sure that the durations can be parsed.
+	connect_timeout, _ := parseUploadDuration(mqtt_config.Connect_timeout)
+	keep_alive, _ := parseUploadDuration(mqtt_config.Keep_alive)
+
+	site := config.Site.Name
+	if site == "" {
+		site = config.Radarcape_hostname
+	}
+	sink := &MqttSink{
+		mqtt_config: mqtt_config,
+		clock:       clock,
+		site:        mqttTopicLevel(site),
+		buffer:      make(chan mqttMessage, mqtt_config.Buffer_size),
+		connected:   make(chan struct{}, 1),
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	client_id := mqtt_config.Client_id
+	if client_id == "" {
+		client_id = defaultMqttClientId()
+	}
+	options := mqtt.NewClientOptions().
+		AddBroker(mqtt_config.brokerUrl()).
+		SetClientID(client_id).
+		SetUsername(mqtt_config.Username).
+		SetPassword(mqtt_config.Password).
+		SetTLSConfig(tls_config).
+		SetConnectTimeout(connect_timeout).
+		SetKeepAlive(keep_alive).
+		SetWriteTimeout(mqttPublishTimeout).
+		SetCleanSession(true).
+		SetAutoReconnect(true).
+		SetMaxReconnectInterval(mqttMaxRetryDelay).
+		SetOnConnectHandler(sink.onConnect).
+		SetConnectionLostHandler(sink.onConnectionLost)
+	sink.client = mqtt.NewClient(options)
+
+	metrics.Set("mqtt_buffered", expvar.Func(func() any { return len(sink.buffer) }))
+
+	go sink.run()
+	return sink, nil
+}
+
+// Get the topic of a record.
+func (sink *MqttSink) topic(record Record) string {
+	return sink.mqtt_config.Topic_prefix + "/" + sink.site + "/" + mqttTopicLevel(record.Typ) + "/" +
+		mqttTopicLevel(record.Hex)
+}
+
+// Add a record to the offline buffer. The oldest record is dropped if the buffer is full.
+func (sink *MqttSink) Publish(record Record) {
+	payload, err := json.Marshal(record)
+	if err != nil {
+		mqtt_publish_errors_counter.Add(1)
+		mqtt_log.Warn("failed to encode the record.", "hex", record.Hex, "err", err)
+		return
+	}
+	message := mqttMessage{topic: sink.topic(record), payload: payload}
+
+	dropped := false
+	for pushed := false; !pushed; {
+		select {
+		case sink.buffer <- message:
+			pushed = true
+		default:
+			// The publishing goroutine may take a record in the meantime, hence the loop.
+			select {
+			case <-sink.buffer:
+				mqtt_dropped_counter.Add(1)
+				dropped = true
+			default:
+			}
+		}
+	}
+
+	if dropped && !sink.overflowing {
+		sink.overflowing = true
+		mqtt_log.WarnSevere("the MQTT offline buffer is full. Dropping the oldest records.",
+			"buffer_size", cap(sink.buffer))
+	} else if !dropped && sink.overflowing && len(sink.buffer) < cap(sink.buffer)/2 {
+		sink.overflowing = false
+		mqtt_log.Info("the MQTT offline buffer is draining again.", "dropped_total", mqtt_dropped_counter.Value())
+	}
+}
+
+// Send the buffered records and disconnect from the broker. Records which can't be sent
+// within mqttCloseTimeout are lost. Publish must not be called afterwards.
+func (sink *MqttSink) Close() error {
+	close(sink.buffer)
+	timer := sink.clock.NewTimer(mqttCloseTimeout)
+	defer timer.Stop()
+	select {
+	case <-sink.done:
+	case <-timer.C():
+		close(sink.stop)
+		mqtt_log.Warn("timed out sending the buffered records to the MQTT broker.", "unsent", len(sink.buffer))
+	}
+	sink.client.Disconnect(250)
+	mqtt_connected_gauge.Set(0)
+	return nil
+}
+
+// Publishing goroutine.
+//
+// Connects to the broker and sends the buffered records in order. A record which can't be
+// sent is retried once the client is connected again.
+func (sink *MqttSink) run() {
+	defer close(sink.done)
+
+	if !sink.connect() {
+		return
+	}
+
+	for message := range sink.buffer {
+		for !sink.send(message) {
+			retry_timer := sink.clock.NewTimer(mqttRetryDelay)
+			select {
+			case <-sink.connected:
+			case <-retry_timer.C():
+			case <-sink.stop:
+				retry_timer.Stop()
+				return
+			}
+			retry_timer.Stop()
+		}
+	}
+}
+
+// Establish the first connection to the broker. Afterwards the client reconnects on its own.
+// Returns false if the sink was stopped in the meantime.
+func (sink *MqttSink) connect() bool {
+	delay := mqttRetryDelay
+	for {
+		token := sink.client.Connect()
+		token.Wait()
+		err := token.Error()
+		if err == nil {
+			return true
+		}
+		mqtt_log.Warn("failed to connect to the MQTT broker. Buffering the records.",
+			"broker", sink.mqtt_config.Broker, "retry_in", delay, "err", err)
+
+		retry_timer := sink.clock.NewTimer(delay)
+		select {
+		case <-retry_timer.C():
+		case <-sink.stop:
+			retry_timer.Stop()
+			return false
+		}
+		if delay *= 2; delay > mqttMaxRetryDelay {
+			delay = mqttMaxRetryDelay
+		}
+	}
+}
+
+// Publish a message and wait until the broker received it (for QoS 1 and 2). Returns false
+// if it has to be sent again.
+func (sink *MqttSink) send(message mqttMessage) bool {
+	if !sink.client.IsConnectionOpen() {
+		return false
+	}
+	token := sink.client.Publish(message.topic, byte(sink.mqtt_config.Qos), sink.mqtt_config.Retain, message.payload)
+	var err error
+	if token.WaitTimeout(mqttPublishTimeout) {
+		err = token.Error()
+	} else {
+		err = errors.New("timed out waiting for the broker")
+	}
+	if err != nil {
+		mqtt_publish_errors_counter.Add(1)
+		mqtt_log.Debug("failed to publish a record. Retrying.", "topic", message.topic, "err", err)
+		return false
+	}
+	mqtt_published_counter.Add(1)
+	return true
+}
+
+func (sink *MqttSink) onConnect(client mqtt.Client) {
+	mqtt_connected_gauge.Set(1)
+	mqtt_log.Info("connected to the MQTT broker.", "broker", sink.mqtt_config.Broker, "buffered", len(sink.buffer))
+	select {
+	case sink.connected <- struct{}{}:
+	default:
+	}
+}
+
+func (sink *MqttSink) onConnectionLost(client mqtt.Client, err error) {
+	mqtt_connected_gauge.Set(0)
+	mqtt_log.Warn("lost the connection to the MQTT broker. Buffering the records until it is back.",
+		"broker", sink.mqtt_config.Broker, "err", err)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testMqttBroker is a minimal MQTT broker which accepts the user radar and keeps the
+// messages which are published to it.
+type testMqttBroker struct {
+	listener net.Listener
+	messages chan *packets.PublishPacket
+
+	mu          sync.Mutex
+	connections []net.Conn
+}
+
+// Start a broker on `address`, e.g. 127.0.0.1:0 for a free port.
+func startTestMqttBroker(t *testing.T, address string) *testMqttBroker {
+	t.Helper()
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broker := &testMqttBroker{listener: listener, messages: make(chan *packets.PublishPacket, 100)}
+	t.Cleanup(broker.close)
+	go broker.serve()
+	return broker
+}
+
+func (broker *testMqttBroker) serve() {
+	for {
+		conn, err := broker.listener.Accept()
+		if err != nil {
+			return
+		}
+		broker.mu.Lock()
+		broker.connections = append(broker.connections, conn)
+		broker.mu.Unlock()
+		go broker.handle(conn)
+	}
+}
+
+// Answer the packets of a client until it disconnects.
+func (broker *testMqttBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	for {
+		packet, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		var reply packets.ControlPacket
+		switch packet := packet.(type) {
+		case *packets.ConnectPacket:
+			connack := packets.NewControlPacket(packets.Connack).(*packets.ConnackPacket)
+			if packet.Username != "radar" || string(packet.Password) != "secret" {
+				connack.ReturnCode = packets.ErrRefusedBadUsernameOrPassword
+			}
+			reply = connack
+		case *packets.PublishPacket:
+			broker.messages <- packet
+			if packet.Qos == 1 {
+				puback := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				puback.MessageID = packet.MessageID
+				reply = puback
+			}
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+		if reply != nil {
+			if err := reply.Write(conn); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (broker *testMqttBroker) close() {
+	broker.listener.Close()
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	for _, conn := range broker.connections {
+		conn.Close()
+	}
+}
+
+// Wait for the next message which is published to the broker.
+func (broker *testMqttBroker) nextMessage(t *testing.T) *packets.PublishPacket {
+	t.Helper()
+	select {
+	case message := <-broker.messages:
+		return message
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a message")
+		return nil
+	}
+}
+
+// Check the topic and the payload of a published record.
+func checkMqttMessage(t *testing.T, message *packets.PublishPacket, poll_seq uint64) {
+	t.Helper()
+	if message.TopicName != "radarcape/Zurich/A320/4b1805" {
+		t.Errorf("published to %s", message.TopicName)
+	}
+	var record Record
+	if err := json.Unmarshal(message.Payload, &record); err != nil {
+		t.Fatalf("invalid payload %s: %s", message.Payload, err)
+	}
+	if record.Poll_seq != poll_seq || record.Fli != "SWR123" {
+		t.Errorf("published the record %+v, expected the one of poll %d", record, poll_seq)
+	}
+	checkRecordTimes(t, record, testRecord(poll_seq))
+}
+
+func newTestMqttConfig(t *testing.T, address string) Config {
+	return newTestConfig(t, func(config *Config) {
+		config.Site.Name = "Zurich"
+		config.Mqtt = MqttConfig{Broker: "tcp://" + address, Username: "radar", Password: "secret", Qos: 1}
+	})
+}
+
+func TestMqttSinkPublishesTheRecords(t *testing.T) {
+	broker := startTestMqttBroker(t, "127.0.0.1:0")
+	sink, err := NewMqttSink(newTestMqttConfig(t, broker.listener.Addr().String()), RealClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for poll_seq := uint64(1); poll_seq <= 3; poll_seq++ {
+		sink.Publish(testRecord(poll_seq))
+	}
+	for poll_seq := uint64(1); poll_seq <= 3; poll_seq++ {
+		message := broker.nextMessage(t)
+		checkMqttMessage(t, message, poll_seq)
+		if message.Qos != 1 {
+			t.Errorf("published with QoS %d", message.Qos)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMqttSinkBuffersTheRecordsUntilTheBrokerIsReachable(t *testing.T) {
+	// Reserve a port on which the broker is started later on.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	clock := NewFakeClock(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC))
+	config := newTestMqttConfig(t, address)
+	config.Mqtt.Buffer_size = 3
+	sink, err := NewMqttSink(config, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The buffer keeps the latest records.
+	for poll_seq := uint64(1); poll_seq <= 5; poll_seq++ {
+		sink.Publish(testRecord(poll_seq))
+	}
+	waitUntil(t, "the first connection attempt failed", func() bool { return clock.Waiters() > 0 })
+
+	broker := startTestMqttBroker(t, address)
+	clock.Advance(mqttRetryDelay)
+	for poll_seq := uint64(3); poll_seq <= 5; poll_seq++ {
+		checkMqttMessage(t, broker.nextMessage(t), poll_seq)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -7,113 +7,631 @@ package main
 import (
 	"encoding/csv"
 	"errors"
+	"expvar"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// WriteConfig groups the parameters which trade off the number of write calls against the
+// amount of data which is lost if the program or the machine crashes.
+type WriteConfig struct {
+	Flush_records  int    `yaml:"flush_records"`  // flush a file once this many records are buffered. 0 disables.
+	Flush_interval string `yaml:"flush_interval"` // flush all the files at this interval, e.g. 1s. off disables.
+	Fsync_interval string `yaml:"fsync_interval"` // fsync all the files at this interval, e.g. 30s. off disables.
+}
+
+// Parse an interval of the WriteConfig. Returns zero if the interval is turned off.
+func parseWriteInterval(interval string) (time.Duration, error) {
+	switch strings.TrimSpace(interval) {
+	case "", "0", "off":
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, err
+	}
+	if duration < 0 {
+		return 0, fmt.Errorf("interval %s must not be negative", duration)
+	}
+	return duration, nil
+}
+
+// sinkRetryDelay is the time after which the processor retries to write to the csv files
+// after a failure.
+const sinkRetryDelay time.Duration = 30 * time.Second
+
+// Counters of the processor.
+var (
+	processor_written_counter  = new(expvar.Int)
+	processor_failures_counter = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("processor_written", processor_written_counter)
+	metrics.Set("processor_failures", processor_failures_counter)
+}
+
 // Data processor goroutine.
 //
-// This Goroutine receives data from the receiver goroutine and saves the data to the corresponding
-// output file. If the CsvGenerationLogic goroutine has generated a new set of CSV writers (due to
-// date change), the old csv files are closed and we continue to write into the new csvs.
-func ProcessAircraftData(aircraft_data_chan <-chan AircraftData, config Config, ticker *TimeTicker) {
-	csv_writers_chan := make(chan map[string]CsvWriteCloser)
+// This Goroutine receives data from the receiver goroutine through the write-ahead log and saves the
+// data to the corresponding output file. Every time the ticker fires (due to the start of a new
+// partition), the old csv files are closed and we continue to write into new csvs. If we receive
+// data of an aircraft type which was added by a config reload, the csv file for this type is created
+// on the fly. Once a file exceeds the maximum size, we continue with the next part of the partition.
+//
+// The records are buffered and written to the files once enough records were collected or the flush
+// interval has passed. The files are fsynced at the fsync interval and when they are closed. Records
+// are acknowledged in the write-ahead log once they were written to the files (or fsynced, if an fsync
+// interval is configured). If the files can't be written, the processor stops taking records from the
+// write-ahead log and periodically retries to write the records which were not flushed yet. The data
+// which was written after the last flush is cut off first, so the files don't end up with partial or
+// duplicate rows. Once the ticker is stopped, all the buffered data is written and the function returns.
+func ProcessAircraftData(wal *WriteAheadLog, config_store *ConfigStore, clock Clock, ticker *TimeTicker) {
+	sink := &csvSink{config_store: config_store, buffered: make(map[string][]bufferedRecord)}
 
-	go CsvGenerationLogic(csv_writers_chan, config, ticker)
+	// Records which were taken from the write-ahead log but not acknowledged yet.
+	var unacked []SequencedRecord
 
-	csv_writers := <-csv_writers_chan
+	// The intervals are only read on startup. Validate makes sure that they can be parsed.
+	var flush_chan, fsync_chan <-chan time.Time
+	write_config := config_store.Get().Write
+	if flush_interval, _ := parseWriteInterval(write_config.Flush_interval); flush_interval > 0 {
+		flush_ticker := clock.NewTicker(flush_interval)
+		defer flush_ticker.Stop()
+		flush_chan = flush_ticker.C()
+	}
+	fsync_interval, _ := parseWriteInterval(write_config.Fsync_interval)
+	if fsync_interval > 0 {
+		fsync_ticker := clock.NewTicker(fsync_interval)
+		defer fsync_ticker.Stop()
+		fsync_chan = fsync_ticker.C()
+	}
 
-	LogInfo("ProcessAircraftData: Successfully started worker goroutine.")
+	// Acknowledge the records which were committed to the files.
+	commit := func() {
+		if len(unacked) == 0 {
+			return
+		}
+		committed := unacked[len(unacked)-1].Seq
+		if first_pending, ok := sink.firstPendingSeq(); ok {
+			if first_pending <= unacked[0].Seq {
+				return
+			}
+			committed = first_pending - 1
+		}
+		wal.Ack(committed)
+		for len(unacked) > 0 && unacked[0].Seq <= committed {
+			unacked = unacked[1:]
+		}
+	}
+
+	// Stop taking records until the files can be written again.
+	failed := false
+	var retry_chan <-chan time.Time
+	fail := func(err error) {
+		if !failed {
+			processor_failures_counter.Add(1)
+			processor_log.WarnSevere("failed to write the csv files. The records are kept in the write-ahead log "+
+				"and written once the files can be written again.", "retry_in", sinkRetryDelay, "err", err)
+		} else {
+			processor_log.Warn("still failing to write the csv files.", "retry_in", sinkRetryDelay, "err", err)
+		}
+		failed = true
+		sink.reset()
+		retry_chan = clock.NewTimer(sinkRetryDelay).C()
+	}
+
+	if err := sink.open(config_store.Partitioning().Start(clock.Now())); err != nil {
+		fail(err)
+	}
+
+	processor_log.Info("successfully started worker goroutine.")
 
 	for {
+		// Records are only taken from the write-ahead log while the files can be written.
+		records_chan := wal.C()
+		if failed {
+			records_chan = nil
+		}
+
 		select {
-		case data := <-aircraft_data_chan:
+		case record := <-records_chan:
+
+			unacked = append(unacked, record)
+			if err := sink.write(record, config_store.Get().Write.Flush_records); err != nil {
+				fail(err)
+				continue
+			}
+			if fsync_interval == 0 {
+				commit()
+			}
+
+		case <-flush_chan:
+
+			if failed {
+				continue
+			}
+			if err := sink.flushAll(); err != nil {
+				fail(err)
+				continue
+			}
+			if fsync_interval == 0 {
+				commit()
+			}
+
+		case <-fsync_chan:
+
+			if failed {
+				continue
+			}
+			if err := sink.sync(); err != nil {
+				fail(err)
+				continue
+			}
+			commit()
+
+		case <-retry_chan:
+
+			retry_chan = nil
+			rewritten_records := sink.bufferedRecords()
+			if err := sink.reopen(); err != nil {
+				fail(err)
+				continue
+			}
+			failed = false
+			processor_log.Info("writing the csv files again.", "rewritten_records", rewritten_records)
+			commit()
+
+		case ticker_time, ok := <-ticker.Processor_tick_chan:
 
-			// Write the received data to the relevant csv.
-			if err := csv_writers[data.Typ].Write(data.GetDataAsList()); err != nil {
-				LogError(err)
+			if !failed {
+				if err := sink.close(); err != nil {
+					fail(err)
+				} else {
+					commit()
+				}
 			}
+			if !ok {
+				processor_log.Info("closed csv files. Stopping the worker goroutine.", "uncommitted_records", len(unacked))
+				return
+			}
+
+			processor_log.Debug("csv generation ticker rolled over", "time", ticker_time)
+			start := config_store.Partitioning().Start(clock.Now())
+			if failed {
+				// The files of the new partition are opened on the next retry. The buffered
+				// records are written to the files of their own partition.
+				sink.start = start
+				continue
+			}
+			if err := sink.open(start); err != nil {
+				fail(err)
+				continue
+			}
+			processor_log.Info("changed csv writers.")
+		}
+	}
+}
+
+// csvSink writes the records to the csv files of the current partition.
+type csvSink struct {
+	config_store *ConfigStore
+	start        time.Time // start of the current partition.
+	writers      map[string]CsvWriteCloser
+
+	// Records per aircraft type which were not flushed yet and the files which were written
+	// to since the last fsync. The buffered records are kept after a failure, such that they
+	// are written again once the files can be written.
+	buffered map[string][]bufferedRecord
+	unsynced map[string]bool
+}
+
+// bufferedRecord is a record which was not flushed yet together with the start of the
+// partition it belongs to.
+type bufferedRecord struct {
+	SequencedRecord
+	start time.Time
+}
+
+// Open the csv files of all the configured aircraft types for the partition starting at `start`.
+func (sink *csvSink) open(start time.Time) error {
+	config := sink.config_store.Get()
+	sink.start = start
+	sink.unsynced = make(map[string]bool)
+
+	writers, err := GenerateCsvWriters(config.Data_dir, start, sink.config_store.Partitioning(), config.Icao_aircraft_types)
+	sink.writers = writers
+	return err
+}
+
+// Get the writer of an aircraft type. The csv of aircraft types which were added since the last
+// rollover is opened on the fly.
+func (sink *csvSink) writer(aircraft_type string) (CsvWriteCloser, error) {
+	if writer, ok := sink.writers[aircraft_type]; ok {
+		return writer, nil
+	}
+	config := sink.config_store.Get()
+	writers, err := GenerateCsvWriters(config.Data_dir, sink.start, sink.config_store.Partitioning(), []string{aircraft_type})
+	for writer_type, writer := range writers {
+		sink.writers[writer_type] = writer
+	}
+	return writers[aircraft_type], err
+}
+
+// Write a record to the buffer of its csv and flush the buffer once it holds `flush_records`
+// records. A `flush_records` of zero never flushes.
+func (sink *csvSink) write(record SequencedRecord, flush_records int) error {
+	aircraft_type := record.Record.Typ
+	sink.buffered[aircraft_type] = append(sink.buffered[aircraft_type], bufferedRecord{record, sink.start})
+
+	writer, err := sink.writer(aircraft_type)
+	if err != nil {
+		return err
+	}
+	if err := writer.WriteRecord(record.Record); err != nil {
+		return err
+	}
+	processor_written_counter.Add(1)
+
+	if flush_records > 0 && len(sink.buffered[aircraft_type]) >= flush_records {
+		return sink.flush(aircraft_type)
+	}
+	return nil
+}
+
+// Write the buffered records of an aircraft type to its file and continue with the
+// next part if the file got too large.
+func (sink *csvSink) flush(aircraft_type string) error {
+	writer := sink.writers[aircraft_type]
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	delete(sink.buffered, aircraft_type)
+	sink.unsynced[aircraft_type] = true
+
+	config := sink.config_store.Get()
+	partitioning := sink.config_store.Partitioning()
+	if partitioning.Max_size == 0 || writer.Size() < partitioning.Max_size {
+		return nil
+	}
+
+	delete(sink.writers, aircraft_type)
+	delete(sink.unsynced, aircraft_type)
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	next_writer, err := openCsvWriter(getDataFolder(config.Data_dir, writer.Start), aircraft_type,
+		writer.Start, writer.Part+1, partitioning)
+	if err != nil {
+		return err
+	}
+	sink.writers[aircraft_type] = next_writer
+	processor_log.Info("csv file exceeded the maximum size. Continuing with the next part.",
+		"type", aircraft_type, "part", writer.Part+1)
+	return nil
+}
 
-			// Flush the buffer.
-			csv_writers[data.Typ].Flush()
+// Write the buffered records of all the aircraft types to the files.
+func (sink *csvSink) flushAll() error {
+	for aircraft_type := range sink.buffered {
+		if err := sink.flush(aircraft_type); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Commit the files which were written to since the last fsync to the disk.
+func (sink *csvSink) sync() error {
+	for aircraft_type := range sink.unsynced {
+		if err := sink.writers[aircraft_type].Sync(); err != nil {
+			return err
+		}
+		delete(sink.unsynced, aircraft_type)
+	}
+	return nil
+}
+
+// Get the sequence number of the first record which was not flushed yet.
+func (sink *csvSink) firstPendingSeq() (uint64, bool) {
+	first, ok := uint64(0), false
+	for _, records := range sink.buffered {
+		if len(records) > 0 && (!ok || records[0].Seq < first) {
+			first, ok = records[0].Seq, true
+		}
+	}
+	return first, ok
+}
 
-		case new_csv_writers := <-csv_writers_chan:
+// Get the number of records which were not flushed yet.
+func (sink *csvSink) bufferedRecords() int {
+	count := 0
+	for _, records := range sink.buffered {
+		count += len(records)
+	}
+	return count
+}
 
-			for _, writer := range csv_writers {
-				writer.Close()
+// Write all the buffered records and close the files.
+//
+// The files which were closed successfully are removed from the sink, the others are kept
+// such that reset can cut off the data which was written after their last flush.
+func (sink *csvSink) close() error {
+	var first_err error
+	for aircraft_type, writer := range sink.writers {
+		if err := writer.Close(); err != nil {
+			if first_err == nil {
+				first_err = fmt.Errorf("%s: %w", aircraft_type, err)
 			}
-			csv_writers = new_csv_writers
-			LogInfo("ProcessAircraftData: Changed csv writers in processAircaftData goroutine.")
+			continue
 		}
+		delete(sink.writers, aircraft_type)
+		delete(sink.buffered, aircraft_type)
+		delete(sink.unsynced, aircraft_type)
+	}
+	return first_err
+}
+
+// Close the files after a failure.
+//
+// The data which was written after the last flush of a file is cut off, such that the
+// buffered records can be written again without leaving a partial row or a duplicate
+// behind. The flushed data is committed to the disk if possible.
+func (sink *csvSink) reset() {
+	for aircraft_type, writer := range sink.writers {
+		discardCsvWriter(aircraft_type, writer)
+	}
+	sink.writers = nil
+	sink.unsynced = nil
+}
 
+// Cut off the data which was written to a file after its last flush and close the file.
+func discardCsvWriter(aircraft_type string, writer CsvWriteCloser) {
+	if err := writer.Truncate(); err != nil {
+		processor_log.WarnSevere("failed to cut off the unflushed data of the csv file. "+
+			"It may hold a partial or a duplicate row.", "type", aircraft_type, "path", writer.path, "err", err)
 	}
+	writer.Sync()
+	writer.Closer.Close()
 }
 
-// Highlevel CSV generation logic goroutine.
+// Reopen the files of the current partition after a failure and write the buffered records.
 //
-// Every time the provided ticker triggers, we change the CSV writers to a new date.
-func CsvGenerationLogic(csv_writers_chan chan map[string]CsvWriteCloser, config Config, ticker *TimeTicker) {
+// Buffered records of an earlier partition (e.g. if the files failed while they were closed at
+// the rollover) are written to the files of their own partition, which are closed right away.
+func (sink *csvSink) reopen() error {
+	for {
+		start, found := time.Time{}, false
+		for _, records := range sink.buffered {
+			for _, record := range records {
+				if !record.start.Equal(sink.start) {
+					start, found = record.start, true
+				}
+			}
+		}
+		if !found {
+			break
+		}
+		if err := sink.writePartition(start); err != nil {
+			return err
+		}
+	}
+
+	if err := sink.open(sink.start); err != nil {
+		return err
+	}
+	for aircraft_type, records := range sink.buffered {
+		writer, err := sink.writer(aircraft_type)
+		if err != nil {
+			return err
+		}
+		for _, record := range records {
+			if err := writer.WriteRecord(record.Record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := sink.flushAll(); err != nil {
+		return err
+	}
+	return sink.sync()
+}
+
+// Write the buffered records of the partition starting at `start` to its files and close
+// them. The records are removed from the buffer once the files were closed.
+func (sink *csvSink) writePartition(start time.Time) error {
+	records_per_type := make(map[string][]bufferedRecord)
+	aircraft_types := make([]string, 0, len(sink.buffered))
+	for aircraft_type, records := range sink.buffered {
+		for _, record := range records {
+			if record.start.Equal(start) {
+				records_per_type[aircraft_type] = append(records_per_type[aircraft_type], record)
+			}
+		}
+		if len(records_per_type[aircraft_type]) > 0 {
+			aircraft_types = append(aircraft_types, aircraft_type)
+		}
+	}
 
-	csv_writers_chan <- GenerateCsvWriters(time.Now(), config.Icao_aircraft_types)
+	config := sink.config_store.Get()
+	writers, err := GenerateCsvWriters(config.Data_dir, start, sink.config_store.Partitioning(), aircraft_types)
+	for aircraft_type, records := range records_per_type {
+		for _, record := range records {
+			if err != nil {
+				break
+			}
+			err = writers[aircraft_type].WriteRecord(record.Record)
+		}
+	}
+	for aircraft_type, writer := range writers {
+		if err != nil {
+			break
+		}
+		if err = writer.Close(); err != nil {
+			err = fmt.Errorf("%s: %w", aircraft_type, err)
+		}
+	}
+	if err != nil {
+		// The records are written again on the next retry.
+		for aircraft_type, writer := range writers {
+			discardCsvWriter(aircraft_type, writer)
+		}
+		return err
+	}
 
-	// Every time the ticker fires, we generate a new batch of csv files
-	for ticker_time := range ticker.Processor_tick_chan {
-		csv_writers_chan <- GenerateCsvWriters(time.Now(), config.Icao_aircraft_types)
-		if DEBUG {
-			LogInfo("CsvGenerationLogic: ticker rolled over:", ticker_time)
+	for aircraft_type, records := range sink.buffered {
+		remaining := records[:0]
+		for _, record := range records {
+			if !record.start.Equal(start) {
+				remaining = append(remaining, record)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(sink.buffered, aircraft_type)
+		} else {
+			sink.buffered[aircraft_type] = remaining
 		}
 	}
+	processor_log.Info("wrote the buffered records of an earlier partition.", "start", start)
+	return nil
 }
 
 // CSV generator function.
 //
-// This method generates the folder path and the csv files where the data is saved. If
-// a csv is already present for the given day we simply append to said csv, otherwise we generate
-// a new one with the relevant header. We wrap the csv writer and the file in a `CsvWriteCloser` struct
-// in order to close the file properly after writing to it.
-func GenerateCsvWriters(date time.Time, aircrafts []string) map[string]CsvWriteCloser {
-	if DEBUG {
-		LogInfo("GenerateCsvWriters: Generating CSV files")
-	}
+// This method generates the folder path and the csv files where the data of the partition
+// starting at `start` is saved. If a csv is already present for the given partition we simply
+// append to the last part of said csv (unless it exceeds the maximum size), otherwise we generate
+// a new one with the relevant header. We wrap the csv writer and the file in a `CsvWriteCloser`
+// struct in order to close the file properly after writing to it. The writers which could be
+// created are returned even if an error occurs.
+func GenerateCsvWriters(data_dir string, start time.Time, partitioning Partitioning, aircrafts []string,
+) (map[string]CsvWriteCloser, error) {
+	processor_log.Debug("generating csv files", "start", start)
 
 	csv_writers := make(map[string]CsvWriteCloser, len(aircrafts))
 
-	folder_path := getDataFolder(date)
+	folder_path := getDataFolder(data_dir, start)
 
 	if err := createFolder(folder_path); err != nil {
-		LogError(err)
+		return csv_writers, fmt.Errorf("failed to create the data folder %s: %w", folder_path, err)
 	}
 
 	for _, aircraft_type := range aircrafts {
-		file_path := folder_path + "output_file_" + aircraft_type + ".csv"
-		file_does_not_exist := false
-
-		// Check if file at the given file_path already exists.
-		if _, err := os.Stat(file_path); errors.Is(err, os.ErrNotExist) {
-			file_does_not_exist = true
-		} else if err != nil {
-			LogError(err)
+		// Continue with the last part which was written to, e.g. after a restart.
+		part := 0
+		for {
+			_, err := os.Stat(folder_path + partitioning.FileName(aircraft_type, start, part+1))
+			if err != nil {
+				break
+			}
+			part++
+		}
+		file_path := folder_path + partitioning.FileName(aircraft_type, start, part)
+		file_info, err := os.Stat(file_path)
+		if err == nil && partitioning.Max_size > 0 && file_info.Size() >= partitioning.Max_size {
+			part++
+		} else if err == nil && partitioning.Compression.Extension() != "" && !isCompleteDataFile(file_path) {
+			// Appending to a compressed stream which was cut off by a crash would make
+			// the data after the cut unreadable.
+			processor_log.Warn("compressed csv file was not closed properly. Continuing with the next part.",
+				"path", file_path)
+			part++
+		} else if err == nil {
+			// Don't mix rows of different layouts in one file.
+			layout := partitioning.CsvLayout(aircraft_type)
+			matches, empty, err := csvHeaderMatches(file_path, layout.Header())
+			if err != nil {
+				return csv_writers, fmt.Errorf("failed to read the header of %s: %w", file_path, err)
+			}
+			if !matches && !empty {
+				if partitioning.Csv.Header_mismatch == headerMismatchMigrate {
+					processor_log.Warn("the header of the csv file doesn't match the columns. Migrating the file.",
+						"path", file_path)
+					if err := migrateCsvFile(file_path, layout, partitioning.Compression); err != nil {
+						return csv_writers, fmt.Errorf("failed to migrate %s: %w", file_path, err)
+					}
+					if err := updateDayMetadata(folder_path, filepath.Base(file_path), layout,
+						partitioning.Config_hash); err != nil {
+						processor_log.Warn("failed to update the metadata file.", "folder", folder_path, "err", err)
+					}
+				} else {
+					processor_log.Warn("the header of the csv file doesn't match the columns. Continuing with the next part.",
+						"path", file_path)
+					part++
+				}
+			}
 		}
 
-		// Open/Create the CSV file.
-		csv_file, err := os.OpenFile(file_path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
+		csv_writer, err := openCsvWriter(folder_path, aircraft_type, start, part, partitioning)
 		if err != nil {
-			LogError(err)
+			return csv_writers, err
 		}
+		csv_writers[aircraft_type] = csv_writer
+	}
 
-		// Add the csv writer to the writers map.
-		csv_writers[aircraft_type] = CsvWriteCloser{csv.NewWriter(csv_file), csv_file}
+	processor_log.Info("new csv files generated.", "folder", folder_path)
+	return csv_writers, nil
+}
 
-		// If the file was newly created we add the necessary header ot the csv file.
-		if file_does_not_exist {
-			err = csv_writers[aircraft_type].Write(AircraftData{}.GetHeadersAsList())
-			if err != nil {
-				LogError(err)
-			}
-			csv_writers[aircraft_type].Flush()
+// Open the csv file of the given part of a partition for appending.
+//
+// If the file was newly created (or is empty), the header is written to it and the layout
+// is recorded in the metadata file of the day.
+func openCsvWriter(folder_path string, aircraft_type string, start time.Time, part int, partitioning Partitioning,
+) (CsvWriteCloser, error) {
+	file_path := folder_path + partitioning.FileName(aircraft_type, start, part)
+	file_does_not_exist := false
+
+	// Check if file at the given file_path already exists.
+	file_info, err := os.Stat(file_path)
+	if errors.Is(err, os.ErrNotExist) || err == nil && file_info.Size() == 0 {
+		file_does_not_exist = true
+	} else if err != nil {
+		return CsvWriteCloser{}, fmt.Errorf("failed to stat csv file %s: %w", file_path, err)
+	}
+
+	// Open/Create the CSV file.
+	csv_file, err := os.OpenFile(file_path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, os.ModePerm)
+	if err != nil {
+		return CsvWriteCloser{}, fmt.Errorf("failed to open csv file %s: %w", file_path, err)
+	}
+
+	size := &countingWriter{Writer: csv_file}
+	if !file_does_not_exist {
+		size.n = file_info.Size()
+		size.flushed = size.n
+	}
+
+	// Compressed data is appended as a new gzip member or zstd frame.
+	compressor, err := newFrameWriter(size, partitioning.Compression)
+	if err != nil {
+		csv_file.Close()
+		return CsvWriteCloser{}, fmt.Errorf("failed to create the compressor of %s: %w", file_path, err)
+	}
+
+	csv_writer := CsvWriteCloser{Closer: csv_file, Start: start, Part: part, path: file_path, layout: partitioning.CsvLayout(aircraft_type), size: size,
+		compressor: compressor}
+	if compressor != nil {
+		csv_writer.Writer = csv.NewWriter(compressor)
+	} else {
+		csv_writer.Writer = csv.NewWriter(size)
+	}
+
+	// If the file was newly created we add the necessary header ot the csv file.
+	if file_does_not_exist {
+		csv_writer.Write(csv_writer.layout.Header())
+		if err := csv_writer.Flush(); err != nil {
+			csv_writer.Closer.Close()
+			return CsvWriteCloser{}, fmt.Errorf("failed to write csv header to %s: %w", file_path, err)
+		}
+		err := updateDayMetadata(folder_path, filepath.Base(file_path), csv_writer.layout, partitioning.Config_hash)
+		if err != nil {
+			processor_log.Warn("failed to update the metadata file.", "folder", folder_path, "err", err)
 		}
 	}
 
-	LogInfo("GenerateCsvWriters: New CSV files generated.")
-	return csv_writers
+	return csv_writer, nil
 }
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Check the lines of a csv file: the header followed by the records of the given flights.
+func checkCsvFile(t *testing.T, file_path string, flights ...string) {
+	t.Helper()
+	content, err := ioutil.ReadFile(file_path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != len(flights)+1 {
+		t.Fatalf("%s holds %d records, expected %d:\n%s", file_path, len(lines)-1, len(flights), content)
+	}
+	for i, flight := range flights {
+		if !strings.Contains(lines[i+1], flight) {
+			t.Errorf("record %d of %s is %q, expected the flight %s", i+1, file_path, lines[i+1], flight)
+		}
+	}
+}
+
+// Run the processor and the uploader on a fake clock for several days in Zurich, including
+// the 23h day of 2024-03-31. Every day gets its own files which are uploaded at 03:00 of the
+// next day.
+func TestProcessorAndUploaderOverSeveralDays(t *testing.T) {
+	zurich := loadZurich(t)
+	config := newTestConfig(t, func(config *Config) {
+		config.Timezone = "Europe/Zurich"
+		config.Write = WriteConfig{Flush_records: 1, Flush_interval: "off"}
+	})
+	config_store := NewConfigStore(config)
+	clock := NewFakeClock(time.Date(2024, 3, 29, 12, 0, 0, 0, zurich))
+
+	wal, err := OpenWriteAheadLog(config.State_dir+"wal/", config.Wal, clock, config.Write.walSyncInterval())
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheduler := NewScheduler(clock, config.State_dir+"scheduler_state.json")
+	rollover_schedule, err := config.ParsedSchedule(config.Schedule.Rollover)
+	if err != nil {
+		t.Fatal(err)
+	}
+	upload_schedule, err := config.ParsedSchedule(config.Schedule.Upload)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	processor_done := make(chan struct{})
+	go func() {
+		ProcessAircraftData(wal, config_store, clock, scheduler.Add("rollover", rollover_schedule, false))
+		close(processor_done)
+	}()
+	uploader_done := make(chan struct{})
+	go func() {
+		UploadFilesToSharedFolder(config_store, clock, scheduler.Add("upload", upload_schedule, true))
+		close(uploader_done)
+	}()
+
+	// Only the rollover and the upload tickers wait for the clock.
+	waitForTickers := func() {
+		waitUntil(t, "the tickers wait for their next run", func() bool { return clock.Waiters() == 2 })
+	}
+
+	days := []time.Time{
+		time.Date(2024, 3, 29, 0, 0, 0, 0, zurich),
+		time.Date(2024, 3, 30, 0, 0, 0, 0, zurich),
+		time.Date(2024, 3, 31, 0, 0, 0, 0, zurich),
+		time.Date(2024, 4, 1, 0, 0, 0, 0, zurich),
+	}
+	poll_seq := uint64(0)
+	for _, day := range days {
+		// A record of an A320 at noon, and of a B738 on the 23h day.
+		clock.Set(day.Add(12 * time.Hour))
+		records := []Record{NewRecord(AircraftData{Hex: "4b1805", Typ: "A320", Fli: "SWR" + day.Format("0102")},
+			clock.Now(), 0, poll_seq+1)}
+		if day.Day() == 31 {
+			records = append(records, NewRecord(AircraftData{Hex: "4b1806", Typ: "B738", Fli: "EDW0331"},
+				clock.Now(), 0, poll_seq+2))
+		}
+		poll_seq += uint64(len(records))
+		if err := wal.Append(records); err != nil {
+			t.Fatal(err)
+		}
+		// The records have to be written before the rollover, otherwise they go to the files of
+		// the next day.
+		waitUntil(t, "the records of "+day.Format(dateFormatString)+" are written", func() bool {
+			for _, record := range records {
+				content, _ := ioutil.ReadFile(getDataFolder(config.Data_dir, day) + "output_file_" + record.Typ + ".csv")
+				if !strings.Contains(string(content), record.Fli) {
+					return false
+				}
+			}
+			return true
+		})
+
+		// The files of the next day are started at 00:00:10.
+		next_day := time.Date(day.Year(), day.Month(), day.Day()+1, 0, 0, 0, 0, zurich)
+		waitForTickers()
+		clock.Set(next_day.Add(10 * time.Second))
+		waitUntil(t, "the files of "+next_day.Format(dateFormatString)+" are started", func() bool {
+			_, err := os.Stat(getDataFolder(config.Data_dir, next_day) + "output_file_A320.csv")
+			return err == nil
+		})
+
+		// The day is uploaded at 03:00 of the next day and removed from the data directory.
+		waitForTickers()
+		clock.Set(time.Date(next_day.Year(), next_day.Month(), next_day.Day(), 3, 0, 0, 0, zurich))
+		waitUntil(t, day.Format(dateFormatString)+" is uploaded", func() bool {
+			_, err := os.Stat(getDataFolder(config.Data_dir, day))
+			return os.IsNotExist(err)
+		})
+	}
+
+	scheduler.Stop()
+	<-processor_done
+	<-uploader_done
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	ledger, err := readUploadLedger(config.State_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, day := range days {
+		upload_folder_path := getDataFolder(config.Upload_folder_path, day)
+		checkCsvFile(t, upload_folder_path+"output_file_A320.csv", "SWR"+day.Format("0102"))
+		if day.Day() == 31 {
+			checkCsvFile(t, upload_folder_path+"output_file_B738.csv", "EDW0331")
+		} else {
+			checkCsvFile(t, upload_folder_path+"output_file_B738.csv")
+		}
+		if _, err := os.Stat(upload_folder_path + manifestFileName); err != nil {
+			t.Errorf("the manifest of %s was not uploaded: %s", day.Format(dateFormatString), err)
+		}
+		if uploaded := ledger[day.Format(dateFormatString)]; uploaded == nil || !uploaded.complete {
+			t.Errorf("the upload of %s is not recorded: %+v", day.Format(dateFormatString), uploaded)
+		}
+	}
+
+	// The files of the current day stay in the data directory.
+	today_folder_path := getDataFolder(config.Data_dir, time.Date(2024, 4, 2, 0, 0, 0, 0, zurich))
+	checkCsvFile(t, today_folder_path+"output_file_A320.csv")
+	if _, err := os.Stat(getDataFolder(config.Upload_folder_path, time.Date(2024, 4, 2, 0, 0, 0, 0, zurich))); !os.IsNotExist(err) {
+		t.Errorf("the current day was uploaded: %v", err)
+	}
+}
+
+// After a failure, the data which was written after the last flush is cut off and only the
+// records which were not flushed are written again, to the files of their own partition.
+func TestCsvSinkRewritesBufferedRecordsAfterFailure(t *testing.T) {
+	config := newTestConfig(t, nil)
+	sink := &csvSink{config_store: NewConfigStore(config), buffered: make(map[string][]bufferedRecord)}
+	day := time.Date(2024, 3, 30, 0, 0, 0, 0, time.UTC)
+	next_day := day.AddDate(0, 0, 1)
+	if err := sink.open(day); err != nil {
+		t.Fatal(err)
+	}
+
+	record := func(seq uint64, flight string) SequencedRecord {
+		return SequencedRecord{Seq: seq, Record: NewRecord(AircraftData{Hex: "4b1805", Typ: "A320", Fli: flight},
+			day.Add(12*time.Hour), 0, seq)}
+	}
+	if err := sink.write(record(1, "SWR1"), 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.write(record(2, "SWR2"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if first_pending, ok := sink.firstPendingSeq(); !ok || first_pending != 2 {
+		t.Fatalf("the first pending record is %d (%t), expected 2", first_pending, ok)
+	}
+
+	// A failed write leaves a partial row behind, and the files fail until after the rollover.
+	a320_path := getDataFolder(config.Data_dir, day) + "output_file_A320.csv"
+	file, err := os.OpenFile(a320_path, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteString("4b1805,SWR"); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	sink.reset()
+	sink.start = next_day
+
+	if err := sink.reopen(); err != nil {
+		t.Fatal(err)
+	}
+	if buffered := sink.bufferedRecords(); buffered != 0 {
+		t.Errorf("%d records are still buffered", buffered)
+	}
+	if err := sink.close(); err != nil {
+		t.Fatal(err)
+	}
+	checkCsvFile(t, a320_path, "SWR1", "SWR2")
+	checkCsvFile(t, getDataFolder(config.Data_dir, next_day)+"output_file_A320.csv")
+}
+
+// An existing file whose header doesn't match the configured columns is either continued in
+// the next part or rewritten in the new layout, and the layout is recorded in the metadata file.
+func TestGenerateCsvWritersHandlesHeaderMismatch(t *testing.T) {
+	tests := []struct {
+		header_mismatch string
+		file_name       string // file which is written to.
+		part            int
+		existing        string // content of the existing file afterwards.
+	}{
+		{headerMismatchRoll, "output_file_A320_001.csv", 1, "Hex,Fli,Alt\n4b1805,SWR1,35000\n"},
+		{headerMismatchMigrate, "output_file_A320.csv", 0, "Hex,Fli\n4b1805,SWR1\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.header_mismatch, func(t *testing.T) {
+			config := newTestConfig(t, func(config *Config) {
+				config.Csv.Columns = []string{"hex", "fli"}
+				config.Csv.Header_mismatch = test.header_mismatch
+			})
+			day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+			folder_path := getDataFolder(config.Data_dir, day)
+			writeTestFile(t, folder_path+"output_file_A320.csv", "Hex,Fli,Alt\n4b1805,SWR1,35000\n")
+
+			writers, err := GenerateCsvWriters(config.Data_dir, day, config.Partitioning(), []string{"A320"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			writer := writers["A320"]
+			if writer.Part != test.part {
+				t.Errorf("writing to part %d, expected %d", writer.Part, test.part)
+			}
+			if err := writer.WriteRecord(NewRecord(AircraftData{Hex: "4b1806", Typ: "A320", Fli: "SWR2"}, day, 0, 1)); err != nil {
+				t.Fatal(err)
+			}
+			if err := writer.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			if test.part > 0 {
+				checkCsvFile(t, folder_path+test.file_name, "4b1806,SWR2")
+			} else {
+				test.existing += "4b1806,SWR2\n"
+			}
+			if content, err := ioutil.ReadFile(folder_path + "output_file_A320.csv"); err != nil || string(content) != test.existing {
+				t.Errorf("the existing file holds %q (%v), expected %q", content, err, test.existing)
+			}
+
+			data, err := ioutil.ReadFile(folder_path + metadataFileName)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var metadata dayMetadata
+			if err := json.Unmarshal(data, &metadata); err != nil {
+				t.Fatal(err)
+			}
+			file_metadata, ok := metadata.Files[test.file_name]
+			if !ok || len(metadata.Files) != 1 {
+				t.Fatalf("the metadata describes %v, expected %s", metadata.Files, test.file_name)
+			}
+			if file_metadata.Schema_version != csvSchemaVersion || file_metadata.Listener_version != version ||
+				file_metadata.Config_hash != config.Hash() || file_metadata.Header != csvHeaderGo ||
+				!reflect.DeepEqual(file_metadata.Columns, []string{"hex", "fli"}) {
+				t.Errorf("the metadata of %s is %+v", test.file_name, file_metadata)
+			}
+			if metadata.Schema_version != csvSchemaVersion || metadata.Config_hash != config.Hash() {
+				t.Errorf("the metadata of the day is %+v", metadata)
+			}
+		})
+	}
+}
@@ -0,0 +1,287 @@
+// Record queue.
+//
+// Buffers the records between the receiver and the processor. If the processor can't keep
+// up (e.g. because writes to a network share stall), the overflow policy decides whether
+// the receiver blocks, records are dropped, or the records are spilled to a file on disk
+// and fed to the processor once it caught up.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// QueueConfig groups the parameters of the queue between the receiver and the processor.
+type QueueConfig struct {
+	Size            int    `yaml:"size"`            // number of records which are buffered in memory.
+	Overflow_policy string `yaml:"overflow_policy"` // block (default), drop-oldest, drop-newest or spill.
+}
+
+// Overflow policies of the record queue.
+const (
+	overflowBlock      string = "block"
+	overflowDropOldest string = "drop-oldest"
+	overflowDropNewest string = "drop-newest"
+	overflowSpill      string = "spill"
+)
+
+// spillRetryDelay is the time after which reading the spill file is retried after a failure.
+const spillRetryDelay time.Duration = 5 * time.Second
+
+// Counters of the record queue.
+var (
+	queue_received_counter       = new(expvar.Int)
+	queue_dropped_oldest_counter = new(expvar.Int)
+	queue_dropped_newest_counter = new(expvar.Int)
+	queue_spilled_counter        = new(expvar.Int)
+	queue_saturation_counter     = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("queue_received", queue_received_counter)
+	metrics.Set("queue_dropped_oldest", queue_dropped_oldest_counter)
+	metrics.Set("queue_dropped_newest", queue_dropped_newest_counter)
+	metrics.Set("queue_spilled", queue_spilled_counter)
+	metrics.Set("queue_saturations", queue_saturation_counter)
+}
+
+// RecordQueue is a bounded queue of records with a single producer (the receiver) and
+// a single consumer (the processor).
+type RecordQueue struct {
+	records         chan Record
+	overflow_policy string
+	saturated       bool
+	clock           Clock
+
+	// State of the spill file. Once a record was spilled, all the following records are
+	// spilled as well until the file is drained, such that the order is preserved.
+	mu               sync.Mutex
+	cond             *sync.Cond
+	spilling         bool
+	closing          bool // the channel is closed once the spill file is drained.
+	spill_path       string
+	spill_file       *os.File
+	spill_input_file *os.File
+	spill_input      *bufio.Reader
+}
+
+// Create a record queue. `spill_path` is the file which is used by the spill policy, and
+// failed reads of it are retried on `clock`.
+//
+// Records which were spilled before a restart are fed to the processor first.
+func NewRecordQueue(queue_config QueueConfig, spill_path string, clock Clock) (*RecordQueue, error) {
+	queue := &RecordQueue{
+		records:         make(chan Record, queue_config.Size),
+		overflow_policy: queue_config.Overflow_policy,
+		clock:           clock,
+		spill_path:      spill_path,
+	}
+	queue.cond = sync.NewCond(&queue.mu)
+
+	metrics.Set("queue_length", expvar.Func(func() any { return len(queue.records) }))
+	metrics.Set("queue_capacity", expvar.Func(func() any { return cap(queue.records) }))
+
+	if queue.overflow_policy != overflowSpill {
+		return queue, nil
+	}
+
+	spill_file, err := os.OpenFile(spill_path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	spill_input, err := os.Open(spill_path)
+	if err != nil {
+		spill_file.Close()
+		return nil, err
+	}
+	queue.spill_file = spill_file
+	queue.spill_input_file = spill_input
+	queue.spill_input = bufio.NewReader(spill_input)
+
+	if info, err := spill_file.Stat(); err == nil && info.Size() > 0 {
+		queue_log.Info("replaying records which were spilled before the restart.", "path", spill_path, "bytes", info.Size())
+		queue.spilling = true
+	}
+
+	go queue.drainSpillFile()
+	return queue, nil
+}
+
+// Get the channel from which the consumer receives the records.
+func (queue *RecordQueue) C() <-chan Record {
+	return queue.records
+}
+
+// Add a record to the queue and apply the overflow policy if the queue is full.
+func (queue *RecordQueue) Push(record Record) {
+	queue_received_counter.Add(1)
+
+	if queue.overflow_policy == overflowSpill {
+		queue.pushOrSpill(record)
+		return
+	}
+
+	select {
+	case queue.records <- record:
+		queue.checkSaturation()
+		return
+	default:
+	}
+
+	queue.checkSaturation()
+	switch queue.overflow_policy {
+	case overflowDropNewest:
+		queue_dropped_newest_counter.Add(1)
+
+	case overflowDropOldest:
+		// The consumer may take records in the meantime, so we retry until the record fits.
+		for {
+			select {
+			case queue.records <- record:
+				return
+			default:
+			}
+			select {
+			case <-queue.records:
+				queue_dropped_oldest_counter.Add(1)
+			default:
+			}
+		}
+
+	default:
+		queue.records <- record
+	}
+}
+
+// Close the queue once the producer has stopped. The channel of the consumer is closed as
+// soon as the records which were spilled to disk have been fed to it, so the consumer can
+// drain the queue. Push must not be called afterwards.
+func (queue *RecordQueue) Close() {
+	if queue.overflow_policy != overflowSpill {
+		close(queue.records)
+		return
+	}
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	queue.closing = true
+	queue.cond.Signal()
+}
+
+// Log a warning once the queue is full and once it recovered (i.e. is less than half full).
+func (queue *RecordQueue) checkSaturation() {
+	length := len(queue.records)
+	if !queue.saturated && length == cap(queue.records) {
+		queue.saturated = true
+		queue_saturation_counter.Add(1)
+		queue_log.WarnSevere("the record queue is full. The processor can't keep up with the receiver.",
+			"capacity", cap(queue.records), "overflow_policy", queue.overflow_policy,
+			"dropped_oldest", queue_dropped_oldest_counter.Value(), "dropped_newest", queue_dropped_newest_counter.Value())
+	} else if queue.saturated && length < cap(queue.records)/2 {
+		queue.saturated = false
+		queue_log.Info("the record queue recovered.", "length", length, "capacity", cap(queue.records),
+			"dropped_oldest", queue_dropped_oldest_counter.Value(), "dropped_newest", queue_dropped_newest_counter.Value(),
+			"spilled", queue_spilled_counter.Value())
+	}
+}
+
+func (queue *RecordQueue) pushOrSpill(record Record) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	if !queue.spilling {
+		select {
+		case queue.records <- record:
+			queue.checkSaturation()
+			return
+		default:
+		}
+		queue.checkSaturation()
+		queue.spilling = true
+		queue_log.Warn("spilling records to disk.", "path", queue.spill_path)
+	}
+
+	line, err := json.Marshal(record)
+	if err == nil {
+		_, err = queue.spill_file.Write(append(line, '\n'))
+	}
+	if err != nil {
+		// There is no space left anywhere, so the record is lost.
+		queue_dropped_newest_counter.Add(1)
+		queue_log.Warn("failed to spill a record to disk. Dropping it.", "hex", record.Hex, "err", err)
+		return
+	}
+	queue_spilled_counter.Add(1)
+	queue.cond.Signal()
+}
+
+// Feed the spilled records to the consumer and truncate the spill file once it is drained.
+// Closes the channel of the consumer once the queue was closed and the spill file is drained.
+func (queue *RecordQueue) drainSpillFile() {
+	// The start of a line which was read before a read error.
+	var partial_line []byte
+	for {
+		queue.mu.Lock()
+		for !queue.spilling && !queue.closing {
+			queue.cond.Wait()
+		}
+		if !queue.spilling {
+			// The queue was closed and everything was fed to the consumer.
+			queue.mu.Unlock()
+			queue.spill_input_file.Close()
+			queue.spill_file.Close()
+			close(queue.records)
+			return
+		}
+
+		line, err := queue.spill_input.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(line) == 0 && len(partial_line) == 0 {
+			// Everything was fed to the consumer. New records go to the channel again.
+			if err := queue.resetSpillFile(); err != nil {
+				queue_log.Warn("failed to truncate the spill file.", "path", queue.spill_path, "err", err)
+			}
+			queue.spilling = false
+			queue_log.Info("drained the spill file.", "path", queue.spill_path)
+			queue.mu.Unlock()
+			continue
+		}
+		queue.mu.Unlock()
+
+		if err != nil && !errors.Is(err, io.EOF) {
+			// The records stay in the spill file, so we keep what was read and try again.
+			partial_line = append(partial_line, line...)
+			queue_log.WarnSevere("failed to read the spill file. Retrying.", "path", queue.spill_path,
+				"retry_in", spillRetryDelay, "err", err)
+			queue.clock.Sleep(spillRetryDelay)
+			continue
+		}
+		line = append(partial_line, line...)
+		partial_line = nil
+
+		var record Record
+		if err := json.Unmarshal(line, &record); err != nil {
+			// A line which was cut off by a crash.
+			queue_log.Warn("skipping a corrupt record in the spill file.", "err", err)
+			continue
+		}
+		queue.records <- record
+	}
+}
+
+// Truncate the spill file and restart reading at its beginning. Expects the lock to be held.
+func (queue *RecordQueue) resetSpillFile() error {
+	if err := queue.spill_file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := queue.spill_input_file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	queue.spill_input.Reset(queue.spill_input_file)
+	return nil
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+// Take `count` records from the queue and return their poll sequence numbers. Fails the test
+// if there are more records in the queue afterwards.
+func takeQueuedRecords(t *testing.T, queue *RecordQueue, count int) []uint64 {
+	t.Helper()
+	poll_seqs := make([]uint64, 0, count)
+	for len(poll_seqs) < count {
+		select {
+		case record := <-queue.C():
+			poll_seqs = append(poll_seqs, record.Poll_seq)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a record after %v", poll_seqs)
+		}
+	}
+	select {
+	case record := <-queue.C():
+		t.Fatalf("got the unexpected record of poll %d after %v", record.Poll_seq, poll_seqs)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return poll_seqs
+}
+
+func checkPollSeqs(t *testing.T, poll_seqs []uint64, expected ...uint64) {
+	t.Helper()
+	if len(poll_seqs) != len(expected) {
+		t.Fatalf("got the records of the polls %v, expected %v", poll_seqs, expected)
+	}
+	for i := range expected {
+		if poll_seqs[i] != expected[i] {
+			t.Fatalf("got the records of the polls %v, expected %v", poll_seqs, expected)
+		}
+	}
+}
+
+// queueCounters holds the values of the counters of the record queue.
+type queueCounters struct {
+	dropped_oldest, dropped_newest, spilled, saturations int64
+}
+
+func readQueueCounters() queueCounters {
+	return queueCounters{
+		dropped_oldest: queue_dropped_oldest_counter.Value(),
+		dropped_newest: queue_dropped_newest_counter.Value(),
+		spilled:        queue_spilled_counter.Value(),
+		saturations:    queue_saturation_counter.Value(),
+	}
+}
+
+// Get the changes of the counters since `start` was read.
+func (start queueCounters) since() queueCounters {
+	now := readQueueCounters()
+	return queueCounters{
+		dropped_oldest: now.dropped_oldest - start.dropped_oldest,
+		dropped_newest: now.dropped_newest - start.dropped_newest,
+		spilled:        now.spilled - start.spilled,
+		saturations:    now.saturations - start.saturations,
+	}
+}
+
+func TestRecordQueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy   string
+		polls    []uint64 // polls of the records which get through.
+		counters queueCounters
+	}{
+		{overflowDropNewest, []uint64{1, 2}, queueCounters{dropped_newest: 2, saturations: 1}},
+		{overflowDropOldest, []uint64{3, 4}, queueCounters{dropped_oldest: 2, saturations: 1}},
+		{overflowSpill, []uint64{1, 2, 3, 4}, queueCounters{spilled: 2, saturations: 1}},
+	}
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			queue, err := NewRecordQueue(QueueConfig{Size: 2, Overflow_policy: test.policy}, t.TempDir()+"/spill.jsonl", RealClock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := readQueueCounters()
+			for poll_seq := uint64(1); poll_seq <= 4; poll_seq++ {
+				queue.Push(testRecord(poll_seq))
+			}
+			checkPollSeqs(t, takeQueuedRecords(t, queue, len(test.polls)), test.polls...)
+			if counters := start.since(); counters != test.counters {
+				t.Errorf("the counters changed by %+v, expected %+v", counters, test.counters)
+			}
+		})
+	}
+}
+
+func TestRecordQueueBlocksUntilThereIsRoom(t *testing.T) {
+	queue, err := NewRecordQueue(QueueConfig{Size: 2, Overflow_policy: overflowBlock}, "", RealClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := readQueueCounters()
+	queue.Push(testRecord(1))
+	queue.Push(testRecord(2))
+
+	pushed := make(chan struct{})
+	go func() {
+		queue.Push(testRecord(3))
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		t.Fatal("the push to the full queue didn't block")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if record := <-queue.C(); record.Poll_seq != 1 {
+		t.Fatalf("got the record of poll %d, expected 1", record.Poll_seq)
+	}
+	<-pushed
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 2), 2, 3)
+	if counters := start.since(); counters != (queueCounters{saturations: 1}) {
+		t.Errorf("the counters changed by %+v, expected a saturation", counters)
+	}
+}
+
+// The saturation warning is raised once per saturation: the queue has to recover to less than
+// half its capacity before it is raised again.
+func TestRecordQueueWarnsOncePerSaturation(t *testing.T) {
+	queue, err := NewRecordQueue(QueueConfig{Size: 4, Overflow_policy: overflowDropNewest}, "", RealClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := readQueueCounters()
+	for poll_seq := uint64(1); poll_seq <= 5; poll_seq++ {
+		queue.Push(testRecord(poll_seq))
+	}
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 4), 1, 2, 3, 4)
+	if counters := start.since(); counters != (queueCounters{dropped_newest: 1, saturations: 1}) {
+		t.Fatalf("the counters changed by %+v, expected a dropped record and a saturation", counters)
+	}
+
+	// The queue recovered, so the next saturation is counted.
+	for poll_seq := uint64(6); poll_seq <= 10; poll_seq++ {
+		queue.Push(testRecord(poll_seq))
+	}
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 4), 6, 7, 8, 9)
+	if counters := start.since(); counters != (queueCounters{dropped_newest: 2, saturations: 2}) {
+		t.Errorf("the counters changed by %+v, expected 2 dropped records and 2 saturations", counters)
+	}
+}
+
+// The records which were spilled before a restart are fed first. A line which was cut off by
+// a crash is skipped, and the spill file is emptied once it is drained.
+func TestRecordQueueDrainsSpillFileWithCutOffLine(t *testing.T) {
+	spill_path := t.TempDir() + "/spill.jsonl"
+	var spilled []byte
+	for _, poll_seq := range []uint64{1, 2} {
+		line, err := jsonLine(testRecord(poll_seq))
+		if err != nil {
+			t.Fatal(err)
+		}
+		spilled = append(spilled, line...)
+	}
+	line, err := jsonLine(testRecord(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	spilled = append(spilled, line[:len(line)/2]...)
+	if err := ioutil.WriteFile(spill_path, spilled, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err := NewRecordQueue(QueueConfig{Size: 2, Overflow_policy: overflowSpill}, spill_path, RealClock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 2), 1, 2)
+	waitUntil(t, "the spill file is emptied", func() bool {
+		info, err := os.Stat(spill_path)
+		return err == nil && info.Size() == 0
+	})
+
+	queue.Push(testRecord(4))
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 1), 4)
+}
+
+// failingOnceReader fails the first read and is at its end afterwards.
+type failingOnceReader struct {
+	failed bool
+}
+
+func (reader *failingOnceReader) Read(p []byte) (int, error) {
+	if reader.failed {
+		return 0, io.EOF
+	}
+	reader.failed = true
+	return 0, errors.New("input/output error")
+}
+
+// A failed read of the spill file is retried after spillRetryDelay on the clock of the queue,
+// and the part of the line which was read before the failure is kept.
+func TestRecordQueueRetriesFailedSpillFileRead(t *testing.T) {
+	clock := NewFakeClock(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC))
+	queue, err := NewRecordQueue(QueueConfig{Size: 2, Overflow_policy: overflowSpill}, t.TempDir()+"/spill.jsonl", clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	line, err := jsonLine(testRecord(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.mu.Lock()
+	queue.spill_input = bufio.NewReader(io.MultiReader(bytes.NewReader(line[:10]), &failingOnceReader{},
+		bytes.NewReader(line[10:])))
+	queue.spilling = true
+	queue.cond.Signal()
+	queue.mu.Unlock()
+
+	waitUntil(t, "the read is retried", func() bool { return clock.Waiters() == 1 })
+	select {
+	case record := <-queue.C():
+		t.Fatalf("got the record of poll %d before the retry", record.Poll_seq)
+	default:
+	}
+	clock.Advance(spillRetryDelay)
+	checkPollSeqs(t, takeQueuedRecords(t, queue, 1), 1)
+}
+
+// Closing the queue closes the channel of the consumer once the queued and spilled records
+// were taken, so none of them are lost on shutdown.
+func TestRecordQueueCloseKeepsQueuedRecords(t *testing.T) {
+	for _, policy := range []string{overflowBlock, overflowSpill} {
+		t.Run(policy, func(t *testing.T) {
+			queue, err := NewRecordQueue(QueueConfig{Size: 2, Overflow_policy: policy}, t.TempDir()+"/spill.jsonl", RealClock)
+			if err != nil {
+				t.Fatal(err)
+			}
+			polls := uint64(2)
+			if policy == overflowSpill {
+				polls = 4
+			}
+			for poll_seq := uint64(1); poll_seq <= polls; poll_seq++ {
+				queue.Push(testRecord(poll_seq))
+			}
+			queue.Close()
+
+			var poll_seqs []uint64
+			for {
+				select {
+				case record, ok := <-queue.C():
+					if !ok {
+						if uint64(len(poll_seqs)) != polls {
+							t.Errorf("got the records of the polls %v before the queue was closed, expected %d", poll_seqs, polls)
+						}
+						return
+					}
+					poll_seqs = append(poll_seqs, record.Poll_seq)
+				case <-time.After(5 * time.Second):
+					t.Fatalf("the queue was not closed after the records of the polls %v", poll_seqs)
+				}
+			}
+		})
+	}
+}
+
+// Encode a record as a line of the spill file.
+func jsonLine(record Record) ([]byte, error) {
+	line, err := json.Marshal(record)
+	return append(line, '\n'), err
+}
@@ -0,0 +1,112 @@
+// Raw archive.
+//
+// Optionally, every aircraft list is archived as it was received from the radarcape, e.g. to
+// replay it later with other aircraft types. The lists of a day are appended to a gzip
+// compressed file <YYYYMMDD>.json.gz in the raw archive folder. Every list is written as a
+// gzip member of its own, so the file is complete after every list and a crash loses at most
+// the list which was being written. The raw archive is an optional output: it is paused
+// while its disk is running low on space.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"os"
+	"time"
+)
+
+// RawArchiveConfig groups the parameters of the raw archive.
+type RawArchiveConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Dir     string `yaml:"dir"` // default: raw/ in the data directory.
+}
+
+// rawArchiveFolderName is the default folder of the raw archive in the data directory.
+const rawArchiveFolderName string = "raw/"
+
+// rawArchiveExtension is the extension of the files of the raw archive.
+const rawArchiveExtension string = ".json.gz"
+
+// RawArchive writes the aircraft lists into the file of their day.
+//
+// It is not safe for concurrent use.
+type RawArchive struct {
+	dir         string
+	day         string // YYYYMMDD
+	file        *os.File
+	gzip_writer *gzip.Writer
+}
+
+// Get the path of the file of the raw archive of a day. Parts after the first one are
+// numbered, e.g. 20240131_1.json.gz.
+func rawArchiveFilePath(dir string, day time.Time, part int) string {
+	if part == 0 {
+		return dir + day.Format(dateFormatString) + rawArchiveExtension
+	}
+	return fmt.Sprintf("%s%s_%d%s", dir, day.Format(dateFormatString), part, rawArchiveExtension)
+}
+
+// Append an aircraft list to the file of the day of `received` in `dir`.
+func (archive *RawArchive) Write(dir string, received time.Time, aircraft_list []byte) error {
+	if archive.file == nil || archive.dir != dir || archive.day != received.Format(dateFormatString) {
+		if err := archive.open(dir, received); err != nil {
+			return err
+		}
+	}
+
+	archive.gzip_writer.Reset(archive.file)
+	if _, err := archive.gzip_writer.Write(append(bytes.TrimSpace(aircraft_list), '\n')); err != nil {
+		return err
+	}
+	return archive.gzip_writer.Close()
+}
+
+// Open the file of the day of `received`, closing the current one.
+func (archive *RawArchive) open(dir string, received time.Time) error {
+	if err := archive.Close(); err != nil {
+		receiver_log.Warn("failed to close the raw archive.", "err", err)
+	}
+	if err := createFolder(dir); err != nil {
+		return err
+	}
+
+	// Continue with the last part of the day, e.g. after a restart.
+	part := 0
+	for {
+		if _, err := os.Stat(rawArchiveFilePath(dir, received, part+1)); err != nil {
+			break
+		}
+		part++
+	}
+	file_path := rawArchiveFilePath(dir, received, part)
+
+	// Appending to a stream which was cut off by a crash would make the data after the cut
+	// unreadable.
+	if _, err := os.Stat(file_path); err == nil && !isCompleteDataFile(file_path) {
+		receiver_log.Warn("raw archive was not closed properly. Continuing with the next part.", "path", file_path)
+		file_path = rawArchiveFilePath(dir, received, part+1)
+	}
+
+	file, err := os.OpenFile(file_path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	archive.dir = dir
+	archive.day = received.Format(dateFormatString)
+	archive.file = file
+	archive.gzip_writer = gzip.NewWriter(nil)
+	return nil
+}
+
+// Close the current file of the archive. The gzip members are complete already.
+func (archive *RawArchive) Close() error {
+	if archive.file == nil {
+		return nil
+	}
+	err := archive.file.Close()
+	archive.file = nil
+	archive.gzip_writer = nil
+	return err
+}
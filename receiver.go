@@ -7,6 +7,7 @@ package main
 
 import (
 	"encoding/json"
+	"io/ioutil"
 	"net/http"
 	"time"
 )
@@ -17,67 +18,133 @@ import (
 // yields us a json file with the current list of all the observable aircrafts and their respective infos.
 // We then decode the json into a slice of AircraftData structs and subsequently filter out all the messages
 // which are either not of interest to us or are duplicates. The remaining messages are then posted into a
-// channel which sends them to a worker goroutine
-func GetAircraftsFromHttp(aircraft_data_channel chan<- AircraftData,
-	config Config, ticker *time.Ticker,
+// queue which sends them to a worker goroutine, together with the time of the reception (wall clock and
+// monotonic), the GPS time of the message and the number of the poll. The hostname and the aircraft types are taken
+// from the config store on every tick such that a config reload takes effect immediately. If the raw archive is
+// enabled, the aircraft lists are archived as they were received unless the disk is running low on space.
+// The goroutine returns once `stop` is closed, such that the queue can be closed and drained.
+func GetAircraftsFromHttp(aircraft_data_queue *RecordQueue,
+	config_store *ConfigStore, clock Clock, ticker Ticker, stop <-chan struct{},
 ) {
 
 	http_client := &http.Client{}
 
 	connection_established := false
 
+	// Number of the successful polls since the start of the listener. The monotonic receive
+	// time is measured from the start of the goroutine, so it is not affected by changes of
+	// the wall clock.
+	var poll_seq uint64
+	listener_start := clock.Now()
+
 	// Hash map (i.e. Dict) where we store the most up to date message of each ICAO address.
 	last_received_messages := make(map[string]AircraftData)
 
-	aircraftlist_url := "http://" + config.Radarcape_hostname + "/aircraftlist.json"
+	raw_archive := &RawArchive{}
+	disk_guard := NewDiskGuard(clock)
 
-	LogInfo("GetAircraftsFromHttp: Successfully started receiver goroutine.")
+	receiver_log.Info("successfully started receiver goroutine.")
+	defer func() {
+		if err := raw_archive.Close(); err != nil {
+			receiver_log.Warn("failed to close the raw archive.", "err", err)
+		}
+		receiver_log.Info("stopped receiver goroutine.")
+	}()
+
+	for {
+		// Block until new ticker update is received.
+		select {
+		case <-ticker.C():
+		case <-stop:
+			return
+		}
 
-	for range ticker.C { // Block until new ticker update is received
+		config := config_store.Get()
+		aircraftlist_url := "http://" + config.Radarcape_hostname + "/aircraftlist.json"
 
 		// Query the radarcape for a new json containing aircraft data.
-		aircraft_list, err := RequestAircrafList(http_client, aircraftlist_url)
+		aircraft_list, body, err := RequestAircrafList(http_client, aircraftlist_url)
+		received := clock.Now()
 
 		// Check if the reported error is due to a read timeout.
 		if err != nil {
-			LogWarn(err)
+			receiver_log.Warn("failed to request the aircraft list", "url", aircraftlist_url, "err", err)
 			connection_established = false
 			// Prevent spam on stdout.
-			time.Sleep(20 * time.Second)
+			retry_timer := clock.NewTimer(20 * time.Second)
+			select {
+			case <-retry_timer.C():
+			case <-stop:
+				retry_timer.Stop()
+				return
+			}
 			continue
 		} else if !connection_established {
 			connection_established = true
 			SignalConnectionEstablished()
 		}
 
-		// Send aircraft data to the processor goroutine.
-		for _, aircraft := range aircraft_list {
-			// Check whether aircraft type is of interest to us and if we already received this
-			// identical message.
-			if IsInSlice(aircraft.Typ, config.Icao_aircraft_types) &&
-				aircraft != last_received_messages[aircraft.Typ] {
-				// Update our last received message map and send the message to the worker goroutine.
-				last_received_messages[aircraft.Typ] = aircraft
-				aircraft_data_channel <- aircraft
+		// The optional outputs make room for the csv files if the disk is running low on space.
+		if config.Raw_archive.Enabled &&
+			disk_guard.OptionalOutputAllowed(config, optionalOutputRawArchive, config.Raw_archive.Dir) {
+			if err := raw_archive.Write(config.Raw_archive.Dir, received.In(config.Location()), body); err != nil {
+				receiver_log.Warn("failed to write the raw archive.", "dir", config.Raw_archive.Dir, "err", err)
 			}
+		} else if err := raw_archive.Close(); err != nil {
+			receiver_log.Warn("failed to close the raw archive.", "err", err)
+		}
+
+		// Send aircraft data to the processor goroutine.
+		poll_seq++
+		for _, aircraft := range FilterAircraftList(aircraft_list, config.Icao_aircraft_types, last_received_messages) {
+			aircraft_data_queue.Push(NewRecord(aircraft, received, received.Sub(listener_start), poll_seq))
 		}
 	}
 
 }
 
+// Filter the relevant messages from an aircraft list.
+//
+// Only messages of aircraft types which are of interest to us and which differ from the
+// last message we received are kept. `last_received_messages` is updated accordingly.
+func FilterAircraftList(aircraft_list []AircraftData, aircraft_types []string,
+	last_received_messages map[string]AircraftData,
+) []AircraftData {
+	filtered := make([]AircraftData, 0, len(aircraft_list))
+
+	for _, aircraft := range aircraft_list {
+		// Check whether aircraft type is of interest to us and if we already received this
+		// identical message.
+		if IsInSlice(aircraft.Typ, aircraft_types) &&
+			aircraft != last_received_messages[aircraft.Typ] {
+			// Update our last received message map and keep the message.
+			last_received_messages[aircraft.Typ] = aircraft
+			filtered = append(filtered, aircraft)
+		}
+	}
+
+	return filtered
+}
+
 // Wrapper function for opening of the http request.
 //
-// Makes sure that resources are released properly.
-func RequestAircrafList(http_client *http.Client, aircraftlist_url string) (aircraft_list []AircraftData, err error) {
+// Makes sure that resources are released properly. Returns the decoded aircraft list and
+// the body of the response as it was received.
+func RequestAircrafList(http_client *http.Client, aircraftlist_url string) (aircraft_list []AircraftData,
+	body []byte, err error) {
 	resp, err := http_client.Get(aircraftlist_url)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	defer resp.Body.Close()
 
-	if err := json.NewDecoder(resp.Body).Decode(&aircraft_list); err != nil {
-		return nil, err
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := json.Unmarshal(body, &aircraft_list); err != nil {
+		return nil, nil, err
 	}
 
 	return
@@ -88,5 +155,5 @@ func RequestAircrafList(http_client *http.Client, aircraftlist_url string) (airc
 // Currently only a log message on stdout. Could be extended to send a startup log to polybox
 // or whatever.
 func SignalConnectionEstablished() {
-	LogInfo("SignalConnectionEstablished: Established a connection to the radarcape.")
+	receiver_log.Info("established a connection to the radarcape.")
 }
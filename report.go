@@ -0,0 +1,70 @@
+// Daily report.
+//
+// Summarises the data which was recorded on the previous day such that gaps in the
+// recordings are noticed without having to look at the CSVs.
+
+package main
+
+import (
+	"io/ioutil"
+	"time"
+)
+
+// Daily report goroutine.
+//
+// Every time the ticker fires, we log the number of rows and the size of every file
+// of the previous day.
+func DailyReport(config_store *ConfigStore, clock Clock, ticker *TimeTicker) {
+	for range ticker.Processor_tick_chan {
+		config := config_store.Get()
+		prev_day := clock.Now().In(config.Location()).AddDate(0, 0, -1)
+
+		if err := ReportDay(config, prev_day); err != nil {
+			report_log.Warn("failed to create the daily report.", "date", prev_day.Format(dateFormatString), "err", err)
+			continue
+		}
+		ticker.Done()
+	}
+}
+
+// Log the number of rows and the size of every file of the given day.
+//
+// The files are looked up in the local data folder first. If the day was already
+// uploaded, we look in the upload folder instead.
+func ReportDay(config Config, day time.Time) error {
+	folder_path := getDataFolder(config.Data_dir, day)
+	files, err := ioutil.ReadDir(folder_path)
+	if err != nil && config.Upload_folder_path != "" {
+		folder_path = config.Upload_folder_path + day.Format(dateFormatString) + "/"
+		files, err = ioutil.ReadDir(folder_path)
+	}
+	if err != nil {
+		return err
+	}
+
+	total_rows := 0
+	rows_per_file := make([]any, 0, 2*len(files))
+	for _, file := range files {
+		if !isCsvFileName(file.Name()) {
+			continue
+		}
+		rows, err := countCsvRows(folder_path + file.Name())
+		if err != nil {
+			return err
+		}
+		total_rows += rows
+		rows_per_file = append(rows_per_file, file.Name(), rows)
+	}
+
+	report_log.Info("daily report.", append([]any{
+		"date", day.Format(dateFormatString),
+		"folder", folder_path,
+		"total_rows", total_rows,
+	}, rows_per_file...)...)
+
+	if total_rows == 0 {
+		report_log.WarnSevere("no data was recorded.", "date", day.Format(dateFormatString))
+	}
+
+	return nil
+}
@@ -0,0 +1,274 @@
+// Retention logic.
+//
+// Removes day folders (and archives of days) from the local data, the backup folder and the
+// raw archive once they are older than the configured maximum age, or once the folder as a
+// whole exceeds its maximum size, oldest days first. Days which were not uploaded yet
+// according to the upload ledger are never removed from the local data.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// RetentionConfig groups the retention rules. A maximum age or size of zero keeps the data forever.
+type RetentionConfig struct {
+	Data_max_age_days   int `yaml:"data_max_age_days"`
+	Backup_max_age_days int `yaml:"backup_max_age_days"`
+	Raw_max_age_days    int `yaml:"raw_max_age_days"`
+	Data_max_size_mb    int `yaml:"data_max_size_mb"`
+	Backup_max_size_mb  int `yaml:"backup_max_size_mb"`
+	Raw_max_size_mb     int `yaml:"raw_max_size_mb"`
+	Min_free_disk_mb    int `yaml:"min_free_disk_mb"` // the optional outputs pause below. 0 disables the guard.
+}
+
+// Counters of the retention job.
+var (
+	retention_removed_counter       = new(expvar.Int)
+	retention_removed_bytes_counter = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("retention_removed", retention_removed_counter)
+	metrics.Set("retention_removed_bytes", retention_removed_bytes_counter)
+}
+
+// Check the retention rules and add the problems to `config_errors`.
+func (retention RetentionConfig) validate(config_errors *ConfigErrors) {
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"data_max_age_days", retention.Data_max_age_days},
+		{"backup_max_age_days", retention.Backup_max_age_days},
+		{"raw_max_age_days", retention.Raw_max_age_days},
+		{"data_max_size_mb", retention.Data_max_size_mb},
+		{"backup_max_size_mb", retention.Backup_max_size_mb},
+		{"raw_max_size_mb", retention.Raw_max_size_mb},
+		{"min_free_disk_mb", retention.Min_free_disk_mb},
+	}
+	for _, limit := range limits {
+		if limit.value < 0 {
+			config_errors.add("retention.%s: must not be negative", limit.name)
+		}
+	}
+}
+
+// retentionRule describes the limits of one folder of day folders.
+type retentionRule struct {
+	name         string // data, backup or raw.
+	root         string
+	max_age_days int
+	max_size_mb  int
+	// The days are only removed once the upload ledger in this state directory records
+	// their files. Empty doesn't check the uploads.
+	upload_ledger_dir string
+}
+
+// Get the retention rules of the folders which exist in the config.
+func (config Config) retentionRules() []retentionRule {
+	rules := []retentionRule{{
+		name:         "data",
+		root:         getDataRoot(config.Data_dir),
+		max_age_days: config.Retention.Data_max_age_days,
+		max_size_mb:  config.Retention.Data_max_size_mb,
+	}}
+	if config.UploadEnabled() {
+		rules[0].upload_ledger_dir = config.State_dir
+	}
+	if config.Backup_folder_path != "" {
+		rules = append(rules, retentionRule{
+			name:         "backup",
+			root:         config.Backup_folder_path,
+			max_age_days: config.Retention.Backup_max_age_days,
+			max_size_mb:  config.Retention.Backup_max_size_mb,
+		})
+	}
+	if config.Raw_archive.Dir != "" {
+		rules = append(rules, retentionRule{
+			name:         "raw",
+			root:         config.Raw_archive.Dir,
+			max_age_days: config.Retention.Raw_max_age_days,
+			max_size_mb:  config.Retention.Raw_max_size_mb,
+		})
+	}
+	return rules
+}
+
+// Retention cleanup goroutine.
+//
+// Every time the ticker fires, we remove the day folders which are older than the
+// configured maximum age or exceed the maximum size of their folder.
+func RetentionCleanup(config_store *ConfigStore, clock Clock, ticker *TimeTicker) {
+	for range ticker.Processor_tick_chan {
+		config := config_store.Get()
+		today := clock.Now().In(config.Location())
+
+		failed := false
+		for _, rule := range config.retentionRules() {
+			if err := applyRetentionRule(rule, today); err != nil {
+				retention_log.Warn("failed to clean up the "+rule.name+" folder.", "path", rule.root, "err", err)
+				failed = true
+			}
+		}
+		if !failed {
+			ticker.Done()
+		}
+	}
+}
+
+// dayEntry is a day folder or a file of a day, e.g. a day archive.
+type dayEntry struct {
+	name string
+	day  time.Time
+	size int64
+}
+
+// List the day folders and files of days in `root`, oldest first.
+//
+// Files belong to the day at the start of their name, e.g. 20240131.tar.gz or
+// 20240131_1.json.gz. Entries whose name doesn't start with a date are left out.
+func listDayEntries(root string, location *time.Location) ([]dayEntry, error) {
+	entries, err := ioutil.ReadDir(root)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	day_entries := make([]dayEntry, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() {
+			if len(name) <= len(dateFormatString) || name[len(dateFormatString)] != '.' &&
+				name[len(dateFormatString)] != '_' {
+				continue
+			}
+			name = name[:len(dateFormatString)]
+		}
+		day, err := time.ParseInLocation(dateFormatString, name, location)
+		if err != nil {
+			continue
+		}
+
+		size := entry.Size()
+		if entry.IsDir() {
+			if size, err = folderSize(root + entry.Name()); err != nil {
+				return nil, err
+			}
+		}
+		day_entries = append(day_entries, dayEntry{name: entry.Name(), day: day, size: size})
+	}
+
+	sort.SliceStable(day_entries, func(i, j int) bool { return day_entries[i].day.Before(day_entries[j].day) })
+	return day_entries, nil
+}
+
+// Get the total size of the files in a folder.
+func folderSize(folder_path string) (int64, error) {
+	var size int64
+	err := filepath.Walk(folder_path, func(_ string, info fs.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+// Check whether the upload ledger records all the files of a day folder. Other files of a
+// day (e.g. an archive which is left behind) are uploaded once the ledger records the day
+// as complete.
+func isDayEntryUploaded(root string, entry dayEntry, ledger map[string]*uploadedDay) (bool, error) {
+	uploaded := ledger[entry.day.Format(dateFormatString)]
+	info, err := os.Stat(root + entry.name)
+	if err != nil {
+		return false, err
+	}
+	if !info.IsDir() {
+		return uploaded != nil && uploaded.complete, nil
+	}
+
+	file_names, err := listFileNames(root + entry.name + "/")
+	if err != nil {
+		return false, err
+	}
+	// An empty folder has nothing left to upload.
+	return len(file_names) == 0 || uploaded.hasAll(file_names), nil
+}
+
+// Remove the entries of a folder which violate its retention rule.
+//
+// Entries which are more than `max_age_days` days before `today` are removed. Afterwards the
+// oldest entries are removed until the folder is within `max_size_mb`. The entries of
+// `today` are never removed since they are still being written to.
+func applyRetentionRule(rule retentionRule, today time.Time) error {
+	if rule.max_age_days <= 0 && rule.max_size_mb <= 0 {
+		return nil
+	}
+
+	entries, err := listDayEntries(rule.root, today.Location())
+	if err != nil {
+		return err
+	}
+	var ledger map[string]*uploadedDay
+	if rule.upload_ledger_dir != "" {
+		if ledger, err = readUploadLedger(rule.upload_ledger_dir); err != nil {
+			return fmt.Errorf("failed to read the upload ledger: %w", err)
+		}
+	}
+
+	var total_size int64
+	for _, entry := range entries {
+		total_size += entry.size
+	}
+	max_size := int64(rule.max_size_mb) << 20
+	start_of_today := time.Date(today.Year(), today.Month(), today.Day(), 0, 0, 0, 0, today.Location())
+	oldest_kept := start_of_today.AddDate(0, 0, -rule.max_age_days)
+
+	for _, entry := range entries {
+		reason := ""
+		if rule.max_age_days > 0 && entry.day.Before(oldest_kept) {
+			reason = "age"
+		} else if rule.max_size_mb > 0 && total_size > max_size && entry.day.Before(start_of_today) {
+			reason = "size"
+		}
+		if reason == "" {
+			continue
+		}
+
+		if ledger != nil {
+			uploaded, err := isDayEntryUploaded(rule.root, entry, ledger)
+			if err != nil {
+				return err
+			}
+			if !uploaded {
+				retention_log.Warn("keeping a day folder beyond the retention limit since it was not uploaded yet.",
+					"path", rule.root+entry.name, "reason", reason)
+				continue
+			}
+		}
+
+		if err := os.RemoveAll(rule.root + entry.name); err != nil {
+			return err
+		}
+		total_size -= entry.size
+		retention_removed_counter.Add(1)
+		retention_removed_bytes_counter.Add(entry.size)
+		retention_log.Info("removed day folder due to its "+reason+".", "path", rule.root+entry.name,
+			"size_mb", float64(entry.size)/(1<<20), "max_age_days", rule.max_age_days, "max_size_mb", rule.max_size_mb)
+	}
+
+	return nil
+}
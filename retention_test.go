@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestApplyRetentionRuleKeepsDaysWhichWereNotUploaded(t *testing.T) {
+	config := newTestConfig(t, nil)
+	today := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	data_root := getDataRoot(config.Data_dir)
+	target := FolderTarget{Path: config.Upload_folder_path}
+	row := strings.Repeat("x", 600*1024) + "\n"
+
+	// Uploaded, but left behind.
+	writeTestFile(t, data_root+"20240301/output_file_A320.csv", row)
+	recordUpload(config, target, time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC), today, "20240301", "",
+		[]string{"output_file_A320.csv"}, true)
+	// Not uploaded yet.
+	writeTestFile(t, data_root+"20240302/output_file_A320.csv", row)
+	// Uploaded, but left behind.
+	writeTestFile(t, data_root+"20240303/output_file_A320.csv", row)
+	recordUpload(config, target, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), today, "20240303", "",
+		[]string{"output_file_A320.csv"}, true)
+	// Today.
+	writeTestFile(t, data_root+"20240310/output_file_A320.csv", row)
+
+	rule := retentionRule{name: "data", root: data_root, max_size_mb: 1, upload_ledger_dir: config.State_dir}
+	if err := applyRetentionRule(rule, today); err != nil {
+		t.Fatal(err)
+	}
+
+	for day, expected := range map[string]bool{"20240301": false, "20240302": true, "20240303": false, "20240310": true} {
+		_, err := os.Stat(data_root + day)
+		if exists := err == nil; exists != expected {
+			t.Errorf("%s: exists is %t, expected %t", day, exists, expected)
+		}
+	}
+}
+
+func TestApplyRetentionRuleByAge(t *testing.T) {
+	root := t.TempDir() + "/"
+	today := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	writeTestFile(t, root+"20240301/a.csv", "x")
+	writeTestFile(t, root+"20240301.tar.gz", "x")
+	writeTestFile(t, root+"20240308_1.json.gz", "x")
+	writeTestFile(t, root+"notes.txt", "x")
+
+	rule := retentionRule{name: "backup", root: root, max_age_days: 7}
+	if err := applyRetentionRule(rule, today); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]bool{"20240301": false, "20240301.tar.gz": false,
+		"20240308_1.json.gz": true, "notes.txt": true} {
+		_, err := os.Stat(root + name)
+		if exists := err == nil; exists != expected {
+			t.Errorf("%s: exists is %t, expected %t", name, exists, expected)
+		}
+	}
+}
@@ -0,0 +1,195 @@
+// File rotation.
+//
+// The data of every aircraft type is split into partitions of a fixed length (a day
+// by default, or e.g. an hour) and optionally into several parts per partition once a
+// file exceeds a certain size. The file names encode the start of the partition and
+// the part such that the uploader can tell which files are complete.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// RotationConfig groups the parameters which define when a new CSV file is started.
+type RotationConfig struct {
+	Interval    string `yaml:"interval"`    // daily (default), hourly or a number of minutes such as 15m.
+	Max_size_mb int    `yaml:"max_size_mb"` // start a new part once a file exceeds this size. 0 disables.
+}
+
+// Partitioning describes how the data is split into files and how the files are encoded.
+type Partitioning struct {
+	Interval    time.Duration // zero for daily partitions.
+	Max_size    int64         // in bytes, zero disables the size based rotation.
+	Location    *time.Location
+	Compression CompressionConfig
+	Csv         CsvConfig
+	Site        SiteConfig
+	Config_hash string // recorded in the metadata of the files.
+}
+
+// Parse the rotation interval. Daily rotation is represented by a zero interval.
+//
+// Sub-daily intervals have to divide an hour or a day into whole numbers of
+// partitions such that every day starts with a new partition.
+func ParseRotationInterval(interval string) (time.Duration, error) {
+	switch strings.TrimSpace(interval) {
+	case "", "daily", "24h":
+		return 0, nil
+	case "hourly":
+		return time.Hour, nil
+	}
+
+	duration, err := time.ParseDuration(interval)
+	if err != nil {
+		return 0, err
+	}
+	if duration < time.Minute || duration%time.Minute != 0 {
+		return 0, fmt.Errorf("interval %s must be a whole number of minutes", duration)
+	}
+	if duration < time.Hour && time.Hour%duration != 0 {
+		return 0, fmt.Errorf("interval %s must divide an hour", duration)
+	}
+	if duration >= time.Hour && (duration%time.Hour != 0 || 24%(duration/time.Hour) != 0) {
+		return 0, fmt.Errorf("interval %s must be a whole number of hours which divides a day", duration)
+	}
+	return duration, nil
+}
+
+// Get the partitioning of the data as specified in the config.
+//
+// Validate makes sure that the rotation interval can be parsed.
+func (config Config) Partitioning() Partitioning {
+	interval, _ := ParseRotationInterval(config.Rotation.Interval)
+	return Partitioning{
+		Interval:    interval,
+		Max_size:    int64(config.Rotation.Max_size_mb) * 1024 * 1024,
+		Location:    config.Location(),
+		Compression: config.Compression,
+		Csv:         config.Csv,
+		Site:        config.Site,
+		Config_hash: config.Hash(),
+	}
+}
+
+// Get the default rollover schedule which starts new files 10 seconds after the
+// start of every partition.
+func (partitioning Partitioning) RolloverSchedule() string {
+	switch {
+	case partitioning.Interval == 0:
+		return "10 0 0 * * *"
+	case partitioning.Interval < time.Hour:
+		return fmt.Sprintf("10 */%d * * * *", partitioning.Interval/time.Minute)
+	case partitioning.Interval == time.Hour:
+		return "10 0 * * * *"
+	default:
+		return fmt.Sprintf("10 0 */%d * * *", partitioning.Interval/time.Hour)
+	}
+}
+
+// Get the start of the partition which contains `t`.
+func (partitioning Partitioning) Start(t time.Time) time.Time {
+	local_t := t.In(partitioning.Location)
+	day_start := wallClockDate(local_t.Year(), local_t.Month(), local_t.Day(), 0, 0, 0, partitioning.Location)
+	if partitioning.Interval == 0 {
+		return day_start
+	}
+
+	// Partitions are aligned to the wall clock (e.g. 13:00-14:00) such that they
+	// keep their names on days with a DST transition. The partition of an hour which
+	// occurs twice spans both of them.
+	minutes := local_t.Hour()*60 + local_t.Minute()
+	interval_minutes := int(partitioning.Interval / time.Minute)
+	minutes -= minutes % interval_minutes
+	return wallClockDate(local_t.Year(), local_t.Month(), local_t.Day(), minutes/60, minutes%60, 0, partitioning.Location)
+}
+
+// Get the end of the partition which starts at `start`.
+func (partitioning Partitioning) End(start time.Time) time.Time {
+	local_start := start.In(partitioning.Location)
+	if partitioning.Interval == 0 {
+		return wallClockDate(local_start.Year(), local_start.Month(), local_start.Day()+1, 0, 0, 0, partitioning.Location)
+	}
+
+	minutes := local_start.Hour()*60 + local_start.Minute() + int(partitioning.Interval/time.Minute)
+	return wallClockDate(local_start.Year(), local_start.Month(), local_start.Day(), minutes/60, minutes%60, 0, partitioning.Location)
+}
+
+// Get the name of the file of the given partition and part:
+//
+//	output_file_<TYPE>[_<YYYYMMDDTHHMM>][_<PART>].csv[.gz|.zst]
+//
+// The start of the partition is omitted for daily partitions (it is given by the name
+// of the day folder) and the part is omitted for the first part. Compressed files get
+// the extension of the compression format.
+func (partitioning Partitioning) FileName(aircraft_type string, start time.Time, part int) string {
+	file_name := "output_file_" + aircraft_type
+	if partitioning.Interval != 0 {
+		file_name += "_" + start.In(partitioning.Location).Format(partitionFormatString)
+	}
+	if part > 0 {
+		file_name += fmt.Sprintf("_%03d", part)
+	}
+	return file_name + ".csv" + partitioning.Compression.Extension()
+}
+
+// partitionFormatString defines the format of the partition start in the file names.
+const partitionFormatString string = "20060102T1504"
+
+// PartitionFile holds the information which is encoded in the name of a data file.
+type PartitionFile struct {
+	Aircraft_type string
+	Start         string // start of the partition, empty for daily partitions.
+	Part          int
+}
+
+// Parse the name of a data file. Returns false if the name doesn't follow the
+// naming scheme of the data files.
+func ParsePartitionFileName(file_name string) (PartitionFile, bool) {
+	if !strings.HasPrefix(file_name, "output_file_") {
+		return PartitionFile{}, false
+	}
+	name := strings.TrimPrefix(file_name, "output_file_")
+	// Cut all the extensions (e.g. .csv or .csv.gz).
+	if index := strings.Index(name, "."); index >= 0 {
+		name = name[:index]
+	}
+
+	fields := strings.Split(name, "_")
+	partition_file := PartitionFile{Aircraft_type: fields[0]}
+	for _, field := range fields[1:] {
+		if _, err := time.Parse(partitionFormatString, field); err == nil && partition_file.Start == "" {
+			partition_file.Start = field
+		} else if part, err := strconv.Atoi(field); err == nil && part > 0 {
+			partition_file.Part = part
+		} else {
+			return PartitionFile{}, false
+		}
+	}
+	return partition_file, partition_file.Aircraft_type != ""
+}
+
+// partitionGracePeriod is the time after the end of a partition after which we
+// consider its files complete. The rollover happens 10 seconds after the end of the
+// partition, so records can still be written shortly after the end.
+const partitionGracePeriod time.Duration = time.Minute
+
+// Check whether the partition of a data file in the folder of `day` has ended at time `now`,
+// i.e. no more data is written to it.
+func (partitioning Partitioning) IsComplete(file_name string, day time.Time, now time.Time) bool {
+	partition_file, ok := ParsePartitionFileName(file_name)
+	if !ok || partition_file.Start == "" {
+		// Daily files (and unknown files) are complete once the day is over.
+		day_end := Partitioning{Location: partitioning.Location}.End(day)
+		return !day_end.Add(partitionGracePeriod).After(now)
+	}
+
+	start, err := time.ParseInLocation(partitionFormatString, partition_file.Start, partitioning.Location)
+	if err != nil {
+		return false
+	}
+	return !partitioning.End(start).Add(partitionGracePeriod).After(now)
+}
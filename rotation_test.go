@@ -0,0 +1,89 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPartitionsAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	tests := []struct {
+		name      string
+		interval  time.Duration
+		t         string
+		start     string
+		end       string
+		file_name string
+	}{
+		{"23h day", 0, "2024-03-31T12:00:00+02:00", "2024-03-31T00:00:00+01:00", "2024-04-01T00:00:00+02:00", "output_file_A320.csv"},
+		{"25h day", 0, "2024-10-27T12:00:00+01:00", "2024-10-27T00:00:00+02:00", "2024-10-28T00:00:00+01:00", "output_file_A320.csv"},
+		{"hour before the gap", time.Hour, "2024-03-31T01:30:00+01:00", "2024-03-31T01:00:00+01:00", "2024-03-31T03:00:00+02:00", "output_file_A320_20240331T0100.csv"},
+		{"hour after the gap", time.Hour, "2024-03-31T03:30:00+02:00", "2024-03-31T03:00:00+02:00", "2024-03-31T04:00:00+02:00", "output_file_A320_20240331T0300.csv"},
+		{"hour before the repeated hour", time.Hour, "2024-10-27T01:30:00+02:00", "2024-10-27T01:00:00+02:00", "2024-10-27T02:00:00+02:00", "output_file_A320_20241027T0100.csv"},
+		{"first repeated hour", time.Hour, "2024-10-27T02:30:00+02:00", "2024-10-27T02:00:00+02:00", "2024-10-27T03:00:00+01:00", "output_file_A320_20241027T0200.csv"},
+		{"second repeated hour", time.Hour, "2024-10-27T02:30:00+01:00", "2024-10-27T02:00:00+02:00", "2024-10-27T03:00:00+01:00", "output_file_A320_20241027T0200.csv"},
+		{"hour after the repeated hour", time.Hour, "2024-10-27T03:30:00+01:00", "2024-10-27T03:00:00+01:00", "2024-10-27T04:00:00+01:00", "output_file_A320_20241027T0300.csv"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			partitioning := Partitioning{Interval: test.interval, Location: zurich}
+			start := partitioning.Start(parseTestTime(t, test.t))
+			if expected := parseTestTime(t, test.start); !start.Equal(expected) {
+				t.Errorf("the partition starts at %s, expected %s", start, expected)
+			}
+			if end, expected := partitioning.End(start), parseTestTime(t, test.end); !end.Equal(expected) {
+				t.Errorf("the partition ends at %s, expected %s", end, expected)
+			}
+			if file_name := partitioning.FileName("A320", start, 0); file_name != test.file_name {
+				t.Errorf("the file of the partition is %s, expected %s", file_name, test.file_name)
+			}
+		})
+	}
+}
+
+func TestHourlyPartitionsAreCompleteAfterTheRepeatedHour(t *testing.T) {
+	zurich := loadZurich(t)
+	partitioning := Partitioning{Interval: time.Hour, Location: zurich}
+	day := time.Date(2024, 10, 27, 0, 0, 0, 0, zurich)
+	tests := []struct {
+		file_name string
+		now       string
+		complete  bool
+	}{
+		{"output_file_A320_20241027T0100.csv", "2024-10-27T02:00:30+02:00", false},
+		{"output_file_A320_20241027T0100.csv", "2024-10-27T02:01:00+02:00", true},
+		{"output_file_A320_20241027T0200.csv", "2024-10-27T02:30:00+01:00", false},
+		{"output_file_A320_20241027T0200.csv", "2024-10-27T03:01:00+01:00", true},
+		{"output_file_A320.csv", "2024-10-27T23:30:00+01:00", false},
+		{"output_file_A320.csv", "2024-10-28T00:01:00+01:00", true},
+	}
+	for _, test := range tests {
+		if complete := partitioning.IsComplete(test.file_name, day, parseTestTime(t, test.now)); complete != test.complete {
+			t.Errorf("%s complete at %s: %t, expected %t", test.file_name, test.now, complete, test.complete)
+		}
+	}
+}
+
+// A daily file is complete after the first occurrence of midnight if the clocks are turned
+// back at 01:00.
+func TestDailyPartitionsAreCompleteAfterTheFirstMidnight(t *testing.T) {
+	havana, err := time.LoadLocation("America/Havana")
+	if err != nil {
+		t.Fatal(err)
+	}
+	partitioning := Partitioning{Interval: time.Hour, Location: havana}
+	day := time.Date(2024, 11, 2, 0, 0, 0, 0, havana)
+	tests := []struct {
+		now      string
+		complete bool
+	}{
+		{"2024-11-02T23:59:00-04:00", false},
+		{"2024-11-03T00:00:30-04:00", false},
+		{"2024-11-03T00:01:00-04:00", true},
+	}
+	for _, test := range tests {
+		if complete := partitioning.IsComplete("output_file_A320.csv", day, parseTestTime(t, test.now)); complete != test.complete {
+			t.Errorf("complete at %s: %t, expected %t", test.now, complete, test.complete)
+		}
+	}
+}
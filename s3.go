@@ -0,0 +1,557 @@
+// S3 upload target.
+//
+// Uploads the data files into a bucket of an S3-compatible object storage, e.g. MinIO. The
+// objects are named prefix/YYYYMMDD/<file> and carry the site, the aircraft type and the
+// listener version as metadata. Large files are uploaded in parts. Every request body is
+// sent with its MD5 checksum such that the storage rejects corrupted uploads. The parts are
+// hashed and then streamed from the file, so they are never held in memory. Objects which
+// were uploaded before with the same content are not uploaded again.
+//
+// The requests are signed with AWS signature version 4 and the bucket is addressed
+// path-style (https://<endpoint>/<bucket>/<key>), which is what MinIO expects.
+
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3Config groups the parameters of the S3 upload target.
+type S3Config struct {
+	Endpoint          string `yaml:"endpoint"` // e.g. https://nas.example.org:9000
+	Region            string `yaml:"region"`
+	Bucket            string `yaml:"bucket"`
+	Prefix            string `yaml:"prefix"` // of the object keys, e.g. radarcape/zurich.
+	Access_key_id     string `yaml:"access_key_id"`
+	Secret_access_key string `yaml:"secret_access_key"` // preferably set by RADARCAPE_UPLOAD_S3_SECRET_ACCESS_KEY.
+	Storage_class     string `yaml:"storage_class"`     // e.g. STANDARD_IA. Empty uses the default of the bucket.
+	Part_size_mb      int    `yaml:"part_size_mb"`      // larger files are uploaded in parts.
+	Timeout           string `yaml:"timeout"`           // of every request, e.g. 5m.
+}
+
+// Limits of the part size of multipart uploads.
+const (
+	s3MinPartSizeMb int = 5
+	s3MaxPartSizeMb int = 5120
+)
+
+// Metadata keys of the uploaded objects. The md5 of the whole file allows recognising
+// objects which were uploaded before, since the ETag of a multipart upload isn't the md5.
+const (
+	s3MetaSite    string = "X-Amz-Meta-Site"
+	s3MetaType    string = "X-Amz-Meta-Aircraft-Type"
+	s3MetaVersion string = "X-Amz-Meta-Listener-Version"
+	s3MetaMd5     string = "X-Amz-Meta-Md5"
+)
+
+// Storage classes consist of upper case letters and underscores, e.g. REDUCED_REDUNDANCY.
+var s3_storage_class_regexp = regexp.MustCompile(`^[A-Z_]+$`)
+
+// Fill in the default values of the S3 parameters which were not specified.
+func (s3_config *S3Config) applyDefaults() {
+	if s3_config.Region == "" {
+		s3_config.Region = "us-east-1"
+	}
+	if s3_config.Part_size_mb == 0 {
+		s3_config.Part_size_mb = 16
+	}
+	if s3_config.Timeout == "" {
+		s3_config.Timeout = "5m"
+	}
+}
+
+// Normalise the endpoint and the prefix such that keys can be appended to them.
+func (s3_config *S3Config) normalize() {
+	s3_config.Endpoint = strings.TrimRight(strings.TrimSpace(s3_config.Endpoint), "/")
+	s3_config.Region = strings.TrimSpace(s3_config.Region)
+	s3_config.Bucket = strings.TrimSpace(s3_config.Bucket)
+	s3_config.Prefix = strings.Trim(strings.TrimSpace(s3_config.Prefix), "/")
+	s3_config.Storage_class = strings.ToUpper(strings.TrimSpace(s3_config.Storage_class))
+}
+
+// Check the S3 parameters and add the problems to `config_errors`.
+func (s3_config S3Config) validate(config_errors *ConfigErrors) {
+	if s3_config.Endpoint == "" {
+		config_errors.add("upload.s3.endpoint: must be specified for the s3 target")
+	} else if parsed, err := url.Parse(s3_config.Endpoint); err != nil {
+		config_errors.add("upload.s3.endpoint: %s", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" || parsed.Path != "" {
+		config_errors.add("upload.s3.endpoint: %q must be an http or https url without path", s3_config.Endpoint)
+	}
+	if s3_config.Bucket == "" {
+		config_errors.add("upload.s3.bucket: must be specified for the s3 target")
+	}
+	if s3_config.Access_key_id == "" || s3_config.Secret_access_key == "" {
+		config_errors.add("upload.s3: access_key_id and secret_access_key must be specified for the s3 target")
+	}
+	if s3_config.Storage_class != "" && !s3_storage_class_regexp.MatchString(s3_config.Storage_class) {
+		config_errors.add("upload.s3.storage_class: %q is not a storage class (e.g. STANDARD_IA)", s3_config.Storage_class)
+	}
+	if s3_config.Part_size_mb < s3MinPartSizeMb || s3_config.Part_size_mb > s3MaxPartSizeMb {
+		config_errors.add("upload.s3.part_size_mb: %d must be between %d and %d",
+			s3_config.Part_size_mb, s3MinPartSizeMb, s3MaxPartSizeMb)
+	}
+	if _, err := parseUploadDuration(s3_config.Timeout); err != nil {
+		config_errors.add("upload.s3.timeout: %s", err)
+	}
+}
+
+// S3Target uploads the files into a bucket of an S3-compatible object storage.
+type S3Target struct {
+	s3_config S3Config
+	endpoint  *url.URL
+	site      string // name of the site in the metadata of the objects.
+	part_size int64
+	client    *http.Client
+	clock     Clock // timestamps the signatures.
+}
+
+// Create an S3 target from its config.
+func NewS3Target(s3_config S3Config, site string, clock Clock) (*S3Target, error) {
+	endpoint, err := url.Parse(s3_config.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseUploadDuration(s3_config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &S3Target{
+		s3_config: s3_config,
+		endpoint:  endpoint,
+		site:      site,
+		part_size: int64(s3_config.Part_size_mb) << 20,
+		client:    &http.Client{Timeout: timeout},
+		clock:     clock,
+	}, nil
+}
+
+func (target *S3Target) String() string {
+	return "s3://" + target.s3_config.Bucket + "/" + target.s3_config.Prefix
+}
+
+// Object storages have no folders, the day is part of the key of every object.
+func (target *S3Target) MakeDir(dir string) error {
+	return nil
+}
+
+func (target *S3Target) Close() error {
+	target.client.CloseIdleConnections()
+	return nil
+}
+
+// Get the key of the object of a path relative to the prefix.
+func (target *S3Target) objectKey(remote_path string) string {
+	if target.s3_config.Prefix == "" {
+		return remote_path
+	}
+	return target.s3_config.Prefix + "/" + remote_path
+}
+
+// Upload a file unless an object with the same content exists already.
+//
+// Files up to the part size are uploaded with a single PUT, larger files with a multipart
+// upload.
+func (target *S3Target) Upload(local_path string, remote_path string, transfer *UploadTransfer) error {
+	file, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	md5_hash := md5.New()
+	if _, err := io.Copy(md5_hash, file); err != nil {
+		return err
+	}
+	file_md5 := hex.EncodeToString(md5_hash.Sum(nil))
+
+	key := target.objectKey(remote_path)
+	header := target.objectHeader(path.Base(remote_path), file_md5)
+
+	// A repeated upload (e.g. after a failure of another file of the day) skips the
+	// objects which are complete already.
+	if existing, err := target.head(key); err != nil {
+		return err
+	} else if existing != nil && existing.ContentLength == size && existing.Header.Get(s3MetaMd5) == file_md5 {
+		uploader_log.Debug("the object exists already. Skipping the upload.", "key", key)
+		return nil
+	}
+
+	if size <= target.part_size {
+		part, err := hashS3Part(file, 0, size, transfer)
+		if err != nil {
+			return err
+		}
+		_, err = target.do("PUT", key, nil, header, part, http.StatusOK)
+		return err
+	}
+	return target.uploadMultipart(file, size, key, header, transfer)
+}
+
+// Get the headers of a new object: its metadata, the storage class and the content type.
+func (target *S3Target) objectHeader(file_name string, file_md5 string) http.Header {
+	header := http.Header{}
+	header.Set("Content-Type", contentTypeOf(file_name))
+	if target.s3_config.Storage_class != "" {
+		header.Set("X-Amz-Storage-Class", target.s3_config.Storage_class)
+	}
+	if target.site != "" {
+		// Metadata values are sent as headers, so non-ASCII names are encoded.
+		header.Set(s3MetaSite, mime.QEncoding.Encode("utf-8", target.site))
+	}
+	if partition_file, ok := ParsePartitionFileName(file_name); ok {
+		header.Set(s3MetaType, partition_file.Aircraft_type)
+	}
+	header.Set(s3MetaVersion, version)
+	header.Set(s3MetaMd5, file_md5)
+	return header
+}
+
+// Get the content type of a data file from its extension.
+func contentTypeOf(file_name string) string {
+	switch {
+	case strings.HasSuffix(file_name, ".csv"):
+		return "text/csv"
+	case strings.HasSuffix(file_name, ".gz"):
+		return "application/gzip"
+	case strings.HasSuffix(file_name, ".zst"):
+		return "application/zstd"
+	case strings.HasSuffix(file_name, ".json"):
+		return "application/json"
+	default:
+		return "application/octet-stream"
+	}
+}
+
+// Get the metadata of an object or nil if it doesn't exist.
+func (target *S3Target) head(key string) (*http.Response, error) {
+	response, err := target.do("HEAD", key, nil, nil, s3Part{}, http.StatusOK, http.StatusNotFound)
+	if err != nil || response.StatusCode == http.StatusNotFound {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Response of the start of a multipart upload.
+type s3InitiateMultipartUploadResult struct {
+	Upload_id string `xml:"UploadId"`
+}
+
+// Request body of the completion of a multipart upload.
+type s3CompleteMultipartUpload struct {
+	XMLName xml.Name `xml:"CompleteMultipartUpload"`
+	Parts   []s3CompletedPart
+}
+
+type s3CompletedPart struct {
+	XMLName     xml.Name `xml:"Part"`
+	Part_number int      `xml:"PartNumber"`
+	ETag        string   `xml:"ETag"`
+}
+
+// Response of the completion of a multipart upload. The storage reports errors which occur
+// during the completion in the body of a response with the status 200.
+type s3CompleteMultipartUploadResult struct {
+	XMLName xml.Name
+	ETag    string `xml:"ETag"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Upload a file in parts.
+//
+// The ETag of the completed object is compared with the one which is expected from the
+// md5 checksums of the parts. The parts are discarded if the upload fails.
+func (target *S3Target) uploadMultipart(file *os.File, size int64, key string, header http.Header,
+	transfer *UploadTransfer) error {
+	response, err := target.do("POST", key, url.Values{"uploads": {""}}, header, s3Part{}, http.StatusOK)
+	if err != nil {
+		return err
+	}
+	var initiate_result s3InitiateMultipartUploadResult
+	if err := decodeS3Response(response, &initiate_result); err != nil {
+		return err
+	}
+	upload_id := initiate_result.Upload_id
+
+	err = func() error {
+		var complete s3CompleteMultipartUpload
+		part_md5s := make([]byte, 0, md5.Size*int((size+target.part_size-1)/target.part_size))
+		for offset, part_number := int64(0), 1; offset < size; offset, part_number = offset+target.part_size, part_number+1 {
+			length := target.part_size
+			if size-offset < length {
+				length = size - offset
+			}
+			part, err := hashS3Part(file, offset, length, transfer)
+			if err != nil {
+				return err
+			}
+			query := url.Values{"partNumber": {strconv.Itoa(part_number)}, "uploadId": {upload_id}}
+			response, err := target.do("PUT", key, query, nil, part, http.StatusOK)
+			if err != nil {
+				return err
+			}
+			complete.Parts = append(complete.Parts, s3CompletedPart{
+				Part_number: part_number,
+				ETag:        response.Header.Get("ETag"),
+			})
+			part_md5s = append(part_md5s, part.md5...)
+		}
+
+		body, err := xml.Marshal(complete)
+		if err != nil {
+			return err
+		}
+		response, err := target.do("POST", key, url.Values{"uploadId": {upload_id}}, nil, newS3Part(body), http.StatusOK)
+		if err != nil {
+			return err
+		}
+		var complete_result s3CompleteMultipartUploadResult
+		if err := decodeS3Response(response, &complete_result); err != nil {
+			return err
+		}
+		if complete_result.XMLName.Local == "Error" {
+			return fmt.Errorf("failed to complete the upload of %s: %s: %s", key, complete_result.Code,
+				complete_result.Message)
+		}
+
+		// The ETag of a multipart upload is the md5 of the md5s of its parts and their number.
+		sum := md5.Sum(part_md5s)
+		expected_etag := fmt.Sprintf("%s-%d", hex.EncodeToString(sum[:]), len(complete.Parts))
+		if etag := strings.Trim(complete_result.ETag, `"`); etag != expected_etag {
+			return fmt.Errorf("verification of %s failed: the storage reports the ETag %s instead of %s",
+				key, etag, expected_etag)
+		}
+		return nil
+	}()
+	if err != nil {
+		query := url.Values{"uploadId": {upload_id}}
+		if _, abort_err := target.do("DELETE", key, query, nil, s3Part{}, http.StatusNoContent); abort_err != nil {
+			uploader_log.Warn("failed to abort a failed multipart upload.", "key", key, "err", abort_err)
+		}
+	}
+	return err
+}
+
+// s3Part is the body of a request together with its checksums.
+type s3Part struct {
+	data     *io.SectionReader // nil if the request has no body.
+	md5      []byte
+	sha256   []byte
+	transfer *UploadTransfer // throttles and counts the upload of the data. May be nil.
+}
+
+// Create a request body from data in memory and compute its checksums.
+func newS3Part(data []byte) s3Part {
+	md5_sum := md5.Sum(data)
+	sha256_sum := sha256.Sum256(data)
+	return s3Part{data: io.NewSectionReader(bytes.NewReader(data), 0, int64(len(data))), md5: md5_sum[:],
+		sha256: sha256_sum[:]}
+}
+
+// Compute the checksums of a part of a file. The request signature covers the checksum of
+// the body, so the part is read once to hash it and once more while it is sent.
+func hashS3Part(file *os.File, offset int64, length int64, transfer *UploadTransfer) (s3Part, error) {
+	data := io.NewSectionReader(file, offset, length)
+	md5_hash := md5.New()
+	sha256_hash := sha256.New()
+	if n, err := io.Copy(io.MultiWriter(md5_hash, sha256_hash), data); err != nil {
+		return s3Part{}, err
+	} else if n != length {
+		return s3Part{}, fmt.Errorf("%s changed while it was uploaded: read %d bytes instead of %d", file.Name(), n,
+			length)
+	}
+	return s3Part{data: data, md5: md5_hash.Sum(nil), sha256: sha256_hash.Sum(nil), transfer: transfer}, nil
+}
+
+// Send a signed request for an object and check that the storage answers with one of the
+// `expected` statuses. The body of the response is read into memory, so it doesn't have
+// to be closed.
+func (target *S3Target) do(method string, key string, query url.Values, header http.Header, body s3Part,
+	expected ...int) (*http.Response, error) {
+	request_url := *target.endpoint
+	request_url.Path = "/" + target.s3_config.Bucket + "/" + key
+	request_url.RawPath = "/" + s3Escape(target.s3_config.Bucket) + "/" + s3Escape(key)
+	request_url.RawQuery = s3CanonicalQuery(query)
+
+	request, err := http.NewRequest(method, request_url.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	if body.data != nil && body.data.Size() > 0 {
+		// The body is read from its start, also if the part was sent before.
+		data := io.NewSectionReader(body.data, 0, body.data.Size())
+		request.Body = ioutil.NopCloser(body.transfer.Reader(data))
+		request.ContentLength = data.Size()
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+	if body.md5 != nil {
+		request.Header.Set("Content-Md5", base64.StdEncoding.EncodeToString(body.md5))
+	}
+	request.Header.Set("User-Agent", "radarcape_listener/"+version)
+	target.sign(request, body, target.clock.Now().UTC())
+
+	response, err := target.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	response_body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	response.Body = ioutil.NopCloser(bytes.NewReader(response_body))
+
+	for _, status := range expected {
+		if response.StatusCode == status {
+			return response, nil
+		}
+	}
+	return nil, s3StatusError(request, response, response_body)
+}
+
+// Error response of the storage.
+type s3ErrorResponse struct {
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+// Describe an unexpected response by the error code and message of the storage.
+func s3StatusError(request *http.Request, response *http.Response, body []byte) error {
+	var error_response s3ErrorResponse
+	if err := xml.Unmarshal(body, &error_response); err != nil || error_response.Code == "" {
+		return fmt.Errorf("%s %s: %s", request.Method, request.URL.Path, response.Status)
+	}
+	return fmt.Errorf("%s %s: %s: %s: %s", request.Method, request.URL.Path, response.Status,
+		error_response.Code, error_response.Message)
+}
+
+// Decode the xml body of a response.
+func decodeS3Response(response *http.Response, value any) error {
+	if err := xml.NewDecoder(response.Body).Decode(value); err != nil {
+		return fmt.Errorf("%s %s: invalid response: %w", response.Request.Method, response.Request.URL.Path, err)
+	}
+	return nil
+}
+
+// Sign a request with AWS signature version 4.
+//
+// See https://docs.aws.amazon.com/AmazonS3/latest/API/sig-v4-header-based-auth.html
+func (target *S3Target) sign(request *http.Request, body s3Part, now time.Time) {
+	amz_date := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payload_hash := hex.EncodeToString(body.sha256)
+	if body.sha256 == nil {
+		empty_hash := sha256.Sum256(nil)
+		payload_hash = hex.EncodeToString(empty_hash[:])
+	}
+	request.Header.Set("X-Amz-Date", amz_date)
+	request.Header.Set("X-Amz-Content-Sha256", payload_hash)
+
+	// All the headers which were set so far are signed, except for the user agent which
+	// proxies may change.
+	headers := map[string]string{"host": request.URL.Host}
+	for key, values := range request.Header {
+		if key == "User-Agent" {
+			continue
+		}
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonical_headers strings.Builder
+	for _, name := range names {
+		canonical_headers.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signed_headers := strings.Join(names, ";")
+
+	canonical_request := strings.Join([]string{
+		request.Method,
+		request.URL.EscapedPath(),
+		request.URL.RawQuery,
+		canonical_headers.String(),
+		signed_headers,
+		payload_hash,
+	}, "\n")
+	canonical_request_hash := sha256.Sum256([]byte(canonical_request))
+
+	scope := date + "/" + target.s3_config.Region + "/s3/aws4_request"
+	string_to_sign := "AWS4-HMAC-SHA256\n" + amz_date + "\n" + scope + "\n" +
+		hex.EncodeToString(canonical_request_hash[:])
+
+	signing_key := hmacSha256([]byte("AWS4"+target.s3_config.Secret_access_key), date)
+	signing_key = hmacSha256(signing_key, target.s3_config.Region)
+	signing_key = hmacSha256(signing_key, "s3")
+	signing_key = hmacSha256(signing_key, "aws4_request")
+	signature := hex.EncodeToString(hmacSha256(signing_key, string_to_sign))
+
+	request.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+target.s3_config.Access_key_id+"/"+scope+
+		", SignedHeaders="+signed_headers+", Signature="+signature)
+}
+
+func hmacSha256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Escape a key as required by the signature: everything but the unreserved characters
+// and the slashes is percent-encoded.
+func s3Escape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' ||
+			b == '-' || b == '_' || b == '.' || b == '~' || b == '/' {
+			escaped.WriteByte(b)
+		} else {
+			fmt.Fprintf(&escaped, "%%%02X", b)
+		}
+	}
+	return escaped.String()
+}
+
+// Encode the query sorted by the names of the parameters, as required by the signature.
+func s3CanonicalQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parameters := make([]string, 0, len(names))
+	for _, name := range names {
+		for _, value := range query[name] {
+			parameters = append(parameters, strings.ReplaceAll(s3Escape(name), "/", "%2F")+"="+
+				strings.ReplaceAll(s3Escape(value), "/", "%2F"))
+		}
+	}
+	return strings.Join(parameters, "&")
+}
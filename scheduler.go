@@ -0,0 +1,405 @@
+// Job scheduling.
+//
+// The periodic jobs (rollover, upload, retention cleanup and daily report) are
+// configured with cron expressions or intervals. The scheduler remembers when each
+// job ran last such that a run which was missed while the machine was asleep or
+// switched off is caught up on the next start.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ScheduleConfig groups the schedules of the periodic jobs.
+//
+// Every schedule is either a cron expression with an optional leading seconds field
+// (e.g. "10 0 0 * * *" for 00:00:10 every day), one of the shortcuts @yearly, @monthly,
+// @weekly, @daily and @hourly, an interval such as "@every 15m" (aligned to midnight,
+// at most a day and dividing it) or "off" to disable the job.
+type ScheduleConfig struct {
+	Rollover  string `yaml:"rollover"`
+	Upload    string `yaml:"upload"`
+	Retention string `yaml:"retention"`
+	Report    string `yaml:"report"`
+}
+
+// Schedule computes the fire times of a job.
+type Schedule interface {
+	// Get the first fire time which is strictly after `after`.
+	Next(after time.Time) time.Time
+}
+
+// Parse a schedule. Returns a nil schedule if the job is turned off.
+//
+// The wall clock times of the schedule are interpreted in `location`.
+func ParseSchedule(expression string, location *time.Location) (Schedule, error) {
+	expression = strings.TrimSpace(expression)
+
+	switch expression {
+	case "off":
+		return nil, nil
+	case "@yearly", "@annually":
+		expression = "0 0 0 1 1 *"
+	case "@monthly":
+		expression = "0 0 0 1 * *"
+	case "@weekly":
+		expression = "0 0 0 * * 0"
+	case "@daily", "@midnight":
+		expression = "0 0 0 * * *"
+	case "@hourly":
+		expression = "0 0 * * * *"
+	}
+
+	if strings.HasPrefix(expression, "@every ") {
+		interval, err := time.ParseDuration(strings.TrimSpace(strings.TrimPrefix(expression, "@every ")))
+		if err != nil {
+			return nil, err
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval %s is shorter than one second", interval)
+		}
+		// Every day starts with a fire time at midnight, so a longer interval would fire daily.
+		if interval > 24*time.Hour {
+			return nil, fmt.Errorf("interval %s is longer than a day, use a cron expression instead", interval)
+		}
+		if (24*time.Hour)%interval != 0 {
+			return nil, fmt.Errorf("interval %s doesn't divide a day into equal parts", interval)
+		}
+		return IntervalSchedule{interval, location}, nil
+	}
+
+	return parseCronSchedule(expression, location)
+}
+
+// DailySchedule fires every day at the given wall clock time.
+type DailySchedule struct {
+	Hour, Minute, Second int
+	Location             *time.Location
+}
+
+func (schedule DailySchedule) Next(after time.Time) time.Time {
+	return NextDailyTime(after, schedule.Hour, schedule.Minute, schedule.Second, schedule.Location)
+}
+
+// IntervalSchedule fires at fixed intervals which are aligned to midnight, i.e. every
+// day starts with a fire time at 00:00:00. The interval divides 24 hours, so on days
+// with a DST transition only the last interval of the day is shorter or longer.
+type IntervalSchedule struct {
+	Interval time.Duration
+	Location *time.Location
+}
+
+func (schedule IntervalSchedule) Next(after time.Time) time.Time {
+	local_after := after.In(schedule.Location)
+	day_start := wallClockDate(local_after.Year(), local_after.Month(), local_after.Day(), 0, 0, 0, schedule.Location)
+	next_day_start := wallClockDate(local_after.Year(), local_after.Month(), local_after.Day()+1, 0, 0, 0, schedule.Location)
+
+	next_time := day_start.Add((after.Sub(day_start)/schedule.Interval + 1) * schedule.Interval)
+	if !next_time.Before(next_day_start) {
+		return next_day_start
+	}
+	return next_time
+}
+
+// CronSchedule implements the classic cron semantics with an additional seconds field.
+type CronSchedule struct {
+	second, minute, hour, day_of_month, month, day_of_week uint64 // bit sets of the allowed values.
+	location                                               *time.Location
+}
+
+type cronField struct {
+	name     string
+	min, max int
+}
+
+var cron_fields = []cronField{
+	{"second", 0, 59},
+	{"minute", 0, 59},
+	{"hour", 0, 23},
+	{"day of month", 1, 31},
+	{"month", 1, 12},
+	{"day of week", 0, 7}, // 0 and 7 are both sunday.
+}
+
+func parseCronSchedule(expression string, location *time.Location) (Schedule, error) {
+	fields := strings.Fields(expression)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, fmt.Errorf("cron expression %q must have 5 or 6 fields", expression)
+	}
+
+	bit_sets := make([]uint64, len(fields))
+	for i, field := range fields {
+		bit_set, err := parseCronField(field, cron_fields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron expression %q: %w", expression, err)
+		}
+		bit_sets[i] = bit_set
+	}
+
+	// Sunday can be given as 0 or 7.
+	if bit_sets[5]&(1<<7) != 0 {
+		bit_sets[5] |= 1
+	}
+
+	return CronSchedule{
+		second:       bit_sets[0],
+		minute:       bit_sets[1],
+		hour:         bit_sets[2],
+		day_of_month: bit_sets[3],
+		month:        bit_sets[4],
+		day_of_week:  bit_sets[5],
+		location:     location,
+	}, nil
+}
+
+// Parse a comma separated list of values, ranges (a-b) and steps (*/n, a-b/n).
+func parseCronField(field string, spec cronField) (uint64, error) {
+	var bit_set uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if range_part, step_part, ok := strings.Cut(part, "/"); ok {
+			parsed, err := strconv.Atoi(step_part)
+			if err != nil || parsed <= 0 {
+				return 0, fmt.Errorf("invalid step %q in the %s field", step_part, spec.name)
+			}
+			step = parsed
+			part = range_part
+		}
+
+		low, high := spec.min, spec.max
+		if part != "*" {
+			low_part, high_part, is_range := strings.Cut(part, "-")
+			var err error
+			if low, err = strconv.Atoi(low_part); err != nil {
+				return 0, fmt.Errorf("invalid value %q in the %s field", part, spec.name)
+			}
+			high = low
+			if is_range {
+				if high, err = strconv.Atoi(high_part); err != nil {
+					return 0, fmt.Errorf("invalid value %q in the %s field", part, spec.name)
+				}
+			} else if step > 1 {
+				// `a/n` means every n-th value starting at a.
+				high = spec.max
+			}
+		}
+
+		if low < spec.min || high > spec.max || low > high {
+			return 0, fmt.Errorf("%q is out of the range %d-%d of the %s field", part, spec.min, spec.max, spec.name)
+		}
+		for value := low; value <= high; value += step {
+			bit_set |= 1 << uint(value)
+		}
+	}
+
+	return bit_set, nil
+}
+
+func (schedule CronSchedule) Next(after time.Time) time.Time {
+	location := schedule.location
+	t := after.In(location).Truncate(time.Second).Add(time.Second)
+
+	// Move forward to the next candidate. The wall clock might not move forward
+	// (e.g. when the clocks are turned back), in which case we skip ahead by the
+	// given fallback duration.
+	advance := func(candidate time.Time, fallback time.Duration) time.Time {
+		if !candidate.After(t) {
+			return t.Add(fallback)
+		}
+		return candidate
+	}
+
+	// No valid time within five years means the expression can never match (e.g. Feb. 30).
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if schedule.month&(1<<uint(t.Month())) == 0 {
+			t = advance(wallClockDate(t.Year(), t.Month()+1, 1, 0, 0, 0, location), 24*time.Hour)
+			continue
+		}
+		if !schedule.dayMatches(t) {
+			t = advance(wallClockDate(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, location), time.Hour)
+			continue
+		}
+		if schedule.hour&(1<<uint(t.Hour())) == 0 {
+			t = advance(wallClockDate(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, location), time.Minute)
+			continue
+		}
+		if schedule.minute&(1<<uint(t.Minute())) == 0 {
+			t = advance(wallClockDate(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute()+1, 0, location), time.Second)
+			continue
+		}
+		if schedule.second&(1<<uint(t.Second())) == 0 {
+			t = t.Add(time.Second)
+			continue
+		}
+		return t
+	}
+
+	return time.Time{}
+}
+
+// Day of month and day of week are combined like in cron: if both are restricted,
+// either of them has to match, otherwise the restricted one has to match.
+func (schedule CronSchedule) dayMatches(t time.Time) bool {
+	const all_days_of_month uint64 = (1<<32 - 1) &^ 1
+	const all_days_of_week uint64 = 1<<8 - 1
+
+	day_of_month_match := schedule.day_of_month&(1<<uint(t.Day())) != 0
+	day_of_week_match := schedule.day_of_week&(1<<uint(t.Weekday())) != 0
+
+	if schedule.day_of_month == all_days_of_month || schedule.day_of_week == all_days_of_week {
+		return day_of_month_match && day_of_week_match
+	}
+	return day_of_month_match || day_of_week_match
+}
+
+// Scheduler creates the tickers of the jobs and persists the time of their last run.
+type Scheduler struct {
+	clock      Clock
+	state_path string
+
+	mu        sync.Mutex
+	last_runs map[string]time.Time
+	tickers   []*TimeTicker
+}
+
+// Create a scheduler whose state is stored in the file at `state_path`.
+func NewScheduler(clock Clock, state_path string) *Scheduler {
+	scheduler := &Scheduler{
+		clock:      clock,
+		state_path: state_path,
+		last_runs:  make(map[string]time.Time),
+	}
+
+	state, err := ioutil.ReadFile(state_path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		ticker_log.Warn("failed to read the scheduler state. Missed runs are not caught up.", "path", state_path, "err", err)
+	} else if err == nil {
+		if err := json.Unmarshal(state, &scheduler.last_runs); err != nil {
+			ticker_log.Warn("failed to decode the scheduler state. Missed runs are not caught up.", "path", state_path, "err", err)
+		}
+	}
+
+	return scheduler
+}
+
+// Create the ticker of a job.
+//
+// If `catch_up` is set and the job missed a run since it ran last (e.g. because the
+// machine was switched off), the ticker fires immediately. Several missed runs are
+// caught up by a single run. A run only counts once the job called Done on the ticker,
+// so a run which failed or was interrupted is caught up as well.
+func (scheduler *Scheduler) Add(name string, schedule Schedule, catch_up bool) *TimeTicker {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	now := scheduler.clock.Now()
+
+	missed_run := false
+	if last_run, ok := scheduler.last_runs[name]; ok {
+		if next_run := schedule.Next(last_run); !next_run.After(now) {
+			missed_run = true
+			if catch_up {
+				ticker_log.Info("catching up on a missed run.", "job", name, "last_run", last_run, "missed_run", next_run)
+			} else {
+				ticker_log.Debug("skipping missed run.", "job", name, "last_run", last_run, "missed_run", next_run)
+			}
+		}
+	} else {
+		// Start tracking the job from now on such that runs which are missed
+		// from here on can be caught up.
+		scheduler.last_runs[name] = now
+		scheduler.save()
+	}
+	if missed_run && !catch_up {
+		scheduler.last_runs[name] = now
+		scheduler.save()
+	}
+
+	ticker := NewScheduleTicker(scheduler.clock, schedule, missed_run && catch_up, func() {
+		scheduler.markRun(name, scheduler.clock.Now())
+	})
+	scheduler.tickers = append(scheduler.tickers, ticker)
+
+	ticker_log.Info("scheduled job.", "job", name, "next_run", schedule.Next(now))
+	return ticker
+}
+
+// Stop the tickers of all the jobs.
+func (scheduler *Scheduler) Stop() {
+	scheduler.mu.Lock()
+	tickers := scheduler.tickers
+	scheduler.tickers = nil
+	scheduler.mu.Unlock()
+
+	for _, ticker := range tickers {
+		ticker.Stop()
+	}
+}
+
+func (scheduler *Scheduler) markRun(name string, run_time time.Time) {
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	scheduler.last_runs[name] = run_time
+	scheduler.save()
+}
+
+// Write the state file. The state is written to a temporary file first such that a
+// crash while writing does not corrupt it.
+func (scheduler *Scheduler) save() {
+	state, err := json.MarshalIndent(scheduler.last_runs, "", "  ")
+	if err != nil {
+		ticker_log.Warn("failed to encode the scheduler state.", "err", err)
+		return
+	}
+
+	if err := writeFileAtomic(scheduler.state_path, state); err != nil {
+		ticker_log.Warn("failed to save the scheduler state.", "path", scheduler.state_path, "err", err)
+	}
+}
+
+// Write a file by writing to a temporary file in the same folder and renaming it. The file
+// and the folder are synced, so the file is complete after a power loss.
+func writeFileAtomic(file_path string, data []byte) error {
+	if err := createFolder(filepath.Dir(file_path)); err != nil {
+		return err
+	}
+
+	tmp_path := file_path + ".tmp"
+	tmp_file, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp_file.Write(data); err != nil {
+		tmp_file.Close()
+		return err
+	}
+	if err := tmp_file.Sync(); err != nil {
+		tmp_file.Close()
+		return err
+	}
+	if err := tmp_file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp_path, file_path); err != nil {
+		return err
+	}
+	return syncFolder(filepath.Dir(file_path))
+}
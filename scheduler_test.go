@@ -0,0 +1,268 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNextDailyTimeAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	tests := []struct {
+		name                 string
+		now                  string
+		hour, minute, second int
+		expected             string
+	}{
+		{"day before spring", "2024-03-30T00:00:10+01:00", 0, 0, 10, "2024-03-31T00:00:10+01:00"},
+		{"23h day", "2024-03-31T00:00:10+01:00", 0, 0, 10, "2024-04-01T00:00:10+02:00"},
+		{"day before autumn", "2024-10-26T00:00:10+02:00", 0, 0, 10, "2024-10-27T00:00:10+02:00"},
+		{"25h day", "2024-10-27T00:00:10+02:00", 0, 0, 10, "2024-10-28T00:00:10+01:00"},
+		{"time in the gap", "2024-03-31T00:00:00+01:00", 2, 30, 0, "2024-03-31T03:30:00+02:00"},
+		{"repeated time", "2024-10-27T00:00:00+02:00", 2, 30, 0, "2024-10-27T02:30:00+02:00"},
+		{"repeated time once", "2024-10-27T02:30:00+02:00", 2, 30, 0, "2024-10-28T02:30:00+01:00"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			next := NextDailyTime(parseTestTime(t, test.now), test.hour, test.minute, test.second, zurich)
+			if expected := parseTestTime(t, test.expected); !next.Equal(expected) {
+				t.Errorf("next time is %s, expected %s", next, expected)
+			}
+		})
+	}
+}
+
+func TestCronScheduleAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	tests := []struct {
+		name       string
+		expression string
+		after      string
+		expected   []string
+	}{
+		{
+			"daily rollover in spring", "10 0 0 * * *", "2024-03-30T00:00:10+01:00",
+			[]string{"2024-03-31T00:00:10+01:00", "2024-04-01T00:00:10+02:00", "2024-04-02T00:00:10+02:00"},
+		},
+		{
+			"daily rollover in autumn", "10 0 0 * * *", "2024-10-26T00:00:10+02:00",
+			[]string{"2024-10-27T00:00:10+02:00", "2024-10-28T00:00:10+01:00", "2024-10-29T00:00:10+01:00"},
+		},
+		{
+			"hourly rollover skips the gap", "10 0 * * * *", "2024-03-31T00:30:00+01:00",
+			[]string{"2024-03-31T01:00:10+01:00", "2024-03-31T03:00:10+02:00", "2024-03-31T04:00:10+02:00"},
+		},
+		{
+			"hourly rollover at the start of the repeated hour", "10 0 * * * *", "2024-10-27T00:30:00+02:00",
+			[]string{"2024-10-27T01:00:10+02:00", "2024-10-27T02:00:10+02:00", "2024-10-27T03:00:10+01:00"},
+		},
+		{
+			"hourly rollover within the repeated hour", "10 0 * * * *", "2024-10-27T02:15:00+01:00",
+			[]string{"2024-10-27T03:00:10+01:00"},
+		},
+		{
+			"job in the gap", "10 30 2 * * *", "2024-03-30T12:00:00+01:00",
+			[]string{"2024-04-01T02:30:10+02:00"},
+		},
+		{
+			"job in the repeated hour", "10 30 2 * * *", "2024-10-26T12:00:00+02:00",
+			[]string{"2024-10-27T02:30:10+02:00", "2024-10-28T02:30:10+01:00"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.expression, zurich)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := parseTestTime(t, test.after)
+			for _, value := range test.expected {
+				next = schedule.Next(next)
+				if expected := parseTestTime(t, value); !next.Equal(expected) {
+					t.Fatalf("next time is %s, expected %s", next, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestIntervalScheduleAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	tests := []struct {
+		name       string
+		expression string
+		after      string
+		expected   []string
+	}{
+		{
+			"short day", "@every 6h", "2024-03-30T19:00:00+01:00",
+			[]string{"2024-03-31T00:00:00+01:00", "2024-03-31T07:00:00+02:00", "2024-03-31T13:00:00+02:00",
+				"2024-03-31T19:00:00+02:00", "2024-04-01T00:00:00+02:00", "2024-04-01T06:00:00+02:00"},
+		},
+		{
+			"long day", "@every 12h", "2024-10-27T00:00:00+02:00",
+			[]string{"2024-10-27T11:00:00+01:00", "2024-10-27T23:00:00+01:00", "2024-10-28T00:00:00+01:00",
+				"2024-10-28T12:00:00+01:00"},
+		},
+		{
+			"whole day", "@every 24h", "2024-03-30T12:00:00+01:00",
+			[]string{"2024-03-31T00:00:00+01:00", "2024-04-01T00:00:00+02:00"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			schedule, err := ParseSchedule(test.expression, zurich)
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := parseTestTime(t, test.after)
+			for _, value := range test.expected {
+				next = schedule.Next(next)
+				if expected := parseTestTime(t, value); !next.Equal(expected) {
+					t.Fatalf("next time is %s, expected %s", next, expected)
+				}
+			}
+		})
+	}
+}
+
+func TestParseScheduleRejectsInvalidIntervals(t *testing.T) {
+	tests := []struct {
+		expression string
+		err        string
+	}{
+		{"@every 500ms", "interval 500ms is shorter than one second"},
+		{"@every 48h", "interval 48h0m0s is longer than a day, use a cron expression instead"},
+		{"@every 25h", "interval 25h0m0s is longer than a day, use a cron expression instead"},
+		{"@every 7m", "interval 7m0s doesn't divide a day into equal parts"},
+		{"@every 5h", "interval 5h0m0s doesn't divide a day into equal parts"},
+	}
+	for _, test := range tests {
+		_, err := ParseSchedule(test.expression, time.UTC)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got the error %v, expected %q", test.expression, err, test.err)
+		}
+	}
+}
+
+// A step of a ticker test: the fake clock is set to `now` and the ticker is expected to fire
+// at `fired`, or not at all if `fired` is empty.
+type tickerStep struct {
+	now   string
+	fired string
+}
+
+// Run a ticker with the given schedule on a fake clock and check when it fires.
+func checkScheduleTicker(t *testing.T, schedule Schedule, start string, steps []tickerStep) {
+	t.Helper()
+	clock := NewFakeClock(parseTestTime(t, start))
+	ticker := NewScheduleTicker(clock, schedule, false, nil)
+	defer ticker.Stop()
+
+	for _, step := range steps {
+		waitUntil(t, "the ticker waits for its next tick", func() bool { return clock.Waiters() == 1 })
+		clock.Set(parseTestTime(t, step.now))
+		if step.fired == "" {
+			select {
+			case fire_time := <-ticker.Processor_tick_chan:
+				t.Fatalf("the ticker fired at %s before %s", fire_time, step.now)
+			default:
+			}
+			continue
+		}
+
+		select {
+		case fire_time := <-ticker.Processor_tick_chan:
+			if expected := parseTestTime(t, step.fired); !fire_time.Equal(expected) {
+				t.Fatalf("the ticker fired at %s, expected %s", fire_time, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the ticker didn't fire before %s", step.now)
+		}
+	}
+}
+
+func TestScheduleTickerRollsOverDailyAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	schedule := DailySchedule{0, 0, 10, zurich}
+
+	// The rollovers of the 23h day are 23 hours apart.
+	checkScheduleTicker(t, schedule, "2024-03-29T12:00:00+01:00", []tickerStep{
+		{"2024-03-30T12:00:00+01:00", "2024-03-30T00:00:10+01:00"},
+		{"2024-03-31T12:00:00+02:00", "2024-03-31T00:00:10+01:00"},
+		{"2024-04-01T00:00:09+02:00", ""},
+		{"2024-04-01T12:00:00+02:00", "2024-04-01T00:00:10+02:00"},
+	})
+
+	// The rollovers of the 25h day are 25 hours apart.
+	checkScheduleTicker(t, schedule, "2024-10-26T12:00:00+02:00", []tickerStep{
+		{"2024-10-27T12:00:00+01:00", "2024-10-27T00:00:10+02:00"},
+		{"2024-10-27T23:00:10+01:00", ""},
+		{"2024-10-28T00:00:09+01:00", ""},
+		{"2024-10-28T12:00:00+01:00", "2024-10-28T00:00:10+01:00"},
+	})
+}
+
+func TestScheduleTickerRollsOverHourlyAcrossDstTransitions(t *testing.T) {
+	zurich := loadZurich(t)
+	schedule, err := ParseSchedule(Partitioning{Interval: time.Hour, Location: zurich}.RolloverSchedule(), zurich)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkScheduleTicker(t, schedule, "2024-03-31T00:30:00+01:00", []tickerStep{
+		{"2024-03-31T01:30:00+01:00", "2024-03-31T01:00:10+01:00"},
+		{"2024-03-31T03:30:00+02:00", "2024-03-31T03:00:10+02:00"},
+		{"2024-03-31T04:30:00+02:00", "2024-03-31T04:00:10+02:00"},
+	})
+
+	// The repeated hour is a single partition, so there is no rollover when it starts again.
+	checkScheduleTicker(t, schedule, "2024-10-27T00:30:00+02:00", []tickerStep{
+		{"2024-10-27T01:30:00+02:00", "2024-10-27T01:00:10+02:00"},
+		{"2024-10-27T02:30:00+02:00", "2024-10-27T02:00:10+02:00"},
+		{"2024-10-27T02:30:00+01:00", ""},
+		{"2024-10-27T03:30:00+01:00", "2024-10-27T03:00:10+01:00"},
+	})
+}
+
+func TestSchedulerCatchesUpOnRunsWhichWereNotDone(t *testing.T) {
+	state_path := t.TempDir() + "/scheduler.json"
+	schedule := DailySchedule{0, 0, 10, time.UTC}
+	clock := NewFakeClock(parseTestTime(t, "2024-01-01T12:00:00Z"))
+
+	// The run fires after a suspension of the machine but fails.
+	scheduler := NewScheduler(clock, state_path)
+	ticker := scheduler.Add("upload", schedule, true)
+	waitUntil(t, "the ticker waits for its next tick", func() bool { return clock.Waiters() == 1 })
+	clock.Set(parseTestTime(t, "2024-01-02T08:00:00Z"))
+	select {
+	case fire_time := <-ticker.Processor_tick_chan:
+		if expected := parseTestTime(t, "2024-01-02T00:00:10Z"); !fire_time.Equal(expected) {
+			t.Fatalf("the ticker fired at %s, expected %s", fire_time, expected)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the ticker didn't fire after the suspension")
+	}
+	scheduler.Stop()
+
+	// The failed run is caught up after a restart and marked as done.
+	scheduler = NewScheduler(clock, state_path)
+	ticker = scheduler.Add("upload", schedule, true)
+	select {
+	case <-ticker.Processor_tick_chan:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the failed run wasn't caught up")
+	}
+	ticker.Done()
+	scheduler.Stop()
+
+	// A run which was done isn't caught up again.
+	scheduler = NewScheduler(clock, state_path)
+	defer scheduler.Stop()
+	ticker = scheduler.Add("upload", schedule, true)
+	waitUntil(t, "the ticker waits for its next tick", func() bool { return clock.Waiters() == 1 })
+	select {
+	case fire_time := <-ticker.Processor_tick_chan:
+		t.Fatalf("the ticker caught up on the run at %s which was done", fire_time)
+	default:
+	}
+}
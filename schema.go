@@ -0,0 +1,242 @@
+// CSV schema.
+//
+// Makes sure that a csv file only contains rows of one layout. Before the listener appends
+// to an existing file, the header of the file is compared with the header of the configured
+// columns. On a mismatch (e.g. after an upgrade which changed the AircraftData struct or a
+// changed column list) the listener either continues with the next part of the partition
+// or rewrites the file in the new layout. Every day folder contains a metadata file which
+// records the schema version, the listener version and the config of its files.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"gopkg.in/yaml.v2"
+)
+
+// csvSchemaVersion is the version of the layout of the csv files. It has to be increased
+// whenever the fields of the AircraftData struct or the formatting of the values change.
+const csvSchemaVersion int = 1
+
+// Handling of existing files whose header doesn't match the configured columns.
+const (
+	headerMismatchRoll    string = "roll"    // continue with the next part of the partition.
+	headerMismatchMigrate string = "migrate" // rewrite the file in the new layout.
+)
+
+// metadataFileName is the name of the metadata file in every day folder.
+const metadataFileName string = "metadata.json"
+
+// dayMetadata is the content of the metadata file of a day folder. The top level values
+// are the ones of the file which was created last.
+type dayMetadata struct {
+	Schema_version   int                     `json:"schema_version"`
+	Listener_version string                  `json:"listener_version"`
+	Config_hash      string                  `json:"config_hash"`
+	Files            map[string]fileMetadata `json:"files"`
+}
+
+// fileMetadata describes the layout of one csv file.
+type fileMetadata struct {
+	Schema_version   int      `json:"schema_version"`
+	Listener_version string   `json:"listener_version"`
+	Config_hash      string   `json:"config_hash"`
+	Header           string   `json:"header"`  // header naming.
+	Columns          []string `json:"columns"` // json names of the columns.
+}
+
+// Get a hash of the settings which shape the data files (partitions, compression, columns
+// and site), such that files which were written with different settings can be told apart.
+//
+// The other settings, e.g. the credentials of the upload target, are not part of the hash.
+func (config Config) Hash() string {
+	data, err := yaml.Marshal(struct {
+		Rotation    RotationConfig
+		Timezone    string
+		Compression CompressionConfig
+		Csv         CsvConfig
+		Site        SiteConfig
+	}{config.Rotation, config.Timezone, config.Compression, config.Csv, config.Site})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Check whether the header of an existing csv file matches `header`. An empty file has no header.
+func csvHeaderMatches(file_path string, header []string) (matches bool, empty bool, err error) {
+	reader, err := openDataFile(file_path)
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			// A compressed file without a single frame.
+			return false, true, nil
+		}
+		return false, false, err
+	}
+	defer reader.Close()
+
+	csv_reader := csv.NewReader(reader)
+	csv_reader.FieldsPerRecord = -1
+	existing_header, err := csv_reader.Read()
+	if errors.Is(err, io.EOF) {
+		return false, true, nil
+	} else if err != nil {
+		return false, false, err
+	}
+
+	if len(existing_header) != len(header) {
+		return false, false, nil
+	}
+	for i := range header {
+		if existing_header[i] != header[i] {
+			return false, false, nil
+		}
+	}
+	return true, false, nil
+}
+
+// Rewrite an existing csv file in the given layout.
+//
+// The columns of the file are matched by their name in any of the header namings. Columns
+// which the file doesn't contain are left empty. The file is replaced atomically, such
+// that it is either migrated completely or left as it was.
+func migrateCsvFile(file_path string, layout CsvLayout, compression CompressionConfig) (err error) {
+	reader, err := openDataFile(file_path)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	csv_reader := csv.NewReader(reader)
+	csv_reader.FieldsPerRecord = -1
+	existing_header, err := csv_reader.Read()
+	if err != nil {
+		return fmt.Errorf("failed to read the header: %w", err)
+	}
+
+	// Index of every column of the layout in the existing file, -1 if it is missing.
+	source_indices := make([]int, len(layout.columns))
+	for i, column := range layout.columns {
+		source_indices[i] = -1
+		for j, name := range existing_header {
+			if name == column.Go_name || name == column.Json_name || name == column.Long_name {
+				source_indices[i] = j
+				break
+			}
+		}
+	}
+
+	temp_file, err := ioutil.TempFile(filepath.Dir(file_path), ".migrating_")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			temp_file.Close()
+			os.Remove(temp_file.Name())
+		}
+	}()
+
+	compressor, err := newFrameWriter(temp_file, compression)
+	if err != nil {
+		return err
+	}
+	var csv_writer *csv.Writer
+	if compressor != nil {
+		csv_writer = csv.NewWriter(compressor)
+	} else {
+		csv_writer = csv.NewWriter(temp_file)
+	}
+
+	csv_writer.Write(layout.Header())
+	row := make([]string, len(layout.columns))
+	for {
+		existing_row, err := csv_reader.Read()
+		if errors.Is(err, io.EOF) || err != nil && isUnfinishedStream(err) {
+			// The rows up to a crash of a compressed file are kept.
+			break
+		} else if err != nil {
+			return err
+		}
+		for i, source_index := range source_indices {
+			row[i] = ""
+			if source_index >= 0 && source_index < len(existing_row) {
+				row[i] = existing_row[source_index]
+			}
+		}
+		if err := csv_writer.Write(row); err != nil {
+			return err
+		}
+	}
+
+	csv_writer.Flush()
+	if err := csv_writer.Error(); err != nil {
+		return err
+	}
+	if compressor != nil {
+		if err := compressor.Close(); err != nil {
+			return err
+		}
+	}
+	if err := temp_file.Sync(); err != nil {
+		return err
+	}
+	if err := temp_file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(temp_file.Name(), file_path)
+}
+
+// Record the layout of a newly created (or migrated) csv file in the metadata file of its
+// day folder.
+func updateDayMetadata(folder_path string, file_name string, layout CsvLayout, config_hash string) error {
+	metadata_path := folder_path + metadataFileName
+
+	var metadata dayMetadata
+	data, err := ioutil.ReadFile(metadata_path)
+	if err == nil {
+		if err := json.Unmarshal(data, &metadata); err != nil {
+			processor_log.Warn("the metadata file is corrupt. Replacing it.", "path", metadata_path, "err", err)
+			metadata = dayMetadata{}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	columns := make([]string, len(layout.columns))
+	for i, column := range layout.columns {
+		columns[i] = column.Json_name
+	}
+
+	metadata.Schema_version = csvSchemaVersion
+	metadata.Listener_version = version
+	metadata.Config_hash = config_hash
+	if metadata.Files == nil {
+		metadata.Files = make(map[string]fileMetadata)
+	}
+	metadata.Files[file_name] = fileMetadata{
+		Schema_version:   csvSchemaVersion,
+		Listener_version: version,
+		Config_hash:      config_hash,
+		Header:           layout.csv_config.Header,
+		Columns:          columns,
+	}
+
+	data, err = json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(metadata_path, append(data, '\n'))
+}
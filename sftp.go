@@ -0,0 +1,360 @@
+// SFTP upload target.
+//
+// Uploads the data files to a server over SSH. The client authenticates with a private key
+// and only connects to hosts whose key is listed in the known_hosts file. Every file is
+// written to a hidden .part file next to its destination and renamed once it is complete,
+// such that scripts on the server never see half uploaded files. An interrupted upload is
+// resumed from the size of its .part file if the .part file holds the start of the local
+// file, otherwise it starts over.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SftpConfig groups the parameters of the SFTP upload target.
+type SftpConfig struct {
+	Host             string `yaml:"host"` // host name with an optional port, e.g. data.example.org:2222.
+	Username         string `yaml:"username"`
+	Key_file         string `yaml:"key_file"`         // private key, e.g. ~/.ssh/id_ed25519.
+	Key_passphrase   string `yaml:"key_passphrase"`   // preferably set by RADARCAPE_UPLOAD_SFTP_KEY_PASSPHRASE.
+	Known_hosts_file string `yaml:"known_hosts_file"` // default: ~/.ssh/known_hosts.
+	Path             string `yaml:"path"`             // remote folder of the day folders. Relative to the home folder unless absolute.
+	Timeout          string `yaml:"timeout"`          // of the connection setup, e.g. 30s.
+}
+
+// sftpPartSuffix is appended to the names of the files which are being uploaded.
+const sftpPartSuffix string = ".part"
+
+// Fill in the default values of the SFTP parameters which were not specified.
+func (sftp_config *SftpConfig) applyDefaults() {
+	if sftp_config.Known_hosts_file == "" {
+		if home_dir, err := os.UserHomeDir(); err == nil {
+			sftp_config.Known_hosts_file = filepath.Join(home_dir, ".ssh", "known_hosts")
+		}
+	}
+	if sftp_config.Timeout == "" {
+		sftp_config.Timeout = "30s"
+	}
+}
+
+// Normalise the host and expand the home folder in the local paths.
+func (sftp_config *SftpConfig) normalize() {
+	sftp_config.Host = strings.TrimSpace(sftp_config.Host)
+	if sftp_config.Host != "" {
+		if _, _, err := net.SplitHostPort(sftp_config.Host); err != nil {
+			sftp_config.Host = net.JoinHostPort(strings.Trim(sftp_config.Host, "[]"), "22")
+		}
+	}
+	sftp_config.Key_file = expandHomeFolder(strings.TrimSpace(sftp_config.Key_file))
+	sftp_config.Known_hosts_file = expandHomeFolder(strings.TrimSpace(sftp_config.Known_hosts_file))
+	sftp_config.Path = strings.TrimSpace(sftp_config.Path)
+}
+
+// Check the SFTP parameters and add the problems to `config_errors`.
+func (sftp_config SftpConfig) validate(config_errors *ConfigErrors) {
+	if sftp_config.Host == "" {
+		config_errors.add("upload.sftp.host: must be specified for the sftp target")
+	} else if _, _, err := net.SplitHostPort(sftp_config.Host); err != nil {
+		config_errors.add("upload.sftp.host: %s", err)
+	}
+	if sftp_config.Username == "" {
+		config_errors.add("upload.sftp.username: must be specified for the sftp target")
+	}
+	if sftp_config.Key_file == "" {
+		config_errors.add("upload.sftp.key_file: must be specified for the sftp target")
+	}
+	if sftp_config.Known_hosts_file == "" {
+		config_errors.add("upload.sftp.known_hosts_file: must be specified for the sftp target")
+	}
+	if _, err := parseUploadDuration(sftp_config.Timeout); err != nil {
+		config_errors.add("upload.sftp.timeout: %s", err)
+	}
+}
+
+// Replace a leading ~/ by the home folder of the user.
+func expandHomeFolder(file_path string) string {
+	if file_path != "~" && !strings.HasPrefix(file_path, "~/") {
+		return file_path
+	}
+	home_dir, err := os.UserHomeDir()
+	if err != nil {
+		return file_path
+	}
+	return filepath.Join(home_dir, file_path[1:])
+}
+
+// SftpTarget uploads the files to a server over SSH.
+//
+// The connection is opened on the first use and shared by all the uploads until the
+// target is closed or the connection breaks.
+type SftpTarget struct {
+	sftp_config   SftpConfig
+	client_config *ssh.ClientConfig
+
+	mutex      sync.Mutex
+	ssh_client *ssh.Client
+	client     *sftp.Client
+}
+
+// Create an SFTP target from its config. The key and the known hosts are loaded right away.
+func NewSftpTarget(sftp_config SftpConfig) (*SftpTarget, error) {
+	key, err := ioutil.ReadFile(sftp_config.Key_file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the private key: %w", err)
+	}
+	var signer ssh.Signer
+	if sftp_config.Key_passphrase != "" {
+		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(sftp_config.Key_passphrase))
+	} else {
+		signer, err = ssh.ParsePrivateKey(key)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the private key %s: %w", sftp_config.Key_file, err)
+	}
+
+	host_key_callback, err := knownhosts.New(sftp_config.Known_hosts_file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the known hosts: %w", err)
+	}
+	timeout, err := parseUploadDuration(sftp_config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	return &SftpTarget{
+		sftp_config: sftp_config,
+		client_config: &ssh.ClientConfig{
+			User:            sftp_config.Username,
+			Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+			HostKeyCallback: host_key_callback,
+			Timeout:         timeout,
+		},
+	}, nil
+}
+
+func (target *SftpTarget) String() string {
+	return "sftp://" + target.sftp_config.Username + "@" + target.sftp_config.Host + "/" +
+		strings.TrimPrefix(target.sftp_config.Path, "/")
+}
+
+// Get the SFTP client, connecting to the server if necessary.
+func (target *SftpTarget) connect() (*sftp.Client, error) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	if target.client != nil {
+		return target.client, nil
+	}
+
+	ssh_client, err := ssh.Dial("tcp", target.sftp_config.Host, target.client_config)
+	if err != nil {
+		// An unknown host key has to be added to the known hosts, e.g. by connecting with ssh once.
+		return nil, fmt.Errorf("failed to connect to %s (known hosts: %s): %w", target.sftp_config.Host,
+			target.sftp_config.Known_hosts_file, err)
+	}
+	client, err := sftp.NewClient(ssh_client)
+	if err != nil {
+		ssh_client.Close()
+		return nil, err
+	}
+
+	target.ssh_client = ssh_client
+	target.client = client
+
+	// The next upload reconnects once the connection is closed, e.g. by the server.
+	go func() {
+		ssh_client.Wait()
+		target.disconnect(client)
+	}()
+	return client, nil
+}
+
+// Close the connection of `client` unless the target uses another connection already.
+func (target *SftpTarget) disconnect(client *sftp.Client) {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	if target.client != client {
+		return
+	}
+	target.client.Close()
+	target.ssh_client.Close()
+	target.client = nil
+	target.ssh_client = nil
+}
+
+// Check whether an error of the SFTP client means that the connection is broken (rather than
+// an error which the server replied).
+func isSftpTransportError(err error) bool {
+	var net_error net.Error
+	return errors.Is(err, sftp.ErrSSHFxConnectionLost) || errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &net_error)
+}
+
+// Get the remote path of a path relative to the configured folder.
+func (target *SftpTarget) remotePath(relative_path string) string {
+	if target.sftp_config.Path == "" {
+		return path.Clean(relative_path)
+	}
+	return path.Join(target.sftp_config.Path, relative_path)
+}
+
+// Create the configured folder and `dir` within it including the missing parents.
+func (target *SftpTarget) MakeDir(dir string) error {
+	client, err := target.connect()
+	if err != nil {
+		return err
+	}
+	err = client.MkdirAll(target.remotePath(dir))
+	if err != nil && isSftpTransportError(err) {
+		target.disconnect(client)
+	}
+	return err
+}
+
+// Upload a file to a .part file and rename it once it is complete.
+//
+// If a .part file of the upload exists already (because a previous upload was interrupted),
+// the upload continues after its end as long as it holds the start of the local file.
+func (target *SftpTarget) Upload(local_path string, remote_path string, transfer *UploadTransfer) error {
+	client, err := target.connect()
+	if err != nil {
+		return err
+	}
+	err = target.upload(client, local_path, remote_path, transfer)
+	if err != nil && isSftpTransportError(err) {
+		target.disconnect(client)
+	}
+	return err
+}
+
+func (target *SftpTarget) upload(client *sftp.Client, local_path string, remote_path string,
+	transfer *UploadTransfer) error {
+	file, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+
+	destination := target.remotePath(remote_path)
+	part_path := path.Join(path.Dir(destination), "."+path.Base(destination)+sftpPartSuffix)
+
+	// A .part file which doesn't hold the start of the local file (e.g. one of an earlier
+	// version of the file) is overwritten.
+	offset := int64(0)
+	flags := os.O_WRONLY | os.O_CREATE
+	if part_info, err := client.Stat(part_path); err == nil && part_info.Size() > 0 && part_info.Size() <= size {
+		matches, err := sftpPrefixMatches(client, part_path, file, part_info.Size())
+		if err != nil {
+			return err
+		}
+		if matches {
+			offset = part_info.Size()
+			uploader_log.Info("resuming an interrupted upload.", "path", destination, "offset", offset, "size", size)
+		} else {
+			uploader_log.Info("the partial upload doesn't match the file. Uploading it again.", "path", destination)
+		}
+	}
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+
+	remote_file, err := client.OpenFile(part_path, flags)
+	if err != nil {
+		return err
+	}
+	if _, err := remote_file.Seek(offset, io.SeekStart); err != nil {
+		remote_file.Close()
+		return err
+	}
+	if _, err := remote_file.ReadFrom(transfer.Reader(io.NewSectionReader(file, offset, size-offset))); err != nil {
+		remote_file.Close()
+		return err
+	}
+	if err := remote_file.Close(); err != nil {
+		return err
+	}
+
+	part_info, err := client.Stat(part_path)
+	if err != nil {
+		return err
+	}
+	if part_info.Size() != size {
+		return fmt.Errorf("verification of %s failed: the server reports %d bytes instead of %d",
+			part_path, part_info.Size(), size)
+	}
+
+	return target.rename(client, part_path, destination)
+}
+
+// Check whether the first `length` bytes of the remote file and the local file are equal by
+// comparing their hashes.
+func sftpPrefixMatches(client *sftp.Client, remote_path string, file *os.File, length int64) (bool, error) {
+	remote_file, err := client.Open(remote_path)
+	if err != nil {
+		return false, err
+	}
+	defer remote_file.Close()
+
+	remote_hash := sha256.New()
+	if n, err := io.Copy(remote_hash, io.LimitReader(remote_file, length)); err != nil {
+		return false, err
+	} else if n != length {
+		return false, nil
+	}
+	local_hash := sha256.New()
+	if _, err := io.Copy(local_hash, io.NewSectionReader(file, 0, length)); err != nil {
+		return false, err
+	}
+	return bytes.Equal(remote_hash.Sum(nil), local_hash.Sum(nil)), nil
+}
+
+// Rename the completed file, replacing an existing file of the same name (e.g. of a
+// repeated upload). Servers without the posix-rename extension don't replace files on a
+// rename, so the existing file is removed first.
+func (target *SftpTarget) rename(client *sftp.Client, part_path string, destination string) error {
+	if err := client.PosixRename(part_path, destination); err == nil {
+		return nil
+	}
+	if err := client.Remove(destination); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return client.Rename(part_path, destination)
+}
+
+func (target *SftpTarget) Close() error {
+	target.mutex.Lock()
+	defer target.mutex.Unlock()
+
+	if target.client == nil {
+		return nil
+	}
+	target.client.Close()
+	err := target.ssh_client.Close()
+	target.client = nil
+	target.ssh_client = nil
+	return err
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSftpServer is an SSH server with the SFTP subsystem which serves the local file system.
+type testSftpServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	connections []net.Conn
+	accepted    int
+}
+
+// Start an SFTP server on a local port. Returns the server and the config of a target which
+// connects to it with a generated key.
+func startTestSftpServer(t *testing.T) (*testSftpServer, SftpConfig) {
+	t.Helper()
+	dir := t.TempDir() + "/"
+
+	host_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host_signer, err := ssh.NewSignerFromKey(host_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_signer, err := ssh.NewSignerFromKey(client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client_key_der, err := x509.MarshalECPrivateKey(client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir+"id_ecdsa", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: client_key_der})))
+
+	server_config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() != "radar" || string(key.Marshal()) != string(client_signer.PublicKey().Marshal()) {
+				return nil, os.ErrPermission
+			}
+			return nil, nil
+		},
+	}
+	server_config.AddHostKey(host_signer)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &testSftpServer{listener: listener}
+	t.Cleanup(server.close)
+	go server.serve(server_config)
+
+	writeTestFile(t, dir+"known_hosts",
+		knownhosts.Line([]string{knownhosts.Normalize(listener.Addr().String())}, host_signer.PublicKey())+"\n")
+	if err := createFolder(dir + "remote"); err != nil {
+		t.Fatal(err)
+	}
+	return server, SftpConfig{
+		Host:             listener.Addr().String(),
+		Username:         "radar",
+		Key_file:         dir + "id_ecdsa",
+		Known_hosts_file: dir + "known_hosts",
+		Path:             dir + "remote",
+		Timeout:          "5s",
+	}
+}
+
+func (server *testSftpServer) serve(server_config *ssh.ServerConfig) {
+	for {
+		conn, err := server.listener.Accept()
+		if err != nil {
+			return
+		}
+		server.mu.Lock()
+		server.connections = append(server.connections, conn)
+		server.accepted++
+		server.mu.Unlock()
+		go server.handle(conn, server_config)
+	}
+}
+
+// Run the SFTP subsystem on the sessions of a connection.
+func (server *testSftpServer) handle(conn net.Conn, server_config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, server_config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+	for new_channel := range channels {
+		if new_channel.ChannelType() != "session" {
+			new_channel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, channel_requests, err := new_channel.Accept()
+		if err != nil {
+			continue
+		}
+		go func() {
+			for request := range channel_requests {
+				// The payload of a subsystem request is the length prefixed name of the subsystem.
+				ok := request.Type == "subsystem" && string(request.Payload[4:]) == "sftp"
+				request.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+				sftp_server, err := sftp.NewServer(channel)
+				if err != nil {
+					channel.Close()
+					return
+				}
+				go func() {
+					sftp_server.Serve()
+					channel.Close()
+				}()
+			}
+		}()
+	}
+}
+
+// Break the open connections, e.g. like a restart of the server.
+func (server *testSftpServer) breakConnections() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for _, conn := range server.connections {
+		conn.Close()
+	}
+	server.connections = nil
+}
+
+// Get the number of connections which were accepted so far.
+func (server *testSftpServer) acceptedConnections() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.accepted
+}
+
+func (server *testSftpServer) close() {
+	server.listener.Close()
+	server.breakConnections()
+}
+
+// Upload a local file with the given content to `remote_path` and get the number of bytes
+// which were sent.
+func uploadTestFile(t *testing.T, target *SftpTarget, content string, remote_path string) int64 {
+	t.Helper()
+	local_path := t.TempDir() + "/" + "upload.csv"
+	writeTestFile(t, local_path, content)
+	transfer := NewUploadTransfer(RealClock, nil, remote_path, int64(len(content)))
+	err := target.Upload(local_path, remote_path, transfer)
+	transfer.Finish(err)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return transfer.Sent()
+}
+
+func TestSftpTargetUpload(t *testing.T) {
+	_, sftp_config := startTestSftpServer(t)
+	target, err := NewSftpTarget(sftp_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatal(err)
+	}
+	content := "Hex,Fli\n4b1805,SWR123\n"
+	uploadTestFile(t, target, content, "20240305/output_file_A320.csv")
+	checkRemoteFile(t, sftp_config.Path+"/20240305/output_file_A320.csv", content)
+
+	// A repeated upload replaces the file.
+	uploadTestFile(t, target, content+"4b1806,SWR124\n", "20240305/output_file_A320.csv")
+	checkRemoteFile(t, sftp_config.Path+"/20240305/output_file_A320.csv", content+"4b1806,SWR124\n")
+	if _, err := os.Stat(sftp_config.Path + "/20240305/.output_file_A320.csv.part"); !os.IsNotExist(err) {
+		t.Errorf("the .part file was not renamed: %v", err)
+	}
+}
+
+func TestSftpTargetResumesOnlyMatchingPartFiles(t *testing.T) {
+	_, sftp_config := startTestSftpServer(t)
+	target, err := NewSftpTarget(sftp_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	content := strings.Repeat("4b1805,SWR123\n", 100)
+	part_path := sftp_config.Path + "/20240305/.output_file_A320.csv.part"
+
+	// The .part file holds the start of the file, only the rest is sent.
+	writeTestFile(t, part_path, content[:500])
+	if sent := uploadTestFile(t, target, content, "20240305/output_file_A320.csv"); sent != int64(len(content)-500) {
+		t.Errorf("sent %d bytes to resume the upload, expected %d", sent, len(content)-500)
+	}
+	checkRemoteFile(t, sftp_config.Path+"/20240305/output_file_A320.csv", content)
+
+	// The .part file of another version of the file is overwritten.
+	writeTestFile(t, part_path, strings.Repeat("x", 500))
+	if sent := uploadTestFile(t, target, content, "20240305/output_file_A320.csv"); sent != int64(len(content)) {
+		t.Errorf("sent %d bytes to replace a foreign .part file, expected %d", sent, len(content))
+	}
+	checkRemoteFile(t, sftp_config.Path+"/20240305/output_file_A320.csv", content)
+}
+
+func TestSftpTargetReconnectsAfterBrokenConnection(t *testing.T) {
+	server, sftp_config := startTestSftpServer(t)
+	target, err := NewSftpTarget(sftp_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatal(err)
+	}
+	server.breakConnections()
+
+	// The upload right after the break may still use the broken connection, but it must
+	// not stay cached.
+	local_path := t.TempDir() + "/upload.csv"
+	writeTestFile(t, local_path, "Hex\n")
+	for attempt := 0; ; attempt++ {
+		err := target.Upload(local_path, "20240305/output_file_A320.csv", nil)
+		if err == nil {
+			break
+		}
+		if attempt == 1 {
+			t.Fatalf("the target didn't reconnect: %s", err)
+		}
+	}
+	checkRemoteFile(t, sftp_config.Path+"/20240305/output_file_A320.csv", "Hex\n")
+	if accepted := server.acceptedConnections(); accepted != 2 {
+		t.Errorf("%d connections, expected 2", accepted)
+	}
+}
@@ -0,0 +1,263 @@
+// Upload ledger.
+//
+// Every transfer of files to the upload target is recorded in an append-only ledger in the
+// state directory, one JSON object per line. It tells which days were uploaded, when and
+// where to, after the local files are gone. The catch-up and the retention use it to tell
+// which local files were uploaded already.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uploadLedgerFileName is the name of the ledger in the state directory.
+const uploadLedgerFileName string = "upload_ledger.jsonl"
+
+// UploadLedgerEntry describes one transfer of files of a day.
+type UploadLedgerEntry struct {
+	Day      string    `json:"day"` // YYYYMMDD
+	Uploaded time.Time `json:"uploaded"`
+	Target   string    `json:"target"`
+	Path     string    `json:"path"` // folder (or archive) on the target.
+	Backup   string    `json:"backup,omitempty"`
+	Files    []string  `json:"files"`
+	Complete bool      `json:"complete,omitempty"` // all the files of the day have been uploaded.
+
+	// The day was reported as only partly uploaded since its local folder is gone. The entry
+	// doesn't describe a transfer.
+	Acknowledged_incomplete bool `json:"acknowledged_incomplete,omitempty"`
+	// The day was reported as uploaded completely while its local folder was left behind. The
+	// entry doesn't describe a transfer.
+	Acknowledged_left_behind bool `json:"acknowledged_left_behind,omitempty"`
+}
+
+// uploadedDay sums up the ledger entries of a day.
+type uploadedDay struct {
+	files    map[string]bool
+	complete bool
+	// The day was reported as incomplete and no files were uploaded since.
+	acknowledged_incomplete bool
+	// The local folder of the day was reported as left behind and no files were uploaded since.
+	acknowledged_left_behind bool
+}
+
+// Check whether all the given files of the day were uploaded. A nil day has no uploads.
+func (uploaded *uploadedDay) hasAll(file_names []string) bool {
+	if uploaded == nil {
+		return false
+	}
+	for _, file_name := range file_names {
+		if !uploaded.files[file_name] {
+			return false
+		}
+	}
+	return true
+}
+
+// Read the ledger and sum up its entries by day (YYYYMMDD). A missing ledger is empty, and
+// lines which can't be parsed (e.g. cut off by a crash) are skipped.
+func readUploadLedger(state_dir string) (map[string]*uploadedDay, error) {
+	days := make(map[string]*uploadedDay)
+	ledger_file, err := os.Open(state_dir + uploadLedgerFileName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return days, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer ledger_file.Close()
+
+	scanner := bufio.NewScanner(ledger_file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry UploadLedgerEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil || entry.Day == "" {
+			continue
+		}
+		uploaded, ok := days[entry.Day]
+		if !ok {
+			uploaded = &uploadedDay{files: make(map[string]bool)}
+			days[entry.Day] = uploaded
+		}
+		for _, file_name := range entry.Files {
+			uploaded.files[file_name] = true
+		}
+		uploaded.complete = uploaded.complete || entry.Complete
+		switch {
+		case entry.Acknowledged_incomplete:
+			uploaded.acknowledged_incomplete = true
+		case entry.Acknowledged_left_behind:
+			uploaded.acknowledged_left_behind = true
+		default:
+			uploaded.acknowledged_incomplete = false
+			uploaded.acknowledged_left_behind = false
+		}
+	}
+	return days, scanner.Err()
+}
+
+// List the names of the files in a folder.
+func listFileNames(folder_path string) ([]string, error) {
+	entries, err := ioutil.ReadDir(folder_path)
+	if err != nil {
+		return nil, err
+	}
+	file_names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			file_names = append(file_names, entry.Name())
+		}
+	}
+	return file_names, nil
+}
+
+// Append an entry to the ledger.
+func appendUploadLedger(state_dir string, entry UploadLedgerEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err := createFolder(state_dir); err != nil {
+		return err
+	}
+
+	ledger_file, err := os.OpenFile(state_dir+uploadLedgerFileName, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := ledger_file.Write(append(data, '\n')); err != nil {
+		ledger_file.Close()
+		return err
+	}
+	if err := ledger_file.Sync(); err != nil {
+		ledger_file.Close()
+		return err
+	}
+	return ledger_file.Close()
+}
+
+// Record the files of a day which were transferred and whether the day is complete now.
+// Failing to do so doesn't fail the upload, since the files are on the target already.
+func recordUpload(config Config, target UploadTarget, day time.Time, now time.Time, path string, backup string,
+	files []string, complete bool) {
+	if len(files) == 0 && !complete {
+		return
+	}
+	sort.Strings(files)
+	entry := UploadLedgerEntry{
+		Day:      day.Format(dateFormatString),
+		Uploaded: now,
+		Target:   target.String(),
+		Path:     path,
+		Backup:   backup,
+		Files:    files,
+		Complete: complete,
+	}
+	if err := appendUploadLedger(config.State_dir, entry); err != nil {
+		uploader_log.Warn("failed to record the upload in the ledger.", "date", entry.Day, "err", err)
+	}
+}
+
+// Find the days whose data folder still exists locally and which are due for the upload:
+// all the days before `now`, and the current day if the files are rotated more often than
+// daily. The days are returned oldest first.
+//
+// Days which the ledger records as complete are skipped unless their folder contains files
+// which were not uploaded (e.g. written by a replay). Their folders which were left behind
+// are reported once. Days which were only partly uploaded
+// and whose local folder is gone are reported once, since their data on the target is
+// incomplete.
+func pendingUploadDays(config Config, now time.Time) ([]time.Time, error) {
+	ledger, err := readUploadLedger(config.State_dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the upload ledger: %w", err)
+	}
+	entries, err := ioutil.ReadDir(getDataRoot(config.Data_dir))
+	if errors.Is(err, fs.ErrNotExist) {
+		entries = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	location := config.Location()
+	now = now.In(location)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, location)
+
+	days := []time.Time{}
+	for _, entry := range entries {
+		if !entry.IsDir() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		day, err := time.ParseInLocation(dateFormatString, entry.Name(), location)
+		if err != nil {
+			continue
+		}
+		if !day.Before(today) && (!day.Equal(today) || config.Partitioning().Interval == 0) {
+			continue
+		}
+
+		if uploaded := ledger[entry.Name()]; uploaded != nil && uploaded.complete {
+			file_names, err := listFileNames(getDataRoot(config.Data_dir) + entry.Name())
+			if err != nil {
+				return nil, err
+			}
+			if uploaded.hasAll(file_names) {
+				if !uploaded.acknowledged_left_behind {
+					uploader_log.Warn("skipping a day which was uploaded already according to the upload ledger. "+
+						"Its local folder was left behind.", "date", entry.Name(), "files", len(file_names))
+					left_behind := UploadLedgerEntry{Day: entry.Name(), Uploaded: now, Acknowledged_left_behind: true}
+					if err := appendUploadLedger(config.State_dir, left_behind); err != nil {
+						uploader_log.Warn("failed to record the left behind day in the ledger.", "date", entry.Name(),
+							"err", err)
+					}
+				}
+				continue
+			}
+		}
+		days = append(days, day)
+	}
+	sort.Slice(days, func(i, j int) bool { return days[i].Before(days[j]) })
+
+	if incomplete_days := incompleteUploadDays(config, ledger, days); len(incomplete_days) > 0 {
+		uploader_log.WarnSevere("some days were only partly uploaded and their local data is gone. "+
+			"Their data on the upload target is incomplete.", "dates", strings.Join(incomplete_days, ","))
+		for _, day_string := range incomplete_days {
+			entry := UploadLedgerEntry{Day: day_string, Uploaded: now, Acknowledged_incomplete: true}
+			if err := appendUploadLedger(config.State_dir, entry); err != nil {
+				uploader_log.Warn("failed to record the incomplete day in the ledger.", "date", day_string, "err", err)
+			}
+		}
+	}
+	return days, nil
+}
+
+// Find the days which were only partly uploaded according to the ledger and which can't be
+// completed anymore since their local folder is gone (e.g. removed by hand). Days which were
+// reported already are left out.
+func incompleteUploadDays(config Config, ledger map[string]*uploadedDay, pending_days []time.Time) []string {
+	pending := make(map[string]bool, len(pending_days))
+	for _, day := range pending_days {
+		pending[day.Format(dateFormatString)] = true
+	}
+
+	incomplete_days := []string{}
+	for day_string, uploaded := range ledger {
+		if uploaded.complete || uploaded.acknowledged_incomplete || pending[day_string] {
+			continue
+		}
+		if _, err := os.Stat(getDataRoot(config.Data_dir) + day_string); errors.Is(err, fs.ErrNotExist) {
+			incomplete_days = append(incomplete_days, day_string)
+		}
+	}
+	sort.Strings(incomplete_days)
+	return incomplete_days
+}
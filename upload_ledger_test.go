@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingUploadDays(t *testing.T) {
+	config := newTestConfig(t, nil)
+	now := time.Date(2024, 3, 10, 12, 0, 0, 0, time.UTC)
+	data_root := getDataRoot(config.Data_dir)
+	target := FolderTarget{Path: config.Upload_folder_path}
+
+	// Never uploaded.
+	writeTestFile(t, data_root+"20240305/output_file_A320.csv", "Hex\n")
+	// Uploaded completely, the folder was left behind.
+	writeTestFile(t, data_root+"20240306/output_file_A320.csv", "Hex\n")
+	recordUpload(config, target, time.Date(2024, 3, 6, 0, 0, 0, 0, time.UTC), now, "20240306", "",
+		[]string{"output_file_A320.csv"}, true)
+	// Uploaded completely, but a replay wrote another file afterwards.
+	writeTestFile(t, data_root+"20240307/output_file_A320.csv", "Hex\n")
+	writeTestFile(t, data_root+"20240307/output_file_B738.csv", "Hex\n")
+	recordUpload(config, target, time.Date(2024, 3, 7, 0, 0, 0, 0, time.UTC), now, "20240307", "",
+		[]string{"output_file_A320.csv"}, true)
+	// Partly uploaded, the rest is retried.
+	writeTestFile(t, data_root+"20240308/output_file_B738.csv", "Hex\n")
+	recordUpload(config, target, time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC), now, "20240308", "",
+		[]string{"output_file_A320.csv"}, false)
+	// Partly uploaded, the local folder is gone.
+	recordUpload(config, target, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), now, "20240304", "",
+		[]string{"output_file_A320.csv"}, false)
+	// Uploaded completely and removed.
+	recordUpload(config, target, time.Date(2024, 3, 3, 0, 0, 0, 0, time.UTC), now, "20240303", "",
+		[]string{"output_file_A320.csv"}, true)
+	// The current day is still being written to.
+	writeTestFile(t, data_root+"20240310/output_file_A320.csv", "Hex\n")
+
+	days, err := pendingUploadDays(config, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	day_strings := []string{}
+	for _, day := range days {
+		day_strings = append(day_strings, day.Format(dateFormatString))
+	}
+	if expected := []string{"20240305", "20240307", "20240308"}; !reflect.DeepEqual(day_strings, expected) {
+		t.Errorf("pending days: got %v, expected %v", day_strings, expected)
+	}
+
+	ledger, err := readUploadLedger(config.State_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded := ledger["20240304"]; uploaded == nil || !uploaded.acknowledged_incomplete {
+		t.Errorf("the incomplete day was not recorded as reported: %+v", uploaded)
+	}
+	if uploaded := ledger["20240306"]; uploaded == nil || !uploaded.complete || !uploaded.acknowledged_left_behind {
+		t.Errorf("the left behind day was not recorded as reported: %+v", uploaded)
+	}
+
+	// The left behind day is only reported once.
+	if _, err := pendingUploadDays(config, now); err != nil {
+		t.Fatal(err)
+	}
+	if ledger, err = readUploadLedger(config.State_dir); err != nil {
+		t.Fatal(err)
+	}
+	if entries := countLedgerEntries(t, config.State_dir, "20240306"); entries != 2 {
+		t.Errorf("the ledger has %d entries of the left behind day, expected the upload and one report", entries)
+	}
+
+	// The incomplete day is only reported once, unless files of it are uploaded again.
+	if incomplete_days := incompleteUploadDays(config, ledger, days); len(incomplete_days) != 0 {
+		t.Errorf("the incomplete days %v are reported again", incomplete_days)
+	}
+	recordUpload(config, target, time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), now, "20240304", "",
+		[]string{"output_file_B738.csv"}, false)
+	if ledger, err = readUploadLedger(config.State_dir); err != nil {
+		t.Fatal(err)
+	}
+	incomplete_days := incompleteUploadDays(config, ledger, days)
+	if expected := []string{"20240304"}; !reflect.DeepEqual(incomplete_days, expected) {
+		t.Errorf("incomplete days: got %v, expected %v", incomplete_days, expected)
+	}
+}
+
+func TestReadUploadLedgerSkipsBrokenLines(t *testing.T) {
+	state_dir := t.TempDir() + "/"
+	writeTestFile(t, state_dir+uploadLedgerFileName,
+		`{"day":"20240301","files":["a.csv"]}`+"\n"+
+			`{"day":"2024`+"\n"+
+			`{"day":"20240301","files":["b.csv"],"complete":true}`+"\n")
+
+	ledger, err := readUploadLedger(state_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uploaded := ledger["20240301"]
+	if uploaded == nil || !uploaded.complete || !uploaded.hasAll([]string{"a.csv", "b.csv"}) {
+		t.Errorf("unexpected ledger summary: %+v", uploaded)
+	}
+	if ledger["20240302"].hasAll([]string{"a.csv"}) {
+		t.Error("a day without entries has no uploads")
+	}
+}
+
+// Count the entries of a day in the ledger.
+func countLedgerEntries(t *testing.T, state_dir string, day string) int {
+	t.Helper()
+	data, err := ioutil.ReadFile(state_dir + uploadLedgerFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var entry UploadLedgerEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatal(err)
+		}
+		if entry.Day == day {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,294 @@
+// Upload queue.
+//
+// Every day which is due for the upload becomes a job of the upload queue. The state of
+// every job is stored in a file in the state directory, such that pending uploads survive
+// a restart. A job whose upload fails is retried with an exponentially growing delay, and
+// the files of a day are uploaded independently of each other, so a single failing file
+// doesn't hold back the rest of the day. Jobs which are pending for longer than the
+// configured maximum age raise an alert.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// uploadQueueFolderName is the folder of the job files in the state directory.
+const uploadQueueFolderName string = "upload_queue/"
+
+// Counters of the upload queue.
+var (
+	upload_failures_counter = new(expvar.Int)
+	upload_alerts_counter   = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("upload_failures", upload_failures_counter)
+	metrics.Set("upload_alerts", upload_alerts_counter)
+}
+
+// uploadJob is the state of the upload of one day.
+type uploadJob struct {
+	Day          string                     `json:"day"` // YYYYMMDD
+	Created      time.Time                  `json:"created"`
+	Attempts     int                        `json:"attempts"` // failed attempts so far.
+	Next_attempt time.Time                  `json:"next_attempt"`
+	Last_error   string                     `json:"last_error,omitempty"`
+	Failed_files map[string]uploadFileState `json:"failed_files,omitempty"`
+	Alerted      bool                       `json:"alerted"` // the maximum age was exceeded.
+}
+
+// uploadFileState describes a file whose upload failed.
+type uploadFileState struct {
+	Attempts   int    `json:"attempts"`
+	Last_error string `json:"last_error"`
+}
+
+// UploadFileErrors holds the errors of the files of a day whose upload failed, by file name.
+type UploadFileErrors map[string]error
+
+func (file_errors UploadFileErrors) Error() string {
+	file_names := make([]string, 0, len(file_errors))
+	for file_name := range file_errors {
+		file_names = append(file_names, file_name)
+	}
+	sort.Strings(file_names)
+
+	messages := make([]string, len(file_names))
+	for i, file_name := range file_names {
+		messages[i] = file_name + ": " + file_errors[file_name].Error()
+	}
+	return fmt.Sprintf("failed to upload %d files: %s", len(file_errors), strings.Join(messages, "; "))
+}
+
+// UploadQueue holds the pending upload jobs.
+type UploadQueue struct {
+	dir   string
+	clock Clock
+
+	mu   sync.Mutex
+	jobs map[string]*uploadJob // by day.
+}
+
+// Open the upload queue in `dir` and load the jobs which were pending when the listener
+// stopped. They are due right away, e.g. in case the upload target was fixed in the meantime.
+func OpenUploadQueue(dir string, clock Clock) (*UploadQueue, error) {
+	if err := createFolder(dir); err != nil {
+		return nil, err
+	}
+	queue := &UploadQueue{
+		dir:   dir,
+		clock: clock,
+		jobs:  make(map[string]*uploadJob),
+	}
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), ".json") {
+			continue
+		}
+		data, err := ioutil.ReadFile(dir + entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		var job uploadJob
+		if err := json.Unmarshal(data, &job); err != nil || job.Day == "" {
+			uploader_log.Warn("ignoring a corrupt upload job.", "path", dir+entry.Name(), "err", err)
+			continue
+		}
+		job.Next_attempt = clock.Now()
+		queue.jobs[job.Day] = &job
+	}
+	if len(queue.jobs) > 0 {
+		uploader_log.Info("resuming pending uploads.", "days", queue.Days())
+	}
+
+	metrics.Set("upload_jobs_pending", expvar.Func(func() any {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		return len(queue.jobs)
+	}))
+	return queue, nil
+}
+
+// Get the days of the pending jobs in ascending order.
+func (queue *UploadQueue) Days() []string {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	days := make([]string, 0, len(queue.jobs))
+	for day := range queue.jobs {
+		days = append(days, day)
+	}
+	sort.Strings(days)
+	return days
+}
+
+// Add the upload of a day to the queue. A day which is queued already keeps its state,
+// but is attempted right away.
+func (queue *UploadQueue) Add(day time.Time) error {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := queue.clock.Now()
+	day_string := day.Format(dateFormatString)
+	job, ok := queue.jobs[day_string]
+	if !ok {
+		job = &uploadJob{Day: day_string, Created: now}
+		queue.jobs[day_string] = job
+	}
+	job.Next_attempt = now
+	return queue.save(job)
+}
+
+// Get the time of the next due attempt. Returns false if no job is pending.
+func (queue *UploadQueue) NextAttempt() (time.Time, bool) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	var next_attempt time.Time
+	for _, job := range queue.jobs {
+		if next_attempt.IsZero() || job.Next_attempt.Before(next_attempt) {
+			next_attempt = job.Next_attempt
+		}
+	}
+	return next_attempt, len(queue.jobs) > 0
+}
+
+// Upload the days whose next attempt is due.
+//
+// A day is removed from the queue once all of its completed files have been uploaded.
+// Otherwise the next attempt is scheduled after a delay which doubles with every failed
+// attempt.
+func (queue *UploadQueue) RunDue(config Config) {
+	for _, day_string := range queue.Days() {
+		now := queue.clock.Now()
+
+		queue.mu.Lock()
+		job, ok := queue.jobs[day_string]
+		due := ok && !job.Next_attempt.After(now)
+		queue.mu.Unlock()
+		if !due {
+			continue
+		}
+
+		day, err := time.ParseInLocation(dateFormatString, day_string, config.Location())
+		if err != nil {
+			uploader_log.Warn("dropping an upload job of an invalid day.", "day", day_string, "err", err)
+			queue.remove(day_string)
+			continue
+		}
+
+		err = UploadDay(config, queue.clock, day, now.In(config.Location()))
+		if err == nil {
+			if job.Attempts > 0 {
+				uploader_log.Info("uploaded the day after failed attempts.", "date", day_string,
+					"attempts", job.Attempts)
+			}
+			queue.remove(day_string)
+			continue
+		}
+		queue.fail(job, err, config.Upload)
+	}
+}
+
+// Record a failed attempt and schedule the next one.
+func (queue *UploadQueue) fail(job *uploadJob, err error, upload_config UploadConfig) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := queue.clock.Now()
+	job.Attempts++
+	job.Last_error = err.Error()
+	job.Next_attempt = now.Add(upload_config.RetryDelay(job.Attempts))
+
+	// Files which were uploaded in the meantime are not listed anymore.
+	var file_errors UploadFileErrors
+	if errors.As(err, &file_errors) {
+		failed_files := make(map[string]uploadFileState, len(file_errors))
+		for file_name, file_err := range file_errors {
+			failed_files[file_name] = uploadFileState{
+				Attempts:   job.Failed_files[file_name].Attempts + 1,
+				Last_error: file_err.Error(),
+			}
+		}
+		job.Failed_files = failed_files
+	} else {
+		job.Failed_files = nil
+	}
+	upload_failures_counter.Add(1)
+
+	uploader_log.Warn("failed to upload the day. Retrying later.", "date", job.Day, "attempts", job.Attempts,
+		"next_attempt", job.Next_attempt.Format(time.RFC3339), "err", err)
+
+	queue.alertOverdue(job, upload_config, now)
+	if err := queue.save(job); err != nil {
+		uploader_log.Warn("failed to save the upload job.", "date", job.Day, "err", err)
+	}
+}
+
+// Raise an alert for every job which is pending for longer than the maximum age, also while
+// it waits for its next attempt or the upload target is not configured.
+func (queue *UploadQueue) CheckAge(upload_config UploadConfig) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	now := queue.clock.Now()
+	for _, job := range queue.jobs {
+		if !queue.alertOverdue(job, upload_config, now) {
+			continue
+		}
+		if err := queue.save(job); err != nil {
+			uploader_log.Warn("failed to save the upload job.", "date", job.Day, "err", err)
+		}
+	}
+}
+
+// Raise the alert of a job if it is pending for longer than the maximum age. Every job is
+// alerted once. Returns whether the alert was raised.
+func (queue *UploadQueue) alertOverdue(job *uploadJob, upload_config UploadConfig, now time.Time) bool {
+	max_age, _ := parseWriteInterval(upload_config.Max_age)
+	if max_age <= 0 || now.Sub(job.Created) <= max_age || job.Alerted {
+		return false
+	}
+	job.Alerted = true
+	upload_alerts_counter.Add(1)
+	uploader_log.WarnSevere("the upload of a day is pending for too long. Please check the upload target.",
+		"date", job.Day, "pending_since", job.Created.Format(time.RFC3339), "attempts", job.Attempts,
+		"err", job.Last_error)
+	return true
+}
+
+// Remove a finished job.
+func (queue *UploadQueue) remove(day_string string) {
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+
+	delete(queue.jobs, day_string)
+	err := os.Remove(queue.dir + day_string + ".json")
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		uploader_log.Warn("failed to remove the upload job.", "date", day_string, "err", err)
+	}
+}
+
+// Write the state file of a job.
+func (queue *UploadQueue) save(job *uploadJob) error {
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(queue.dir+job.Day+".json", append(data, '\n'))
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+// Check the number of failed attempts and the files which failed of the pending job of a day.
+func checkUploadJob(t *testing.T, queue *UploadQueue, day string, attempts int, failed_files ...string) *uploadJob {
+	t.Helper()
+	queue.mu.Lock()
+	defer queue.mu.Unlock()
+	job, ok := queue.jobs[day]
+	if !ok {
+		t.Fatalf("the upload of %s is not pending", day)
+	}
+	if job.Attempts != attempts {
+		t.Errorf("the upload of %s failed %d times, expected %d", day, job.Attempts, attempts)
+	}
+	if len(job.Failed_files) != len(failed_files) {
+		t.Errorf("the failed files of %s are %v, expected %v", day, job.Failed_files, failed_files)
+	}
+	for _, file_name := range failed_files {
+		if _, ok := job.Failed_files[file_name]; !ok {
+			t.Errorf("%s of %s is not recorded as failed: %v", file_name, day, job.Failed_files)
+		}
+	}
+	return job
+}
+
+// A file which can't be uploaded is retried with a doubling delay, while the other files of
+// the day are uploaded right away. Once the day is pending for too long, an alert is raised.
+// The jobs are resumed after a restart.
+func TestUploadQueueRetriesFailingFileWithBackoff(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) {
+		config.Upload.Retry_interval = "1m"
+		config.Upload.Max_retry_interval = "4m"
+		config.Upload.Max_age = "10m"
+	})
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))
+	data_folder_path := getDataFolder(config.Data_dir, day)
+	upload_folder_path := getDataFolder(config.Upload_folder_path, day)
+	writeTestFile(t, data_folder_path+"output_file_A320.csv", "Hex\n4b1805\n")
+	writeTestFile(t, data_folder_path+"output_file_B738.csv", "Hex\n4b1806\n")
+
+	// The temporary file of the copy of the A320 file can't be created.
+	if err := createFolder(upload_folder_path + "output_file_A320.csv.tmp/"); err != nil {
+		t.Fatal(err)
+	}
+
+	queue_dir := config.State_dir + uploadQueueFolderName
+	queue, err := OpenUploadQueue(queue_dir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Add(day); err != nil {
+		t.Fatal(err)
+	}
+	start := clock.Now()
+	alerts := upload_alerts_counter.Value()
+
+	queue.RunDue(config)
+	job := checkUploadJob(t, queue, "20240305", 1, "output_file_A320.csv")
+	if _, err := os.Stat(upload_folder_path + "output_file_B738.csv"); err != nil {
+		t.Errorf("the B738 file was not uploaded: %s", err)
+	}
+
+	// The delay doubles with every failed attempt up to the maximum retry interval.
+	for i, delay := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 4 * time.Minute} {
+		next_attempt, ok := queue.NextAttempt()
+		if !ok || !next_attempt.Equal(clock.Now().Add(delay)) {
+			t.Fatalf("the next attempt after %d failures is at %s, expected %s", i+1, next_attempt,
+				clock.Now().Add(delay))
+		}
+
+		// The job isn't attempted before it is due.
+		clock.Advance(delay - time.Second)
+		queue.RunDue(config)
+		checkUploadJob(t, queue, "20240305", i+1, "output_file_A320.csv")
+
+		clock.Advance(time.Second)
+		queue.RunDue(config)
+		job = checkUploadJob(t, queue, "20240305", i+2, "output_file_A320.csv")
+
+		// The alert is raised once, by the first attempt after the maximum age.
+		if alerted := clock.Now().Sub(start) > 10*time.Minute; job.Alerted != alerted {
+			t.Errorf("the job is alerted: %t after %s, expected %t", job.Alerted, clock.Now().Sub(start), alerted)
+		}
+	}
+	if count := upload_alerts_counter.Value() - alerts; count != 1 {
+		t.Errorf("%d alerts were raised, expected 1", count)
+	}
+	if job.Failed_files["output_file_A320.csv"].Attempts != 5 {
+		t.Errorf("the A320 file failed %d times, expected 5", job.Failed_files["output_file_A320.csv"].Attempts)
+	}
+
+	// After a restart, the job keeps its state and is due right away.
+	if err := os.Remove(upload_folder_path + "output_file_A320.csv.tmp"); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = OpenUploadQueue(queue_dir, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = checkUploadJob(t, queue, "20240305", 5, "output_file_A320.csv")
+	if !job.Created.Equal(start) || !job.Alerted {
+		t.Errorf("the job was not restored: %+v", job)
+	}
+	if next_attempt, ok := queue.NextAttempt(); !ok || !next_attempt.Equal(clock.Now()) {
+		t.Errorf("the next attempt after the restart is at %s, expected %s", next_attempt, clock.Now())
+	}
+
+	queue.RunDue(config)
+	if days := queue.Days(); len(days) != 0 {
+		t.Errorf("the uploads of %v are still pending", days)
+	}
+	if _, err := os.Stat(queue_dir + "20240305.json"); !os.IsNotExist(err) {
+		t.Errorf("the job file was not removed: %v", err)
+	}
+	checkCsvFile(t, upload_folder_path+"output_file_A320.csv", "4b1805")
+	if _, err := os.Stat(data_folder_path); !os.IsNotExist(err) {
+		t.Errorf("the day folder was not removed: %v", err)
+	}
+}
+
+// A job is alerted once it is pending for too long, even if its next attempt is not due yet.
+func TestUploadQueueAlertsPendingJobsBetweenAttempts(t *testing.T) {
+	config := newTestConfig(t, func(config *Config) {
+		config.Upload.Retry_interval = "1h"
+		config.Upload.Max_retry_interval = "1h"
+		config.Upload.Max_age = "10m"
+	})
+	clock := NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))
+	queue, err := OpenUploadQueue(config.State_dir+uploadQueueFolderName, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Add(time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)); err != nil {
+		t.Fatal(err)
+	}
+	queue.fail(queue.jobs["20240305"], errors.New("the target is offline"), config.Upload)
+	alerts := upload_alerts_counter.Value()
+
+	clock.Advance(10 * time.Minute)
+	queue.CheckAge(config.Upload)
+	if job := checkUploadJob(t, queue, "20240305", 1); job.Alerted {
+		t.Error("the job was alerted before the maximum age")
+	}
+
+	for i := 0; i < 2; i++ {
+		clock.Advance(time.Minute)
+		queue.CheckAge(config.Upload)
+	}
+	if job := checkUploadJob(t, queue, "20240305", 1); !job.Alerted {
+		t.Error("the job was not alerted after the maximum age")
+	}
+	if count := upload_alerts_counter.Value() - alerts; count != 1 {
+		t.Errorf("%d alerts were raised, expected 1", count)
+	}
+
+	// The alert is kept after a restart.
+	queue, err = OpenUploadQueue(config.State_dir+uploadQueueFolderName, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue.CheckAge(config.Upload)
+	if count := upload_alerts_counter.Value() - alerts; count != 1 {
+		t.Errorf("%d alerts were raised after the restart, expected 1", count)
+	}
+}
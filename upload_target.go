@@ -0,0 +1,214 @@
+// Upload targets.
+//
+// The uploader transfers the data files to one of several kinds of targets, e.g. a mounted
+// shared folder, a WebDAV server, an SFTP server or an S3 bucket. The target is selected in the `upload` section of the
+// config.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// UploadConfig groups the parameters of the upload target.
+type UploadConfig struct {
+	Target string       `yaml:"target"` // folder (default, i.e. upload_folder_path), webdav, sftp or s3.
+	Webdav WebdavConfig `yaml:"webdav"`
+	Sftp   SftpConfig   `yaml:"sftp"`
+	S3     S3Config     `yaml:"s3"`
+
+	Retry_interval     string `yaml:"retry_interval"`     // delay of the first retry of a failed upload, e.g. 5m.
+	Max_retry_interval string `yaml:"max_retry_interval"` // upper bound of the doubling retry delay, e.g. 2h.
+	Max_age            string `yaml:"max_age"`            // alert if a day is pending for longer, e.g. 24h. 0 or off disables.
+
+	Workers              int                  `yaml:"workers"` // number of files which are uploaded in parallel.
+	Bandwidth_limit_kbit BandwidthLimitConfig `yaml:"bandwidth_limit_kbit"`
+}
+
+// BandwidthLimitConfig groups the bandwidth limits of the uploads in kbit/s. 0 doesn't limit
+// the bandwidth.
+type BandwidthLimitConfig struct {
+	Per_upload int `yaml:"per_upload"` // bandwidth of each file which is uploaded.
+	Total      int `yaml:"total"`      // bandwidth of all the parallel uploads together.
+}
+
+// Kinds of upload targets.
+const (
+	uploadTargetFolder string = "folder"
+	uploadTargetWebdav string = "webdav"
+	uploadTargetSftp   string = "sftp"
+	uploadTargetS3     string = "s3"
+)
+
+// UploadTarget is a destination of the uploader.
+//
+// Paths are relative to the root of the target and use forward slashes, e.g. 20240131 for
+// the folder of a day or 20240131/output_file_A320.csv for a file.
+type UploadTarget interface {
+	// Create a folder. Creating a folder which exists already is not an error.
+	MakeDir(dir string) error
+	// Transfer a local file. The local file is left as it is. The reads of the file which are
+	// sent to the target are wrapped with `transfer`, which may be nil.
+	Upload(local_path string, remote_path string, transfer *UploadTransfer) error
+	// Describe the target in log messages.
+	String() string
+	// Release the connections of the target.
+	Close() error
+}
+
+// Check whether an upload target is configured.
+func (config Config) UploadEnabled() bool {
+	switch config.Upload.Target {
+	case uploadTargetWebdav:
+		return config.Upload.Webdav.Url != ""
+	case uploadTargetSftp:
+		return config.Upload.Sftp.Host != ""
+	case uploadTargetS3:
+		return config.Upload.S3.Bucket != ""
+	default:
+		return config.Upload_folder_path != ""
+	}
+}
+
+// Create the configured upload target. Requests which are signed with a timestamp use `clock`.
+func (config Config) UploadTarget(clock Clock) (UploadTarget, error) {
+	if !config.UploadEnabled() {
+		return nil, errors.New("no upload target specified")
+	}
+	switch config.Upload.Target {
+	case uploadTargetWebdav:
+		return NewWebdavTarget(config.Upload.Webdav)
+	case uploadTargetSftp:
+		return NewSftpTarget(config.Upload.Sftp)
+	case uploadTargetS3:
+		return NewS3Target(config.Upload.S3, config.Site.Name, clock)
+	default:
+		return FolderTarget{Path: config.Upload_folder_path}, nil
+	}
+}
+
+// Fill in the default values of the upload parameters which were not specified.
+func (upload_config *UploadConfig) applyDefaults() {
+	if upload_config.Target == "" {
+		upload_config.Target = uploadTargetFolder
+	}
+	if upload_config.Retry_interval == "" {
+		upload_config.Retry_interval = "5m"
+	}
+	if upload_config.Max_retry_interval == "" {
+		upload_config.Max_retry_interval = "2h"
+	}
+	if upload_config.Max_age == "" {
+		upload_config.Max_age = "24h"
+	}
+	if upload_config.Workers == 0 {
+		upload_config.Workers = 4
+	}
+	upload_config.Webdav.applyDefaults()
+	upload_config.Sftp.applyDefaults()
+	upload_config.S3.applyDefaults()
+}
+
+// Normalise the upload parameters.
+func (upload_config *UploadConfig) normalize() {
+	upload_config.Target = strings.ToLower(strings.TrimSpace(upload_config.Target))
+	upload_config.Webdav.normalize()
+	upload_config.Sftp.normalize()
+	upload_config.S3.normalize()
+}
+
+// Get the delay before the next attempt of an upload which failed `attempts` times.
+func (upload_config UploadConfig) RetryDelay(attempts int) time.Duration {
+	// Validate makes sure that the intervals can be parsed.
+	delay, _ := parseUploadDuration(upload_config.Retry_interval)
+	max_delay, _ := parseUploadDuration(upload_config.Max_retry_interval)
+	for i := 1; i < attempts && delay < max_delay; i++ {
+		delay *= 2
+	}
+	if delay > max_delay {
+		delay = max_delay
+	}
+	return delay
+}
+
+// Get the bandwidth limits of each upload and of all the uploads in bytes per second. Zero
+// doesn't limit the bandwidth.
+func (upload_config UploadConfig) BandwidthLimits() (per_upload int64, total int64) {
+	limits := upload_config.Bandwidth_limit_kbit
+	return int64(limits.Per_upload) * 1000 / 8, int64(limits.Total) * 1000 / 8
+}
+
+// Check the upload parameters and add the problems to `config_errors`.
+func (upload_config UploadConfig) validate(config_errors *ConfigErrors) {
+	retry_interval, err := parseUploadDuration(upload_config.Retry_interval)
+	if err != nil {
+		config_errors.add("upload.retry_interval: %s", err)
+	}
+	max_retry_interval, err := parseUploadDuration(upload_config.Max_retry_interval)
+	if err != nil {
+		config_errors.add("upload.max_retry_interval: %s", err)
+	} else if max_retry_interval < retry_interval {
+		config_errors.add("upload.max_retry_interval: %s must not be shorter than upload.retry_interval",
+			max_retry_interval)
+	}
+	if _, err := parseWriteInterval(upload_config.Max_age); err != nil {
+		config_errors.add("upload.max_age: %s", err)
+	}
+	if upload_config.Workers < 1 || upload_config.Workers > 64 {
+		config_errors.add("upload.workers: %d must be between 1 and 64", upload_config.Workers)
+	}
+	if upload_config.Bandwidth_limit_kbit.Per_upload < 0 {
+		config_errors.add("upload.bandwidth_limit_kbit.per_upload: must not be negative")
+	}
+	if upload_config.Bandwidth_limit_kbit.Total < 0 {
+		config_errors.add("upload.bandwidth_limit_kbit.total: must not be negative")
+	}
+
+	switch upload_config.Target {
+	case uploadTargetFolder:
+	case uploadTargetWebdav:
+		upload_config.Webdav.validate(config_errors)
+	case uploadTargetSftp:
+		upload_config.Sftp.validate(config_errors)
+	case uploadTargetS3:
+		upload_config.S3.validate(config_errors)
+	default:
+		config_errors.add("upload.target: %q must be folder, webdav, sftp or s3", upload_config.Target)
+	}
+}
+
+// Parse a duration of the upload parameters, e.g. a timeout. It has to be positive.
+func parseUploadDuration(value string) (time.Duration, error) {
+	duration, err := time.ParseDuration(strings.TrimSpace(value))
+	if err != nil {
+		return 0, err
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("%s must be positive", duration)
+	}
+	return duration, nil
+}
+
+// FolderTarget copies the files into a folder, e.g. a mounted network share.
+type FolderTarget struct {
+	Path string // with a trailing slash.
+}
+
+func (target FolderTarget) MakeDir(dir string) error {
+	return createFolder(target.Path + dir + "/")
+}
+
+func (target FolderTarget) Upload(local_path string, remote_path string, transfer *UploadTransfer) error {
+	return copyFile(local_path, target.Path+remote_path, transfer)
+}
+
+func (target FolderTarget) String() string {
+	return target.Path
+}
+
+func (target FolderTarget) Close() error {
+	return nil
+}
@@ -0,0 +1,231 @@
+// Throttling and progress of the uploads.
+//
+// Every upload has a token bucket of its own which caps its bandwidth, and the uploads of a
+// day share another one which limits their total bandwidth, such that a thin uplink is not
+// saturated by the parallel uploads. The progress of every file is logged while it is being
+// uploaded.
+
+package main
+
+import (
+	"expvar"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// uploadProgressInterval is the interval of the progress log messages of a file.
+const uploadProgressInterval time.Duration = 10 * time.Second
+
+// uploadReadSize is the maximum size of the reads of a throttled upload, such that the
+// bandwidth is spread evenly over time.
+const uploadReadSize int = 32 << 10
+
+// Counters of the transfers.
+var (
+	upload_bytes_counter        = new(expvar.Int)
+	uploads_in_progress_counter = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("upload_bytes", upload_bytes_counter)
+	metrics.Set("uploads_in_progress", uploads_in_progress_counter)
+}
+
+// TokenBucket limits the rate of the bytes which are read by the uploads.
+//
+// The bucket fills up with `rate` tokens per second up to a burst of a tenth of a second.
+// Reads take their tokens right away and wait for the debt to be paid off, so concurrent
+// uploads share the bandwidth. It is safe for concurrent use.
+type TokenBucket struct {
+	clock Clock
+	rate  float64 // bytes per second.
+	burst float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// Create a token bucket for the given rate. Returns nil (i.e. no limit) if the rate is not
+// positive.
+func NewTokenBucket(clock Clock, bytes_per_second int64) *TokenBucket {
+	if bytes_per_second <= 0 {
+		return nil
+	}
+	burst := float64(bytes_per_second) / 10
+	if burst < float64(uploadReadSize) {
+		burst = float64(uploadReadSize)
+	}
+	return &TokenBucket{
+		clock:  clock,
+		rate:   float64(bytes_per_second),
+		burst:  burst,
+		tokens: burst,
+		last:   clock.Now(),
+	}
+}
+
+// Take `n` tokens and block until they are available.
+func (bucket *TokenBucket) Wait(n int) {
+	bucket.mu.Lock()
+	now := bucket.clock.Now()
+	bucket.tokens += now.Sub(bucket.last).Seconds() * bucket.rate
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	bucket.last = now
+	bucket.tokens -= float64(n)
+	delay := time.Duration(-bucket.tokens / bucket.rate * float64(time.Second))
+	bucket.mu.Unlock()
+
+	if delay > 0 {
+		bucket.clock.Sleep(delay)
+	}
+}
+
+// BandwidthLimit holds the bandwidth limits of the uploads of a day. A nil limit doesn't
+// throttle the uploads.
+type BandwidthLimit struct {
+	per_upload int64        // bytes per second of each upload. 0 doesn't limit it.
+	total      *TokenBucket // shared by all the uploads. nil doesn't limit it.
+}
+
+// Create the bandwidth limits for the given rates in bytes per second. Returns nil if neither
+// rate is positive.
+func NewBandwidthLimit(clock Clock, per_upload int64, total int64) *BandwidthLimit {
+	if per_upload <= 0 && total <= 0 {
+		return nil
+	}
+	return &BandwidthLimit{per_upload: per_upload, total: NewTokenBucket(clock, total)}
+}
+
+// UploadTransfer throttles the upload of one file and reports its progress.
+//
+// The targets wrap the readers of the file (or its parts) with Reader. A nil transfer
+// leaves the readers as they are.
+type UploadTransfer struct {
+	clock   Clock
+	buckets []*TokenBucket // of the upload and of all the uploads. Empty doesn't limit the bandwidth.
+	path    string         // on the upload target.
+	size    int64
+
+	mu          sync.Mutex
+	started     time.Time
+	sent        int64
+	last_report time.Time
+}
+
+// Start the transfer of a file of `size` bytes to `remote_path`. The transfer is throttled by
+// `bandwidth_limit` unless it is nil.
+func NewUploadTransfer(clock Clock, bandwidth_limit *BandwidthLimit, remote_path string, size int64) *UploadTransfer {
+	var buckets []*TokenBucket
+	if bandwidth_limit != nil {
+		if bucket := NewTokenBucket(clock, bandwidth_limit.per_upload); bucket != nil {
+			buckets = append(buckets, bucket)
+		}
+		if bandwidth_limit.total != nil {
+			buckets = append(buckets, bandwidth_limit.total)
+		}
+	}
+	now := clock.Now()
+	uploads_in_progress_counter.Add(1)
+	return &UploadTransfer{
+		clock:       clock,
+		buckets:     buckets,
+		path:        remote_path,
+		size:        size,
+		started:     now,
+		last_report: now,
+	}
+}
+
+// Wrap a reader of the file such that its reads are throttled and counted.
+func (transfer *UploadTransfer) Reader(r io.Reader) io.Reader {
+	if transfer == nil {
+		return r
+	}
+	return &transferReader{reader: r, transfer: transfer}
+}
+
+// Get the number of bytes which were read so far. Repeated reads (e.g. of a part which is
+// uploaded again) are counted again.
+func (transfer *UploadTransfer) Sent() int64 {
+	transfer.mu.Lock()
+	defer transfer.mu.Unlock()
+	return transfer.sent
+}
+
+// Count the bytes which were read and report the progress every uploadProgressInterval.
+func (transfer *UploadTransfer) add(n int) {
+	upload_bytes_counter.Add(int64(n))
+
+	transfer.mu.Lock()
+	transfer.sent += int64(n)
+	now := transfer.clock.Now()
+	report := now.Sub(transfer.last_report) >= uploadProgressInterval
+	if report {
+		transfer.last_report = now
+	}
+	sent := transfer.sent
+	transfer.mu.Unlock()
+
+	if report {
+		uploader_log.Info("uploading file.", "path", transfer.path, "progress", progressPercent(sent, transfer.size),
+			"sent_mb", float64(sent)/(1<<20), "rate_kbit", transferRateKbit(sent, now.Sub(transfer.started)))
+	}
+}
+
+// End the transfer and log its result.
+func (transfer *UploadTransfer) Finish(err error) {
+	uploads_in_progress_counter.Add(-1)
+	duration := transfer.clock.Now().Sub(transfer.started)
+	if err != nil {
+		uploader_log.Debug("failed to upload file.", "path", transfer.path, "sent_mb", float64(transfer.Sent())/(1<<20),
+			"duration", duration.Round(time.Millisecond).String(), "err", err)
+		return
+	}
+	uploader_log.Info("uploaded file.", "path", transfer.path, "size_mb", float64(transfer.size)/(1<<20),
+		"duration", duration.Round(time.Millisecond).String(), "rate_kbit", transferRateKbit(transfer.Sent(), duration))
+}
+
+// Format the progress of a transfer, e.g. 42%.
+func progressPercent(sent int64, size int64) string {
+	if size <= 0 {
+		return "100%"
+	}
+	percent := sent * 100 / size
+	if percent > 100 {
+		percent = 100
+	}
+	return strconv.FormatInt(percent, 10) + "%"
+}
+
+// Get the average rate of a transfer in kbit/s.
+func transferRateKbit(sent int64, duration time.Duration) int64 {
+	if duration <= 0 {
+		return 0
+	}
+	return int64(float64(sent) * 8 / 1000 / duration.Seconds())
+}
+
+// transferReader counts and throttles the reads of an UploadTransfer.
+type transferReader struct {
+	reader   io.Reader
+	transfer *UploadTransfer
+}
+
+func (reader *transferReader) Read(p []byte) (int, error) {
+	if len(reader.transfer.buckets) > 0 && len(p) > uploadReadSize {
+		p = p[:uploadReadSize]
+	}
+	n, err := reader.reader.Read(p)
+	if n > 0 {
+		reader.transfer.add(n)
+		for _, bucket := range reader.transfer.buckets {
+			bucket.Wait(n)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+// advancingClock is a FakeClock whose Sleep moves the time forward instead of blocking, so
+// the time which the throttled reads take can be measured.
+type advancingClock struct {
+	*FakeClock
+}
+
+func (clock advancingClock) Sleep(d time.Duration) {
+	clock.Advance(d)
+}
+
+// Each upload is capped by the per-upload limit, while the parallel uploads share the total
+// limit.
+func TestBandwidthLimitPerUploadAndTotal(t *testing.T) {
+	const rate int64 = 100 << 10 // bytes per second.
+	const size int = 1 << 20
+	tests := []struct {
+		name       string
+		per_upload int64
+		total      int64
+		duration   time.Duration // of two parallel uploads of `size` bytes.
+	}{
+		{"unlimited", 0, 0, 0},
+		{"per_upload", rate, 0, 10 * time.Second},
+		{"total", 0, rate, 20 * time.Second},
+		{"per_upload_and_total", rate, 2 * rate, 10 * time.Second},
+		{"total_below_per_upload", rate, rate, 20 * time.Second},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := advancingClock{NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))}
+			start := clock.Now()
+			bandwidth_limit := NewBandwidthLimit(clock, test.per_upload, test.total)
+
+			// The reads of the two uploads take turns, like those of two workers.
+			readers := make([]io.Reader, 2)
+			for i := range readers {
+				transfer := NewUploadTransfer(clock, bandwidth_limit, "20240305/output_file_A320.csv", int64(size))
+				defer transfer.Finish(nil)
+				readers[i] = transfer.Reader(bytes.NewReader(make([]byte, size)))
+			}
+			buffer := make([]byte, uploadReadSize)
+			for done := 0; done < len(readers); {
+				done = 0
+				for _, reader := range readers {
+					if _, err := reader.Read(buffer); err == io.EOF {
+						done++
+					}
+				}
+			}
+
+			// The bursts of the buckets and the debt of the last read shift the time a bit.
+			duration := clock.Now().Sub(start)
+			if duration < test.duration*95/100 || duration > test.duration*105/100 {
+				t.Errorf("the uploads took %s, expected %s", duration, test.duration)
+			}
+		})
+	}
+}
@@ -1,116 +1,358 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"sync"
 	"time"
 
 	"golang.org/x/sync/errgroup"
 )
 
-// Upload files of the last day to a shared drive.
+// Upload files of the last day to the upload target.
 //
-// Upload all the files of the previous day to a shared drive where a script on a local machine can
-// download them and save them to the file storage.
-func UploadFilesToSharedFolder(config Config, ticker *TimeTicker) {
-	LogInfo("UploadFilesToSharedFolder: Successfully started uploader goroutine.")
-
-	for range ticker.Processor_tick_chan {
-		err := func() error {
-
-			LogInfo("UploadFilesToSharedFolder: Starting data transfer to the upload folder.")
-
-			prev_day := time.Now().AddDate(0, 0, -1)
+// Upload all the files of the previous days to a shared drive (or another upload target) where a
+// script on a local machine can download them and save them to the file storage. If the files are
+// rotated more often than daily, the completed files of the current day are uploaded as well.
+//
+// On startup and on every run, the data directory is scanned for days which were not uploaded
+// yet (e.g. because the PC was switched off), so they are caught up oldest first. The days are
+// uploaded through the persistent upload queue, so failed uploads are retried until they
+// succeed, also after a restart.
+func UploadFilesToSharedFolder(config_store *ConfigStore, clock Clock, ticker *TimeTicker) {
+	queue, err := OpenUploadQueue(config_store.Get().State_dir+uploadQueueFolderName, clock)
+	if err != nil {
+		uploader_log.WarnSevere("failed to open the upload queue. Stopping the uploader goroutine. "+
+			"Please upload the data files manually and restart the application.", "err", err)
+		return
+	}
+	uploader_log.Info("successfully started uploader goroutine.")
 
-			// Get the data files from the last day from local storage.
-			data_folder_path := getDataFolder(prev_day)
-			files, err := ioutil.ReadDir(data_folder_path)
-			if err != nil {
-				return err
+	// Queue the days which are left in the data directory. Returns whether all of them were
+	// queued.
+	enqueuePendingDays := func(config Config) bool {
+		days, err := pendingUploadDays(config, clock.Now())
+		if err != nil {
+			uploader_log.Warn("failed to scan the data directory for days to upload.", "err", err)
+		}
+		queued := err == nil
+		for _, day := range days {
+			if err := queue.Add(day); err != nil {
+				uploader_log.Warn("failed to save the upload job.", "date", day.Format(dateFormatString), "err", err)
+				queued = false
 			}
+		}
+		return queued
+	}
+	if config := config_store.Get(); config.UploadEnabled() {
+		enqueuePendingDays(config)
+	}
 
-			// Set up the upload folder on the shared drive and the backup folder.
-			new_data_upload_folder_path := config.Upload_folder_path + prev_day.Format(dateFormatString) + "/"
-			if err := createFolder(new_data_upload_folder_path); err != nil {
-				return err
+	// The jobs which were pending before a restart are attempted right away.
+	retry_timer := clock.NewTimer(0)
+	retry_chan := retry_timer.C()
+	for {
+		select {
+		case _, ok := <-ticker.Processor_tick_chan:
+			if !ok {
+				retry_timer.Stop()
+				return
 			}
 
-			var new_data_backup_folder_path string
-			if config.Backup_folder_path != "" {
-				new_data_backup_folder_path = config.Backup_folder_path + prev_day.Format(dateFormatString) + "/"
-				if err := createFolder(new_data_backup_folder_path); err != nil {
-					return err
-				}
-			} else {
-				LogInfo("UploadFilesToSharedFolder: No backup dir specified. Not creating any backups")
+			config := config_store.Get()
+			if !config.UploadEnabled() {
+				uploader_log.Debug("no upload target specified. Skipping the upload.")
+				continue
 			}
 
-			// Parallelize copying of all the files.
-			var error_group errgroup.Group
-
-			for _, file := range files {
-				file_name := file.Name()
-
-				error_group.Go(func() error {
-					// If the backup folder path in the config is not empty, we uplaod the files
-					// and create a backup. Otherwise, we just upload the files (which is equivalent
-					// to moving them).
-					if new_data_backup_folder_path != "" {
-						return UploadFileWithBackup(
-							data_folder_path+file_name,
-							new_data_upload_folder_path+file_name,
-							new_data_backup_folder_path+file_name,
-						)
-					} else {
-						return MoveFile(
-							data_folder_path+file_name,
-							new_data_upload_folder_path+file_name,
-						)
-					}
-				})
+			// The queued days are retried by the upload queue, so the run is done once
+			// they are queued.
+			if enqueuePendingDays(config) {
+				ticker.Done()
 			}
 
-			// Await until all subprocesses spawned with error group are finished.
-			if err := error_group.Wait(); err != nil {
-				return err
-			}
+		case <-retry_chan:
+		}
 
-			LogInfo("UploadFilesToSharedFolder: Finished data transfer.")
+		// Without an upload target, the pending jobs wait for the next tick.
+		retry_timer.Stop()
+		retry_chan = nil
+		config := config_store.Get()
+		queue.CheckAge(config.Upload)
+		if !config.UploadEnabled() {
+			continue
+		}
 
-			// Clean up the empty folder which is left behind.
-			if err := os.Remove(data_folder_path); err != nil {
-				return err
-			}
+		queue.RunDue(config)
+		if next_attempt, ok := queue.NextAttempt(); ok {
+			retry_timer = clock.NewTimer(next_attempt.Sub(clock.Now()))
+			retry_chan = retry_timer.C()
+		}
+	}
+}
+
+// Upload the files of the given day.
+//
+// Move all the data files of the day whose partition has ended at time `now` to the upload
+// target and create a backup if a backup folder is specified in the config. The local day
+// folder is removed once all of its files have been transferred. The files are uploaded
+// independently of each other: if some of them fail, the others are uploaded nevertheless
+// and an UploadFileErrors is returned. The day folder on the target and the backup folder
+// get a manifest of all the files of the day which were uploaded so far. The bandwidth
+// limit and the progress of the transfers are timed with `clock`.
+func UploadDay(config Config, clock Clock, day time.Time, now time.Time) error {
+	target, err := config.UploadTarget(clock)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	return uploadDayTo(config, clock, target, day, now)
+}
+
+// Upload the files of the given day to `target` like UploadDay.
+func uploadDayTo(config Config, clock Clock, target UploadTarget, day time.Time, now time.Time) error {
+	uploader_log.Info("starting data transfer to the upload target.", "date", day.Format(dateFormatString),
+		"target", target.String())
+
+	// Get the data files of the day from local storage.
+	data_folder_path := getDataFolder(config.Data_dir, day)
+	files, err := ioutil.ReadDir(data_folder_path)
+	if errors.Is(err, fs.ErrNotExist) {
+		uploader_log.Info("no data to upload.", "date", day.Format(dateFormatString))
+		return nil
+	} else if err != nil {
+		return err
+	}
 
+	// Files which are still being written to are uploaded later on.
+	partitioning := config.Partitioning()
+	complete_files := make([]fs.FileInfo, 0, len(files))
+	for _, file := range files {
+		if partitioning.IsComplete(file.Name(), day, now) {
+			complete_files = append(complete_files, file)
+		}
+	}
+
+	// Each upload is limited on its own, and all the uploads of the day share the total limit.
+	per_upload_rate, total_rate := config.Upload.BandwidthLimits()
+	bandwidth_limit := NewBandwidthLimit(clock, per_upload_rate, total_rate)
+
+	if config.Compression.Upload_archive {
+		if len(complete_files) == 0 {
+			uploader_log.Info("no completed files to upload.", "date", day.Format(dateFormatString))
+			return nil
+		}
+		if len(complete_files) < len(files) {
+			uploader_log.Info("the day is not finished yet. Uploading the archive later.",
+				"date", day.Format(dateFormatString))
 			return nil
-		}()
+		}
+		return uploadDayArchive(config, clock, target, day, now, data_folder_path, complete_files, bandwidth_limit)
+	}
+
+	// The manifest of the day is kept until the day is finished. If it exists, its last
+	// upload may have failed.
+	day_folder := day.Format(dateFormatString)
+	manifest_path := config.State_dir + manifestFolderName + day_folder + ".sha256"
+	_, err = os.Stat(manifest_path)
+	manifest_pending := err == nil
+	if len(complete_files) == 0 && !manifest_pending {
+		uploader_log.Info("no completed files to upload.", "date", day.Format(dateFormatString))
+		return nil
+	}
+
+	// Set up the day folder on the upload target and the backup folder.
+	if err := target.MakeDir(day_folder); err != nil {
+		return err
+	}
+
+	var new_data_backup_folder_path string
+	if config.Backup_folder_path != "" {
+		new_data_backup_folder_path = config.Backup_folder_path + day.Format(dateFormatString) + "/"
+		if err := createFolder(new_data_backup_folder_path); err != nil {
+			return err
+		}
+	} else {
+		uploader_log.Info("no backup dir specified. Not creating any backups.")
+	}
+
+	// Parallelize copying of the files with a limited number of workers.
+	var error_group errgroup.Group
+	error_group.SetLimit(config.Upload.Workers)
+	var file_errors_mutex sync.Mutex
+	file_errors := make(UploadFileErrors)
+	uploaded_entries := make([]ManifestEntry, 0, len(complete_files))
+
+	for _, file := range complete_files {
+		file_name := file.Name()
+
+		error_group.Go(func() error {
+			// If the backup folder path in the config is not empty, we upload the files
+			// and create a backup. Otherwise, we just upload the files.
+			backup_path := ""
+			if new_data_backup_folder_path != "" {
+				backup_path = new_data_backup_folder_path + file_name
+			}
+			entry, err := manifestEntryOf(data_folder_path, file_name)
+			if err == nil {
+				err = UploadFileWithBackup(clock, target, data_folder_path+file_name, day_folder+"/"+file_name,
+					backup_path, bandwidth_limit)
+			}
+			file_errors_mutex.Lock()
+			if err != nil {
+				file_errors[file_name] = err
+			} else {
+				uploaded_entries = append(uploaded_entries, entry)
+			}
+			file_errors_mutex.Unlock()
+			return err
+		})
+	}
+
+	// Await until all subprocesses spawned with error group are finished.
+	error_group.Wait()
 
-		// Stop the uploader goroutine if the upload fails instead of panicking
-		// and terminating the program.
+	// A failed manifest is retried like a failed file.
+	if len(uploaded_entries) > 0 || manifest_pending {
+		err := uploadDayManifest(target, manifest_path, day_folder, uploaded_entries, new_data_backup_folder_path)
 		if err != nil {
-			LogWarnSevere(err)
-			LogWarnSevere("UploadFilesToSharedFolder: Stopping the uploader goroutine.",
-				"Please upload the data files manually and restart the application.")
-			break
+			file_errors[manifestFileName] = err
 		}
+	}
+
+	uploaded_files := make([]string, len(uploaded_entries))
+	for i, entry := range uploaded_entries {
+		uploaded_files[i] = entry.File
+	}
+	complete := len(file_errors) == 0 && len(complete_files) == len(files)
+	recordUpload(config, target, day, now, day_folder, new_data_backup_folder_path, uploaded_files, complete)
 
+	if len(file_errors) > 0 {
+		uploader_log.Info("finished data transfer with failures.", "date", day.Format(dateFormatString),
+			"files", len(uploaded_entries), "failed_files", len(file_errors))
+		return file_errors
+	}
+
+	uploader_log.Info("finished data transfer.", "date", day.Format(dateFormatString), "files", len(complete_files))
+
+	// Clean up the empty folder and the manifest which are left behind.
+	if len(complete_files) == len(files) {
+		if err := os.Remove(data_folder_path); err != nil {
+			return err
+		}
+		if err := os.Remove(manifest_path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
 	}
 
+	return nil
+}
+
+// Add the uploaded files to the manifest of the day and upload it to the day folder on the
+// target (and to the backup folder).
+func uploadDayManifest(target UploadTarget, manifest_path string, day_folder string, entries []ManifestEntry,
+	backup_folder_path string) error {
+	if err := mergeManifest(manifest_path, day_folder, entries); err != nil {
+		return fmt.Errorf("failed to update the manifest: %w", err)
+	}
+	if backup_folder_path != "" {
+		if err := CopyFile(manifest_path, backup_folder_path+manifestFileName); err != nil {
+			return err
+		}
+	}
+	if err := target.Upload(manifest_path, day_folder+"/"+manifestFileName, nil); err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", manifest_path, target, err)
+	}
+	return nil
 }
 
-// Copy the file from `sourcePath` path to the `backupPath` path and then move it
-// from `sourcePath` path to the `uploadPath` path.
-func UploadFileWithBackup(sourcePath, uploadPath, backupPath string) error {
-	if err := CopyFile(sourcePath, backupPath); err != nil {
+// Upload the files of a finished day as one archive.
+//
+// The archive is created next to the day folder, moved to the root of the upload target (and
+// copied to the backup folder) and the local day folder is removed afterwards. The manifest
+// of the day is part of the archive.
+func uploadDayArchive(config Config, clock Clock, target UploadTarget, day time.Time, now time.Time,
+	data_folder_path string, files []fs.FileInfo, bandwidth_limit *BandwidthLimit) error {
+	archive_name := day.Format(dateFormatString) + archiveExtension
+	archive_path := getDataRoot(config.Data_dir) + archive_name
+
+	file_names := make([]string, 0, len(files))
+	entries := make([]ManifestEntry, 0, len(files))
+	for _, file := range files {
+		// The manifest of an earlier attempt is replaced.
+		if file.Name() == manifestFileName {
+			continue
+		}
+		entry, err := manifestEntryOf(data_folder_path, file.Name())
+		if err != nil {
+			return err
+		}
+		file_names = append(file_names, file.Name())
+		entries = append(entries, entry)
+	}
+	err := writeFileAtomic(data_folder_path+manifestFileName, formatManifest(day.Format(dateFormatString), entries))
+	if err != nil {
+		return err
+	}
+	if err := createArchive(archive_path, data_folder_path, append(file_names, manifestFileName)); err != nil {
 		return err
 	}
 
-	if err := MoveFile(sourcePath, uploadPath); err != nil {
+	if err := target.MakeDir(""); err != nil {
 		return err
 	}
+	backup_path := ""
+	if config.Backup_folder_path != "" {
+		if err := createFolder(config.Backup_folder_path); err != nil {
+			return err
+		}
+		backup_path = config.Backup_folder_path + archive_name
+	}
+	if err := UploadFileWithBackup(clock, target, archive_path, archive_name, backup_path, bandwidth_limit); err != nil {
+		return err
+	}
+
+	uploader_log.Info("finished data transfer.", "date", day.Format(dateFormatString), "archive", archive_name,
+		"files", len(file_names))
+	recordUpload(config, target, day, now, archive_name, backup_path, file_names, true)
+
+	// The files are part of the archive now.
+	return os.RemoveAll(data_folder_path)
+}
+
+// Copy the file from `sourcePath` path to the `backupPath` path (unless it is empty), upload
+// it to `uploadPath` on the upload target and remove the local file afterwards. The upload
+// is throttled by `bandwidth_limit` unless it is nil and its progress is timed with `clock`.
+func UploadFileWithBackup(clock Clock, target UploadTarget, sourcePath, uploadPath, backupPath string,
+	bandwidth_limit *BandwidthLimit) error {
+	if backupPath != "" {
+		if err := CopyFile(sourcePath, backupPath); err != nil {
+			return err
+		}
+	}
 
+	info, err := os.Stat(sourcePath)
+	if err != nil {
+		return err
+	}
+	transfer := NewUploadTransfer(clock, bandwidth_limit, uploadPath, info.Size())
+	err = target.Upload(sourcePath, uploadPath, transfer)
+	transfer.Finish(err)
+	if err != nil {
+		return fmt.Errorf("failed to upload %s to %s: %w", sourcePath, target, err)
+	}
+
+	// The upload was successful, so now delete the original file
+	if err := os.Remove(sourcePath); err != nil {
+		return fmt.Errorf("failed removing original file: %s", err)
+	}
 	return nil
 }
 
@@ -135,24 +377,58 @@ func MoveFile(sourcePath, destPath string) error {
 //
 // Create a copy of a file at a given location without removing the original file.
 // We use this funciton to create a local backup of the data files just in case the
-// data upload fails.
+// data upload fails. The copy is written to a temporary file next to `destPath`, synced to
+// disk and compared with the original by its SHA-256 checksum before it is renamed, so a
+// flaky share never leaves a truncated file under the final name.
 // Source: https://gist.github.com/var23rav/23ae5d0d4d830aff886c3c970b8f6c6b
 func CopyFile(sourcePath, destPath string) error {
+	return copyFile(sourcePath, destPath, nil)
+}
+
+// Copy a file like CopyFile with the reads of the source wrapped by `transfer`.
+func copyFile(sourcePath, destPath string, transfer *UploadTransfer) error {
 	inputFile, err := os.Open(sourcePath)
 	if err != nil {
 		return fmt.Errorf("couldn't open source file: %s", err)
 	}
 	defer inputFile.Close()
 
-	outputFile, err := os.Create(destPath)
+	tmpPath := destPath + ".tmp"
+	outputFile, err := os.Create(tmpPath)
 	if err != nil {
 		return fmt.Errorf("couldn't open dest file: %s", err)
 	}
+	defer os.Remove(tmpPath)
 	defer outputFile.Close()
 
-	if _, err = io.Copy(outputFile, inputFile); err != nil {
+	hash := sha256.New()
+	if _, err = io.Copy(outputFile, transfer.Reader(io.TeeReader(inputFile, hash))); err != nil {
 		return fmt.Errorf("writing to output file failed: %s", err)
 	}
+	if err := outputFile.Sync(); err != nil {
+		return fmt.Errorf("syncing the output file failed: %s", err)
+	}
+	if err := outputFile.Close(); err != nil {
+		return fmt.Errorf("closing the output file failed: %s", err)
+	}
 
+	// Read the copy back to make sure that it arrived as it was written.
+	sourceChecksum := hex.EncodeToString(hash.Sum(nil))
+	destChecksum, err := fileSha256(tmpPath)
+	if err != nil {
+		return fmt.Errorf("couldn't read back the output file: %s", err)
+	}
+	if destChecksum != sourceChecksum {
+		return fmt.Errorf("verification of the copy %s failed: sha256 %s instead of %s", destPath, destChecksum,
+			sourceChecksum)
+	}
+
+	if err := os.Rename(tmpPath, destPath); err != nil {
+		return err
+	}
+	// The local file is removed after the copy, so the rename has to survive a power loss.
+	if err := syncFolder(filepath.Dir(destPath)); err != nil {
+		return fmt.Errorf("syncing the destination folder failed: %s", err)
+	}
 	return nil
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingTarget is an UploadTarget which counts the uploads of every remote path.
+//
+// The first uploads wait until `workers` of them run at the same time, so a test fails if
+// the worker pool uploads less files in parallel than configured.
+type countingTarget struct {
+	workers int
+	clock   Clock
+
+	mu         sync.Mutex
+	uploads    map[string]int
+	active     int
+	max_active int
+	full       chan struct{}
+	errors     []string
+}
+
+func newCountingTarget(workers int, clock Clock) *countingTarget {
+	return &countingTarget{workers: workers, clock: clock, uploads: make(map[string]int), full: make(chan struct{})}
+}
+
+func (target *countingTarget) MakeDir(dir string) error {
+	return nil
+}
+
+func (target *countingTarget) Upload(local_path string, remote_path string, transfer *UploadTransfer) error {
+	target.mu.Lock()
+	target.uploads[remote_path]++
+	target.active++
+	if target.active > target.max_active {
+		target.max_active = target.active
+		if target.max_active == target.workers {
+			close(target.full)
+		}
+	}
+	if transfer != nil && !transfer.started.Equal(target.clock.Now()) {
+		target.errors = append(target.errors, "the transfer of "+remote_path+" is not timed with the clock")
+	}
+	target.mu.Unlock()
+
+	defer func() {
+		target.mu.Lock()
+		target.active--
+		target.mu.Unlock()
+	}()
+
+	file, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := io.Copy(ioutil.Discard, transfer.Reader(file)); err != nil {
+		return err
+	}
+
+	// The manifest is uploaded after the files, so it doesn't wait for the other workers.
+	if transfer != nil {
+		select {
+		case <-target.full:
+		case <-time.After(5 * time.Second):
+		}
+	}
+	return nil
+}
+
+func (target *countingTarget) String() string {
+	return "counting target"
+}
+
+func (target *countingTarget) Close() error {
+	return nil
+}
+
+func TestUploadDayUploadsEveryFileOnceWithParallelWorkers(t *testing.T) {
+	const workers = 3
+	config := newTestConfig(t, func(config *Config) {
+		config.Upload.Workers = workers
+	})
+	day := time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC)
+	clock := NewFakeClock(time.Date(2024, 3, 6, 1, 0, 0, 0, time.UTC))
+	data_folder_path := getDataFolder(config.Data_dir, day)
+
+	file_names := make([]string, 0, 10)
+	for i := 0; i < 10; i++ {
+		file_name := fmt.Sprintf("output_file_T%02d.csv", i)
+		writeTestFile(t, data_folder_path+file_name, "Hex\n"+file_name+"\n")
+		file_names = append(file_names, file_name)
+	}
+
+	target := newCountingTarget(workers, clock)
+	if err := uploadDayTo(config, clock, target, day, clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, file_name := range append(file_names, manifestFileName) {
+		if count := target.uploads["20240305/"+file_name]; count != 1 {
+			t.Errorf("%s was uploaded %d times", file_name, count)
+		}
+	}
+	if len(target.uploads) != len(file_names)+1 {
+		t.Errorf("unexpected uploads: %v", target.uploads)
+	}
+	if target.max_active != workers {
+		t.Errorf("%d files were uploaded in parallel, expected %d", target.max_active, workers)
+	}
+	for _, message := range target.errors {
+		t.Error(message)
+	}
+	if _, err := os.Stat(data_folder_path); !os.IsNotExist(err) {
+		t.Errorf("the day folder was not removed: %v", err)
+	}
+
+	ledger, err := readUploadLedger(config.State_dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uploaded := ledger["20240305"]; uploaded == nil || !uploaded.complete || !uploaded.hasAll(file_names) {
+		t.Errorf("the upload of the day is not recorded: %+v", uploaded)
+	}
+}
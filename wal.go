@@ -0,0 +1,609 @@
+// Write-ahead log.
+//
+// Persistent append-only queue between the receiver and the processor. Every record is
+// appended to a segment file in the state directory before it is handed to the processor,
+// and the processor acknowledges the records once the CSVs they were written to have been
+// committed. Records which were not acknowledged (e.g. because the data folder was not
+// writable or the listener was stopped) are replayed after a restart. Segments whose records
+// have all been acknowledged are deleted.
+//
+// The active segment is synced to the disk at the flush interval of the csv files (or after
+// every append if the flushes only depend on the number of records), so a power loss loses at
+// most the records of the last interval. The ack position is saved at most once a second and
+// on shutdown, so after a crash up to a second of records which had already been written to
+// the csv files are replayed and end up twice in the files.
+//
+// Every entry of a segment consists of the length and the CRC-32 of the payload (both as
+// little endian uint32) followed by the JSON encoded record. Segments are named after the
+// sequence number of their first record.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// WalConfig groups the parameters of the write-ahead log.
+type WalConfig struct {
+	Segment_size_mb int `yaml:"segment_size_mb"` // start a new segment once the active one exceeds this size.
+}
+
+// SequencedRecord is a record together with its position in the write-ahead log.
+type SequencedRecord struct {
+	Seq    uint64
+	Record Record
+}
+
+const (
+	walSegmentExtension string = ".wal"
+	walAckFileName      string = "acked"
+	walEntryHeaderSize  int    = 8
+	// Upper bound of the size of an entry. Larger lengths indicate a corrupt entry.
+	walMaxEntrySize uint32 = 1 << 20
+	// Minimum time between two writes of the ack file.
+	walAckSaveInterval time.Duration = time.Second
+)
+
+// Counters of the write-ahead log.
+var (
+	wal_appended_counter      = new(expvar.Int)
+	wal_acked_counter         = new(expvar.Int)
+	wal_append_errors_counter = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("wal_appended", wal_appended_counter)
+	metrics.Set("wal_acked", wal_acked_counter)
+	metrics.Set("wal_append_errors", wal_append_errors_counter)
+}
+
+// WriteAheadLog is a persistent queue of records with a single producer and a single consumer.
+type WriteAheadLog struct {
+	dir          string
+	segment_size int64
+	records      chan SequencedRecord
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	closed   bool
+	segments []uint64 // sequence numbers of the first records of the segments in ascending order.
+	next_seq uint64   // sequence number of the next appended record.
+	acked    uint64   // all the records with a lower sequence number have been acknowledged.
+
+	// The segment which is appended to.
+	active      walSegmentFile
+	active_size int64
+
+	// Position of the consumer.
+	read_seq       uint64
+	reader         *os.File
+	reader_input   *bufio.Reader
+	reader_segment int // index of the segment which is read.
+
+	clock         Clock
+	sync_interval time.Duration // zero syncs after every append.
+	unsynced      bool          // the active segment was appended to since the last sync.
+	stop          chan struct{} // closed when the log is closed.
+	last_ack_save time.Time
+}
+
+// walSegmentFile is the file of the active segment. The tests replace it to simulate failed
+// writes.
+type walSegmentFile interface {
+	io.WriteCloser
+	Truncate(size int64) error
+	Sync() error
+}
+
+// Get the interval at which the segments are synced: the flush interval of the csv files or,
+// if they are only flushed by the number of records, their fsync interval. Zero syncs after
+// every append. Validate makes sure that the intervals can be parsed.
+func (write_config WriteConfig) walSyncInterval() time.Duration {
+	if flush_interval, _ := parseWriteInterval(write_config.Flush_interval); flush_interval > 0 {
+		return flush_interval
+	}
+	fsync_interval, _ := parseWriteInterval(write_config.Fsync_interval)
+	return fsync_interval
+}
+
+// Open the write-ahead log in `dir` and start feeding the records which were not
+// acknowledged yet to the consumer. The active segment is synced every `sync_interval`.
+func OpenWriteAheadLog(dir string, wal_config WalConfig, clock Clock, sync_interval time.Duration,
+) (*WriteAheadLog, error) {
+	if err := createFolder(dir); err != nil {
+		return nil, err
+	}
+
+	wal := &WriteAheadLog{
+		dir:          dir,
+		segment_size: int64(wal_config.Segment_size_mb) * 1024 * 1024,
+		records:      make(chan SequencedRecord),
+		clock:        clock,
+		stop:         make(chan struct{}),
+
+		sync_interval: sync_interval,
+	}
+	wal.cond = sync.NewCond(&wal.mu)
+
+	if err := wal.load(); err != nil {
+		return nil, err
+	}
+
+	metrics.Set("wal_pending", expvar.Func(func() any {
+		wal.mu.Lock()
+		defer wal.mu.Unlock()
+		return wal.next_seq - wal.acked
+	}))
+
+	if pending := wal.next_seq - wal.acked; pending > 0 {
+		queue_log.Info("replaying records which were not committed before the restart.", "records", pending)
+	}
+
+	go wal.feed()
+	if sync_interval > 0 {
+		go wal.syncPeriodically()
+	}
+	return wal, nil
+}
+
+// Read the ack file and the existing segments.
+func (wal *WriteAheadLog) load() error {
+	ack_data, err := ioutil.ReadFile(wal.dir + walAckFileName)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if wal.acked, err = strconv.ParseUint(strings.TrimSpace(string(ack_data)), 10, 64); err != nil {
+			return fmt.Errorf("invalid ack file: %w", err)
+		}
+	}
+
+	entries, err := ioutil.ReadDir(wal.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.Name(), walSegmentExtension) {
+			continue
+		}
+		base, err := strconv.ParseUint(strings.TrimSuffix(entry.Name(), walSegmentExtension), 10, 64)
+		if err != nil {
+			continue
+		}
+		wal.segments = append(wal.segments, base)
+	}
+	sort.Slice(wal.segments, func(i, j int) bool { return wal.segments[i] < wal.segments[j] })
+
+	if len(wal.segments) == 0 {
+		wal.next_seq = wal.acked
+		wal.read_seq = wal.acked
+		return wal.startSegment()
+	}
+
+	// Count the valid entries of the last segment and cut off an entry which was only
+	// partially written before a crash.
+	last_base := wal.segments[len(wal.segments)-1]
+	entries_count, valid_size, err := scanSegment(wal.segmentPath(last_base))
+	if err != nil {
+		return err
+	}
+	if err := os.Truncate(wal.segmentPath(last_base), valid_size); err != nil {
+		return err
+	}
+	wal.next_seq = last_base + entries_count
+	if wal.acked > wal.next_seq {
+		wal.acked = wal.next_seq
+	}
+	wal.read_seq = wal.acked
+
+	wal.active, err = os.OpenFile(wal.segmentPath(last_base), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	wal.active_size = valid_size
+
+	wal.removeAckedSegments()
+	return nil
+}
+
+// Count the valid entries of a segment. Also returns the size of the valid part.
+func scanSegment(segment_path string) (uint64, int64, error) {
+	file, err := os.Open(segment_path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	input := bufio.NewReader(file)
+	var count uint64
+	var size int64
+	for {
+		payload, err := readWalEntry(input)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				queue_log.Warn("cutting off a corrupt entry of the write-ahead log.", "path", segment_path, "err", err)
+			}
+			return count, size, nil
+		}
+		count++
+		size += int64(walEntryHeaderSize + len(payload))
+	}
+}
+
+// Read the next entry of a segment and check its checksum.
+func readWalEntry(input io.Reader) ([]byte, error) {
+	header := make([]byte, walEntryHeaderSize)
+	if _, err := io.ReadFull(input, header); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(header[0:4])
+	checksum := binary.LittleEndian.Uint32(header[4:8])
+	if length > walMaxEntrySize {
+		return nil, fmt.Errorf("entry size %d exceeds the maximum", length)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(input, payload); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != checksum {
+		return nil, errors.New("checksum mismatch")
+	}
+	return payload, nil
+}
+
+func (wal *WriteAheadLog) segmentPath(base uint64) string {
+	return fmt.Sprintf("%s%020d%s", wal.dir, base, walSegmentExtension)
+}
+
+// Start a new segment at the next sequence number. Expects the lock to be held.
+func (wal *WriteAheadLog) startSegment() error {
+	if wal.active != nil {
+		if err := wal.active.Sync(); err != nil {
+			return err
+		}
+		if err := wal.active.Close(); err != nil {
+			return err
+		}
+	}
+
+	active, err := os.OpenFile(wal.segmentPath(wal.next_seq), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	wal.active = active
+	wal.active_size = 0
+	wal.segments = append(wal.segments, wal.next_seq)
+	return nil
+}
+
+// Append records to the log. They are written with a single write call.
+func (wal *WriteAheadLog) Append(records []Record) error {
+	var buffer []byte
+	for _, record := range records {
+		payload, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		header := make([]byte, walEntryHeaderSize)
+		binary.LittleEndian.PutUint32(header[0:4], uint32(len(payload)))
+		binary.LittleEndian.PutUint32(header[4:8], crc32.ChecksumIEEE(payload))
+		buffer = append(append(buffer, header...), payload...)
+	}
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return errors.New("the write-ahead log is closed")
+	}
+	if _, err := wal.active.Write(buffer); err != nil {
+		wal.cutOffFailedAppend()
+		return err
+	}
+	wal.active_size += int64(len(buffer))
+	wal.unsynced = true
+	if wal.sync_interval == 0 {
+		if err := wal.syncActive(); err != nil {
+			queue_log.Warn("failed to sync the write-ahead log.", "err", err)
+		}
+	}
+	wal.next_seq += uint64(len(records))
+	wal_appended_counter.Add(int64(len(records)))
+	wal.cond.Broadcast()
+
+	if wal.segment_size > 0 && wal.active_size >= wal.segment_size {
+		if err := wal.startSegment(); err != nil {
+			queue_log.Warn("failed to start a new segment of the write-ahead log.", "err", err)
+		}
+	}
+	return nil
+}
+
+// Cut off the entries which were partially written by a failed append, such that the segment
+// stays readable. If that fails, the following records go to a new segment, so they are not
+// lost behind the broken entry. Expects the lock to be held.
+func (wal *WriteAheadLog) cutOffFailedAppend() {
+	// The reader may have buffered the part which is cut off, so it reopens the segment.
+	if wal.reader != nil && wal.reader_segment == len(wal.segments)-1 {
+		wal.reader.Close()
+		wal.reader = nil
+	}
+	err := wal.active.Truncate(wal.active_size)
+	if err == nil {
+		return
+	}
+	if wal.active_size == 0 {
+		// A new segment would start at the same sequence number.
+		queue_log.WarnSevere("failed to cut off a partially written entry of the write-ahead log.", "err", err)
+		return
+	}
+	queue_log.Warn("failed to cut off a partially written entry. Starting a new segment.", "err", err)
+	if err := wal.startSegment(); err != nil {
+		queue_log.WarnSevere("failed to start a new segment of the write-ahead log.", "err", err)
+	}
+}
+
+// Sink is a consumer of the records next to the csv files, e.g. a live feed.
+//
+// The records are handed to the sinks as soon as they were appended to the write-ahead log.
+// So the sinks don't depend on the csv files being writable, and the records which are
+// replayed after a restart are not handed over again. Publish must not block the log; a sink
+// buffers or drops the records it can't deliver.
+type Sink interface {
+	Publish(record Record)
+	Close() error
+}
+
+// Append the records of the queue to the log and hand them to the `sinks` until the queue or
+// the log is closed. The sinks are closed before the function returns.
+//
+// The records which arrived in the meantime are appended in one go.
+func (wal *WriteAheadLog) AppendFromQueue(records <-chan Record, sinks []Sink) {
+	defer func() {
+		for _, sink := range sinks {
+			if err := sink.Close(); err != nil {
+				queue_log.Warn("failed to close a sink.", "err", err)
+			}
+		}
+	}()
+
+	for {
+		var record Record
+		select {
+		case next, ok := <-records:
+			if !ok {
+				return
+			}
+			record = next
+		case <-wal.stop:
+			return
+		}
+
+		batch := []Record{record}
+	drain:
+		for {
+			select {
+			case record, ok := <-records:
+				if !ok {
+					break drain
+				}
+				batch = append(batch, record)
+			default:
+				break drain
+			}
+		}
+
+		if err := wal.Append(batch); err != nil {
+			wal_append_errors_counter.Add(int64(len(batch)))
+			queue_log.WarnSevere("failed to append records to the write-ahead log. The records are lost.",
+				"records", len(batch), "err", err)
+			continue
+		}
+		for _, sink := range sinks {
+			for _, record := range batch {
+				sink.Publish(record)
+			}
+		}
+	}
+}
+
+// Sync the active segment every sync interval until the log is closed.
+func (wal *WriteAheadLog) syncPeriodically() {
+	ticker := wal.clock.NewTicker(wal.sync_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C():
+			wal.mu.Lock()
+			err := wal.syncActive()
+			wal.mu.Unlock()
+			if err != nil {
+				queue_log.Warn("failed to sync the write-ahead log.", "err", err)
+			}
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// Sync the active segment if it was appended to. Expects the lock to be held.
+func (wal *WriteAheadLog) syncActive() error {
+	if !wal.unsynced || wal.closed {
+		return nil
+	}
+	if err := wal.active.Sync(); err != nil {
+		return err
+	}
+	wal.unsynced = false
+	return nil
+}
+
+// Get the channel from which the consumer receives the records in order.
+func (wal *WriteAheadLog) C() <-chan SequencedRecord {
+	return wal.records
+}
+
+// Feed the records to the consumer until the log is closed.
+func (wal *WriteAheadLog) feed() {
+	for {
+		record, err := wal.next()
+		if errors.Is(err, fs.ErrClosed) {
+			return
+		} else if err != nil {
+			// Skip the rest of the segment, its entries can't be read anymore.
+			queue_log.WarnSevere("failed to read the write-ahead log. Skipping the rest of the segment.", "err", err)
+			wal.skipSegment()
+			continue
+		}
+		select {
+		case wal.records <- record:
+		case <-wal.stop:
+			return
+		}
+	}
+}
+
+// Read the next record. Blocks until a record is available.
+func (wal *WriteAheadLog) next() (SequencedRecord, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	for wal.read_seq >= wal.next_seq && !wal.closed {
+		wal.cond.Wait()
+	}
+	if wal.closed {
+		return SequencedRecord{}, fs.ErrClosed
+	}
+
+	// Open the segment which contains the next record and skip the records before it.
+	segment := sort.Search(len(wal.segments), func(i int) bool { return wal.segments[i] > wal.read_seq }) - 1
+	if segment < 0 {
+		// The records before the first segment were removed by hand.
+		segment = 0
+		wal.read_seq = wal.segments[0]
+	}
+	if wal.reader == nil || segment != wal.reader_segment {
+		if wal.reader != nil {
+			wal.reader.Close()
+		}
+		reader, err := os.Open(wal.segmentPath(wal.segments[segment]))
+		if err != nil {
+			return SequencedRecord{}, err
+		}
+		wal.reader = reader
+		wal.reader_input = bufio.NewReader(reader)
+		wal.reader_segment = segment
+		for seq := wal.segments[segment]; seq < wal.read_seq; seq++ {
+			if _, err := readWalEntry(wal.reader_input); err != nil {
+				return SequencedRecord{}, err
+			}
+		}
+	}
+
+	payload, err := readWalEntry(wal.reader_input)
+	if err != nil {
+		return SequencedRecord{}, err
+	}
+	record := SequencedRecord{Seq: wal.read_seq}
+	wal.read_seq++
+	if err := json.Unmarshal(payload, &record.Record); err != nil {
+		return SequencedRecord{}, err
+	}
+	return record, nil
+}
+
+// Continue reading at the start of the segment after the one which is read.
+func (wal *WriteAheadLog) skipSegment() {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.reader_segment+1 < len(wal.segments) {
+		wal.read_seq = wal.segments[wal.reader_segment+1]
+	} else {
+		wal.read_seq = wal.next_seq
+	}
+	if wal.reader != nil {
+		wal.reader.Close()
+		wal.reader = nil
+	}
+}
+
+// Acknowledge all the records up to and including `seq`, i.e. they have been committed
+// and don't have to be replayed after a restart.
+func (wal *WriteAheadLog) Ack(seq uint64) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if seq+1 <= wal.acked || seq >= wal.read_seq {
+		return
+	}
+	wal_acked_counter.Add(int64(seq + 1 - wal.acked))
+	wal.acked = seq + 1
+
+	wal.removeAckedSegments()
+	if wal.clock.Now().Sub(wal.last_ack_save) >= walAckSaveInterval {
+		wal.saveAck()
+	}
+}
+
+// Delete the segments whose records have all been acknowledged. Expects the lock to be held.
+func (wal *WriteAheadLog) removeAckedSegments() {
+	for len(wal.segments) > 1 && wal.segments[1] <= wal.acked {
+		if wal.reader != nil && wal.reader_segment == 0 {
+			wal.reader.Close()
+			wal.reader = nil
+		}
+		if err := os.Remove(wal.segmentPath(wal.segments[0])); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			queue_log.Warn("failed to remove a segment of the write-ahead log.", "err", err)
+			return
+		}
+		wal.segments = wal.segments[1:]
+		wal.reader_segment--
+	}
+}
+
+// Persist the ack position. Expects the lock to be held.
+func (wal *WriteAheadLog) saveAck() {
+	if err := writeFileAtomic(wal.dir+walAckFileName, []byte(strconv.FormatUint(wal.acked, 10)+"\n")); err != nil {
+		queue_log.Warn("failed to save the position of the write-ahead log.", "err", err)
+	}
+	wal.last_ack_save = wal.clock.Now()
+}
+
+// Persist the ack position and close the segments.
+func (wal *WriteAheadLog) Close() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return nil
+	}
+	wal.closed = true
+	wal.cond.Broadcast()
+	close(wal.stop)
+
+	wal.saveAck()
+	if wal.reader != nil {
+		wal.reader.Close()
+	}
+	if err := wal.active.Sync(); err != nil {
+		wal.active.Close()
+		return err
+	}
+	return wal.active.Close()
+}
@@ -0,0 +1,377 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingSink is a Sink which keeps the published records.
+type recordingSink struct {
+	mu      sync.Mutex
+	records []Record
+	closed  bool
+}
+
+func (sink *recordingSink) Publish(record Record) {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.records = append(sink.records, record)
+}
+
+func (sink *recordingSink) Close() error {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	sink.closed = true
+	return nil
+}
+
+// Get the poll sequence numbers of the published records.
+func (sink *recordingSink) pollSeqs() []uint64 {
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	poll_seqs := make([]uint64, len(sink.records))
+	for i, record := range sink.records {
+		poll_seqs[i] = record.Poll_seq
+	}
+	return poll_seqs
+}
+
+// Start appending the records of a queue to the log. The returned channel is closed once
+// the appending goroutine returned.
+func appendFromTestQueue(wal *WriteAheadLog, sink Sink) (chan<- Record, <-chan struct{}) {
+	queue := make(chan Record)
+	done := make(chan struct{})
+	go func() {
+		wal.AppendFromQueue(queue, []Sink{sink})
+		close(done)
+	}()
+	return queue, done
+}
+
+// Create the record of a poll. It was received 1.5 seconds after the GPS time of the message.
+func testRecord(poll_seq uint64) Record {
+	gps_time := time.Date(2024, 3, 5, 12, 0, 0, 250_000_000, time.UTC).Add(time.Duration(poll_seq) * time.Second)
+	aircraft := AircraftData{Hex: "4b1805", Typ: "A320", Fli: "SWR123", Uti: uint64(gps_time.Unix()),
+		Ns: uint32(gps_time.Nanosecond())}
+	return NewRecord(aircraft, gps_time.Add(1500*time.Millisecond), time.Duration(poll_seq)*time.Second, poll_seq)
+}
+
+// Check that a record which went through a sink or the log still carries its reception and
+// GPS times.
+func checkRecordTimes(t *testing.T, record Record, expected Record) {
+	t.Helper()
+	if !record.Received.Equal(expected.Received) || record.Received_mono != expected.Received_mono ||
+		!record.Gps_time.Equal(expected.Gps_time) || record.Gps_time.IsZero() {
+		t.Errorf("the record of poll %d was received at %s (%s) with the GPS time %s, expected %s (%s) and %s",
+			record.Poll_seq, record.Received, record.Received_mono, record.Gps_time, expected.Received,
+			expected.Received_mono, expected.Gps_time)
+	}
+}
+
+func TestAppendFromQueuePublishesEveryRecordOnce(t *testing.T) {
+	dir := t.TempDir() + "/"
+	wal, err := OpenWriteAheadLog(dir, WalConfig{}, RealClock, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink := &recordingSink{}
+	queue, done := appendFromTestQueue(wal, sink)
+
+	// The records are published although nobody takes them from the log, e.g. because the
+	// csv files can't be written.
+	for poll_seq := uint64(1); poll_seq <= 3; poll_seq++ {
+		queue <- testRecord(poll_seq)
+	}
+	waitUntil(t, "the records are published", func() bool { return len(sink.pollSeqs()) == 3 })
+
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if !sink.closed {
+		t.Error("the sink was not closed with the log")
+	}
+
+	// After a restart, the records which were not acknowledged are replayed to the
+	// processor, but they are not published again.
+	wal, err = OpenWriteAheadLog(dir, WalConfig{}, RealClock, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted_sink := &recordingSink{}
+	queue, done = appendFromTestQueue(wal, restarted_sink)
+	queue <- testRecord(4)
+	for expected := uint64(1); expected <= 4; expected++ {
+		select {
+		case record := <-wal.C():
+			if record.Record.Poll_seq != expected {
+				t.Fatalf("replayed poll %d, expected %d", record.Record.Poll_seq, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the record of poll %d", expected)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+
+	if poll_seqs := sink.pollSeqs(); len(poll_seqs) != 3 || poll_seqs[0] != 1 || poll_seqs[2] != 3 {
+		t.Errorf("published before the restart: %v, expected [1 2 3]", poll_seqs)
+	}
+	if poll_seqs := restarted_sink.pollSeqs(); len(poll_seqs) != 1 || poll_seqs[0] != 4 {
+		t.Errorf("published after the restart: %v, expected [4]", poll_seqs)
+	}
+}
+
+// On shutdown, the queue is closed before the log, and the records which were still queued
+// are appended before the appending goroutine returns.
+func TestAppendFromQueueAppendsQueuedRecordsBeforeReturning(t *testing.T) {
+	dir := t.TempDir() + "/"
+	wal := openTestWal(t, dir, 0)
+	queue := make(chan Record, 3)
+	for poll_seq := uint64(1); poll_seq <= 3; poll_seq++ {
+		queue <- testRecord(poll_seq)
+	}
+	close(queue)
+	sink := &recordingSink{}
+	wal.AppendFromQueue(queue, []Sink{sink})
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if poll_seqs := sink.pollSeqs(); !reflect.DeepEqual(poll_seqs, []uint64{1, 2, 3}) || !sink.closed {
+		t.Errorf("published %v (closed: %t), expected [1 2 3]", poll_seqs, sink.closed)
+	}
+
+	wal = openTestWal(t, dir, 0)
+	defer wal.Close()
+	checkWalRecords(t, wal, 0, 1, 2, 3)
+}
+
+// Open a write-ahead log in `dir`. A `segment_size` of one byte starts a new segment after
+// every append.
+func openTestWal(t *testing.T, dir string, segment_size int64) *WriteAheadLog {
+	t.Helper()
+	wal, err := OpenWriteAheadLog(dir, WalConfig{}, NewFakeClock(time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wal.segment_size = segment_size
+	return wal
+}
+
+// Append the records of the given polls one by one.
+func appendTestRecords(t *testing.T, wal *WriteAheadLog, poll_seqs ...uint64) {
+	t.Helper()
+	for _, poll_seq := range poll_seqs {
+		if err := wal.Append([]Record{testRecord(poll_seq)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Check that the log feeds exactly the records of the given polls, with consecutive sequence
+// numbers starting at `first_seq`.
+func checkWalRecords(t *testing.T, wal *WriteAheadLog, first_seq uint64, poll_seqs ...uint64) {
+	t.Helper()
+	for i, poll_seq := range poll_seqs {
+		select {
+		case record := <-wal.C():
+			if record.Seq != first_seq+uint64(i) || record.Record.Poll_seq != poll_seq {
+				t.Fatalf("got record %d of poll %d, expected record %d of poll %d",
+					record.Seq, record.Record.Poll_seq, first_seq+uint64(i), poll_seq)
+			}
+			checkRecordTimes(t, record.Record, testRecord(poll_seq))
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for the record of poll %d", poll_seq)
+		}
+	}
+	select {
+	case record := <-wal.C():
+		t.Fatalf("got the unexpected record %d of poll %d", record.Seq, record.Record.Poll_seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Get the names of the segment files in `dir`.
+func walSegmentNames(t *testing.T, dir string) []string {
+	t.Helper()
+	segment_paths, err := filepath.Glob(dir + "*" + walSegmentExtension)
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, len(segment_paths))
+	for i, segment_path := range segment_paths {
+		names[i] = filepath.Base(segment_path)
+	}
+	return names
+}
+
+func TestWriteAheadLogReplaysUnackedRecordsAfterRestart(t *testing.T) {
+	dir := t.TempDir() + "/"
+	wal := openTestWal(t, dir, 0)
+	appendTestRecords(t, wal, 1, 2, 3, 4, 5)
+	checkWalRecords(t, wal, 0, 1, 2, 3, 4, 5)
+	wal.Ack(1)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ack position is persisted on close, so only the unacknowledged records come back
+	// and new records continue the sequence.
+	if ack_data, err := ioutil.ReadFile(dir + walAckFileName); err != nil || string(ack_data) != "2\n" {
+		t.Fatalf("the ack file holds %q (%v), expected 2", ack_data, err)
+	}
+	wal = openTestWal(t, dir, 0)
+	appendTestRecords(t, wal, 6)
+	checkWalRecords(t, wal, 2, 3, 4, 5, 6)
+	wal.Ack(5)
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal = openTestWal(t, dir, 0)
+	defer wal.Close()
+	checkWalRecords(t, wal, 6)
+}
+
+func TestWriteAheadLogRemovesAckedSegments(t *testing.T) {
+	dir := t.TempDir() + "/"
+	wal := openTestWal(t, dir, 1)
+	appendTestRecords(t, wal, 1, 2, 3, 4)
+	checkWalRecords(t, wal, 0, 1, 2, 3, 4)
+
+	// Every append starts a new segment, and the active segment after the last append is empty.
+	if names := walSegmentNames(t, dir); len(names) != 5 {
+		t.Fatalf("the log has the segments %v, expected 5", names)
+	}
+
+	// A segment is only removed once all of its records have been acknowledged.
+	wal.Ack(1)
+	expected := []string{
+		"00000000000000000002" + walSegmentExtension,
+		"00000000000000000003" + walSegmentExtension,
+		"00000000000000000004" + walSegmentExtension,
+	}
+	if names := walSegmentNames(t, dir); !reflect.DeepEqual(names, expected) {
+		t.Fatalf("the log has the segments %v after the ack, expected %v", names, expected)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wal = openTestWal(t, dir, 1)
+	defer wal.Close()
+	checkWalRecords(t, wal, 2, 3, 4)
+}
+
+func TestWriteAheadLogCutsOffCorruptLastEntry(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(segment []byte) []byte
+		polls   []uint64 // polls of the records which are replayed.
+	}{
+		{"cut off entry", func(segment []byte) []byte { return segment[:len(segment)-5] }, []uint64{1, 2}},
+		{"cut off header", func(segment []byte) []byte {
+			return append(segment, 0x10, 0x00)
+		}, []uint64{1, 2, 3}},
+		{"checksum mismatch", func(segment []byte) []byte {
+			segment[len(segment)-2] ^= 0xff
+			return segment
+		}, []uint64{1, 2}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir() + "/"
+			wal := openTestWal(t, dir, 0)
+			appendTestRecords(t, wal, 1, 2, 3)
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			segment_path := dir + "00000000000000000000" + walSegmentExtension
+			segment, err := ioutil.ReadFile(segment_path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(segment_path, test.corrupt(segment), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			// The corrupt entry is cut off, and the next record takes its place.
+			wal = openTestWal(t, dir, 0)
+			defer wal.Close()
+			appendTestRecords(t, wal, 4)
+			checkWalRecords(t, wal, 0, append(test.polls, 4)...)
+		})
+	}
+}
+
+// failingSegmentFile is a segment file whose next write only writes half of the data and fails.
+type failingSegmentFile struct {
+	*os.File
+	fail_truncate bool
+	failed        bool
+}
+
+func (file *failingSegmentFile) Write(data []byte) (int, error) {
+	if file.failed {
+		return file.File.Write(data)
+	}
+	file.failed = true
+	n, _ := file.File.Write(data[:len(data)/2])
+	return n, errors.New("no space left on device")
+}
+
+func (file *failingSegmentFile) Truncate(size int64) error {
+	if file.fail_truncate {
+		return errors.New("input/output error")
+	}
+	return file.File.Truncate(size)
+}
+
+// The records which are appended after a failed append are fed and replayed, whether the
+// partially written entry could be cut off or not.
+func TestWriteAheadLogContinuesAfterFailedAppend(t *testing.T) {
+	tests := []struct {
+		name          string
+		fail_truncate bool
+		segments      int
+	}{
+		{"cut off", false, 1},
+		{"new segment", true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir() + "/"
+			wal := openTestWal(t, dir, 0)
+			appendTestRecords(t, wal, 1)
+			checkWalRecords(t, wal, 0, 1)
+
+			wal.mu.Lock()
+			wal.active = &failingSegmentFile{File: wal.active.(*os.File), fail_truncate: test.fail_truncate}
+			wal.mu.Unlock()
+			if err := wal.Append([]Record{testRecord(2), testRecord(3)}); err == nil {
+				t.Fatal("the failed append didn't return an error")
+			}
+			appendTestRecords(t, wal, 4, 5)
+			checkWalRecords(t, wal, 1, 4, 5)
+			if err := wal.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if names := walSegmentNames(t, dir); len(names) != test.segments {
+				t.Errorf("the log has the segments %v, expected %d", names, test.segments)
+			}
+
+			wal = openTestWal(t, dir, 0)
+			defer wal.Close()
+			checkWalRecords(t, wal, 0, 1, 4, 5)
+		})
+	}
+}
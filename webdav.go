@@ -0,0 +1,425 @@
+// WebDAV upload target.
+//
+// Uploads the data files to a WebDAV server, e.g. a Nextcloud or ownCloud instance. Day
+// folders are created with MKCOL and the files are transferred with PUT. On Nextcloud,
+// large files are uploaded in chunks such that they don't run into the request size
+// limits of the web server. After the upload, the size of the file on the server (and
+// its checksum if the server stores one) is compared with the local file.
+
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// WebdavConfig groups the parameters of the WebDAV upload target.
+type WebdavConfig struct {
+	Url           string `yaml:"url"` // e.g. https://cloud.example.com/remote.php/dav/files/<user>/radarcape/
+	Username      string `yaml:"username"`
+	Password      string `yaml:"password"`      // app password. Preferably set by RADARCAPE_UPLOAD_WEBDAV_PASSWORD.
+	Chunk_size_mb int    `yaml:"chunk_size_mb"` // larger files are uploaded in chunks on Nextcloud.
+	Timeout       string `yaml:"timeout"`       // of every request, e.g. 5m.
+}
+
+// Limits of the chunk size of the Nextcloud chunked upload.
+const (
+	webdavMinChunkSizeMb int = 5
+	webdavMaxChunkSizeMb int = 5120
+)
+
+// Path of the files of a user on Nextcloud and the path of its chunked uploads.
+const (
+	nextcloudFilesPath   string = "/remote.php/dav/files/"
+	nextcloudUploadsPath string = "/remote.php/dav/uploads/"
+)
+
+// Fill in the default values of the WebDAV parameters which were not specified.
+func (webdav_config *WebdavConfig) applyDefaults() {
+	if webdav_config.Chunk_size_mb == 0 {
+		webdav_config.Chunk_size_mb = 10
+	}
+	if webdav_config.Timeout == "" {
+		webdav_config.Timeout = "5m"
+	}
+}
+
+// Normalise the url such that file paths can be appended to it.
+func (webdav_config *WebdavConfig) normalize() {
+	webdav_config.Url = strings.TrimSpace(webdav_config.Url)
+	if webdav_config.Url != "" && !strings.HasSuffix(webdav_config.Url, "/") {
+		webdav_config.Url += "/"
+	}
+}
+
+// Check the WebDAV parameters and add the problems to `config_errors`.
+func (webdav_config WebdavConfig) validate(config_errors *ConfigErrors) {
+	if webdav_config.Url == "" {
+		config_errors.add("upload.webdav.url: must be specified for the webdav target")
+	} else if parsed, err := url.Parse(webdav_config.Url); err != nil {
+		config_errors.add("upload.webdav.url: %s", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" || parsed.Host == "" {
+		config_errors.add("upload.webdav.url: %q must be an http or https url", webdav_config.Url)
+	} else if parsed.User != nil {
+		config_errors.add("upload.webdav.url: the credentials must be given by username and password")
+	}
+	if webdav_config.Chunk_size_mb < webdavMinChunkSizeMb || webdav_config.Chunk_size_mb > webdavMaxChunkSizeMb {
+		config_errors.add("upload.webdav.chunk_size_mb: %d must be between %d and %d",
+			webdav_config.Chunk_size_mb, webdavMinChunkSizeMb, webdavMaxChunkSizeMb)
+	}
+	if _, err := parseUploadDuration(webdav_config.Timeout); err != nil {
+		config_errors.add("upload.webdav.timeout: %s", err)
+	}
+}
+
+// WebdavTarget uploads the files to a WebDAV server.
+type WebdavTarget struct {
+	base_url   *url.URL // with a trailing slash.
+	username   string
+	password   string
+	chunk_size int64
+	client     *http.Client
+}
+
+// Create a WebDAV target from its config.
+func NewWebdavTarget(webdav_config WebdavConfig) (*WebdavTarget, error) {
+	base_url, err := url.Parse(webdav_config.Url)
+	if err != nil {
+		return nil, err
+	}
+	timeout, err := parseUploadDuration(webdav_config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &WebdavTarget{
+		base_url:   base_url,
+		username:   webdav_config.Username,
+		password:   webdav_config.Password,
+		chunk_size: int64(webdav_config.Chunk_size_mb) << 20,
+		client:     &http.Client{Timeout: timeout},
+	}, nil
+}
+
+func (target *WebdavTarget) String() string {
+	return target.base_url.Redacted()
+}
+
+func (target *WebdavTarget) Close() error {
+	target.client.CloseIdleConnections()
+	return nil
+}
+
+// Create the base folder including its missing parents and the folders of `dir`, one level
+// at a time.
+func (target *WebdavTarget) MakeDir(dir string) error {
+	if err := target.makeCollection(target.base_url); err != nil {
+		return err
+	}
+	path := ""
+	for _, name := range strings.Split(dir, "/") {
+		if name == "" {
+			continue
+		}
+		path += name + "/"
+		if err := target.makeCollection(target.resolve(path)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Upload a file and verify it afterwards.
+func (target *WebdavTarget) Upload(local_path string, remote_path string, transfer *UploadTransfer) error {
+	file, err := os.Open(local_path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	hash := sha1.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+
+	file_url := target.resolve(remote_path)
+	uploads_url := target.nextcloudUploadsUrl()
+	if uploads_url != nil && info.Size() > target.chunk_size {
+		err = target.uploadChunked(file, info.Size(), checksum, file_url, uploads_url, transfer)
+	} else {
+		err = target.put(file_url, transfer.Reader(io.NewSectionReader(file, 0, info.Size())), info.Size(), checksum,
+			nil)
+	}
+	if err != nil {
+		return err
+	}
+
+	return target.verify(file_url, info.Size(), checksum)
+}
+
+// Upload a file with the chunking protocol of Nextcloud.
+//
+// The chunks are uploaded into a temporary upload folder and assembled on the server by
+// moving the folder's .file to the destination. The upload folder is removed if the
+// upload fails.
+func (target *WebdavTarget) uploadChunked(file *os.File, size int64, checksum string, file_url *url.URL,
+	uploads_url *url.URL, transfer *UploadTransfer) error {
+	transfer_id := make([]byte, 8)
+	if _, err := rand.Read(transfer_id); err != nil {
+		return err
+	}
+	upload_url := uploads_url.ResolveReference(&url.URL{Path: "radarcape-" + hex.EncodeToString(transfer_id) + "/"})
+	destination := http.Header{
+		"Destination":     {file_url.String()},
+		"Oc-Total-Length": {strconv.FormatInt(size, 10)},
+	}
+
+	if err := target.do("MKCOL", upload_url, nil, 0, destination, http.StatusCreated); err != nil {
+		return err
+	}
+
+	err := func() error {
+		for offset, chunk := int64(0), 1; offset < size; offset, chunk = offset+target.chunk_size, chunk+1 {
+			length := target.chunk_size
+			if size-offset < length {
+				length = size - offset
+			}
+			chunk_url := upload_url.ResolveReference(&url.URL{Path: fmt.Sprintf("%05d", chunk)})
+			chunk_reader := transfer.Reader(io.NewSectionReader(file, offset, length))
+			if err := target.put(chunk_url, chunk_reader, length, "", destination); err != nil {
+				return err
+			}
+		}
+
+		header := destination.Clone()
+		header.Set("Oc-Checksum", "SHA1:"+checksum)
+		file_part_url := upload_url.ResolveReference(&url.URL{Path: ".file"})
+		return target.do("MOVE", file_part_url, nil, 0, header,
+			http.StatusCreated, http.StatusNoContent)
+	}()
+	if err != nil {
+		if cleanup_err := target.do("DELETE", upload_url, nil, 0, nil, http.StatusNoContent); cleanup_err != nil {
+			uploader_log.Warn("failed to remove the chunks of a failed upload.", "url", upload_url.Redacted(),
+				"err", cleanup_err)
+		}
+	}
+	return err
+}
+
+// Upload one file (or chunk). The checksum is stored by servers which support it.
+func (target *WebdavTarget) put(file_url *url.URL, body io.Reader, size int64, checksum string,
+	header http.Header) error {
+	if checksum != "" {
+		header = header.Clone()
+		if header == nil {
+			header = http.Header{}
+		}
+		header.Set("Oc-Checksum", "SHA1:"+checksum)
+	}
+	return target.do("PUT", file_url, body, size, header,
+		http.StatusOK, http.StatusCreated, http.StatusNoContent)
+}
+
+// Properties of a file as reported by PROPFIND.
+type webdavMultistatus struct {
+	Responses []struct {
+		Propstats []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				Content_length string   `xml:"getcontentlength"`
+				Checksums      []string `xml:"checksums>checksum"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+// The properties which are compared after an upload. oc:checksums is only known to
+// Nextcloud and ownCloud. Other servers report it as not found.
+const webdavPropfindBody string = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:" xmlns:oc="http://owncloud.org/ns">
+  <d:prop>
+    <d:getcontentlength/>
+    <oc:checksums/>
+  </d:prop>
+</d:propfind>`
+
+// Compare the size and, if available, the SHA1 checksum of the uploaded file with the
+// local file.
+func (target *WebdavTarget) verify(file_url *url.URL, size int64, checksum string) error {
+	request, err := target.newRequest("PROPFIND", file_url, strings.NewReader(webdavPropfindBody),
+		int64(len(webdavPropfindBody)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Depth", "0")
+	request.Header.Set("Content-Type", "application/xml; charset=utf-8")
+
+	response, err := target.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusMultiStatus {
+		return webdavStatusError(request, response)
+	}
+
+	var multistatus webdavMultistatus
+	if err := xml.NewDecoder(response.Body).Decode(&multistatus); err != nil {
+		return fmt.Errorf("PROPFIND %s: invalid response: %w", file_url.Redacted(), err)
+	}
+
+	remote_size := ""
+	remote_checksum := ""
+	for _, response := range multistatus.Responses {
+		for _, propstat := range response.Propstats {
+			if !strings.Contains(propstat.Status, " 200 ") {
+				continue
+			}
+			if propstat.Prop.Content_length != "" {
+				remote_size = propstat.Prop.Content_length
+			}
+			for _, value := range propstat.Prop.Checksums {
+				// e.g. "SHA1:<hex> MD5:<hex> ADLER32:<hex>"
+				for _, field := range strings.Fields(value) {
+					if algorithm, sum, ok := strings.Cut(field, ":"); ok && strings.EqualFold(algorithm, "SHA1") {
+						remote_checksum = sum
+					}
+				}
+			}
+		}
+	}
+
+	if remote_size != strconv.FormatInt(size, 10) {
+		return fmt.Errorf("verification of %s failed: the server reports %q bytes instead of %d",
+			file_url.Redacted(), remote_size, size)
+	}
+	if remote_checksum != "" && !strings.EqualFold(remote_checksum, checksum) {
+		return fmt.Errorf("verification of %s failed: the server reports the SHA1 checksum %s instead of %s",
+			file_url.Redacted(), remote_checksum, checksum)
+	}
+	uploader_log.Debug("verified the upload.", "url", file_url.Redacted(), "size", size,
+		"checksum_verified", remote_checksum != "")
+	return nil
+}
+
+// Create a collection including its missing parents. A collection which exists already is
+// not an error.
+//
+// Servers answer a MKCOL whose parent is missing with 409 Conflict, so the missing parents
+// are created first, starting with the deepest one.
+func (target *WebdavTarget) makeCollection(collection_url *url.URL) error {
+	request, err := target.newRequest("MKCOL", collection_url, nil, 0)
+	if err != nil {
+		return err
+	}
+	response, err := target.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	switch response.StatusCode {
+	case http.StatusCreated, http.StatusMethodNotAllowed:
+		io.Copy(ioutil.Discard, response.Body)
+		return nil
+	case http.StatusConflict:
+		parent_url := collection_url.ResolveReference(&url.URL{Path: "../"})
+		if parent_url.Path == collection_url.Path {
+			return webdavStatusError(request, response)
+		}
+		io.Copy(ioutil.Discard, response.Body)
+		if err := target.makeCollection(parent_url); err != nil {
+			return err
+		}
+		return target.do("MKCOL", collection_url, nil, 0, nil, http.StatusCreated, http.StatusMethodNotAllowed)
+	}
+	return webdavStatusError(request, response)
+}
+
+// Send a request and check that the server answers with one of the `expected` statuses.
+func (target *WebdavTarget) do(method string, request_url *url.URL, body io.Reader, size int64,
+	header http.Header, expected ...int) error {
+	request, err := target.newRequest(method, request_url, body, size)
+	if err != nil {
+		return err
+	}
+	for key, values := range header {
+		request.Header[key] = values
+	}
+
+	response, err := target.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	for _, status := range expected {
+		if response.StatusCode == status {
+			io.Copy(ioutil.Discard, response.Body)
+			return nil
+		}
+	}
+	return webdavStatusError(request, response)
+}
+
+func (target *WebdavTarget) newRequest(method string, request_url *url.URL, body io.Reader,
+	size int64) (*http.Request, error) {
+	request, err := http.NewRequest(method, request_url.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	request.ContentLength = size
+	if body == nil {
+		request.Body = nil
+	}
+	if target.username != "" || target.password != "" {
+		request.SetBasicAuth(target.username, target.password)
+	}
+	request.Header.Set("User-Agent", "radarcape_listener/"+version)
+	return request, nil
+}
+
+// Describe an unexpected response including the start of its body, which usually contains
+// the reason of the error.
+func webdavStatusError(request *http.Request, response *http.Response) error {
+	body, _ := ioutil.ReadAll(io.LimitReader(response.Body, 512))
+	message := string(bytes.TrimSpace(body))
+	if message == "" {
+		return fmt.Errorf("%s %s: %s", request.Method, request.URL.Redacted(), response.Status)
+	}
+	return fmt.Errorf("%s %s: %s: %s", request.Method, request.URL.Redacted(), response.Status, message)
+}
+
+// Get the url of a path relative to the base url.
+func (target *WebdavTarget) resolve(path string) *url.URL {
+	return target.base_url.ResolveReference(&url.URL{Path: path})
+}
+
+// Get the url of the chunked uploads of the user if the base url points to the files of a
+// Nextcloud user, otherwise nil.
+func (target *WebdavTarget) nextcloudUploadsUrl() *url.URL {
+	prefix, rest, found := strings.Cut(target.base_url.Path, nextcloudFilesPath)
+	if !found {
+		return nil
+	}
+	user, _, _ := strings.Cut(rest, "/")
+	if user == "" {
+		return nil
+	}
+	return target.base_url.ResolveReference(&url.URL{Path: prefix + nextcloudUploadsPath + user + "/"})
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/net/webdav"
+)
+
+// testNextcloud is a WebDAV server with the chunked uploads and the checksums of Nextcloud.
+//
+// The files of the user radar are served by the WebDAV handler of x/net. The checksum of an
+// upload is stored as the oc:checksums property of the file like Nextcloud does.
+type testNextcloud struct {
+	file_system webdav.FileSystem
+	handler     *webdav.Handler
+
+	mu              sync.Mutex
+	uploads         map[string]map[string][]byte // chunks of the uploads by their folder.
+	chunks          int
+	wrong_checksums bool // store a checksum which doesn't match the uploaded file.
+}
+
+const testNextcloudFilesPath string = nextcloudFilesPath + "radar"
+
+func startTestNextcloud(t *testing.T) (*testNextcloud, *httptest.Server) {
+	t.Helper()
+	server := &testNextcloud{file_system: webdav.NewMemFS(), uploads: make(map[string]map[string][]byte)}
+	server.handler = &webdav.Handler{
+		Prefix:     testNextcloudFilesPath,
+		FileSystem: server.file_system,
+		LockSystem: webdav.NewMemLS(),
+	}
+	http_server := httptest.NewServer(server)
+	t.Cleanup(http_server.Close)
+	return server, http_server
+}
+
+func (server *testNextcloud) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	if username, password, ok := request.BasicAuth(); !ok || username != "radar" || password != "secret" {
+		writer.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	if upload_path := strings.TrimPrefix(request.URL.Path, nextcloudUploadsPath+"radar/"); upload_path != request.URL.Path {
+		server.serveUpload(writer, request, upload_path)
+		return
+	}
+
+	server.handler.ServeHTTP(writer, request)
+	if request.Method == "PUT" {
+		server.storeChecksum(strings.TrimPrefix(request.URL.Path, testNextcloudFilesPath), request.Header.Get("Oc-Checksum"))
+	}
+}
+
+// Handle the requests of a chunked upload, e.g. MKCOL <folder>/, PUT <folder>/00001 and
+// MOVE <folder>/.file.
+func (server *testNextcloud) serveUpload(writer http.ResponseWriter, request *http.Request, upload_path string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	folder, chunk, _ := strings.Cut(upload_path, "/")
+	switch {
+	case request.Method == "MKCOL" && chunk == "":
+		server.uploads[folder] = make(map[string][]byte)
+		writer.WriteHeader(http.StatusCreated)
+
+	case request.Method == "PUT" && server.uploads[folder] != nil:
+		data, err := ioutil.ReadAll(request.Body)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		server.uploads[folder][chunk] = data
+		server.chunks++
+		writer.WriteHeader(http.StatusCreated)
+
+	case request.Method == "MOVE" && chunk == ".file" && server.uploads[folder] != nil:
+		chunk_names := make([]string, 0, len(server.uploads[folder]))
+		for chunk_name := range server.uploads[folder] {
+			chunk_names = append(chunk_names, chunk_name)
+		}
+		sort.Strings(chunk_names)
+		var data []byte
+		for _, chunk_name := range chunk_names {
+			data = append(data, server.uploads[folder][chunk_name]...)
+		}
+		delete(server.uploads, folder)
+
+		destination, err := url.Parse(request.Header.Get("Destination"))
+		if err != nil || request.Header.Get("Oc-Total-Length") != strconv.Itoa(len(data)) {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		file_path := strings.TrimPrefix(destination.Path, testNextcloudFilesPath)
+		file, err := server.file_system.OpenFile(context.Background(), file_path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o644)
+		if err != nil {
+			writer.WriteHeader(http.StatusConflict)
+			return
+		}
+		file.Write(data)
+		file.Close()
+		server.storeChecksumLocked(file_path, request.Header.Get("Oc-Checksum"))
+		writer.WriteHeader(http.StatusCreated)
+
+	case request.Method == "DELETE" && chunk == "":
+		delete(server.uploads, folder)
+		writer.WriteHeader(http.StatusNoContent)
+
+	default:
+		writer.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (server *testNextcloud) storeChecksum(file_path string, checksum string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	server.storeChecksumLocked(file_path, checksum)
+}
+
+// Store the checksum of an upload (e.g. "SHA1:<hex>") as the oc:checksums property of the file.
+func (server *testNextcloud) storeChecksumLocked(file_path string, checksum string) {
+	if checksum == "" {
+		return
+	}
+	if server.wrong_checksums {
+		checksum = "SHA1:" + strings.Repeat("0", 40)
+	}
+	file, err := server.file_system.OpenFile(context.Background(), file_path, os.O_RDWR, 0)
+	if err != nil {
+		return
+	}
+	defer file.Close()
+	file.(webdav.DeadPropsHolder).Patch([]webdav.Proppatch{{Props: []webdav.Property{{
+		XMLName:  xml.Name{Space: "http://owncloud.org/ns", Local: "checksums"},
+		InnerXML: []byte(`<checksum xmlns="http://owncloud.org/ns">` + checksum + ` MD5:0</checksum>`),
+	}}}})
+}
+
+// Get the number of chunks which were uploaded so far.
+func (server *testNextcloud) uploadedChunks() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.chunks
+}
+
+// Read a file of the user from the server.
+func (server *testNextcloud) readFile(t *testing.T, file_path string) string {
+	t.Helper()
+	file, err := server.file_system.OpenFile(context.Background(), file_path, os.O_RDONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	data, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// Create a target whose base folder is two levels below the files of the user.
+func newTestWebdavTarget(t *testing.T, http_server *httptest.Server) *WebdavTarget {
+	t.Helper()
+	webdav_config := WebdavConfig{
+		Url:      http_server.URL + testNextcloudFilesPath + "/sites/radarcape",
+		Username: "radar",
+		Password: "secret",
+	}
+	webdav_config.applyDefaults()
+	webdav_config.normalize()
+	target, err := NewWebdavTarget(webdav_config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	return target
+}
+
+func TestWebdavTargetUpload(t *testing.T) {
+	server, http_server := startTestNextcloud(t)
+	target := newTestWebdavTarget(t, http_server)
+
+	// The base folder and its parent are missing.
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatalf("creating an existing folder: %s", err)
+	}
+
+	content := "Hex,Fli\n4b1805,SWR123\n"
+	local_path := t.TempDir() + "/output_file_A320.csv"
+	writeTestFile(t, local_path, content)
+	if err := target.Upload(local_path, "20240305/output_file_A320.csv", nil); err != nil {
+		t.Fatal(err)
+	}
+	if data := server.readFile(t, "/sites/radarcape/20240305/output_file_A320.csv"); data != content {
+		t.Errorf("the server stores %q, expected %q", data, content)
+	}
+	if chunks := server.uploadedChunks(); chunks != 0 {
+		t.Errorf("a small file was uploaded in %d chunks", chunks)
+	}
+}
+
+func TestWebdavTargetUploadsChunksToNextcloud(t *testing.T) {
+	server, http_server := startTestNextcloud(t)
+	target := newTestWebdavTarget(t, http_server)
+	target.chunk_size = 1000
+
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatal(err)
+	}
+	content := strings.Repeat("4b1805,SWR123\n", 200)
+	local_path := t.TempDir() + "/output_file_A320.csv"
+	writeTestFile(t, local_path, content)
+	transfer := NewUploadTransfer(RealClock, nil, "20240305/output_file_A320.csv", int64(len(content)))
+	if err := target.Upload(local_path, "20240305/output_file_A320.csv", transfer); err != nil {
+		t.Fatal(err)
+	}
+	if data := server.readFile(t, "/sites/radarcape/20240305/output_file_A320.csv"); data != content {
+		t.Errorf("the server stores %d bytes, expected %d", len(data), len(content))
+	}
+	if chunks := server.uploadedChunks(); chunks != 3 {
+		t.Errorf("uploaded %d chunks, expected 3", chunks)
+	}
+	if sent := transfer.Sent(); sent != int64(len(content)) {
+		t.Errorf("sent %d bytes, expected %d", sent, len(content))
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.uploads) != 0 {
+		t.Errorf("the upload folders were not removed: %v", server.uploads)
+	}
+}
+
+func TestWebdavTargetVerifiesTheChecksum(t *testing.T) {
+	server, http_server := startTestNextcloud(t)
+	target := newTestWebdavTarget(t, http_server)
+	if err := target.MakeDir("20240305"); err != nil {
+		t.Fatal(err)
+	}
+	local_path := t.TempDir() + "/output_file_A320.csv"
+	writeTestFile(t, local_path, "Hex\n")
+	hash := sha1.Sum([]byte("Hex\n"))
+	checksum := hex.EncodeToString(hash[:])
+
+	// The size and the matching checksum are verified.
+	file_url := target.resolve("20240305/output_file_A320.csv")
+	if err := target.Upload(local_path, "20240305/output_file_A320.csv", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := target.verify(file_url, 5, checksum); err == nil || !strings.Contains(err.Error(), "bytes instead of 5") {
+		t.Errorf("a wrong size was not detected: %v", err)
+	}
+
+	server.mu.Lock()
+	server.wrong_checksums = true
+	server.mu.Unlock()
+	err := target.Upload(local_path, "20240305/output_file_A320.csv", nil)
+	if err == nil || !strings.Contains(err.Error(), "SHA1 checksum") {
+		t.Errorf("a wrong checksum was not detected: %v", err)
+	}
+}